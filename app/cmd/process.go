@@ -2,13 +2,19 @@ package cmd
 
 import (
 	"context"
+	"fmt"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 
+	rpc "github.com/longhorn/types/pkg/generated/imrpc"
+
 	"github.com/longhorn/longhorn-instance-manager/pkg/client"
+	"github.com/longhorn/longhorn-instance-manager/pkg/process"
 	"github.com/longhorn/longhorn-instance-manager/pkg/util"
 )
 
@@ -18,9 +24,14 @@ func ProcessCmd() cli.Command {
 		Subcommands: []cli.Command{
 			ProcessCreateCmd(),
 			ProcessDeleteCmd(),
+			ProcessDeleteBatchCmd(),
 			ProcessGetCmd(),
 			ProcessListCmd(),
 			ProcessReplaceCmd(),
+			ProcessStatsCmd(),
+			ProcessEventsCmd(),
+			ProcessDebugDumpCmd(),
+			PortPoolGetCmd(),
 		},
 	}
 }
@@ -42,6 +53,94 @@ func ProcessCreateCmd() cli.Command {
 				Name:  "port-args",
 				Usage: "Automatically add additional arguments when starting the process. In case of space, use `,` instead.",
 			},
+			cli.StringSliceFlag{
+				Name:  "env",
+				Usage: "Replace the environment of the process with KEY=VALUE. PATH is kept unless it is set. Can be specified multiple times",
+			},
+			cli.StringFlag{
+				Name:  "working-dir",
+				Usage: "The absolute working directory of the process",
+			},
+			cli.IntFlag{
+				Name:  "uid",
+				Usage: "The user id the process runs as",
+			},
+			cli.IntFlag{
+				Name:  "gid",
+				Usage: "The group id the process runs as",
+			},
+			cli.BoolFlag{
+				Name:  "drop-privileges",
+				Usage: "Run the process as nobody. Cannot be combined with --uid and --gid",
+			},
+			cli.StringSliceFlag{
+				Name:  "label",
+				Usage: "Label the process with KEY=VALUE. Can be specified multiple times",
+			},
+			cli.StringFlag{
+				Name:  "cpuset",
+				Usage: "The CPUs the process may run on, e.g. 0-3,8. The default of the process manager is used if unset",
+			},
+			cli.IntFlag{
+				Name:  "nice",
+				Usage: "The nice value of the process in the range [-20, 19]",
+			},
+			cli.StringFlag{
+				Name:  "io-class",
+				Usage: "The I/O scheduling class of the process: RealTime, BestEffort or Idle",
+			},
+			cli.IntFlag{
+				Name:  "io-priority",
+				Usage: "The I/O priority of the process in the range [0, 7] within its I/O scheduling class",
+			},
+			cli.IntFlag{
+				Name:  "oom-score-adj",
+				Usage: "The oom_score_adj of the process in the range [-1000, 1000]",
+			},
+			cli.DurationFlag{
+				Name:  "probe-timeout",
+				Usage: "The timeout of each health probe of the process, in whole seconds. The default of the process manager is used if unset",
+			},
+			cli.DurationFlag{
+				Name:  "startup-timeout",
+				Usage: "How long the process has to pass its health probe once started, in whole seconds. The default of the process manager is used if unset",
+			},
+			cli.DurationFlag{
+				Name:  "stop-grace-period",
+				Usage: "How long the process has to exit after the stop signal before it is killed, in whole seconds. The default of the process manager is used if unset",
+			},
+			cli.StringFlag{
+				Name:  "cpu-max",
+				Usage: "The cgroup cpu.max of the process, e.g. \"50000 100000\" for half a CPU. Requires the process cgroups",
+			},
+			cli.StringFlag{
+				Name:  "memory-max",
+				Usage: "The cgroup memory.max of the process, in bytes. Requires the process cgroups",
+			},
+			cli.StringSliceFlag{
+				Name:  "io-max",
+				Usage: "A cgroup io.max entry of the process, e.g. \"8:0 rbps=1048576\". Requires the process cgroups. Can be specified multiple times",
+			},
+			cli.UintFlag{
+				Name:  "io-weight",
+				Usage: "The cgroup io.weight of the process, in the range [1, 10000]. Requires the process cgroups",
+			},
+			cli.StringFlag{
+				Name:  "restart-policy",
+				Usage: "When the process is restarted after it exits: Never, OnFailure or Always. The default of the process manager is used if unset",
+			},
+			cli.IntFlag{
+				Name:  "max-restarts",
+				Usage: "The number of restarts in a row after which the process is left failed, 0 for no limit. The default of the process manager is used if unset",
+			},
+			cli.DurationFlag{
+				Name:  "restart-backoff",
+				Usage: "The delay before the first restart, in whole seconds, doubled with every restart in a row. The default of the process manager is used if unset",
+			},
+			cli.StringFlag{
+				Name:  "stop-escalation",
+				Usage: "The signals sent to the process still running during the stop grace period, with their delays in whole seconds, e.g. SIGTERM:10s,SIGQUIT:5s",
+			},
 		},
 		Action: func(c *cli.Context) {
 			if err := createProcess(c); err != nil {
@@ -61,14 +160,98 @@ func createProcess(c *cli.Context) error {
 	}
 	defer cli.Close()
 
-	process, err := cli.ProcessCreate(c.String("name"), c.String("binary"),
-		c.Int("port-count"), c.Args(), c.StringSlice("port-args"))
+	spec, err := processSpecFromFlags(c)
+	if err != nil {
+		return err
+	}
+	process, err := cli.ProcessCreateWithSpec(spec)
 	if err != nil {
 		return errors.Wrap(err, "failed to create process")
 	}
 	return util.PrintJSON(process)
 }
 
+func processSpecFromFlags(c *cli.Context) (*rpc.ProcessSpec, error) {
+	spec := &rpc.ProcessSpec{
+		Name:           c.String("name"),
+		Binary:         c.String("binary"),
+		Args:           c.Args(),
+		PortCount:      int32(c.Int("port-count")),
+		PortArgs:       c.StringSlice("port-args"),
+		WorkingDir:     c.String("working-dir"),
+		DropPrivileges: c.Bool("drop-privileges"),
+	}
+	for _, env := range c.StringSlice("env") {
+		key, value, found := strings.Cut(env, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid environment variable %q, expected KEY=VALUE", env)
+		}
+		if spec.Env == nil {
+			spec.Env = map[string]string{}
+		}
+		spec.Env[key] = value
+	}
+	for _, label := range c.StringSlice("label") {
+		key, value, found := strings.Cut(label, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid label %q, expected KEY=VALUE", label)
+		}
+		if spec.Labels == nil {
+			spec.Labels = map[string]string{}
+		}
+		spec.Labels[key] = value
+	}
+	if c.IsSet("uid") {
+		uid := uint32(c.Int("uid"))
+		spec.Uid = &uid
+	}
+	if c.IsSet("gid") {
+		gid := uint32(c.Int("gid"))
+		spec.Gid = &gid
+	}
+	scheduling := &rpc.ProcessScheduling{
+		CpuSet:  c.String("cpuset"),
+		IoClass: c.String("io-class"),
+	}
+	int32Flag := func(name string) *int32 {
+		if !c.IsSet(name) {
+			return nil
+		}
+		value := int32(c.Int(name))
+		return &value
+	}
+	scheduling.Nice = int32Flag("nice")
+	scheduling.IoPriority = int32Flag("io-priority")
+	scheduling.OomScoreAdj = int32Flag("oom-score-adj")
+	if scheduling.CpuSet != "" || scheduling.IoClass != "" || scheduling.Nice != nil || scheduling.IoPriority != nil || scheduling.OomScoreAdj != nil {
+		spec.Scheduling = scheduling
+	}
+	resources := &rpc.ProcessResources{
+		CpuMax:    c.String("cpu-max"),
+		MemoryMax: c.String("memory-max"),
+		IoMax:     c.StringSlice("io-max"),
+		IoWeight:  uint32(c.Uint("io-weight")),
+	}
+	if resources.CpuMax != "" || resources.MemoryMax != "" || len(resources.IoMax) != 0 || resources.IoWeight != 0 {
+		spec.Resources = resources
+	}
+	spec.RestartPolicy = c.String("restart-policy")
+	spec.MaxRestarts = int32Flag("max-restarts")
+	spec.RestartBackoffSeconds = int64(c.Duration("restart-backoff") / time.Second)
+	escalation, err := process.ParseStopEscalation(c.String("stop-escalation"))
+	if err != nil {
+		return nil, err
+	}
+	timeouts := &process.TimeoutOptions{
+		ProbeTimeout:    c.Duration("probe-timeout"),
+		StartupTimeout:  c.Duration("startup-timeout"),
+		StopGracePeriod: c.Duration("stop-grace-period"),
+		StopEscalation:  escalation,
+	}
+	spec.Timeouts = timeouts.RPC()
+	return spec, nil
+}
+
 func ProcessDeleteCmd() cli.Command {
 	return cli.Command{
 		Name: "delete",
@@ -102,6 +285,48 @@ func deleteProcess(c *cli.Context) error {
 	return util.PrintJSON(process)
 }
 
+func ProcessDeleteBatchCmd() cli.Command {
+	return cli.Command{
+		Name: "delete-batch",
+		Flags: []cli.Flag{
+			cli.StringSliceFlag{
+				Name:  "name",
+				Usage: "The name of a process to delete, can be repeated",
+			},
+			cli.StringFlag{
+				Name:  "selector",
+				Usage: "Delete the processes whose labels match the label selector instead, e.g. longhorn.io/node=node-1",
+			},
+			cli.IntFlag{
+				Name:  "parallelism",
+				Usage: "The number of deletions running at the same time, 10 if 0",
+			},
+		},
+		Action: func(c *cli.Context) {
+			if err := deleteProcessBatch(c); err != nil {
+				logrus.WithError(err).Fatal("Error running process delete-batch command")
+			}
+		},
+	}
+}
+
+func deleteProcessBatch(c *cli.Context) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cli, err := getProcessManagerClient(c, ctx, cancel)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize client")
+	}
+	defer cli.Close()
+
+	results, err := cli.ProcessDeleteBatch(c.StringSlice("name"), c.String("selector"), c.Int("parallelism"))
+	if err != nil {
+		return errors.Wrap(err, "failed to delete processes")
+	}
+	return util.PrintJSON(results)
+}
+
 func ProcessGetCmd() cli.Command {
 	return cli.Command{
 		Name: "get",
@@ -138,6 +363,12 @@ func ProcessListCmd() cli.Command {
 	return cli.Command{
 		Name:      "list",
 		ShortName: "ls",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "selector",
+				Usage: "List the processes whose labels match the label selector, e.g. longhorn.io/volume=vol-1",
+			},
+		},
 		Action: func(c *cli.Context) {
 			if err := listProcess(c); err != nil {
 				logrus.WithError(err).Fatal("Error running engine stop command")
@@ -155,7 +386,7 @@ func listProcess(c *cli.Context) error {
 	}
 	defer cli.Close()
 
-	processes, err := cli.ProcessList()
+	processes, err := cli.ProcessListWithSelector(c.String("selector"))
 	if err != nil {
 		return errors.Wrap(err, "failed to list processes")
 	}
@@ -184,6 +415,18 @@ func ProcessReplaceCmd() cli.Command {
 				Usage: "The signal used to terminate the old process",
 				Value: "SIGHUP",
 			},
+			cli.DurationFlag{
+				Name:  "ready-timeout",
+				Usage: "How long the new process has to be running before the old one is terminated anyway, in whole seconds. The startup timeout of the process is used if unset",
+			},
+			cli.BoolFlag{
+				Name:  "require-ready",
+				Usage: "Fail the replace rather than terminating the old process if the new one is not running after the ready timeout",
+			},
+			cli.DurationFlag{
+				Name:  "observation-window",
+				Usage: "How long the new process is watched after the switch, in whole seconds. If it exits in the meantime, the old process is relaunched",
+			},
 		},
 		Action: func(c *cli.Context) {
 			if err := replaceProcess(c); err != nil {
@@ -202,14 +445,148 @@ func replaceProcess(c *cli.Context) error {
 	}
 	defer cli.Close()
 
-	process, err := cli.ProcessReplace(c.String("name"), c.String("binary"),
-		c.Int("port-count"), c.Args(), c.StringSlice("port-args"), c.String("terminate-signal"))
+	process, err := cli.ProcessReplaceWithOptions(c.String("name"), c.String("binary"),
+		c.Int("port-count"), c.Args(), c.StringSlice("port-args"), c.String("terminate-signal"),
+		client.ProcessReplaceOptions{
+			ReadyTimeout:      c.Duration("ready-timeout"),
+			RequireReady:      c.Bool("require-ready"),
+			ObservationWindow: c.Duration("observation-window"),
+		})
 	if err != nil {
 		return errors.Wrap(err, "failed to replace processes")
 	}
 	return util.PrintJSON(process)
 }
 
+func ProcessStatsCmd() cli.Command {
+	return cli.Command{
+		Name: "stats",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name: "name",
+			},
+		},
+		Action: func(c *cli.Context) {
+			if err := getProcessStats(c); err != nil {
+				logrus.WithError(err).Fatal("Error running process stats command")
+			}
+		},
+	}
+}
+
+func getProcessStats(c *cli.Context) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cli, err := getProcessManagerClient(c, ctx, cancel)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize client")
+	}
+	defer cli.Close()
+
+	stats, err := cli.ProcessStats(c.String("name"))
+	if err != nil {
+		return errors.Wrap(err, "failed to get process stats")
+	}
+	return util.PrintJSON(stats)
+}
+
+func ProcessEventsCmd() cli.Command {
+	return cli.Command{
+		Name: "events",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name: "name",
+			},
+		},
+		Action: func(c *cli.Context) {
+			if err := getProcessEvents(c); err != nil {
+				logrus.WithError(err).Fatal("Error running process events command")
+			}
+		},
+	}
+}
+
+func getProcessEvents(c *cli.Context) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cli, err := getProcessManagerClient(c, ctx, cancel)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize client")
+	}
+	defer cli.Close()
+
+	events, err := cli.ProcessEvents(c.String("name"))
+	if err != nil {
+		return errors.Wrap(err, "failed to get process events")
+	}
+	return util.PrintJSON(events)
+}
+
+func ProcessDebugDumpCmd() cli.Command {
+	return cli.Command{
+		Name: "debug-dump",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name: "name",
+			},
+			cli.StringFlag{
+				Name:  "signal",
+				Value: process.DefaultDebugDumpSignal,
+				Usage: "The signal triggering the dump: SIGQUIT, SIGUSR1 or SIGUSR2. SIGQUIT makes a Go process dump its goroutines and exit",
+			},
+		},
+		Action: func(c *cli.Context) {
+			if err := dumpProcess(c); err != nil {
+				logrus.WithError(err).Fatal("Error running process debug-dump command")
+			}
+		},
+	}
+}
+
+func dumpProcess(c *cli.Context) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cli, err := getProcessManagerClient(c, ctx, cancel)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize client")
+	}
+	defer cli.Close()
+
+	path, err := cli.ProcessDebugDump(c.String("name"), c.String("signal"))
+	if err != nil {
+		return errors.Wrap(err, "failed to dump process")
+	}
+	fmt.Println(path)
+	return nil
+}
+
+func PortPoolGetCmd() cli.Command {
+	return cli.Command{
+		Name: "port-pool",
+		Action: func(c *cli.Context) {
+			if err := getPortPool(c); err != nil {
+				logrus.WithError(err).Fatal("Error running process port-pool command")
+			}
+		},
+	}
+}
+
+func getPortPool(c *cli.Context) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cli, err := getProcessManagerClient(c, ctx, cancel)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize client")
+	}
+	defer cli.Close()
+
+	pool, err := cli.PortPoolGet()
+	if err != nil {
+		return errors.Wrap(err, "failed to get port pool")
+	}
+	return util.PrintJSON(pool)
+}
+
 func getProcessManagerClient(c *cli.Context, ctx context.Context, ctxCancel context.CancelFunc) (*client.ProcessManagerClient, error) {
 	url := c.GlobalString("url")
 	tlsDir := c.GlobalString("tls-dir")
@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"golang.org/x/sync/errgroup"
@@ -68,6 +69,152 @@ func StartCmd() cli.Command {
 				Name:  "spdk-enabled",
 				Usage: "enable SPDK support",
 			},
+			cli.StringFlag{
+				Name:  "process-restart-policy",
+				Value: string(process.RestartPolicyNever),
+				Usage: "specifies when the process manager restarts an exited process: 'Never', 'OnFailure' or 'Always'",
+			},
+			cli.IntFlag{
+				Name:  "process-max-restarts",
+				Value: 5,
+				Usage: "specifies the maximum number of consecutive restarts of a process, 0 means unlimited",
+			},
+			cli.DurationFlag{
+				Name:  "process-restart-backoff",
+				Value: process.DefaultRestartBackoff,
+				Usage: "specifies the initial delay before restarting a process, which doubles with every consecutive restart",
+			},
+			cli.BoolFlag{
+				Name:  "process-cgroups",
+				Usage: "runs each process in its own cgroup v2 cgroup under the cgroup of the instance-manager. All the processes in that cgroup, including the instance-manager, are moved into a leaf cgroup named instance-manager. Required by the process resource limits",
+			},
+			cli.StringFlag{
+				Name:  "process-cpu-max",
+				Usage: "specifies the cgroup v2 cpu.max of each process, e.g. '50000 100000' for half a CPU. The limits of a process override it",
+			},
+			cli.StringFlag{
+				Name:  "process-memory-max",
+				Usage: "specifies the cgroup v2 memory.max of each process in bytes. The limits of a process override it",
+			},
+			cli.StringSliceFlag{
+				Name:  "process-io-max",
+				Usage: "specifies a cgroup v2 io.max entry of each process, e.g. '8:0 rbps=1048576 wiops=120'. Can be specified multiple times. The limits of a process override them",
+			},
+			cli.Int64Flag{
+				Name:  "process-log-max-size",
+				Usage: "specifies the size in bytes at which a process log file is rotated, 0 disables the rotation. In handover mode, the log files are checked periodically and rotated by copying and truncating them",
+			},
+			cli.IntFlag{
+				Name:  "process-log-max-segments",
+				Value: 5,
+				Usage: "specifies the number of rotated segments kept for each process log file, 0 keeps all of them",
+			},
+			cli.BoolFlag{
+				Name:  "process-log-compress",
+				Usage: "gzip the rotated segments of process log files",
+			},
+			cli.DurationFlag{
+				Name:  "process-log-retention",
+				Usage: "specifies how long the log files of a deleted process are kept, 0 keeps them forever",
+			},
+			cli.DurationFlag{
+				Name:  "process-liveness-period",
+				Usage: "specifies how often the gRPC health of the running processes is probed, 0 disables the liveness probes",
+			},
+			cli.IntFlag{
+				Name:  "process-liveness-failure-threshold",
+				Value: process.DefaultLivenessFailureThreshold,
+				Usage: "specifies the number of liveness probes failed in a row for a process to be unhealthy",
+			},
+			cli.StringFlag{
+				Name:  "process-liveness-action",
+				Value: string(process.LivenessActionNone),
+				Usage: "specifies what to do with an unhealthy process besides setting its Healthy condition: 'None', 'Restart' or 'Error'",
+			},
+			cli.StringSliceFlag{
+				Name:  "process-binary-dir",
+				Usage: "specifies a directory the process binaries are allowed in, e.g. the engine binaries mount. Can be specified multiple times. Binaries from anywhere are allowed if not set",
+			},
+			cli.StringFlag{
+				Name:  "process-binary-checksums",
+				Usage: "specifies a file in the sha256sum format pinning the SHA-256 of each allowed process binary by its absolute path",
+			},
+			cli.BoolFlag{
+				Name:  "handover",
+				Usage: "start the processes detached from the daemon, journal them and leave them running when it shuts down or crashes, so a newly started instance-manager adopts them by PID and port",
+			},
+			cli.IntFlag{
+				Name:  "process-max-count",
+				Usage: "specifies the maximum number of processes, 0 means unlimited",
+			},
+			cli.IntFlag{
+				Name:  "process-max-engines",
+				Usage: "specifies the maximum number of engine processes, 0 means unlimited",
+			},
+			cli.IntFlag{
+				Name:  "process-max-replicas",
+				Usage: "specifies the maximum number of replica processes, 0 means unlimited",
+			},
+			cli.IntFlag{
+				Name:  "process-max-starting",
+				Usage: "specifies the maximum number of processes starting at the same time, 0 means unlimited. The restarts of the processes wait for their turn, while the creations are queued up to the admission queue timeout",
+			},
+			cli.DurationFlag{
+				Name:  "process-admission-queue-timeout",
+				Usage: "specifies how long a process creation waits for a starting slot before it is rejected, 0 rejects it right away",
+			},
+			cli.IntFlag{
+				Name:  "process-crash-log-lines",
+				Value: process.DefaultCrashLogLines,
+				Usage: "specifies the number of log lines collected along with the core files into <logs-dir>/crash/ when a process exits abnormally, 0 disables the collection",
+			},
+			cli.BoolFlag{
+				Name:  "process-core-dumps",
+				Usage: "lift the core file size limit and set GOTRACEBACK=crash for the processes, so they dump core when they crash. It applies to the daemon itself too",
+			},
+			cli.StringFlag{
+				Name:  "process-cpuset",
+				Usage: "specifies the CPUs each process may run on, e.g. 0-3,8",
+			},
+			cli.IntFlag{
+				Name:  "process-nice",
+				Usage: "specifies the nice value of each process in the range [-20, 19]",
+			},
+			cli.StringFlag{
+				Name:  "process-io-class",
+				Usage: "specifies the I/O scheduling class of each process: RealTime, BestEffort or Idle",
+			},
+			cli.IntFlag{
+				Name:  "process-io-priority",
+				Usage: "specifies the I/O priority of each process within its I/O scheduling class in the range [0, 7]",
+			},
+			cli.IntFlag{
+				Name:  "process-oom-score-adj",
+				Usage: "specifies the oom_score_adj of each process in the range [-1000, 1000], -1000 protects the processes from the OOM killer",
+			},
+			cli.UintFlag{
+				Name:  "process-io-weight",
+				Usage: "specifies the cgroup v2 io.weight of each process in the range [1, 10000]. The limits of a process override it",
+			},
+			cli.DurationFlag{
+				Name:  "process-startup-timeout",
+				Value: process.DefaultStartupTimeout,
+				Usage: "specifies how long each process has to pass its health probe once started before it is stopped",
+			},
+			cli.DurationFlag{
+				Name:  "process-stop-grace-period",
+				Value: process.DefaultStopGracePeriod,
+				Usage: "specifies how long each process has to exit after the stop signal before it is killed",
+			},
+			cli.DurationFlag{
+				Name:  "process-probe-timeout",
+				Value: util.DefaultGRPCHealthProbeTimeout,
+				Usage: "specifies the timeout of each health probe of a process",
+			},
+			cli.StringFlag{
+				Name:  "process-stop-escalation",
+				Usage: "specifies the signals sent to a process still running during its stop grace period, each after its delay since the previous signal, e.g. SIGTERM:10s,SIGQUIT:5s",
+			},
 		},
 		Action: func(c *cli.Context) {
 			if err := start(c); err != nil {
@@ -85,15 +232,24 @@ func cleanup(pm *process.Manager) {
 		logrus.WithError(err).Errorf("Failed to list processes before shutting down %v", types.ProcessManagerGrpcService)
 		return
 	}
-	for _, p := range pmResp.Processes {
-		if _, err := pm.ProcessDelete(context.TODO(), &rpc.ProcessDeleteRequest{
-			Name: p.Spec.Name,
-		}); err != nil {
-			logrus.WithError(err).Errorf("Failed to delete process %s", p.Spec.Name)
+	deadline := time.Now().Add(pm.StopTimeout())
+	names := make([]string, 0, len(pmResp.Processes))
+	for name := range pmResp.Processes {
+		names = append(names, name)
+	}
+	if len(names) != 0 {
+		resp, err := pm.ProcessDeleteBatch(context.TODO(), &rpc.ProcessDeleteBatchRequest{Names: names})
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to delete processes before shutting down %v", types.ProcessManagerGrpcService)
+		}
+		for _, result := range resp.GetResults() {
+			if result.Error != "" {
+				logrus.Errorf("Failed to delete process %s: %v", result.Name, result.Error)
+			}
 		}
 	}
 
-	for i := 0; i < types.WaitCount; i++ {
+	for time.Now().Before(deadline) {
 		pmResp, err := pm.ProcessList(context.TODO(), &rpc.ProcessListRequest{})
 		if err != nil {
 			logrus.WithError(err).Errorf("Failed to list processes when shutting down %v", types.ProcessManagerGrpcService)
@@ -109,6 +265,69 @@ func cleanup(pm *process.Manager) {
 	logrus.Errorf("Failed to clean up all processes for %s graceful shutdown", types.ProcessManagerGrpcService)
 }
 
+func handover(pm *process.Manager) {
+	logrus.Infof("Handing over the processes of %v to the next instance-manager", types.ProcessManagerGrpcService)
+
+	if err := pm.Handover(); err != nil {
+		logrus.WithError(err).Errorf("Failed to hand over the processes of %v, deleting them instead", types.ProcessManagerGrpcService)
+		cleanup(pm)
+	}
+}
+
+// enableCoreDumps lifts the core file size limit and makes the Go runtime dump core on fatal errors.
+// Both are inherited by the processes started afterwards.
+func enableCoreDumps() error {
+	// RLIM_INFINITY
+	infinity := ^uint64(0)
+	limit := &syscall.Rlimit{Cur: infinity, Max: infinity}
+	if err := syscall.Setrlimit(syscall.RLIMIT_CORE, limit); err != nil {
+		return errors.Wrap(err, "failed to lift the core file size limit")
+	}
+	return os.Setenv("GOTRACEBACK", "crash")
+}
+
+func schedulingOptions(c *cli.Context) (process.SchedulingOptions, error) {
+	ioClass, err := process.ParseIOClass(c.String("process-io-class"))
+	if err != nil {
+		return process.SchedulingOptions{}, err
+	}
+	scheduling := process.SchedulingOptions{
+		CPUSet:  c.String("process-cpuset"),
+		IOClass: ioClass,
+	}
+	intFlag := func(name string) *int {
+		if !c.IsSet(name) {
+			return nil
+		}
+		value := c.Int(name)
+		return &value
+	}
+	scheduling.Nice = intFlag("process-nice")
+	scheduling.IOPriority = intFlag("process-io-priority")
+	scheduling.OOMScoreAdj = intFlag("process-oom-score-adj")
+	if err := scheduling.Validate(); err != nil {
+		return process.SchedulingOptions{}, errors.Wrap(err, "invalid process scheduling")
+	}
+	return scheduling, nil
+}
+
+func timeoutOptions(c *cli.Context) (process.TimeoutOptions, error) {
+	escalation, err := process.ParseStopEscalation(c.String("process-stop-escalation"))
+	if err != nil {
+		return process.TimeoutOptions{}, errors.Wrap(err, "invalid process stop escalation")
+	}
+	timeouts := process.TimeoutOptions{
+		StartupTimeout:  c.Duration("process-startup-timeout"),
+		StopGracePeriod: c.Duration("process-stop-grace-period"),
+		StopEscalation:  escalation,
+		ProbeTimeout:    c.Duration("process-probe-timeout"),
+	}
+	if err := timeouts.Validate(); err != nil {
+		return process.TimeoutOptions{}, errors.Wrap(err, "invalid process timeouts")
+	}
+	return timeouts, nil
+}
+
 func unfreezeFilesystems() error {
 	// We do not need to switch to the host mount namespace to get mount points here. Usually, longhorn-engine runs in a
 	// container that has / bind mounted to /host with at least HostToContainer (rslave) propagation.
@@ -144,6 +363,74 @@ func start(c *cli.Context) (err error) {
 	spdkPortRange := c.String("spdk-port-range")
 	spdkEnabled := c.Bool("spdk-enabled")
 
+	restartPolicy, err := process.ParseRestartPolicy(c.String("process-restart-policy"))
+	if err != nil {
+		return err
+	}
+	livenessAction, err := process.ParseLivenessAction(c.String("process-liveness-action"))
+	if err != nil {
+		return err
+	}
+	pmConfig := process.ManagerConfig{
+		RestartPolicy:  restartPolicy,
+		MaxRestarts:    c.Int("process-max-restarts"),
+		RestartBackoff: c.Duration("process-restart-backoff"),
+		Cgroups:        c.Bool("process-cgroups"),
+		Resources: process.ResourceLimits{
+			CPUMax:    c.String("process-cpu-max"),
+			MemoryMax: c.String("process-memory-max"),
+			IOMax:     c.StringSlice("process-io-max"),
+			IOWeight:  uint32(c.Uint("process-io-weight")),
+		},
+		LogRotation: util.LogRotation{
+			MaxSize:     c.Int64("process-log-max-size"),
+			MaxSegments: c.Int("process-log-max-segments"),
+			Compress:    c.Bool("process-log-compress"),
+		},
+		LogRetention: c.Duration("process-log-retention"),
+
+		LivenessPeriod:           c.Duration("process-liveness-period"),
+		LivenessFailureThreshold: c.Int("process-liveness-failure-threshold"),
+		LivenessAction:           livenessAction,
+
+		Handover: c.Bool("handover"),
+
+		Admission: process.AdmissionLimits{
+			MaxProcesses: c.Int("process-max-count"),
+			MaxEngines:   c.Int("process-max-engines"),
+			MaxReplicas:  c.Int("process-max-replicas"),
+			MaxStarting:  c.Int("process-max-starting"),
+			QueueTimeout: c.Duration("process-admission-queue-timeout"),
+		},
+
+		CrashLogLines: c.Int("process-crash-log-lines"),
+	}
+	if pmConfig.Scheduling, err = schedulingOptions(c); err != nil {
+		return err
+	}
+	if pmConfig.Timeouts, err = timeoutOptions(c); err != nil {
+		return err
+	}
+	if c.Bool("process-core-dumps") {
+		if err := enableCoreDumps(); err != nil {
+			return err
+		}
+	}
+	if host, _, err := net.SplitHostPort(listen); err == nil {
+		pmConfig.PortProbeHost = host
+	}
+	binaryPolicy := &process.BinaryPolicy{
+		AllowedDirs: c.StringSlice("process-binary-dir"),
+	}
+	if checksumFile := c.String("process-binary-checksums"); checksumFile != "" {
+		if binaryPolicy.Checksums, err = process.LoadBinaryChecksums(checksumFile); err != nil {
+			return errors.Wrapf(err, "failed to load the process binary checksums from %v", checksumFile)
+		}
+	}
+	if !binaryPolicy.IsEmpty() {
+		pmConfig.BinaryPolicy = binaryPolicy
+	}
+
 	defer func() {
 		if spdkEnabled {
 			logrus.Infof("Stopping spdk_tgt daemon")
@@ -186,6 +473,7 @@ func start(c *cli.Context) (err error) {
 	go func() {
 		debugAddress := ":6060"
 		debugHandler := http.DefaultServeMux
+		debugHandler.Handle("/metrics", promhttp.Handler())
 		logrus.Infof("Debug pprof server listening on %s", debugAddress)
 		if err := http.ListenAndServe(debugAddress, debugHandler); err != nil && err != http.ErrServerClosed {
 			logrus.Errorf("ListenAndServe: %s", err)
@@ -214,10 +502,19 @@ func start(c *cli.Context) (err error) {
 	servers[types.DiskGrpcService] = diskGRPCServer
 	listeners[types.DiskGrpcService] = diskGRPCListener
 
+	// Start process-manager server
+	pm, pmGRPCServer, pmGRPCListener, err := setupProcessManagerGRPCServer(ctx, processPortRange, logsDir, addresses[types.ProcessManagerGrpcService], pmConfig)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to set up %s", types.ProcessManagerGrpcService)
+		return err
+	}
+	servers[types.ProcessManagerGrpcService] = pmGRPCServer
+	listeners[types.ProcessManagerGrpcService] = pmGRPCListener
+
 	// Start instance server
 	instanceGRPCServer, instanceRPCListener, err := setupInstanceGRPCServer(ctx, logsDir,
 		addresses[types.InstanceGrpcService], addresses[types.ProcessManagerGrpcService],
-		addresses[types.SpdkGrpcService], tlsConfig, spdkEnabled)
+		addresses[types.SpdkGrpcService], tlsConfig, spdkEnabled, pm)
 	if err != nil {
 		logrus.WithError(err).Errorf("Failed to set up %s", types.InstanceGrpcService)
 		return err
@@ -235,15 +532,6 @@ func start(c *cli.Context) (err error) {
 	servers[types.ProxyGRPCService] = proxyGRPCServer
 	listeners[types.ProxyGRPCService] = proxyGRPCListener
 
-	// Start process-manager server
-	pm, pmGRPCServer, pmGRPCListener, err := setupProcessManagerGRPCServer(ctx, processPortRange, logsDir, addresses[types.ProcessManagerGrpcService])
-	if err != nil {
-		logrus.WithError(err).Errorf("Failed to set up %s", types.ProcessManagerGrpcService)
-		return err
-	}
-	servers[types.ProcessManagerGrpcService] = pmGRPCServer
-	listeners[types.ProcessManagerGrpcService] = pmGRPCListener
-
 	// Start spdk server
 	if spdkEnabled {
 		spdkGRPCServer, spdkGRPCListener, err := setupSPDKGRPCServer(ctx, spdkPortRange, addresses[types.SpdkGrpcService])
@@ -294,7 +582,11 @@ func start(c *cli.Context) (err error) {
 			}
 
 			if name == types.ProcessManagerGrpcService {
-				cleanup(pm)
+				if pmConfig.Handover {
+					handover(pm)
+				} else {
+					cleanup(pm)
+				}
 			}
 
 			logrus.Infof("Stopped %s", name)
@@ -407,8 +699,8 @@ func setupProxyGRPCServer(ctx context.Context, logsDir, listen, diskServiceAddre
 	return grpcProxyServer, grpcProxyListener, nil
 }
 
-func setupProcessManagerGRPCServer(ctx context.Context, portRange, logsDir, listen string) (*process.Manager, *grpc.Server, net.Listener, error) {
-	srv, err := process.NewManager(ctx, portRange, logsDir)
+func setupProcessManagerGRPCServer(ctx context.Context, portRange, logsDir, listen string, config process.ManagerConfig) (*process.Manager, *grpc.Server, net.Listener, error) {
+	srv, err := process.NewManager(ctx, portRange, logsDir, config)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -431,8 +723,9 @@ func setupProcessManagerGRPCServer(ctx context.Context, portRange, logsDir, list
 	return srv, grpcServer, grpcListener, nil
 }
 
-func setupInstanceGRPCServer(ctx context.Context, logsDir, listen, processManagerServiceAddress, spdkServiceAddress string, tlsConfig *tls.Config, spdkEnabled bool) (*grpc.Server, net.Listener, error) {
-	srv, err := instance.NewServer(ctx, logsDir, processManagerServiceAddress, spdkServiceAddress, spdkEnabled)
+func setupInstanceGRPCServer(ctx context.Context, logsDir, listen, processManagerServiceAddress, spdkServiceAddress string, tlsConfig *tls.Config, spdkEnabled bool,
+	pm *process.Manager) (*grpc.Server, net.Listener, error) {
+	srv, err := instance.NewServer(ctx, logsDir, processManagerServiceAddress, spdkServiceAddress, spdkEnabled, pm, pm)
 	if err != nil {
 		return nil, nil, err
 	}
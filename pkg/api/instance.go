@@ -19,13 +19,14 @@ type InstanceProcessSpec struct {
 }
 
 type Instance struct {
-	Name           string         `json:"name"`
-	Type           string         `json:"type"`
-	DataEngine     string         `json:"dataEngine"`
-	PortCount      int32          `json:"portCount"`
-	PortArgs       []string       `json:"portArgs"`
-	InstanceStatus InstanceStatus `json:"instanceStatus"`
-	Deleted        bool           `json:"deleted"`
+	Name           string            `json:"name"`
+	Type           string            `json:"type"`
+	DataEngine     string            `json:"dataEngine"`
+	PortCount      int32             `json:"portCount"`
+	PortArgs       []string          `json:"portArgs"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	InstanceStatus InstanceStatus    `json:"instanceStatus"`
+	Deleted        bool              `json:"deleted"`
 
 	InstanceProccessSpec *InstanceProcessSpec
 
@@ -42,6 +43,7 @@ func RPCToInstance(obj *rpc.InstanceResponse) *Instance {
 		DataEngine:         dataEngines[obj.Spec.DataEngine.String()],
 		PortCount:          obj.Spec.PortCount,
 		PortArgs:           obj.Spec.PortArgs,
+		Labels:             obj.Spec.Labels,
 		InstanceStatus:     RPCToInstanceStatus(obj.Status),
 	}
 
@@ -63,16 +65,46 @@ func RPCToInstanceList(obj *rpc.InstanceListResponse) map[string]*Instance {
 	return ret
 }
 
+// InstanceBatchResult is the result of the operation on one instance of a batch. Error is empty
+// if the operation succeeded, ErrorCode is the gRPC status code of the failure otherwise.
+type InstanceBatchResult struct {
+	Name      string    `json:"name"`
+	Instance  *Instance `json:"instance,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	ErrorCode int32     `json:"errorCode,omitempty"`
+}
+
+func RPCToInstanceBatchResults(obj *rpc.InstanceBatchResponse) []*InstanceBatchResult {
+	ret := make([]*InstanceBatchResult, 0, len(obj.Results))
+	for _, r := range obj.Results {
+		result := &InstanceBatchResult{
+			Name:      r.Name,
+			Error:     r.Error,
+			ErrorCode: r.ErrorCode,
+		}
+		if r.Instance != nil {
+			result.Instance = RPCToInstance(r.Instance)
+		}
+		ret = append(ret, result)
+	}
+	return ret
+}
+
 type InstanceStatus struct {
-	State                  string          `json:"state"`
-	ErrorMsg               string          `json:"errorMsg"`
-	Conditions             map[string]bool `json:"conditions"`
-	PortStart              int32           `json:"portStart"`
-	PortEnd                int32           `json:"portEnd"`
-	TargetPortStart        int32           `json:"targetPortStart"`
-	TargetPortEnd          int32           `json:"targetPortEnd"`
-	StandbyTargetPortStart int32           `json:"standbyTargetPortStart"`
-	StandbyTargetPortEnd   int32           `json:"standbyTargetPortEnd"`
+	State                  string             `json:"state"`
+	ErrorMsg               string             `json:"errorMsg"`
+	Conditions             map[string]bool    `json:"conditions"`
+	PortStart              int32              `json:"portStart"`
+	PortEnd                int32              `json:"portEnd"`
+	TargetPortStart        int32              `json:"targetPortStart"`
+	TargetPortEnd          int32              `json:"targetPortEnd"`
+	StandbyTargetPortStart int32              `json:"standbyTargetPortStart"`
+	StandbyTargetPortEnd   int32              `json:"standbyTargetPortEnd"`
+	RestartCount           int32              `json:"restartCount,omitempty"`
+	StartTime              string             `json:"startTime,omitempty"`
+	ReadyTime              string             `json:"readyTime,omitempty"`
+	LastExitTime           string             `json:"lastExitTime,omitempty"`
+	LastExit               *ProcessExitStatus `json:"lastExit,omitempty"`
 }
 
 func RPCToInstanceStatus(obj *rpc.InstanceStatus) InstanceStatus {
@@ -86,6 +118,11 @@ func RPCToInstanceStatus(obj *rpc.InstanceStatus) InstanceStatus {
 		TargetPortEnd:          obj.TargetPortEnd,
 		StandbyTargetPortStart: obj.StandbyTargetPortStart,
 		StandbyTargetPortEnd:   obj.StandbyTargetPortEnd,
+		RestartCount:           obj.RestartCount,
+		StartTime:              obj.StartTime,
+		ReadyTime:              obj.ReadyTime,
+		LastExitTime:           obj.LastExitTime,
+		LastExit:               RPCToProcessExitStatus(obj.LastExit),
 	}
 }
 
@@ -99,7 +136,9 @@ func NewInstanceStream(stream rpc.InstanceService_InstanceWatchClient) *Instance
 	}
 }
 
-func (s *InstanceStream) Recv() (*emptypb.Empty, error) {
+// Recv returns the next changed instance, or an empty response as a notification unless the watch
+// asked for the full instances.
+func (s *InstanceStream) Recv() (*rpc.InstanceResponse, error) {
 	return s.stream.Recv()
 }
 
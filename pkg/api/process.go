@@ -36,20 +36,71 @@ func RPCToProcessList(obj *rpc.ProcessListResponse) map[string]*Process {
 }
 
 type ProcessStatus struct {
-	State      string          `json:"state"`
-	ErrorMsg   string          `json:"errorMsg"`
-	Conditions map[string]bool `json:"conditions"`
-	PortStart  int32           `json:"portStart"`
-	PortEnd    int32           `json:"portEnd"`
+	State        string             `json:"state"`
+	ErrorMsg     string             `json:"errorMsg"`
+	Conditions   map[string]bool    `json:"conditions"`
+	PortStart    int32              `json:"portStart"`
+	PortEnd      int32              `json:"portEnd"`
+	RestartCount int32              `json:"restartCount,omitempty"`
+	StartTime    string             `json:"startTime,omitempty"`
+	ReadyTime    string             `json:"readyTime,omitempty"`
+	LastExitTime string             `json:"lastExitTime,omitempty"`
+	LastExit     *ProcessExitStatus `json:"lastExit,omitempty"`
+	Scheduling   *ProcessScheduling `json:"scheduling,omitempty"`
 }
 
 func RPCToProcessStatus(obj *rpc.ProcessStatus) ProcessStatus {
 	return ProcessStatus{
-		State:      obj.State,
-		ErrorMsg:   obj.ErrorMsg,
-		Conditions: obj.Conditions,
-		PortStart:  obj.PortStart,
-		PortEnd:    obj.PortEnd,
+		State:        obj.State,
+		ErrorMsg:     obj.ErrorMsg,
+		Conditions:   obj.Conditions,
+		PortStart:    obj.PortStart,
+		PortEnd:      obj.PortEnd,
+		RestartCount: obj.RestartCount,
+		StartTime:    obj.StartTime,
+		ReadyTime:    obj.ReadyTime,
+		LastExitTime: obj.LastExitTime,
+		LastExit:     RPCToProcessExitStatus(obj.LastExit),
+		Scheduling:   RPCToProcessScheduling(obj.Scheduling),
+	}
+}
+
+type ProcessExitStatus struct {
+	Code      int32 `json:"code"`
+	Signal    int32 `json:"signal,omitempty"`
+	OOMKilled bool  `json:"oomKilled,omitempty"`
+}
+
+func RPCToProcessExitStatus(obj *rpc.ProcessExitStatus) *ProcessExitStatus {
+	if obj == nil {
+		return nil
+	}
+	return &ProcessExitStatus{
+		Code:      obj.Code,
+		Signal:    obj.Signal,
+		OOMKilled: obj.OomKilled,
+	}
+}
+
+// ProcessScheduling is the scheduling applied to a process.
+type ProcessScheduling struct {
+	CPUSet      string `json:"cpuSet,omitempty"`
+	Nice        int32  `json:"nice"`
+	IOClass     string `json:"ioClass,omitempty"`
+	IOPriority  int32  `json:"ioPriority"`
+	OOMScoreAdj int32  `json:"oomScoreAdj"`
+}
+
+func RPCToProcessScheduling(obj *rpc.ProcessScheduling) *ProcessScheduling {
+	if obj == nil {
+		return nil
+	}
+	return &ProcessScheduling{
+		CPUSet:      obj.CpuSet,
+		Nice:        obj.GetNice(),
+		IOClass:     obj.IoClass,
+		IOPriority:  obj.GetIoPriority(),
+		OOMScoreAdj: obj.GetOomScoreAdj(),
 	}
 }
 
@@ -113,6 +113,9 @@ type InstanceCreateRequest struct {
 	Binary     string
 	BinaryArgs []string
 
+	// Labels are only supported by the v1 data engine instances.
+	Labels map[string]string
+
 	Engine  EngineCreateRequest
 	Replica ReplicaCreateRequest
 
@@ -122,19 +125,58 @@ type InstanceCreateRequest struct {
 
 // InstanceCreate creates an instance.
 func (c *InstanceServiceClient) InstanceCreate(req *InstanceCreateRequest) (*api.Instance, error) {
-	if req.Name == "" || req.InstanceType == "" {
-		return nil, fmt.Errorf("failed to create instance: missing required parameter")
+	createReq, err := instanceCreateRequest(req)
+	if err != nil {
+		return nil, err
 	}
 
-	driver, ok := rpc.DataEngine_value[getDataEngine(req.DataEngine)]
-	if !ok {
-		return nil, fmt.Errorf("failed to delete instance: invalid data engine %v", req.DataEngine)
+	client := c.getControllerServiceClient()
+	ctx, cancel := context.WithTimeout(context.Background(), types.GRPCServiceTimeout)
+	defer cancel()
+
+	p, err := client.InstanceCreate(ctx, createReq)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create instance")
+	}
+
+	return api.RPCToInstance(p), nil
+}
+
+// InstanceCreateBatch creates the instances, with at most parallelism creations running at the
+// same time, 10 if 0. It returns the result of each creation in the order of the requests.
+func (c *InstanceServiceClient) InstanceCreateBatch(reqs []*InstanceCreateRequest, parallelism int) ([]*api.InstanceBatchResult, error) {
+	batchReq := &rpc.InstanceCreateBatchRequest{
+		Parallelism: int32(parallelism),
+	}
+	for _, req := range reqs {
+		createReq, err := instanceCreateRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		batchReq.Requests = append(batchReq.Requests, createReq)
 	}
 
 	client := c.getControllerServiceClient()
 	ctx, cancel := context.WithTimeout(context.Background(), types.GRPCServiceTimeout)
 	defer cancel()
 
+	resp, err := client.InstanceCreateBatch(ctx, batchReq)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create instances")
+	}
+	return api.RPCToInstanceBatchResults(resp), nil
+}
+
+func instanceCreateRequest(req *InstanceCreateRequest) (*rpc.InstanceCreateRequest, error) {
+	if req.Name == "" || req.InstanceType == "" {
+		return nil, fmt.Errorf("failed to create instance: missing required parameter")
+	}
+
+	driver, ok := rpc.DataEngine_value[getDataEngine(req.DataEngine)]
+	if !ok {
+		return nil, fmt.Errorf("failed to create instance: invalid data engine %v", req.DataEngine)
+	}
+
 	var processInstanceSpec *rpc.ProcessInstanceSpec
 	var spdkInstanceSpec *rpc.SpdkInstanceSpec
 	if rpc.DataEngine(driver) == rpc.DataEngine_DATA_ENGINE_V1 {
@@ -164,7 +206,7 @@ func (c *InstanceServiceClient) InstanceCreate(req *InstanceCreateRequest) (*api
 		}
 	}
 
-	p, err := client.InstanceCreate(ctx, &rpc.InstanceCreateRequest{
+	return &rpc.InstanceCreateRequest{
 		Spec: &rpc.InstanceSpec{
 			// nolint:all replaced with DataEngine
 			BackendStoreDriver: rpc.BackendStoreDriver(driver),
@@ -181,13 +223,10 @@ func (c *InstanceServiceClient) InstanceCreate(req *InstanceCreateRequest) (*api
 			UpgradeRequired:  req.Engine.UpgradeRequired,
 			InitiatorAddress: req.Engine.InitiatorAddress,
 			TargetAddress:    req.Engine.TargetAddress,
-		},
-	})
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create instance")
-	}
 
-	return api.RPCToInstance(p), nil
+			Labels: req.Labels,
+		},
+	}, nil
 }
 
 // InstanceDelete deletes the instance by name.
@@ -220,6 +259,65 @@ func (c *InstanceServiceClient) InstanceDelete(dataEngine, name, instanceType, d
 	return api.RPCToInstance(p), nil
 }
 
+type InstanceDeleteRequest struct {
+	DataEngine      string
+	Name            string
+	InstanceType    string
+	DiskUUID        string
+	CleanupRequired bool
+}
+
+// InstanceDeleteBatch deletes the instances, see InstanceCreateBatch.
+func (c *InstanceServiceClient) InstanceDeleteBatch(reqs []*InstanceDeleteRequest, parallelism int) ([]*api.InstanceBatchResult, error) {
+	batchReq := &rpc.InstanceDeleteBatchRequest{
+		Parallelism: int32(parallelism),
+	}
+	for _, req := range reqs {
+		if req.Name == "" {
+			return nil, fmt.Errorf("failed to delete instances: missing required parameter name")
+		}
+		driver, ok := rpc.DataEngine_value[getDataEngine(req.DataEngine)]
+		if !ok {
+			return nil, fmt.Errorf("failed to delete instance %v: invalid data engine %v", req.Name, req.DataEngine)
+		}
+		batchReq.Requests = append(batchReq.Requests, &rpc.InstanceDeleteRequest{
+			Name: req.Name,
+			Type: req.InstanceType,
+			// nolint:all replaced with DataEngine
+			BackendStoreDriver: rpc.BackendStoreDriver(driver),
+			DataEngine:         rpc.DataEngine(driver),
+			DiskUuid:           req.DiskUUID,
+			CleanupRequired:    req.CleanupRequired,
+		})
+	}
+	return c.instanceDeleteBatch(batchReq)
+}
+
+// InstanceDeleteBySelector deletes all the instances whose labels match the selector, which cannot
+// be empty, see InstanceCreateBatch. The results are sorted by name.
+func (c *InstanceServiceClient) InstanceDeleteBySelector(selector string, cleanupRequired bool, parallelism int) ([]*api.InstanceBatchResult, error) {
+	if selector == "" {
+		return nil, fmt.Errorf("failed to delete instances: missing required parameter selector")
+	}
+	return c.instanceDeleteBatch(&rpc.InstanceDeleteBatchRequest{
+		LabelSelector:   selector,
+		CleanupRequired: cleanupRequired,
+		Parallelism:     int32(parallelism),
+	})
+}
+
+func (c *InstanceServiceClient) instanceDeleteBatch(req *rpc.InstanceDeleteBatchRequest) ([]*api.InstanceBatchResult, error) {
+	client := c.getControllerServiceClient()
+	ctx, cancel := context.WithTimeout(context.Background(), types.GRPCServiceTimeout)
+	defer cancel()
+
+	resp, err := client.InstanceDeleteBatch(ctx, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to delete instances")
+	}
+	return api.RPCToInstanceBatchResults(resp), nil
+}
+
 // InstanceGet returns the instance by name.
 func (c *InstanceServiceClient) InstanceGet(dataEngine, name, instanceType string) (*api.Instance, error) {
 	if name == "" {
@@ -249,11 +347,18 @@ func (c *InstanceServiceClient) InstanceGet(dataEngine, name, instanceType strin
 }
 
 func (c *InstanceServiceClient) InstanceList() (map[string]*api.Instance, error) {
+	return c.InstanceListWithSelector("")
+}
+
+// InstanceListWithSelector lists the instances whose labels match the selector, all of them if it is empty.
+func (c *InstanceServiceClient) InstanceListWithSelector(selector string) (map[string]*api.Instance, error) {
 	client := c.getControllerServiceClient()
 	ctx, cancel := context.WithTimeout(context.Background(), types.GRPCServiceTimeout)
 	defer cancel()
 
-	instances, err := client.InstanceList(ctx, &emptypb.Empty{})
+	instances, err := client.InstanceList(ctx, &rpc.InstanceListRequest{
+		LabelSelector: selector,
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to list instances")
 	}
@@ -262,6 +367,11 @@ func (c *InstanceServiceClient) InstanceList() (map[string]*api.Instance, error)
 
 // InstanceLog returns the log stream of an instance.
 func (c *InstanceServiceClient) InstanceLog(ctx context.Context, dataEngine, name, instanceType string) (*api.LogStream, error) {
+	return c.InstanceLogWithOptions(ctx, dataEngine, name, instanceType, util.LogStreamOptions{})
+}
+
+// InstanceLogWithOptions returns the log stream of an instance, see ProcessManagerClient.ProcessLogWithOptions.
+func (c *InstanceServiceClient) InstanceLogWithOptions(ctx context.Context, dataEngine, name, instanceType string, opts util.LogStreamOptions) (*api.LogStream, error) {
 	if name == "" {
 		return nil, fmt.Errorf("failed to get instance: missing required parameter name")
 	}
@@ -278,6 +388,10 @@ func (c *InstanceServiceClient) InstanceLog(ctx context.Context, dataEngine, nam
 		// nolint:all replaced with DataEngine
 		BackendStoreDriver: rpc.BackendStoreDriver(driver),
 		DataEngine:         rpc.DataEngine(driver),
+		Tail:               int32(opts.Tail),
+		Follow:             opts.Follow,
+		Since:              formatLogTime(opts.Since),
+		Until:              formatLogTime(opts.Until),
 	})
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to get instance log of %v", name)
@@ -287,8 +401,46 @@ func (c *InstanceServiceClient) InstanceLog(ctx context.Context, dataEngine, nam
 
 // InstanceWatch watches for instance updates.
 func (c *InstanceServiceClient) InstanceWatch(ctx context.Context) (*api.InstanceStream, error) {
+	return c.InstanceWatchWithOptions(ctx, InstanceWatchOptions{})
+}
+
+// InstanceWatchOptions are the options of InstanceWatchWithOptions. The filters limit the watch to
+// the matching instances, the unset ones match all instances.
+type InstanceWatchOptions struct {
+	// Names matches any of the names.
+	Names      []string
+	NamePrefix string
+	// Type is types.InstanceTypeEngine or types.InstanceTypeReplica.
+	Type        string
+	DataEngines []string
+	VolumeName  string
+	// LabelSelector is a Kubernetes label selector, only the v1 data engine instances have labels.
+	LabelSelector string
+	// Full receives the changed instances, with Deleted set for the removed ones, rather than empty
+	// responses as notifications.
+	Full bool
+}
+
+// InstanceWatchWithOptions watches for the updates of the instances matching the filters of the options.
+func (c *InstanceServiceClient) InstanceWatchWithOptions(ctx context.Context, opts InstanceWatchOptions) (*api.InstanceStream, error) {
+	req := &rpc.InstanceWatchRequest{
+		Names:         opts.Names,
+		NamePrefix:    opts.NamePrefix,
+		Type:          opts.Type,
+		VolumeName:    opts.VolumeName,
+		LabelSelector: opts.LabelSelector,
+		Full:          opts.Full,
+	}
+	for _, dataEngine := range opts.DataEngines {
+		driver, ok := rpc.DataEngine_value[getDataEngine(dataEngine)]
+		if !ok {
+			return nil, fmt.Errorf("failed to watch instances: invalid data engine %v", dataEngine)
+		}
+		req.DataEngines = append(req.DataEngines, rpc.DataEngine(driver))
+	}
+
 	client := c.getControllerServiceClient()
-	stream, err := client.InstanceWatch(ctx, &emptypb.Empty{})
+	stream, err := client.InstanceWatch(ctx, req)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to open instance update stream")
 	}
@@ -450,6 +602,60 @@ func (c *InstanceServiceClient) InstanceDeleteTarget(dataEngine, name, instanceT
 	return nil
 }
 
+// InstanceStats returns the current resource usage of the process of a v1 data engine instance,
+// and its rolling averages.
+func (c *InstanceServiceClient) InstanceStats(dataEngine, name, instanceType string) (*rpc.ProcessStatsResponse, error) {
+	if name == "" {
+		return nil, fmt.Errorf("failed to get instance stats: missing required parameter name")
+	}
+
+	driver, ok := rpc.DataEngine_value[getDataEngine(dataEngine)]
+	if !ok {
+		return nil, fmt.Errorf("failed to get instance stats: invalid data engine %v", dataEngine)
+	}
+
+	client := c.getControllerServiceClient()
+	ctx, cancel := context.WithTimeout(context.Background(), types.GRPCServiceTimeout)
+	defer cancel()
+
+	resp, err := client.InstanceStats(ctx, &rpc.InstanceStatsRequest{
+		Name:       name,
+		Type:       instanceType,
+		DataEngine: rpc.DataEngine(driver),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get stats of instance %v", name)
+	}
+	return resp, nil
+}
+
+// InstanceEvents returns the recorded events of the process of a v1 data engine instance,
+// from the oldest to the newest.
+func (c *InstanceServiceClient) InstanceEvents(dataEngine, name, instanceType string) (*rpc.ProcessEventsResponse, error) {
+	if name == "" {
+		return nil, fmt.Errorf("failed to get instance events: missing required parameter name")
+	}
+
+	driver, ok := rpc.DataEngine_value[getDataEngine(dataEngine)]
+	if !ok {
+		return nil, fmt.Errorf("failed to get instance events: invalid data engine %v", dataEngine)
+	}
+
+	client := c.getControllerServiceClient()
+	ctx, cancel := context.WithTimeout(context.Background(), types.GRPCServiceTimeout)
+	defer cancel()
+
+	resp, err := client.InstanceEvents(ctx, &rpc.InstanceEventsRequest{
+		Name:       name,
+		Type:       instanceType,
+		DataEngine: rpc.DataEngine(driver),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get events of instance %v", name)
+	}
+	return resp, nil
+}
+
 // InstanceResume resumes an instance.
 func (c *InstanceServiceClient) VersionGet() (*meta.VersionOutput, error) {
 	client := c.getControllerServiceClient()
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"time"
 
 	rpc "github.com/longhorn/types/pkg/generated/imrpc"
 	"github.com/pkg/errors"
@@ -87,15 +88,27 @@ func NewProcessManagerClientWithTLS(ctx context.Context, ctxCancel context.Cance
 }
 
 func (c *ProcessManagerClient) ProcessCreate(name, binary string, portCount int, args, portArgs []string) (*rpc.ProcessResponse, error) {
+	return c.ProcessCreateWithSpec(&rpc.ProcessSpec{
+		Name:      name,
+		Binary:    binary,
+		Args:      args,
+		PortCount: int32(portCount),
+		PortArgs:  portArgs,
+	})
+}
+
+// ProcessCreateWithSpec is ProcessCreate with the options of the process, e.g. its environment,
+// working directory or credential, set in the spec.
+func (c *ProcessManagerClient) ProcessCreateWithSpec(spec *rpc.ProcessSpec) (*rpc.ProcessResponse, error) {
 	logrus.WithFields(logrus.Fields{
-		"name":      name,
-		"binary":    binary,
-		"args":      args,
-		"portCount": portCount,
-		"portArgs":  portArgs,
+		"name":      spec.Name,
+		"binary":    spec.Binary,
+		"args":      spec.Args,
+		"portCount": spec.PortCount,
+		"portArgs":  spec.PortArgs,
 	}).Info("Creating process")
 
-	if name == "" || binary == "" {
+	if spec.Name == "" || spec.Binary == "" {
 		return nil, fmt.Errorf("failed to start process: missing required parameter")
 	}
 
@@ -104,13 +117,7 @@ func (c *ProcessManagerClient) ProcessCreate(name, binary string, portCount int,
 	defer cancel()
 
 	return client.ProcessCreate(ctx, &rpc.ProcessCreateRequest{
-		Spec: &rpc.ProcessSpec{
-			Name:      name,
-			Binary:    binary,
-			Args:      args,
-			PortCount: int32(portCount),
-			PortArgs:  portArgs,
-		},
+		Spec: spec,
 	})
 }
 
@@ -128,6 +135,28 @@ func (c *ProcessManagerClient) ProcessDelete(name string) (*rpc.ProcessResponse,
 	})
 }
 
+// ProcessDeleteBatch deletes the processes named by names, or all the processes whose labels match
+// the selector if names is empty, with at most parallelism deletions running at the same time, 10 if 0.
+func (c *ProcessManagerClient) ProcessDeleteBatch(names []string, selector string, parallelism int) ([]*rpc.ProcessBatchResult, error) {
+	if len(names) == 0 && selector == "" {
+		return nil, fmt.Errorf("failed to delete processes: missing required parameter names or selector")
+	}
+
+	client := c.getControllerServiceClient()
+	ctx, cancel := context.WithTimeout(context.Background(), types.GRPCServiceTimeout)
+	defer cancel()
+
+	resp, err := client.ProcessDeleteBatch(ctx, &rpc.ProcessDeleteBatchRequest{
+		Names:         names,
+		LabelSelector: selector,
+		Parallelism:   int32(parallelism),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to delete processes")
+	}
+	return resp.Results, nil
+}
+
 func (c *ProcessManagerClient) ProcessGet(name string) (*rpc.ProcessResponse, error) {
 	if name == "" {
 		return nil, fmt.Errorf("failed to get process: missing required parameter name")
@@ -143,11 +172,18 @@ func (c *ProcessManagerClient) ProcessGet(name string) (*rpc.ProcessResponse, er
 }
 
 func (c *ProcessManagerClient) ProcessList() (map[string]*rpc.ProcessResponse, error) {
+	return c.ProcessListWithSelector("")
+}
+
+// ProcessListWithSelector lists the processes whose labels match the selector, all of them if it is empty.
+func (c *ProcessManagerClient) ProcessListWithSelector(selector string) (map[string]*rpc.ProcessResponse, error) {
 	client := c.getControllerServiceClient()
 	ctx, cancel := context.WithTimeout(context.Background(), types.GRPCServiceTimeout)
 	defer cancel()
 
-	resp, err := client.ProcessList(ctx, &rpc.ProcessListRequest{})
+	resp, err := client.ProcessList(ctx, &rpc.ProcessListRequest{
+		LabelSelector: selector,
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to list processes")
 	}
@@ -155,13 +191,23 @@ func (c *ProcessManagerClient) ProcessList() (map[string]*rpc.ProcessResponse, e
 }
 
 func (c *ProcessManagerClient) ProcessLog(ctx context.Context, name string) (*api.LogStream, error) {
+	return c.ProcessLogWithOptions(ctx, name, util.LogStreamOptions{})
+}
+
+// ProcessLogWithOptions returns the log stream of a process limited to the tail or a time window of
+// the log, and following the new lines until ctx is done if opts.Follow is set.
+func (c *ProcessManagerClient) ProcessLogWithOptions(ctx context.Context, name string, opts util.LogStreamOptions) (*api.LogStream, error) {
 	if name == "" {
 		return nil, fmt.Errorf("failed to get process: missing required parameter name")
 	}
 
 	client := c.getControllerServiceClient()
 	stream, err := client.ProcessLog(ctx, &rpc.LogRequest{
-		Name: name,
+		Name:   name,
+		Tail:   int32(opts.Tail),
+		Follow: opts.Follow,
+		Since:  formatLogTime(opts.Since),
+		Until:  formatLogTime(opts.Until),
 	})
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to get process log of %v", name)
@@ -170,8 +216,37 @@ func (c *ProcessManagerClient) ProcessLog(ctx context.Context, name string) (*ap
 }
 
 func (c *ProcessManagerClient) ProcessWatch(ctx context.Context) (*api.ProcessStream, error) {
+	return c.ProcessWatchWithOptions(ctx, ProcessWatchOptions{})
+}
+
+// ProcessWatchOptions are the options of ProcessWatchWithOptions.
+type ProcessWatchOptions struct {
+	// SinceRevision resumes the watch after the revision of a process update or of a process list.
+	// 0 watches the updates from now on.
+	SinceRevision uint64
+	// The rest limit the watch to the matching processes, the unset ones match all processes.
+	// Names matches any of the names.
+	Names      []string
+	NamePrefix string
+	// Type is types.InstanceTypeEngine or types.InstanceTypeReplica.
+	Type       string
+	VolumeName string
+	// LabelSelector is a Kubernetes label selector.
+	LabelSelector string
+}
+
+// ProcessWatchWithOptions watches for process updates. If the updates since the revision are no
+// longer kept, a response with ResyncRequired is received followed by the state of all processes.
+func (c *ProcessManagerClient) ProcessWatchWithOptions(ctx context.Context, opts ProcessWatchOptions) (*api.ProcessStream, error) {
 	client := c.getControllerServiceClient()
-	stream, err := client.ProcessWatch(ctx, &emptypb.Empty{})
+	stream, err := client.ProcessWatch(ctx, &rpc.ProcessWatchRequest{
+		SinceRevision: opts.SinceRevision,
+		Names:         opts.Names,
+		NamePrefix:    opts.NamePrefix,
+		Type:          opts.Type,
+		VolumeName:    opts.VolumeName,
+		LabelSelector: opts.LabelSelector,
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to open process update stream")
 	}
@@ -180,6 +255,24 @@ func (c *ProcessManagerClient) ProcessWatch(ctx context.Context) (*api.ProcessSt
 }
 
 func (c *ProcessManagerClient) ProcessReplace(name, binary string, portCount int, args, portArgs []string, terminateSignal string) (*rpc.ProcessResponse, error) {
+	return c.ProcessReplaceWithOptions(name, binary, portCount, args, portArgs, terminateSignal, ProcessReplaceOptions{})
+}
+
+type ProcessReplaceOptions struct {
+	// ReadyTimeout is how long the replacement has to be running before the replace goes ahead
+	// anyway, or fails if RequireReady is set. The startup timeout of the replacement is used if 0.
+	ReadyTimeout time.Duration
+	RequireReady bool
+	// ObservationWindow is how long the replacement is watched after the switch. If it exits in the
+	// meantime, the replaced process is relaunched with the RolledBack condition. 0 disables it.
+	ObservationWindow time.Duration
+}
+
+// ProcessReplaceWithOptions replaces a process like ProcessReplace, with the readiness timeout and
+// the rollback after the switch set by the options. The response is the replacement, a rollback is
+// reported by the watch.
+func (c *ProcessManagerClient) ProcessReplaceWithOptions(name, binary string, portCount int, args, portArgs []string, terminateSignal string,
+	opts ProcessReplaceOptions) (*rpc.ProcessResponse, error) {
 	if name == "" || binary == "" {
 		return nil, fmt.Errorf("failed to start process: missing required parameter")
 	}
@@ -199,8 +292,71 @@ func (c *ProcessManagerClient) ProcessReplace(name, binary string, portCount int
 			PortCount: int32(portCount),
 			PortArgs:  portArgs,
 		},
-		TerminateSignal: terminateSignal,
+		TerminateSignal:          terminateSignal,
+		ReadyTimeoutSeconds:      int64(opts.ReadyTimeout / time.Second),
+		RequireReady:             opts.RequireReady,
+		ObservationWindowSeconds: int64(opts.ObservationWindow / time.Second),
+	})
+}
+
+// ProcessStats returns the current resource usage of the process, and its rolling averages.
+func (c *ProcessManagerClient) ProcessStats(name string) (*rpc.ProcessStatsResponse, error) {
+	if name == "" {
+		return nil, fmt.Errorf("failed to get process stats: missing required parameter name")
+	}
+
+	client := c.getControllerServiceClient()
+	ctx, cancel := context.WithTimeout(context.Background(), types.GRPCServiceTimeout)
+	defer cancel()
+
+	return client.ProcessStats(ctx, &rpc.ProcessStatsRequest{
+		Name: name,
+	})
+}
+
+// ProcessEvents returns the recorded events of a process, from the oldest to the newest.
+func (c *ProcessManagerClient) ProcessEvents(name string) (*rpc.ProcessEventsResponse, error) {
+	if name == "" {
+		return nil, fmt.Errorf("failed to get process events: missing required parameter name")
+	}
+
+	client := c.getControllerServiceClient()
+	ctx, cancel := context.WithTimeout(context.Background(), types.GRPCServiceTimeout)
+	defer cancel()
+
+	return client.ProcessEvents(ctx, &rpc.ProcessEventsRequest{
+		Name: name,
+	})
+}
+
+// ProcessDebugDump sends the signal, SIGQUIT if empty, to a running process and returns the path of
+// the artifact its output is captured into on the instance-manager.
+func (c *ProcessManagerClient) ProcessDebugDump(name, signal string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("failed to dump process: missing required parameter")
+	}
+
+	client := c.getControllerServiceClient()
+	ctx, cancel := context.WithTimeout(context.Background(), types.GRPCServiceTimeout)
+	defer cancel()
+
+	resp, err := client.ProcessDebugDump(ctx, &rpc.ProcessDebugDumpRequest{
+		Name:   name,
+		Signal: signal,
 	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to dump process %v", name)
+	}
+	return resp.Path, nil
+}
+
+// PortPoolGet returns the used, free and quarantined ports of the process manager.
+func (c *ProcessManagerClient) PortPoolGet() (*rpc.PortPoolResponse, error) {
+	client := c.getControllerServiceClient()
+	ctx, cancel := context.WithTimeout(context.Background(), types.GRPCServiceTimeout)
+	defer cancel()
+
+	return client.PortPoolGet(ctx, &emptypb.Empty{})
 }
 
 func (c *ProcessManagerClient) VersionGet() (*meta.VersionOutput, error) {
@@ -232,3 +388,11 @@ func (c *ProcessManagerClient) CheckConnection() error {
 	_, err := c.health.Check(getContextWithGRPCTimeout(c.ctx), req)
 	return err
 }
+
+// formatLogTime formats a time of the log stream options, the zero time being unset.
+func formatLogTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return util.FormatTime(&t)
+}
@@ -0,0 +1,182 @@
+package instance
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/labels"
+
+	grpccodes "google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+
+	rpc "github.com/longhorn/types/pkg/generated/imrpc"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/client"
+	"github.com/longhorn/longhorn-instance-manager/pkg/util"
+)
+
+// batchProcessManagerClient opens a single process manager client for the v1 instances of a batch,
+// rather than one per instance.
+type batchProcessManagerClient struct {
+	sync.Mutex
+	address string
+	cancel  context.CancelFunc
+	client  *client.ProcessManagerClient
+}
+
+func (c *batchProcessManagerClient) get() (*client.ProcessManagerClient, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.client != nil {
+		return c.client, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pmClient, err := client.NewProcessManagerClient(ctx, cancel, "tcp://"+c.address, nil)
+	if err != nil {
+		cancel()
+		return nil, grpcstatus.Error(grpccodes.Internal, errors.Wrapf(err, "failed to create ProcessManagerClient").Error())
+	}
+	c.client, c.cancel = pmClient, cancel
+	return pmClient, nil
+}
+
+func (c *batchProcessManagerClient) close() {
+	c.Lock()
+	defer c.Unlock()
+	if c.client != nil {
+		c.client.Close()
+		c.cancel()
+	}
+}
+
+func (s *Server) newBatchProcessManagerClient() *batchProcessManagerClient {
+	ops, _ := s.ops[rpc.DataEngine_DATA_ENGINE_V1].(V1DataEngineInstanceOps)
+	return &batchProcessManagerClient{address: ops.processManagerServiceAddress}
+}
+
+// InstanceCreateBatch creates the instances, with at most parallelism creations running at the same
+// time. It returns the result of each creation in the order of the requests.
+func (s *Server) InstanceCreateBatch(ctx context.Context, req *rpc.InstanceCreateBatchRequest) (*rpc.InstanceBatchResponse, error) {
+	for _, r := range req.Requests {
+		if r.GetSpec() == nil {
+			return nil, grpcstatus.Error(grpccodes.InvalidArgument, "missing instance spec")
+		}
+	}
+	logrus.Infof("Creating %v instances in a batch", len(req.Requests))
+
+	pmClient := s.newBatchProcessManagerClient()
+	defer pmClient.close()
+
+	results := make([]*rpc.InstanceBatchResult, len(req.Requests))
+	errs := util.RunBatch(ctx, len(req.Requests), int(req.Parallelism), func(i int) (err error) {
+		r := req.Requests[i]
+		results[i] = &rpc.InstanceBatchResult{Name: r.Spec.Name}
+		if r.Spec.DataEngine != rpc.DataEngine_DATA_ENGINE_V1 {
+			results[i].Instance, err = s.InstanceCreate(ctx, r)
+			return err
+		}
+		c, err := pmClient.get()
+		if err != nil {
+			return err
+		}
+		results[i].Instance, err = processInstanceCreate(c, r)
+		return err
+	})
+	return &rpc.InstanceBatchResponse{Results: batchResults(results, errs, func(i int) string {
+		return req.Requests[i].Spec.Name
+	})}, nil
+}
+
+// InstanceDeleteBatch deletes the instances of the request, or all the instances whose labels match
+// its label selector, see InstanceCreateBatch. The results of a selector are sorted by name.
+//
+// The instances selected by labels are listed first, so the labels of each v1 instance are checked
+// again right before it is deleted, and the instance is skipped with FailedPrecondition if they no
+// longer match. An instance relabeled between that check and its deletion is still deleted.
+func (s *Server) InstanceDeleteBatch(ctx context.Context, req *rpc.InstanceDeleteBatchRequest) (*rpc.InstanceBatchResponse, error) {
+	if len(req.Requests) != 0 && req.LabelSelector != "" {
+		return nil, grpcstatus.Error(grpccodes.InvalidArgument, "cannot set both requests and label selector")
+	}
+
+	reqs := req.Requests
+	var selector labels.Selector
+	if len(reqs) == 0 {
+		// The selector cannot be empty, so all instances are never deleted by mistake
+		if strings.TrimSpace(req.LabelSelector) == "" {
+			return nil, grpcstatus.Error(grpccodes.InvalidArgument, "missing requests or label selector")
+		}
+		var err error
+		if selector, err = util.ParseLabelSelector(req.LabelSelector); err != nil {
+			return nil, grpcstatus.Error(grpccodes.InvalidArgument, err.Error())
+		}
+		resp, err := s.InstanceList(ctx, &rpc.InstanceListRequest{LabelSelector: req.LabelSelector})
+		if err != nil {
+			return nil, err
+		}
+		for _, instance := range resp.Instances {
+			reqs = append(reqs, &rpc.InstanceDeleteRequest{
+				Name:            instance.Spec.Name,
+				Type:            instance.Spec.Type,
+				DataEngine:      instance.Spec.DataEngine,
+				CleanupRequired: req.CleanupRequired,
+			})
+		}
+		sort.Slice(reqs, func(i, j int) bool {
+			return reqs[i].Name < reqs[j].Name
+		})
+	}
+	logrus.Infof("Deleting %v instances in a batch", len(reqs))
+
+	pmClient := s.newBatchProcessManagerClient()
+	defer pmClient.close()
+	labeler := s.processLabeler()
+
+	results := make([]*rpc.InstanceBatchResult, len(reqs))
+	errs := util.RunBatch(ctx, len(reqs), int(req.Parallelism), func(i int) (err error) {
+		r := reqs[i]
+		results[i] = &rpc.InstanceBatchResult{Name: r.Name}
+		if r.DataEngine != rpc.DataEngine_DATA_ENGINE_V1 {
+			results[i].Instance, err = s.InstanceDelete(ctx, r)
+			return err
+		}
+		if selector != nil && labeler != nil {
+			set, err := labeler.ProcessLabels(r.Name)
+			if err != nil {
+				return err
+			}
+			if !selector.Matches(labels.Set(set)) {
+				return grpcstatus.Errorf(grpccodes.FailedPrecondition, "labels of instance %v no longer match selector %v", r.Name, selector)
+			}
+		}
+		c, err := pmClient.get()
+		if err != nil {
+			return err
+		}
+		results[i].Instance, err = processInstanceDelete(c, r)
+		return err
+	})
+	return &rpc.InstanceBatchResponse{Results: batchResults(results, errs, func(i int) string {
+		return reqs[i].Name
+	})}, nil
+}
+
+// batchResults sets the errors of the batch in the results, including the results of the
+// instances never processed because the batch was canceled.
+func batchResults(results []*rpc.InstanceBatchResult, errs []error, name func(i int) string) []*rpc.InstanceBatchResult {
+	for i, err := range errs {
+		if results[i] == nil {
+			results[i] = &rpc.InstanceBatchResult{Name: name(i)}
+		}
+		if err != nil {
+			st := grpcstatus.Convert(err)
+			results[i].Error = st.Message()
+			results[i].ErrorCode = int32(st.Code())
+		}
+	}
+	return results
+}
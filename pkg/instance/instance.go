@@ -10,6 +10,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/protobuf/types/known/emptypb"
+	"k8s.io/apimachinery/pkg/labels"
 
 	grpccodes "google.golang.org/grpc/codes"
 	grpcstatus "google.golang.org/grpc/status"
@@ -22,6 +23,7 @@ import (
 	"github.com/longhorn/longhorn-instance-manager/pkg/client"
 	"github.com/longhorn/longhorn-instance-manager/pkg/meta"
 	"github.com/longhorn/longhorn-instance-manager/pkg/types"
+	"github.com/longhorn/longhorn-instance-manager/pkg/util"
 )
 
 const (
@@ -40,6 +42,8 @@ type InstanceOps interface {
 	InstanceResume(*rpc.InstanceResumeRequest) (*emptypb.Empty, error)
 	InstanceSwitchOverTarget(*rpc.InstanceSwitchOverTargetRequest) (*emptypb.Empty, error)
 	InstanceDeleteTarget(*rpc.InstanceDeleteTargetRequest) (*emptypb.Empty, error)
+	InstanceStats(*rpc.InstanceStatsRequest) (*rpc.ProcessStatsResponse, error)
+	InstanceEvents(*rpc.InstanceEventsRequest) (*rpc.ProcessEventsResponse, error)
 
 	LogSetLevel(context.Context, *rpc.LogSetLevelRequest) (*emptypb.Empty, error)
 	LogSetFlags(context.Context, *rpc.LogSetFlagsRequest) (*emptypb.Empty, error)
@@ -47,8 +51,24 @@ type InstanceOps interface {
 	LogGetFlags(context.Context, *rpc.LogGetFlagsRequest) (*rpc.LogGetFlagsResponse, error)
 }
 
+// ProcessSuspender freezes and thaws the processes of the v1 data engine instances. The process
+// manager service has no RPCs for it, so the instance server calls the process manager in the same daemon.
+type ProcessSuspender interface {
+	ProcessSuspend(name string) error
+	ProcessResume(name string) error
+}
+
+// ProcessLabeler gets and sets the labels of the processes of the v1 data engine instances. Like
+// ProcessSuspender, it is implemented by the process manager in the same daemon.
+type ProcessLabeler interface {
+	ProcessLabels(name string) (map[string]string, error)
+	ProcessSetLabels(name string, labels map[string]string) error
+}
+
 type V1DataEngineInstanceOps struct {
 	processManagerServiceAddress string
+	processSuspender             ProcessSuspender
+	processLabeler               ProcessLabeler
 }
 type V2DataEngineInstanceOps struct {
 	spdkServiceAddress string
@@ -64,10 +84,13 @@ type Server struct {
 	ops                 map[rpc.DataEngine]InstanceOps
 }
 
-func NewServer(ctx context.Context, logsDir, processManagerServiceAddress, spdkServiceAddress string, v2DataEngineEnabled bool) (*Server, error) {
+func NewServer(ctx context.Context, logsDir, processManagerServiceAddress, spdkServiceAddress string, v2DataEngineEnabled bool,
+	processSuspender ProcessSuspender, processLabeler ProcessLabeler) (*Server, error) {
 	ops := map[rpc.DataEngine]InstanceOps{
 		rpc.DataEngine_DATA_ENGINE_V1: V1DataEngineInstanceOps{
 			processManagerServiceAddress: processManagerServiceAddress,
+			processSuspender:             processSuspender,
+			processLabeler:               processLabeler,
 		},
 		rpc.DataEngine_DATA_ENGINE_V2: V2DataEngineInstanceOps{
 			spdkServiceAddress: spdkServiceAddress,
@@ -123,10 +146,6 @@ func (s *Server) InstanceCreate(ctx context.Context, req *rpc.InstanceCreateRequ
 }
 
 func (ops V1DataEngineInstanceOps) InstanceCreate(req *rpc.InstanceCreateRequest) (*rpc.InstanceResponse, error) {
-	if req.Spec.ProcessInstanceSpec == nil {
-		return nil, grpcstatus.Error(grpccodes.InvalidArgument, "ProcessInstanceSpec is required for longhorn data engine")
-	}
-
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	pmClient, err := client.NewProcessManagerClient(ctx, cancel, "tcp://"+ops.processManagerServiceAddress, nil)
@@ -135,7 +154,22 @@ func (ops V1DataEngineInstanceOps) InstanceCreate(req *rpc.InstanceCreateRequest
 	}
 	defer pmClient.Close()
 
-	process, err := pmClient.ProcessCreate(req.Spec.Name, req.Spec.ProcessInstanceSpec.Binary, int(req.Spec.PortCount), req.Spec.ProcessInstanceSpec.Args, req.Spec.PortArgs)
+	return processInstanceCreate(pmClient, req)
+}
+
+// processInstanceCreate creates the process of a v1 instance with a client that may be shared by a batch.
+func processInstanceCreate(pmClient *client.ProcessManagerClient, req *rpc.InstanceCreateRequest) (*rpc.InstanceResponse, error) {
+	if req.Spec.ProcessInstanceSpec == nil {
+		return nil, grpcstatus.Error(grpccodes.InvalidArgument, "ProcessInstanceSpec is required for longhorn data engine")
+	}
+	process, err := pmClient.ProcessCreateWithSpec(&rpc.ProcessSpec{
+		Name:      req.Spec.Name,
+		Binary:    req.Spec.ProcessInstanceSpec.Binary,
+		Args:      req.Spec.ProcessInstanceSpec.Args,
+		PortCount: req.Spec.PortCount,
+		PortArgs:  req.Spec.PortArgs,
+		Labels:    req.Spec.Labels,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -143,6 +177,9 @@ func (ops V1DataEngineInstanceOps) InstanceCreate(req *rpc.InstanceCreateRequest
 }
 
 func (ops V2DataEngineInstanceOps) InstanceCreate(req *rpc.InstanceCreateRequest) (*rpc.InstanceResponse, error) {
+	if len(req.Spec.Labels) != 0 {
+		return nil, grpcstatus.Errorf(grpccodes.Unimplemented, "labels are not supported for data engine %v", req.Spec.DataEngine)
+	}
 	c, err := spdkclient.NewSPDKClient(ops.spdkServiceAddress)
 	if err != nil {
 		return nil, grpcstatus.Error(grpccodes.Internal, errors.Wrapf(err, "failed to create SPDK client").Error())
@@ -193,6 +230,11 @@ func (ops V1DataEngineInstanceOps) InstanceDelete(req *rpc.InstanceDeleteRequest
 	}
 	defer pmClient.Close()
 
+	return processInstanceDelete(pmClient, req)
+}
+
+// processInstanceDelete deletes the process of a v1 instance with a client that may be shared by a batch.
+func processInstanceDelete(pmClient *client.ProcessManagerClient, req *rpc.InstanceDeleteRequest) (*rpc.InstanceResponse, error) {
 	process, err := pmClient.ProcessDelete(req.Name)
 	if err != nil {
 		return nil, err
@@ -287,12 +329,17 @@ func (ops V2DataEngineInstanceOps) InstanceGet(req *rpc.InstanceGetRequest) (*rp
 	}
 }
 
-func (s *Server) InstanceList(ctx context.Context, req *emptypb.Empty) (*rpc.InstanceListResponse, error) {
+func (s *Server) InstanceList(ctx context.Context, req *rpc.InstanceListRequest) (*rpc.InstanceListResponse, error) {
 	logrus.WithFields(logrus.Fields{}).Trace("Listing instances")
 
+	selector, err := util.ParseLabelSelector(req.LabelSelector)
+	if err != nil {
+		return nil, grpcstatus.Error(grpccodes.InvalidArgument, err.Error())
+	}
+
 	instances := map[string]*rpc.InstanceResponse{}
 
-	err := s.ops[rpc.DataEngine_DATA_ENGINE_V1].InstanceList(instances)
+	err = s.ops[rpc.DataEngine_DATA_ENGINE_V1].InstanceList(instances)
 	if err != nil {
 		return nil, err
 	}
@@ -304,6 +351,12 @@ func (s *Server) InstanceList(ctx context.Context, req *emptypb.Empty) (*rpc.Ins
 		}
 	}
 
+	for name, instance := range instances {
+		if !selector.Matches(labels.Set(instance.Spec.Labels)) {
+			delete(instances, name)
+		}
+	}
+
 	return &rpc.InstanceListResponse{
 		Instances: instances,
 	}, nil
@@ -323,11 +376,7 @@ func (ops V1DataEngineInstanceOps) InstanceList(instances map[string]*rpc.Instan
 		return err
 	}
 	for _, process := range processes {
-		processType := types.InstanceTypeReplica
-		if lhLonghorn.IsEngineProcess(process.Spec.Name) {
-			processType = types.InstanceTypeEngine
-		}
-		instances[process.Spec.Name] = processResponseToInstanceResponse(process, processType)
+		instances[process.Spec.Name] = processResponseToInstanceResponse(process, processResponseType(process))
 	}
 	return nil
 }
@@ -412,6 +461,11 @@ func (s *Server) InstanceLog(req *rpc.InstanceLogRequest, srv rpc.InstanceServic
 }
 
 func (ops V1DataEngineInstanceOps) InstanceLog(req *rpc.InstanceLogRequest, srv rpc.InstanceService_InstanceLogServer) error {
+	opts, err := util.NewLogStreamOptions(req.Tail, req.Follow, req.Since, req.Until)
+	if err != nil {
+		return grpcstatus.Error(grpccodes.InvalidArgument, err.Error())
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	pmClient, err := client.NewProcessManagerClient(ctx, cancel, "tcp://"+ops.processManagerServiceAddress, nil)
@@ -420,7 +474,8 @@ func (ops V1DataEngineInstanceOps) InstanceLog(req *rpc.InstanceLogRequest, srv
 	}
 	defer pmClient.Close()
 
-	stream, err := pmClient.ProcessLog(context.Background(), req.Name)
+	// A followed log is streamed until the client goes away
+	stream, err := pmClient.ProcessLogWithOptions(srv.Context(), req.Name, opts)
 	if err != nil {
 		return err
 	}
@@ -444,23 +499,102 @@ func (ops V2DataEngineInstanceOps) InstanceLog(req *rpc.InstanceLogRequest, srv
 	return grpcstatus.Error(grpccodes.Unimplemented, "v2 data engine instance log is not supported")
 }
 
-func (s *Server) handleNotify(ctx context.Context, notifyChan chan struct{}, srv rpc.InstanceService_InstanceWatchServer) error {
+func (s *Server) handleNotify(ctx context.Context, notifyChan chan *instanceNotification, opts InstanceWatchOptions, send func(*rpc.InstanceResponse) error) error {
 	logrus.Info("Start handling notify")
 
+	labels := s.newInstanceLabelCache()
+
+	sent := sentInstances{}
+	if opts.Full {
+		// The instances the watcher may know about before the watch are needed to tell which are deleted
+		dataEngines := []rpc.DataEngine{rpc.DataEngine_DATA_ENGINE_V1}
+		if s.v2DataEngineEnabled {
+			dataEngines = append(dataEngines, rpc.DataEngine_DATA_ENGINE_V2)
+		}
+		for _, dataEngine := range dataEngines {
+			instances := map[string]*rpc.InstanceResponse{}
+			if err := s.ops[dataEngine].InstanceList(instances); err != nil {
+				logrus.WithError(err).Warnf("Failed to list the %v instances", dataEngine)
+				continue
+			}
+			for _, instance := range instances {
+				if opts.Filter.MatchLabels(instance, labels.labelsOf(instance)) {
+					sent.update(instance)
+				}
+			}
+		}
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			logrus.Info("Stopped handling notify due to the context done")
 			return ctx.Err()
-		case <-notifyChan:
-			if err := srv.Send(&emptypb.Empty{}); err != nil {
-				return errors.Wrap(err, "failed to send instance response")
+		case n := <-notifyChan:
+			if !opts.Filter.matchLabels(n, labels.labelsOf(n.instance)) {
+				continue
+			}
+			if !opts.Full {
+				if err := send(nil); err != nil {
+					return errors.Wrap(err, "failed to send instance response")
+				}
+				continue
+			}
+			instances, err := s.notifiedInstances(n, &opts.Filter, labels)
+			if err != nil {
+				logrus.WithError(err).Warn("Failed to get the notified instances")
+				continue
 			}
+			if n.instance == nil {
+				instances = append(instances, sent.deleted(instanceKind{n.dataEngine, n.instanceType}, instances)...)
+			}
+			for _, instance := range instances {
+				sent.update(instance)
+				if err := send(instance); err != nil {
+					return errors.Wrap(err, "failed to send instance response")
+				}
+			}
+		}
+	}
+}
+
+// notifiedInstances returns the instance of the notification, or all instances of its data engine
+// matching the filter if the notifier doesn't tell which instance has changed.
+func (s *Server) notifiedInstances(n *instanceNotification, filter *InstanceWatchFilter, labels *instanceLabelCache) ([]*rpc.InstanceResponse, error) {
+	if n.instance != nil {
+		return []*rpc.InstanceResponse{n.instance}, nil
+	}
+
+	instances := map[string]*rpc.InstanceResponse{}
+	if err := s.ops[n.dataEngine].InstanceList(instances); err != nil {
+		return nil, err
+	}
+	var matched []*rpc.InstanceResponse
+	for _, instance := range instances {
+		if instance.Spec.Type == n.instanceType && filter.MatchLabels(instance, labels.labelsOf(instance)) {
+			matched = append(matched, instance)
 		}
 	}
+	return matched, nil
 }
 
-func (s *Server) InstanceWatch(req *emptypb.Empty, srv rpc.InstanceService_InstanceWatchServer) error {
+// InstanceWatch sends the changed instances matching the filters of the request, or empty responses
+// as notifications unless the request asks for the full instances.
+func (s *Server) InstanceWatch(req *rpc.InstanceWatchRequest, srv rpc.InstanceService_InstanceWatchServer) error {
+	return s.WatchInstances(instanceWatchOptionsFromRequest(req), func(instance *rpc.InstanceResponse) error {
+		if instance == nil {
+			instance = &rpc.InstanceResponse{}
+		}
+		return srv.Send(instance)
+	})
+}
+
+// WatchInstances calls send for the instances changed on the node and matching the filter of the
+// options. Unless the options ask for the full instances, send is called with nil as a notification.
+func (s *Server) WatchInstances(opts InstanceWatchOptions, send func(*rpc.InstanceResponse) error) error {
+	if err := opts.Filter.Validate(); err != nil {
+		return grpcstatus.Error(grpccodes.InvalidArgument, err.Error())
+	}
 	logrus.Info("Start watching instances")
 
 	done := make(chan struct{})
@@ -505,7 +639,7 @@ func (s *Server) InstanceWatch(req *emptypb.Empty, srv rpc.InstanceService_Insta
 		clients["spdkClient"] = spdkClient
 	}
 
-	notifyChan := make(chan struct{}, 1024)
+	notifyChan := make(chan *instanceNotification, 1024)
 	defer close(notifyChan)
 
 	g, ctx := errgroup.WithContext(s.ctx)
@@ -515,7 +649,7 @@ func (s *Server) InstanceWatch(req *emptypb.Empty, srv rpc.InstanceService_Insta
 			// Close the clients for closing streams and unblocking notifier Recv() with error.
 			done <- struct{}{}
 		}()
-		err := s.handleNotify(ctx, notifyChan, srv)
+		err := s.handleNotify(ctx, notifyChan, opts, send)
 		if err != nil {
 			logrus.WithError(err).Error("Failed to handle notify")
 		}
@@ -523,16 +657,16 @@ func (s *Server) InstanceWatch(req *emptypb.Empty, srv rpc.InstanceService_Insta
 	})
 
 	g.Go(func() error {
-		return s.watchProcess(ctx, req, pmClient, notifyChan)
+		return s.watchProcess(ctx, pmClient, notifyChan)
 	})
 
 	if s.v2DataEngineEnabled {
 		g.Go(func() error {
-			return s.watchSPDKEngine(ctx, req, spdkClient, notifyChan)
+			return s.watchSPDKEngine(ctx, spdkClient, notifyChan)
 		})
 
 		g.Go(func() error {
-			return s.watchSPDKReplica(ctx, req, spdkClient, notifyChan)
+			return s.watchSPDKReplica(ctx, spdkClient, notifyChan)
 		})
 	}
 
@@ -544,7 +678,7 @@ func (s *Server) InstanceWatch(req *emptypb.Empty, srv rpc.InstanceService_Insta
 	return nil
 }
 
-func (s *Server) watchSPDKReplica(ctx context.Context, req *emptypb.Empty, client *spdkclient.SPDKClient, notifyChan chan struct{}) error {
+func (s *Server) watchSPDKReplica(ctx context.Context, client *spdkclient.SPDKClient, notifyChan chan *instanceNotification) error {
 	logrus.Info("Start watching SPDK replicas")
 
 	notifier, err := client.ReplicaWatch(context.Background())
@@ -575,13 +709,16 @@ func (s *Server) watchSPDKReplica(ctx context.Context, req *emptypb.Empty, clien
 				time.Sleep(monitorRetryPollInterval)
 				failureCount++
 			} else {
-				notifyChan <- struct{}{}
+				notifyChan <- &instanceNotification{
+					dataEngine:   rpc.DataEngine_DATA_ENGINE_V2,
+					instanceType: types.InstanceTypeReplica,
+				}
 			}
 		}
 	}
 }
 
-func (s *Server) watchSPDKEngine(ctx context.Context, req *emptypb.Empty, client *spdkclient.SPDKClient, notifyChan chan struct{}) error {
+func (s *Server) watchSPDKEngine(ctx context.Context, client *spdkclient.SPDKClient, notifyChan chan *instanceNotification) error {
 	logrus.Info("Start watching SPDK engines")
 
 	notifier, err := client.EngineWatch(context.Background())
@@ -612,13 +749,16 @@ func (s *Server) watchSPDKEngine(ctx context.Context, req *emptypb.Empty, client
 				time.Sleep(monitorRetryPollInterval)
 				failureCount++
 			} else {
-				notifyChan <- struct{}{}
+				notifyChan <- &instanceNotification{
+					dataEngine:   rpc.DataEngine_DATA_ENGINE_V2,
+					instanceType: types.InstanceTypeEngine,
+				}
 			}
 		}
 	}
 }
 
-func (s *Server) watchProcess(ctx context.Context, req *emptypb.Empty, client *client.ProcessManagerClient, notifyChan chan struct{}) error {
+func (s *Server) watchProcess(ctx context.Context, client *client.ProcessManagerClient, notifyChan chan *instanceNotification) error {
 	logrus.Info("Start watching processes")
 
 	notifier, err := client.ProcessWatch(context.Background())
@@ -638,7 +778,7 @@ func (s *Server) watchProcess(ctx context.Context, req *emptypb.Empty, client *c
 			logrus.Info("Stopped watching processes")
 			return ctx.Err()
 		default:
-			_, err := notifier.Recv()
+			process, err := notifier.Recv()
 			if err != nil {
 				status, ok := grpcstatus.FromError(err)
 				if ok && status.Code() == grpccodes.Canceled {
@@ -648,13 +788,33 @@ func (s *Server) watchProcess(ctx context.Context, req *emptypb.Empty, client *c
 				logrus.WithError(err).Error("Failed to receive next item in process watch")
 				time.Sleep(monitorRetryPollInterval)
 				failureCount++
+			} else if process.ResyncRequired {
+				// The updates in between are lost, the instances of both types have to be got again
+				for _, instanceType := range []string{types.InstanceTypeEngine, types.InstanceTypeReplica} {
+					notifyChan <- &instanceNotification{
+						dataEngine:   rpc.DataEngine_DATA_ENGINE_V1,
+						instanceType: instanceType,
+					}
+				}
 			} else {
-				notifyChan <- struct{}{}
+				processType := processResponseType(process)
+				notifyChan <- &instanceNotification{
+					dataEngine:   rpc.DataEngine_DATA_ENGINE_V1,
+					instanceType: processType,
+					instance:     processResponseToInstanceResponse(process, processType),
+				}
 			}
 		}
 	}
 }
 
+func processResponseType(p *rpc.ProcessResponse) string {
+	if lhLonghorn.IsEngineProcess(p.Spec.Name) {
+		return types.InstanceTypeEngine
+	}
+	return types.InstanceTypeReplica
+}
+
 func processResponseToInstanceResponse(p *rpc.ProcessResponse, processType string) *rpc.InstanceResponse {
 	// v1 data engine doesn't support the separation of initiator and target, so
 	// initiator and target are always on the same node.
@@ -677,6 +837,7 @@ func processResponseToInstanceResponse(p *rpc.ProcessResponse, processType strin
 			},
 			PortCount: int32(p.Spec.PortCount),
 			PortArgs:  p.Spec.PortArgs,
+			Labels:    p.Spec.Labels,
 		},
 		Status: &rpc.InstanceStatus{
 			State:           p.Status.State,
@@ -686,6 +847,11 @@ func processResponseToInstanceResponse(p *rpc.ProcessResponse, processType strin
 			TargetPortEnd:   targetPortEnd,
 			ErrorMsg:        p.Status.ErrorMsg,
 			Conditions:      p.Status.Conditions,
+			RestartCount:    p.Status.RestartCount,
+			StartTime:       p.Status.StartTime,
+			ReadyTime:       p.Status.ReadyTime,
+			LastExitTime:    p.Status.LastExitTime,
+			LastExit:        p.Status.LastExit,
 		},
 		Deleted: p.Deleted,
 	}
@@ -748,7 +914,21 @@ func (s *Server) InstanceSuspend(ctx context.Context, req *rpc.InstanceSuspendRe
 }
 
 func (ops V1DataEngineInstanceOps) InstanceSuspend(req *rpc.InstanceSuspendRequest) (*emptypb.Empty, error) {
-	return nil, grpcstatus.Error(grpccodes.Unimplemented, "v1 data engine instance suspend is not supported")
+	if ops.processSuspender == nil {
+		return nil, grpcstatus.Error(grpccodes.Unimplemented, "v1 data engine instance suspend is not supported")
+	}
+
+	switch req.Type {
+	case types.InstanceTypeEngine:
+		if err := ops.processSuspender.ProcessSuspend(req.Name); err != nil {
+			return nil, err
+		}
+		return &emptypb.Empty{}, nil
+	case types.InstanceTypeReplica:
+		return nil, grpcstatus.Errorf(grpccodes.InvalidArgument, "suspend is not supported for instance type %v", req.Type)
+	default:
+		return nil, grpcstatus.Errorf(grpccodes.InvalidArgument, "unknown instance type %v", req.Type)
+	}
 }
 
 func (ops V2DataEngineInstanceOps) InstanceSuspend(req *rpc.InstanceSuspendRequest) (*emptypb.Empty, error) {
@@ -787,7 +967,21 @@ func (s *Server) InstanceResume(ctx context.Context, req *rpc.InstanceResumeRequ
 }
 
 func (ops V1DataEngineInstanceOps) InstanceResume(req *rpc.InstanceResumeRequest) (*emptypb.Empty, error) {
-	return nil, grpcstatus.Error(grpccodes.Unimplemented, "v1 data engine instance resume is not supported")
+	if ops.processSuspender == nil {
+		return nil, grpcstatus.Error(grpccodes.Unimplemented, "v1 data engine instance resume is not supported")
+	}
+
+	switch req.Type {
+	case types.InstanceTypeEngine:
+		if err := ops.processSuspender.ProcessResume(req.Name); err != nil {
+			return nil, err
+		}
+		return &emptypb.Empty{}, nil
+	case types.InstanceTypeReplica:
+		return nil, grpcstatus.Errorf(grpccodes.InvalidArgument, "resume is not supported for instance type %v", req.Type)
+	default:
+		return nil, grpcstatus.Errorf(grpccodes.InvalidArgument, "unknown instance type %v", req.Type)
+	}
 }
 
 func (ops V2DataEngineInstanceOps) InstanceResume(req *rpc.InstanceResumeRequest) (*emptypb.Empty, error) {
@@ -889,3 +1083,64 @@ func (ops V2DataEngineInstanceOps) InstanceDeleteTarget(req *rpc.InstanceDeleteT
 		return nil, grpcstatus.Errorf(grpccodes.InvalidArgument, "unknown instance type %v", req.Type)
 	}
 }
+
+func (s *Server) InstanceStats(ctx context.Context, req *rpc.InstanceStatsRequest) (*rpc.ProcessStatsResponse, error) {
+	logrus.WithFields(logrus.Fields{
+		"name":       req.Name,
+		"type":       req.Type,
+		"dataEngine": req.DataEngine,
+	}).Trace("Getting instance stats")
+
+	ops, ok := s.ops[req.DataEngine]
+	if !ok {
+		return nil, grpcstatus.Errorf(grpccodes.Unimplemented, "unsupported data engine %v", req.DataEngine)
+	}
+	return ops.InstanceStats(req)
+}
+
+func (ops V1DataEngineInstanceOps) InstanceStats(req *rpc.InstanceStatsRequest) (*rpc.ProcessStatsResponse, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pmClient, err := client.NewProcessManagerClient(ctx, cancel, "tcp://"+ops.processManagerServiceAddress, nil)
+	if err != nil {
+		return nil, grpcstatus.Error(grpccodes.Internal, errors.Wrapf(err, "failed to create ProcessManagerClient").Error())
+	}
+	defer pmClient.Close()
+
+	return pmClient.ProcessStats(req.Name)
+}
+
+func (ops V2DataEngineInstanceOps) InstanceStats(req *rpc.InstanceStatsRequest) (*rpc.ProcessStatsResponse, error) {
+	// The v2 data engine instances are not processes of their own, but live in the SPDK target
+	return nil, grpcstatus.Error(grpccodes.Unimplemented, "v2 data engine instance stats are not supported")
+}
+
+func (s *Server) InstanceEvents(ctx context.Context, req *rpc.InstanceEventsRequest) (*rpc.ProcessEventsResponse, error) {
+	logrus.WithFields(logrus.Fields{
+		"name":       req.Name,
+		"type":       req.Type,
+		"dataEngine": req.DataEngine,
+	}).Trace("Getting instance events")
+
+	ops, ok := s.ops[req.DataEngine]
+	if !ok {
+		return nil, grpcstatus.Errorf(grpccodes.Unimplemented, "unsupported data engine %v", req.DataEngine)
+	}
+	return ops.InstanceEvents(req)
+}
+
+func (ops V1DataEngineInstanceOps) InstanceEvents(req *rpc.InstanceEventsRequest) (*rpc.ProcessEventsResponse, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pmClient, err := client.NewProcessManagerClient(ctx, cancel, "tcp://"+ops.processManagerServiceAddress, nil)
+	if err != nil {
+		return nil, grpcstatus.Error(grpccodes.Internal, errors.Wrapf(err, "failed to create ProcessManagerClient").Error())
+	}
+	defer pmClient.Close()
+
+	return pmClient.ProcessEvents(req.Name)
+}
+
+func (ops V2DataEngineInstanceOps) InstanceEvents(req *rpc.InstanceEventsRequest) (*rpc.ProcessEventsResponse, error) {
+	return nil, grpcstatus.Error(grpccodes.Unimplemented, "v2 data engine instance events are not supported")
+}
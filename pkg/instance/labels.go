@@ -0,0 +1,38 @@
+package instance
+
+import (
+	rpc "github.com/longhorn/types/pkg/generated/imrpc"
+)
+
+func (s *Server) processLabeler() ProcessLabeler {
+	ops, ok := s.ops[rpc.DataEngine_DATA_ENGINE_V1].(V1DataEngineInstanceOps)
+	if !ok {
+		return nil
+	}
+	return ops.processLabeler
+}
+
+// instanceLabelCache remembers the labels of the instances, so the updates of the instances
+// deleted in the meantime still match the label selectors.
+type instanceLabelCache struct {
+	labeler ProcessLabeler
+	labels  map[string]map[string]string
+}
+
+func (s *Server) newInstanceLabelCache() *instanceLabelCache {
+	return &instanceLabelCache{
+		labeler: s.processLabeler(),
+		labels:  map[string]map[string]string{},
+	}
+}
+
+func (c *instanceLabelCache) labelsOf(instance *rpc.InstanceResponse) map[string]string {
+	if c.labeler == nil || instance == nil || instance.Spec == nil || instance.Spec.DataEngine != rpc.DataEngine_DATA_ENGINE_V1 {
+		return nil
+	}
+	name := instance.Spec.Name
+	if set, err := c.labeler.ProcessLabels(name); err == nil {
+		c.labels[name] = set
+	}
+	return c.labels[name]
+}
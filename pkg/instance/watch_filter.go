@@ -0,0 +1,190 @@
+package instance
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	rpc "github.com/longhorn/types/pkg/generated/imrpc"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/types"
+	"github.com/longhorn/longhorn-instance-manager/pkg/util"
+)
+
+// InstanceWatchFilter limits the instances a watch is notified about. The zero value matches all instances.
+type InstanceWatchFilter struct {
+	// Names matches the instances with any of the names.
+	Names []string
+	// NamePrefix matches the instances with a name starting with the prefix.
+	NamePrefix string
+	// Type is types.InstanceTypeEngine or types.InstanceTypeReplica.
+	Type string
+	// DataEngines matches the instances of any of the data engines.
+	DataEngines []rpc.DataEngine
+	// VolumeName matches the instances of the volume.
+	VolumeName string
+	// LabelSelector matches the instances whose labels match the Kubernetes label selector.
+	// Only the v1 data engine instances have labels.
+	LabelSelector string
+
+	selector labels.Selector
+}
+
+type InstanceWatchOptions struct {
+	Filter InstanceWatchFilter
+	// Full sends the changed instances rather than empty notifications. The SPDK watches don't tell
+	// which instance has changed, so all v2 instances matching the filter are sent for them.
+	Full bool
+}
+
+// instanceWatchOptionsFromRequest returns the options of an InstanceWatch request.
+func instanceWatchOptionsFromRequest(req *rpc.InstanceWatchRequest) InstanceWatchOptions {
+	return InstanceWatchOptions{
+		Filter: InstanceWatchFilter{
+			Names:         req.GetNames(),
+			NamePrefix:    req.GetNamePrefix(),
+			Type:          req.GetType(),
+			DataEngines:   req.GetDataEngines(),
+			VolumeName:    req.GetVolumeName(),
+			LabelSelector: req.GetLabelSelector(),
+		},
+		Full: req.GetFull(),
+	}
+}
+
+// instanceNotification tells the kind of instance that has changed, and the instance itself
+// if the notifier knows it.
+type instanceNotification struct {
+	dataEngine   rpc.DataEngine
+	instanceType string
+	instance     *rpc.InstanceResponse
+}
+
+func (f *InstanceWatchFilter) Validate() error {
+	if f.Type != "" && f.Type != types.InstanceTypeEngine && f.Type != types.InstanceTypeReplica {
+		return fmt.Errorf("invalid instance type %v", f.Type)
+	}
+	for _, dataEngine := range f.DataEngines {
+		if _, ok := rpc.DataEngine_name[int32(dataEngine)]; !ok {
+			return fmt.Errorf("invalid data engine %v", dataEngine)
+		}
+	}
+	selector, err := util.ParseLabelSelector(f.LabelSelector)
+	if err != nil {
+		return err
+	}
+	f.selector = selector
+	return nil
+}
+
+// matchKind returns true if the filter matches the instances of the data engine and the type.
+func (f *InstanceWatchFilter) matchKind(dataEngine rpc.DataEngine, instanceType string) bool {
+	if f.Type != "" && f.Type != instanceType {
+		return false
+	}
+	if len(f.DataEngines) == 0 {
+		return true
+	}
+	for _, d := range f.DataEngines {
+		if d == dataEngine {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns true if the filter matches the instance without labels.
+func (f *InstanceWatchFilter) Match(instance *rpc.InstanceResponse) bool {
+	return f.MatchLabels(instance, nil)
+}
+
+// MatchLabels returns true if the filter matches the instance with the given labels.
+func (f *InstanceWatchFilter) MatchLabels(instance *rpc.InstanceResponse, set map[string]string) bool {
+	if instance == nil || instance.Spec == nil {
+		return false
+	}
+	if !f.matchKind(instance.Spec.DataEngine, instance.Spec.Type) {
+		return false
+	}
+	if f.NamePrefix != "" && !strings.HasPrefix(instance.Spec.Name, f.NamePrefix) {
+		return false
+	}
+	if len(f.Names) != 0 && !slices.Contains(f.Names, instance.Spec.Name) {
+		return false
+	}
+	if f.VolumeName != "" && instanceVolumeName(instance, set) != f.VolumeName {
+		return false
+	}
+	if f.LabelSelector != "" {
+		selector := f.selector
+		if selector == nil {
+			var err error
+			if selector, err = labels.Parse(f.LabelSelector); err != nil {
+				return false
+			}
+		}
+		if !selector.Matches(labels.Set(set)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchLabels returns true if the filter matches the notification. A notification without the
+// instance matches as long as the kind of instance does.
+func (f *InstanceWatchFilter) matchLabels(n *instanceNotification, set map[string]string) bool {
+	if n.instance == nil {
+		return f.matchKind(n.dataEngine, n.instanceType)
+	}
+	return f.MatchLabels(n.instance, set)
+}
+
+// instanceKind is the data engine and the type of instances.
+type instanceKind struct {
+	dataEngine   rpc.DataEngine
+	instanceType string
+}
+
+// sentInstances are the instances a full watch has sent and not deleted, by kind. The notifiers that
+// don't tell which instance has changed don't tell about the deleted ones either, so an instance missing
+// from a listing of its kind is sent as deleted.
+type sentInstances map[instanceKind]map[string]*rpc.InstanceResponse
+
+func (sent sentInstances) update(instance *rpc.InstanceResponse) {
+	kind := instanceKind{instance.Spec.DataEngine, instance.Spec.Type}
+	if instance.Deleted {
+		delete(sent[kind], instance.Spec.Name)
+		return
+	}
+	if sent[kind] == nil {
+		sent[kind] = map[string]*rpc.InstanceResponse{}
+	}
+	sent[kind][instance.Spec.Name] = instance
+}
+
+// deleted returns the instances of the kind sent before but missing from the listed ones, as deleted.
+func (sent sentInstances) deleted(kind instanceKind, listed []*rpc.InstanceResponse) []*rpc.InstanceResponse {
+	names := map[string]bool{}
+	for _, instance := range listed {
+		names[instance.Spec.Name] = true
+	}
+	var deleted []*rpc.InstanceResponse
+	for name, instance := range sent[kind] {
+		if !names[name] {
+			deleted = append(deleted, &rpc.InstanceResponse{Spec: instance.Spec, Status: instance.Status, Deleted: true})
+		}
+	}
+	return deleted
+}
+
+func instanceVolumeName(instance *rpc.InstanceResponse, set map[string]string) string {
+	if instance.Spec.VolumeName != "" {
+		return instance.Spec.VolumeName
+	}
+	if volumeName := set[types.LabelVolume]; volumeName != "" {
+		return volumeName
+	}
+	// The v1 instances are named after their volume
+	return util.ProcessNameToVolumeName(instance.Spec.Name)
+}
@@ -0,0 +1,151 @@
+package process
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	lhLonghorn "github.com/longhorn/go-common-libs/longhorn"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/types"
+)
+
+const (
+	AdmissionReasonMaxProcesses = "max_processes"
+	AdmissionReasonMaxEngines   = "max_engines"
+	AdmissionReasonMaxReplicas  = "max_replicas"
+	AdmissionReasonMaxStarting  = "max_starting"
+)
+
+// AdmissionLimits caps the processes the process manager accepts, e.g. to avoid overloading
+// the node with a mass recreate after a restart. Zero values are unlimited.
+type AdmissionLimits struct {
+	// MaxProcesses is the maximum number of registered processes.
+	MaxProcesses int
+	// MaxEngines and MaxReplicas are the maximum numbers of registered processes of each type.
+	MaxEngines  int
+	MaxReplicas int
+	// MaxStarting is the maximum number of processes starting at the same time, either created or
+	// restarted. The restarts wait for a slot however long it takes.
+	MaxStarting int
+	// QueueTimeout is how long a creation waits for one of the starting processes to be running.
+	// The creation is rejected right away if it is 0.
+	QueueTimeout time.Duration
+}
+
+// checkCapacity must be called with the manager lock held.
+func (pm *Manager) checkCapacity(name string) error {
+	limits := pm.config.Admission
+	if limits.MaxProcesses <= 0 && limits.MaxEngines <= 0 && limits.MaxReplicas <= 0 {
+		return nil
+	}
+
+	isEngine := lhLonghorn.IsEngineProcess(name)
+	engines, replicas := 0, 0
+	for _, p := range pm.processes {
+		if lhLonghorn.IsEngineProcess(p.Name) {
+			engines++
+		} else {
+			replicas++
+		}
+	}
+
+	switch {
+	case limits.MaxProcesses > 0 && engines+replicas >= limits.MaxProcesses:
+		return rejectAdmission(AdmissionReasonMaxProcesses, "cannot create process %v: reached the maximum of %v processes", name, limits.MaxProcesses)
+	case isEngine && limits.MaxEngines > 0 && engines >= limits.MaxEngines:
+		return rejectAdmission(AdmissionReasonMaxEngines, "cannot create process %v: reached the maximum of %v engine processes", name, limits.MaxEngines)
+	case !isEngine && limits.MaxReplicas > 0 && replicas >= limits.MaxReplicas:
+		return rejectAdmission(AdmissionReasonMaxReplicas, "cannot create process %v: reached the maximum of %v replica processes", name, limits.MaxReplicas)
+	}
+	return nil
+}
+
+// acquireStartSlot waits for a process to be allowed to start, according to MaxStarting. The returned
+// function releases the slot, once the process is running or failed to start.
+func (pm *Manager) acquireStartSlot(ctx context.Context, name string) (func(), error) {
+	if pm.startSlots == nil {
+		return func() {}, nil
+	}
+	release := func() {
+		<-pm.startSlots
+	}
+
+	select {
+	case pm.startSlots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	timeout := pm.config.Admission.QueueTimeout
+	if timeout <= 0 {
+		return nil, rejectAdmission(AdmissionReasonMaxStarting, "cannot create process %v: reached the maximum of %v starting processes", name, cap(pm.startSlots))
+	}
+
+	admissionQueueDepth.Inc()
+	defer admissionQueueDepth.Dec()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case pm.startSlots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, rejectAdmission(AdmissionReasonMaxStarting, "cannot create process %v: timed out after %v waiting for one of the %v starting processes", name, timeout, cap(pm.startSlots))
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	case <-pm.ctx.Done():
+		return nil, status.Errorf(codes.Unavailable, "cannot create process %v: the process manager is shutting down", name)
+	}
+}
+
+func rejectAdmission(reason, format string, args ...interface{}) error {
+	admissionRejectionsTotal.WithLabelValues(reason).Inc()
+	return status.Errorf(codes.ResourceExhausted, format, args...)
+}
+
+// acquireRestartSlot waits for a start slot for a restart of the process, according to MaxStarting,
+// so a crash loop of many processes doesn't overload the node. Unlike a creation, a restart is never
+// rejected, it waits until a slot is free. It returns false if the process is stopped in the meantime.
+func (p *Process) acquireRestartSlot() (func(), bool) {
+	if p.startSlots == nil {
+		return func() {}, true
+	}
+	release := func() {
+		<-p.startSlots
+	}
+
+	select {
+	case p.startSlots <- struct{}{}:
+		return release, true
+	default:
+	}
+
+	admissionQueueDepth.Inc()
+	defer admissionQueueDepth.Dec()
+
+	ticker := time.NewTicker(types.WaitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case p.startSlots <- struct{}{}:
+			return release, true
+		case <-ticker.C:
+			p.lock.RLock()
+			stopRequested := p.stopRequested
+			p.lock.RUnlock()
+			if stopRequested {
+				return nil, false
+			}
+		}
+	}
+}
+
+// releaseStartSlot must be called with the process lock held.
+func (p *Process) releaseStartSlot() {
+	if release := p.startSlotRelease; release != nil {
+		p.startSlotRelease = nil
+		release()
+	}
+}
@@ -0,0 +1,82 @@
+package process
+
+import (
+	"sort"
+	"strings"
+
+	rpc "github.com/longhorn/types/pkg/generated/imrpc"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/util"
+)
+
+// ProcessDeleteBatch deletes the processes named by the request, or all the processes whose labels
+// match its label selector, with at most parallelism deletions running at the same time. It returns
+// the result of each deletion in the order of the names, or sorted by name for a selector.
+//
+// The processes selected by labels are listed first, so the labels of each process are checked again
+// right before it is deleted, and the process is skipped with FailedPrecondition if they no longer
+// match. A process relabeled between that check and its stop is still deleted.
+func (pm *Manager) ProcessDeleteBatch(ctx context.Context, req *rpc.ProcessDeleteBatchRequest) (*rpc.ProcessBatchResponse, error) {
+	if len(req.Names) != 0 && req.LabelSelector != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot set both names and label selector")
+	}
+
+	names := req.Names
+	var selector labels.Selector
+	if len(names) == 0 {
+		// The selector cannot be empty, so all processes are never deleted by mistake
+		if strings.TrimSpace(req.LabelSelector) == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "missing names or label selector")
+		}
+		var err error
+		if selector, err = util.ParseLabelSelector(req.LabelSelector); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		resp, err := pm.ProcessList(ctx, &rpc.ProcessListRequest{LabelSelector: req.LabelSelector})
+		if err != nil {
+			return nil, err
+		}
+		for name := range resp.Processes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	results := make([]*rpc.ProcessBatchResult, len(names))
+	errs := util.RunBatch(ctx, len(names), int(req.Parallelism), func(i int) (err error) {
+		results[i] = &rpc.ProcessBatchResult{Name: names[i]}
+		if selector == nil {
+			results[i].Process, err = pm.ProcessDelete(ctx, &rpc.ProcessDeleteRequest{Name: names[i]})
+			return err
+		}
+		results[i].Process, err = pm.deleteSelectedProcess(names[i], selector)
+		return err
+	})
+	for i, err := range errs {
+		if results[i] == nil {
+			results[i] = &rpc.ProcessBatchResult{Name: names[i]}
+		}
+		if err != nil {
+			st := status.Convert(err)
+			results[i].Error = st.Message()
+			results[i].ErrorCode = int32(st.Code())
+		}
+	}
+	return &rpc.ProcessBatchResponse{Results: results}, nil
+}
+
+// deleteSelectedProcess deletes the process named by name if its labels still match the selector.
+func (pm *Manager) deleteSelectedProcess(name string, selector labels.Selector) (*rpc.ProcessResponse, error) {
+	p := pm.findProcess(name)
+	if p == nil {
+		return nil, status.Errorf(codes.NotFound, "cannot find process %v", name)
+	}
+	if !selector.Matches(labels.Set(p.Labels())) {
+		return nil, status.Errorf(codes.FailedPrecondition, "labels of process %v no longer match selector %v", name, selector)
+	}
+	return pm.deleteProcess(p), nil
+}
@@ -0,0 +1,210 @@
+package process
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// BinaryPolicy decides which binaries the process manager is allowed to execute.
+// The zero value allows any binary. The verified binaries are executed from the opened file,
+// so they cannot be scripts, whose interpreter would have to open the file again.
+type BinaryPolicy struct {
+	// AllowedDirs are the directories the binaries must be in, after resolving the symlinks.
+	// Empty allows the binaries from anywhere.
+	AllowedDirs []string
+	// Checksums maps the resolved path of each allowed binary, without symlinks, to its hex encoded SHA-256.
+	// Once set, the binaries not pinned here are rejected.
+	Checksums map[string]string
+
+	lock   sync.Mutex
+	hashes map[string]binaryHash
+}
+
+// binaryHash caches the SHA-256 of a binary until the file changes, since the engine binaries are large.
+// The file is identified by its device and inode, and its change time tells if it has been modified,
+// since unlike the modification time it cannot be set back, e.g. by utimes.
+type binaryHash struct {
+	dev   uint64
+	ino   uint64
+	ctime syscall.Timespec
+	size  int64
+	sum   string
+}
+
+func (bp *BinaryPolicy) IsEmpty() bool {
+	return bp == nil || (len(bp.AllowedDirs) == 0 && len(bp.Checksums) == 0)
+}
+
+// Verify returns the binary opened if the policy allows executing it, or a PermissionDenied error
+// otherwise. The checks are done on the opened file, which is the one to execute, so the binary
+// cannot be swapped in between. The file is nil if the policy is empty. Each decision is logged
+// as an audit event.
+func (bp *BinaryPolicy) Verify(processName, binary string) (*os.File, error) {
+	f, resolved, err := bp.verify(binary)
+	entry := logrus.WithFields(logrus.Fields{
+		"audit":    "binary",
+		"process":  processName,
+		"binary":   binary,
+		"resolved": resolved,
+	})
+	if err != nil {
+		entry.WithError(err).Warn("Process Manager: denied executing binary")
+		return nil, status.Errorf(codes.PermissionDenied, "binary %v of process %v is not allowed: %v", binary, processName, err)
+	}
+	entry.Info("Process Manager: allowed executing binary")
+	return f, nil
+}
+
+func (bp *BinaryPolicy) verify(binary string) (f *os.File, resolved string, err error) {
+	if bp.IsEmpty() {
+		// The command creation reports the missing binary, as without a policy
+		return nil, binary, nil
+	}
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, "", err
+	}
+	if f, err = os.Open(path); err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			f = nil
+		}
+	}()
+	// The link of the file descriptor is the path of the opened file without symlinks
+	if resolved, err = os.Readlink(fdPath(f)); err != nil {
+		return nil, "", err
+	}
+
+	if len(bp.AllowedDirs) != 0 {
+		allowed := false
+		for _, dir := range bp.AllowedDirs {
+			if isInDir(resolved, dir) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, resolved, fmt.Errorf("%v is outside of the allowed directories %v", resolved, bp.AllowedDirs)
+		}
+	}
+
+	if len(bp.Checksums) != 0 {
+		expected, ok := bp.Checksums[resolved]
+		if !ok {
+			return nil, resolved, fmt.Errorf("%v has no pinned checksum", resolved)
+		}
+		sum, err := bp.checksum(f, resolved)
+		if err != nil {
+			return nil, resolved, err
+		}
+		if !strings.EqualFold(sum, expected) {
+			return nil, resolved, fmt.Errorf("SHA-256 %v of %v doesn't match the pinned %v", sum, resolved, expected)
+		}
+	}
+	return f, resolved, nil
+}
+
+// fdPath returns the path the opened file can be executed from.
+func fdPath(f *os.File) string {
+	return fmt.Sprintf("/proc/self/fd/%d", f.Fd())
+}
+
+// isInDir returns true if the resolved path is under the directory. The directory itself
+// can be a symlink, e.g. to the host path of a mount.
+func isInDir(path, dir string) bool {
+	if resolvedDir, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolvedDir
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (bp *BinaryPolicy) checksum(f *os.File, path string) (string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("failed to get the inode of %v", path)
+	}
+	key := binaryHash{dev: uint64(stat.Dev), ino: stat.Ino, ctime: stat.Ctim, size: info.Size()}
+
+	bp.lock.Lock()
+	defer bp.lock.Unlock()
+
+	if h, ok := bp.hashes[path]; ok && h.dev == key.dev && h.ino == key.ino && h.ctime == key.ctime && h.size == key.size {
+		return h.sum, nil
+	}
+	hash := sha256.New()
+	// Read from the start without moving the offset of the file to execute
+	if _, err := io.Copy(hash, io.NewSectionReader(f, 0, info.Size())); err != nil {
+		return "", errors.Wrapf(err, "failed to compute the checksum of %v", path)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if bp.hashes == nil {
+		bp.hashes = map[string]binaryHash{}
+	}
+	key.sum = sum
+	bp.hashes[path] = key
+	return sum, nil
+}
+
+// LoadBinaryChecksums reads the pinned checksums from a file in the sha256sum output format,
+// i.e. a hex encoded SHA-256 followed by the absolute path of the binary on each line.
+func LoadBinaryChecksums(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	checksums := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid checksum on line %v of %v", line, file)
+		}
+		sum, path := fields[0], strings.TrimPrefix(fields[1], "*")
+		if decoded, err := hex.DecodeString(sum); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 %v on line %v of %v", sum, line, file)
+		}
+		if !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("binary path %v on line %v of %v is not absolute", path, line, file)
+		}
+		checksums[filepath.Clean(path)] = strings.ToLower(sum)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return checksums, nil
+}
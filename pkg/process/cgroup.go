@@ -0,0 +1,401 @@
+package process
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	rpc "github.com/longhorn/types/pkg/generated/imrpc"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/types"
+)
+
+const (
+	CgroupV2MountPoint = "/sys/fs/cgroup"
+
+	// The instance-manager itself is moved into this leaf cgroup, since a cgroup v2 cgroup
+	// containing processes cannot delegate controllers to its children.
+	cgroupSupervisorName = "instance-manager"
+
+	CgroupFreezeWaitCount = 50
+)
+
+var cgroupControllers = []string{"cpu", "memory", "io"}
+
+// ResourceLimits are the cgroup v2 limits applied to a process. Empty values are left unlimited.
+type ResourceLimits struct {
+	// CPUMax is written to cpu.max, e.g. "50000 100000" for half a CPU.
+	CPUMax string `json:"cpuMax,omitempty"`
+	// MemoryMax is written to memory.max, in bytes or "max".
+	MemoryMax string `json:"memoryMax,omitempty"`
+	// IOMax entries are written to io.max, e.g. "8:0 rbps=1048576 wiops=120".
+	IOMax []string `json:"ioMax,omitempty"`
+	// IOWeight is written to io.weight, in the range [1, 10000].
+	IOWeight uint32 `json:"ioWeight,omitempty"`
+}
+
+func (r *ResourceLimits) IsEmpty() bool {
+	return r == nil || (r.CPUMax == "" && r.MemoryMax == "" && len(r.IOMax) == 0 && r.IOWeight == 0)
+}
+
+func (r *ResourceLimits) Validate() error {
+	if r == nil {
+		return nil
+	}
+	values := append([]string{r.CPUMax, r.MemoryMax}, r.IOMax...)
+	for _, value := range values {
+		if strings.ContainsAny(value, "\n\x00") {
+			return fmt.Errorf("invalid resource limit %q", value)
+		}
+	}
+	if r.IOWeight > 10000 {
+		return fmt.Errorf("invalid io weight %v, expected in the range [1, 10000]", r.IOWeight)
+	}
+	return nil
+}
+
+// withDefaults returns the limits with the unset fields taken from the defaults, nil if none is set.
+func (r *ResourceLimits) withDefaults(defaults *ResourceLimits) *ResourceLimits {
+	merged := ResourceLimits{}
+	if r != nil {
+		merged = *r
+	}
+	if defaults != nil {
+		if merged.CPUMax == "" {
+			merged.CPUMax = defaults.CPUMax
+		}
+		if merged.MemoryMax == "" {
+			merged.MemoryMax = defaults.MemoryMax
+		}
+		if merged.IOMax == nil {
+			merged.IOMax = defaults.IOMax
+		}
+		if merged.IOWeight == 0 {
+			merged.IOWeight = defaults.IOWeight
+		}
+	}
+	if merged.IsEmpty() {
+		return nil
+	}
+	return &merged
+}
+
+// RPC returns the limits set in a process spec, nil if none is set.
+func (r *ResourceLimits) RPC() *rpc.ProcessResources {
+	if r.IsEmpty() {
+		return nil
+	}
+	return &rpc.ProcessResources{
+		CpuMax:    r.CPUMax,
+		MemoryMax: r.MemoryMax,
+		IoMax:     r.IOMax,
+		IoWeight:  r.IOWeight,
+	}
+}
+
+// resourceLimitsFromRPC returns the limits of a process spec, nil if none is set.
+func resourceLimitsFromRPC(resources *rpc.ProcessResources) *ResourceLimits {
+	r := &ResourceLimits{
+		CPUMax:    resources.GetCpuMax(),
+		MemoryMax: resources.GetMemoryMax(),
+		IOMax:     resources.GetIoMax(),
+		IOWeight:  resources.GetIoWeight(),
+	}
+	if r.IsEmpty() {
+		return nil
+	}
+	return r
+}
+
+// ResourceUsage is read from the cgroup of a process.
+type ResourceUsage struct {
+	CPUUsageUsec      uint64 `json:"cpuUsageUsec"`
+	MemoryCurrent     uint64 `json:"memoryCurrent"`
+	IOReadBytes       uint64 `json:"ioReadBytes"`
+	IOWriteBytes      uint64 `json:"ioWriteBytes"`
+	IOReadOps         uint64 `json:"ioReadOps"`
+	IOWriteOps        uint64 `json:"ioWriteOps"`
+	OOMKillCount      uint64 `json:"oomKillCount"`
+	ThrottledUsec     uint64 `json:"throttledUsec"`
+	NumberOfProcesses uint64 `json:"numberOfProcesses"`
+}
+
+func (u *ResourceUsage) RPC() *rpc.ProcessResourceUsage {
+	return &rpc.ProcessResourceUsage{
+		CpuUsageUsec:      u.CPUUsageUsec,
+		MemoryCurrent:     u.MemoryCurrent,
+		IoReadBytes:       u.IOReadBytes,
+		IoWriteBytes:      u.IOWriteBytes,
+		IoReadOps:         u.IOReadOps,
+		IoWriteOps:        u.IOWriteOps,
+		OomKillCount:      u.OOMKillCount,
+		ThrottledUsec:     u.ThrottledUsec,
+		NumberOfProcesses: u.NumberOfProcesses,
+	}
+}
+
+// CgroupManager creates a child cgroup under the cgroup of the instance-manager for
+// each process. Creating the first one moves every process in the cgroup of the instance-manager,
+// including the instance-manager itself, into the leaf cgroup cgroupSupervisorName.
+type CgroupManager struct {
+	lock *sync.Mutex
+
+	mountPoint  string
+	root        string
+	initialized bool
+}
+
+func NewCgroupManager(mountPoint string) *CgroupManager {
+	return &CgroupManager{
+		lock:       &sync.Mutex{},
+		mountPoint: mountPoint,
+	}
+}
+
+func getSelfCgroup() (string, error) {
+	file, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// cgroup v2 has a single hierarchy with ID 0, e.g. "0::/kubepods/pod1234/abcd"
+		if path, found := strings.CutPrefix(scanner.Text(), "0::"); found {
+			return path, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("cgroup v2 is not available")
+}
+
+// init moves the instance-manager into a leaf cgroup and enables the controllers for
+// the process cgroups. It must be called with the lock held.
+func (m *CgroupManager) init() error {
+	if m.initialized {
+		return nil
+	}
+
+	self, err := getSelfCgroup()
+	if err != nil {
+		return err
+	}
+	root := filepath.Join(m.mountPoint, self)
+	// Already in the supervisor cgroup, e.g. after a restart of the instance-manager
+	if filepath.Base(root) == cgroupSupervisorName {
+		root = filepath.Dir(root)
+	}
+
+	supervisor := filepath.Join(root, cgroupSupervisorName)
+	if err := os.MkdirAll(supervisor, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create cgroup %v", supervisor)
+	}
+	procs, err := os.ReadFile(filepath.Join(root, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+	for _, pid := range strings.Fields(string(procs)) {
+		logrus.Infof("Process Manager: moving process %v from cgroup %v to cgroup %v", pid, root, supervisor)
+		if err := writeCgroupFile(supervisor, "cgroup.procs", pid); err != nil {
+			return errors.Wrapf(err, "failed to move process %v to cgroup %v", pid, supervisor)
+		}
+	}
+
+	available, err := os.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	var enabled []string
+	for _, controller := range cgroupControllers {
+		if !strings.Contains(" "+strings.TrimSpace(string(available))+" ", " "+controller+" ") {
+			logrus.Warnf("Process Manager: cgroup controller %v is not available in %v", controller, root)
+			continue
+		}
+		enabled = append(enabled, "+"+controller)
+	}
+	if len(enabled) > 0 {
+		if err := writeCgroupFile(root, "cgroup.subtree_control", strings.Join(enabled, " ")); err != nil {
+			return errors.Wrapf(err, "failed to enable cgroup controllers %v in %v", enabled, root)
+		}
+	}
+
+	logrus.Infof("Process Manager: creating process cgroups under %v with controllers %v", root, enabled)
+	m.root = root
+	m.initialized = true
+	return nil
+}
+
+// Create creates the cgroup with the given name and applies the limits, if any.
+func (m *CgroupManager) Create(name string, limits *ResourceLimits) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.init(); err != nil {
+		return "", errors.Wrap(err, "failed to initialize cgroups")
+	}
+
+	path := filepath.Join(m.root, name)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return "", errors.Wrapf(err, "failed to create cgroup %v", path)
+	}
+	if limits.IsEmpty() {
+		return path, nil
+	}
+
+	if limits.CPUMax != "" {
+		if err := writeCgroupFile(path, "cpu.max", limits.CPUMax); err != nil {
+			return "", err
+		}
+	}
+	if limits.MemoryMax != "" {
+		if err := writeCgroupFile(path, "memory.max", limits.MemoryMax); err != nil {
+			return "", err
+		}
+	}
+	for _, ioMax := range limits.IOMax {
+		if err := writeCgroupFile(path, "io.max", ioMax); err != nil {
+			return "", err
+		}
+	}
+	if limits.IOWeight != 0 {
+		if err := writeCgroupFile(path, "io.weight", "default "+strconv.FormatUint(uint64(limits.IOWeight), 10)); err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// Freeze freezes or thaws all processes in the cgroup. Freezing is asynchronous, so it waits
+// for the cgroup to report the new state.
+func (m *CgroupManager) Freeze(path string, frozen bool) error {
+	value := "0"
+	if frozen {
+		value = "1"
+	}
+	if err := writeCgroupFile(path, "cgroup.freeze", value); err != nil {
+		return err
+	}
+	for i := 0; i < CgroupFreezeWaitCount; i++ {
+		events, err := readCgroupKeyValues(path, "cgroup.events")
+		if err != nil {
+			return err
+		}
+		if (events["frozen"] == 1) == frozen {
+			return nil
+		}
+		time.Sleep(types.WaitInterval)
+	}
+	return fmt.Errorf("timed out waiting for cgroup %v to be frozen=%v", path, frozen)
+}
+
+// Remove deletes the cgroup. It fails if there are still processes in it.
+func (m *CgroupManager) Remove(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove cgroup %v", path)
+	}
+	return nil
+}
+
+// Path returns the path of an existing cgroup with the given name.
+func (m *CgroupManager) Path(name string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.init(); err != nil {
+		return "", err
+	}
+	path := filepath.Join(m.root, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (m *CgroupManager) GetUsage(path string) (*ResourceUsage, error) {
+	usage := &ResourceUsage{}
+
+	cpuStat, err := readCgroupKeyValues(path, "cpu.stat")
+	if err != nil {
+		return nil, err
+	}
+	usage.CPUUsageUsec = cpuStat["usage_usec"]
+	usage.ThrottledUsec = cpuStat["throttled_usec"]
+
+	if content, err := os.ReadFile(filepath.Join(path, "memory.current")); err == nil {
+		usage.MemoryCurrent, _ = strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	}
+	if memoryEvents, err := readCgroupKeyValues(path, "memory.events"); err == nil {
+		usage.OOMKillCount = memoryEvents["oom_kill"]
+	}
+
+	if content, err := os.ReadFile(filepath.Join(path, "io.stat")); err == nil {
+		// e.g. "8:0 rbytes=1459200 wbytes=314773504 rios=192 wios=353 dbytes=0 dios=0"
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			for _, field := range fields[1:] {
+				key, value, found := strings.Cut(field, "=")
+				if !found {
+					continue
+				}
+				v, _ := strconv.ParseUint(value, 10, 64)
+				switch key {
+				case "rbytes":
+					usage.IOReadBytes += v
+				case "wbytes":
+					usage.IOWriteBytes += v
+				case "rios":
+					usage.IOReadOps += v
+				case "wios":
+					usage.IOWriteOps += v
+				}
+			}
+		}
+	}
+
+	if content, err := os.ReadFile(filepath.Join(path, "cgroup.procs")); err == nil {
+		usage.NumberOfProcesses = uint64(len(strings.Fields(string(content))))
+	}
+	return usage, nil
+}
+
+func readCgroupKeyValues(path, file string) (map[string]uint64, error) {
+	content, err := os.ReadFile(filepath.Join(path, file))
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]uint64{}
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[fields[0]] = v
+	}
+	return values, nil
+}
+
+func writeCgroupFile(path, file, value string) error {
+	if err := os.WriteFile(filepath.Join(path, file), []byte(value), 0644); err != nil {
+		return errors.Wrapf(err, "failed to write %v to %v", value, filepath.Join(path, file))
+	}
+	return nil
+}
@@ -1,25 +1,58 @@
 package process
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/types"
 )
 
 type Executor interface {
 	NewCommand(name string, arg ...string) (Command, error)
+	// AttachCommand returns a command for a process that is already running with the given PID,
+	// e.g. a process launched by a previous instance-manager.
+	AttachCommand(pid int, name string, arg ...string) (Command, error)
 }
 
 type Command interface {
 	Run() error
 	SetOutput(io.Writer)
+	// SetStartHook sets a function that is called with the PID right after the process starts.
+	// If it fails, the process is killed and Run returns the error.
+	SetStartHook(hook func(pid int) error)
+	// SetEnv replaces the inherited environment of the process. It must be called before Run.
+	SetEnv(env []string)
+	// SetDir sets the working directory of the process. It must be called before Run.
+	SetDir(dir string)
+	// SetCredential sets the uid/gid the process runs as. It must be called before Run.
+	SetCredential(credential *syscall.Credential)
+	// SetDetached starts the process in its own session without the parent death signal,
+	// so it keeps running after the instance-manager exits. It must be called before Run.
+	SetDetached(detached bool)
+	// SetCgroup starts the process directly in the cgroup v2 cgroup at path, so no child process
+	// can escape it. It must be called before Run.
+	SetCgroup(path string)
+	// SetBinaryFile executes the binary from the opened file rather than the one looked up by
+	// name, e.g. the binary verified by the binary policy. It must be called before Run.
+	SetBinaryFile(file *os.File)
 	IsRunning() bool
+	Pid() int
 	Stop()
 	StopWithSignal(signal syscall.Signal)
+	// Signal sends a signal that is not meant to stop the process, e.g. SIGSTOP or SIGCONT.
+	Signal(signal syscall.Signal) error
 	Kill()
 }
 
@@ -29,9 +62,17 @@ func (be *BinaryExecutor) NewCommand(name string, arg ...string) (Command, error
 	return NewBinaryCommand(name, arg...)
 }
 
+func (be *BinaryExecutor) AttachCommand(pid int, name string, arg ...string) (Command, error) {
+	return NewAttachedCommand(pid, name, arg...)
+}
+
 type BinaryCommand struct {
 	*sync.RWMutex
 	*exec.Cmd
+
+	startHook  func(pid int) error
+	cgroup     string
+	binaryFile *os.File
 }
 
 func NewBinaryCommand(binary string, arg ...string) (*BinaryCommand, error) {
@@ -57,6 +98,103 @@ func NewBinaryCommand(binary string, arg ...string) (*BinaryCommand, error) {
 	}, nil
 }
 
+func (bc *BinaryCommand) Run() error {
+	if err := bc.start(); err != nil {
+		return err
+	}
+
+	if bc.startHook != nil {
+		if err := bc.startHook(bc.Process.Pid); err != nil {
+			bc.Kill()
+			_ = bc.Cmd.Wait()
+			return err
+		}
+	}
+	return bc.Cmd.Wait()
+}
+
+func (bc *BinaryCommand) start() error {
+	bc.Lock()
+	defer bc.Unlock()
+
+	if bc.cgroup == "" {
+		return bc.Cmd.Start()
+	}
+
+	// Unlike moving the process after it starts, clone3 with CLONE_INTO_CGROUP leaves no window
+	// in which the process or its children run outside of the cgroup
+	dir, err := os.Open(bc.cgroup)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open cgroup %v", bc.cgroup)
+	}
+	defer dir.Close()
+	bc.SysProcAttr.UseCgroupFD = true
+	bc.SysProcAttr.CgroupFD = int(dir.Fd())
+	if err := bc.Cmd.Start(); err != nil {
+		return errors.Wrapf(err, "failed to start process in cgroup %v", bc.cgroup)
+	}
+	return nil
+}
+
+func (bc *BinaryCommand) SetCgroup(path string) {
+	bc.Lock()
+	defer bc.Unlock()
+	bc.cgroup = path
+}
+
+func (bc *BinaryCommand) SetBinaryFile(file *os.File) {
+	bc.Lock()
+	defer bc.Unlock()
+	// The arguments keep the binary path, only the executed file changes
+	bc.binaryFile = file
+	bc.Path = fdPath(file)
+}
+
+func (bc *BinaryCommand) SetStartHook(hook func(pid int) error) {
+	bc.Lock()
+	defer bc.Unlock()
+	bc.startHook = hook
+}
+
+func (bc *BinaryCommand) SetEnv(env []string) {
+	bc.Lock()
+	defer bc.Unlock()
+	bc.Env = env
+}
+
+func (bc *BinaryCommand) SetDir(dir string) {
+	bc.Lock()
+	defer bc.Unlock()
+	bc.Dir = dir
+}
+
+func (bc *BinaryCommand) SetCredential(credential *syscall.Credential) {
+	bc.Lock()
+	defer bc.Unlock()
+	bc.SysProcAttr.Credential = credential
+}
+
+func (bc *BinaryCommand) SetDetached(detached bool) {
+	bc.Lock()
+	defer bc.Unlock()
+	if detached {
+		bc.SysProcAttr.Pdeathsig = 0
+		bc.SysProcAttr.Setsid = true
+	} else {
+		bc.SysProcAttr.Pdeathsig = syscall.SIGKILL
+		bc.SysProcAttr.Setsid = false
+	}
+}
+
+func (bc *BinaryCommand) Pid() int {
+	bc.RLock()
+	defer bc.RUnlock()
+	if bc.Process == nil {
+		return 0
+	}
+	return bc.Process.Pid
+}
+
 func (bc *BinaryCommand) SetOutput(writer io.Writer) {
 	bc.Lock()
 	defer bc.Unlock()
@@ -80,6 +218,15 @@ func (bc *BinaryCommand) StopWithSignal(signal syscall.Signal) {
 	}
 }
 
+func (bc *BinaryCommand) Signal(signal syscall.Signal) error {
+	bc.RLock()
+	defer bc.RUnlock()
+	if bc.Process == nil {
+		return fmt.Errorf("process is not started")
+	}
+	return bc.Process.Signal(signal)
+}
+
 func (bc *BinaryCommand) Stop() {
 	bc.RLock()
 	defer bc.RUnlock()
@@ -100,8 +247,170 @@ func (bc *BinaryCommand) Kill() {
 	}
 }
 
+// ErrUnknownExitStatus is returned by AttachedCommand.Run, the exit status of a process that
+// is not a child of the current instance-manager cannot be collected.
+var ErrUnknownExitStatus = errors.New("process exited with unknown status")
+
+// AttachedCommand tracks a process that is not a child of the current instance-manager.
+// The exit status of such a process cannot be collected, so Run only reports that it is gone.
+type AttachedCommand struct {
+	*sync.RWMutex
+
+	pid    int
+	exited bool
+}
+
+func NewAttachedCommand(pid int, binary string, arg ...string) (*AttachedCommand, error) {
+	var err error
+
+	binary, err = exec.LookPath(binary)
+	if err != nil {
+		return nil, err
+	}
+
+	binary, err = filepath.Abs(binary)
+	if err != nil {
+		return nil, err
+	}
+
+	cmdline, err := getProcessCmdline(pid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get cmdline of process %v", pid)
+	}
+	if !reflect.DeepEqual(cmdline, append([]string{binary}, arg...)) {
+		return nil, fmt.Errorf("process %v is running %v rather than %v", pid, cmdline, binary)
+	}
+
+	return &AttachedCommand{
+		RWMutex: &sync.RWMutex{},
+		pid:     pid,
+	}, nil
+}
+
+func getProcessCmdline(pid int) ([]string, error) {
+	content, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return nil, err
+	}
+	content = bytes.TrimSuffix(content, []byte{0})
+	if len(content) == 0 {
+		return nil, fmt.Errorf("empty cmdline")
+	}
+
+	var cmdline []string
+	for _, arg := range bytes.Split(content, []byte{0}) {
+		cmdline = append(cmdline, string(arg))
+	}
+	return cmdline, nil
+}
+
+func isProcessAlive(pid int) bool {
+	if err := syscall.Kill(pid, 0); err != nil {
+		return false
+	}
+	// A zombie still accepts signals, but it has already exited.
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	if i := bytes.LastIndexByte(stat, ')'); i >= 0 && i+2 < len(stat) && stat[i+2] == 'Z' {
+		var ws syscall.WaitStatus
+		// Reap it in case the process was reparented to the instance-manager
+		_, _ = syscall.Wait4(pid, &ws, syscall.WNOHANG, nil)
+		return false
+	}
+	return true
+}
+
+func (ac *AttachedCommand) Run() error {
+	ticker := time.NewTicker(types.WaitInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !isProcessAlive(ac.pid) {
+			break
+		}
+	}
+
+	ac.Lock()
+	ac.exited = true
+	ac.Unlock()
+	return ErrUnknownExitStatus
+}
+
+func (ac *AttachedCommand) SetOutput(writer io.Writer) {
+	// The output of the process is still going to where its original parent directed it.
+}
+
+func (ac *AttachedCommand) SetStartHook(hook func(pid int) error) {
+	// The process has been started already.
+}
+
+func (ac *AttachedCommand) SetEnv(env []string) {
+	// The process has been started already.
+}
+
+func (ac *AttachedCommand) SetDir(dir string) {
+	// The process has been started already.
+}
+
+func (ac *AttachedCommand) SetCredential(credential *syscall.Credential) {
+	// The process has been started already.
+}
+
+func (ac *AttachedCommand) SetDetached(detached bool) {
+	// The process has been started already.
+}
+
+func (ac *AttachedCommand) SetCgroup(path string) {
+	// The process has been started already.
+}
+
+func (ac *AttachedCommand) SetBinaryFile(file *os.File) {
+	// The process has been started already.
+}
+
+func (ac *AttachedCommand) IsRunning() bool {
+	ac.RLock()
+	defer ac.RUnlock()
+	return !ac.exited
+}
+
+func (ac *AttachedCommand) Pid() int {
+	return ac.pid
+}
+
+func (ac *AttachedCommand) StopWithSignal(signal syscall.Signal) {
+	ac.RLock()
+	defer ac.RUnlock()
+	if ac.exited {
+		return
+	}
+	if err := syscall.Kill(ac.pid, signal); err != nil {
+		logrus.WithError(err).Error("failed to send signal to process")
+	}
+}
+
+func (ac *AttachedCommand) Signal(signal syscall.Signal) error {
+	ac.RLock()
+	defer ac.RUnlock()
+	if ac.exited {
+		return fmt.Errorf("process %v has exited", ac.pid)
+	}
+	return syscall.Kill(ac.pid, signal)
+}
+
+func (ac *AttachedCommand) Stop() {
+	ac.StopWithSignal(syscall.SIGINT)
+}
+
+func (ac *AttachedCommand) Kill() {
+	ac.StopWithSignal(syscall.SIGKILL)
+}
+
 type MockExecutor struct {
 	CreationHook func(cmd *MockCommand) (*MockCommand, error)
+	AttachHook   func(cmd *MockCommand) (*MockCommand, error)
 }
 
 func (me *MockExecutor) NewCommand(name string, arg ...string) (Command, error) {
@@ -112,13 +421,35 @@ func (me *MockExecutor) NewCommand(name string, arg ...string) (Command, error)
 	return me.CreationHook(NewMockCommand(name, arg...))
 }
 
+func (me *MockExecutor) AttachCommand(pid int, name string, arg ...string) (Command, error) {
+	cmd := NewMockCommand(name, arg...)
+	cmd.pid = pid
+	cmd.isRunning = true
+	if me.AttachHook == nil {
+		return cmd, nil
+	}
+	return me.AttachHook(cmd)
+}
+
 type MockCommand struct {
 	*sync.RWMutex
 
-	Binary string
-	Args   []string
-
-	stopCh chan error
+	Binary     string
+	Args       []string
+	Env        []string
+	Dir        string
+	Credential *syscall.Credential
+	Signals    []syscall.Signal
+	Detached   bool
+	Cgroup     string
+	BinaryFile *os.File
+	// StopSignals are the signals the command was stopped with. The IgnoredSignals do not stop it.
+	StopSignals    []syscall.Signal
+	IgnoredSignals map[syscall.Signal]bool
+
+	pid       int
+	startHook func(pid int) error
+	stopCh    chan error
 
 	isRunning bool
 	stopped   bool
@@ -141,20 +472,74 @@ func NewMockCommand(name string, arg ...string) *MockCommand {
 func (mc *MockCommand) Run() error {
 	mc.Lock()
 	mc.isRunning = true
+	hook := mc.startHook
 	mc.Unlock()
 
+	if hook != nil {
+		if err := hook(mc.pid); err != nil {
+			return err
+		}
+	}
 	return <-mc.stopCh
 }
 
 func (mc *MockCommand) SetOutput(writer io.Writer) {
 }
 
+func (mc *MockCommand) SetStartHook(hook func(pid int) error) {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.startHook = hook
+}
+
+func (mc *MockCommand) SetEnv(env []string) {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.Env = env
+}
+
+func (mc *MockCommand) SetDir(dir string) {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.Dir = dir
+}
+
+func (mc *MockCommand) SetCredential(credential *syscall.Credential) {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.Credential = credential
+}
+
+func (mc *MockCommand) SetDetached(detached bool) {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.Detached = detached
+}
+
+func (mc *MockCommand) SetCgroup(path string) {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.Cgroup = path
+}
+
+func (mc *MockCommand) SetBinaryFile(file *os.File) {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.BinaryFile = file
+}
+
 func (mc *MockCommand) IsRunning() bool {
 	mc.RLock()
 	defer mc.RUnlock()
 	return mc.isRunning
 }
 
+func (mc *MockCommand) Pid() int {
+	mc.RLock()
+	defer mc.RUnlock()
+	return mc.pid
+}
+
 func (mc *MockCommand) Stop() {
 	mc.Lock()
 	mc.stopped = true
@@ -164,7 +549,21 @@ func (mc *MockCommand) Stop() {
 }
 
 func (mc *MockCommand) StopWithSignal(signal syscall.Signal) {
-	mc.Stop()
+	mc.Lock()
+	mc.StopSignals = append(mc.StopSignals, signal)
+	ignored := mc.IgnoredSignals[signal]
+	mc.Unlock()
+
+	if !ignored {
+		mc.Stop()
+	}
+}
+
+func (mc *MockCommand) Signal(signal syscall.Signal) error {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.Signals = append(mc.Signals, signal)
+	return nil
 }
 
 func (mc *MockCommand) Kill() {
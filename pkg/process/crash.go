@@ -0,0 +1,246 @@
+package process
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/util"
+)
+
+const (
+	CrashDirName         = "crash"
+	DefaultCrashLogLines = 500
+	// MaxCrashReports is the number of crash reports kept for each process, e.g. one restarted over and over
+	MaxCrashReports = 5
+
+	crashReportTimeFormat = "20060102T150405.000Z"
+	crashReportSuffix     = "-report.json"
+)
+
+var corePatternFile = "/proc/sys/kernel/core_pattern"
+
+// CrashReport describes an abnormal exit of a process. It is written along with the last lines of
+// the process log and the core files into <logsDir>/crash/<name>-<uuid>/.
+type CrashReport struct {
+	Name      string      `json:"name"`
+	UUID      string      `json:"uuid"`
+	Binary    string      `json:"binary"`
+	Args      []string    `json:"args"`
+	PID       int         `json:"pid"`
+	StartTime *time.Time  `json:"startTime,omitempty"`
+	ExitTime  time.Time   `json:"exitTime"`
+	Exit      *ExitStatus `json:"exit,omitempty"`
+	ErrorMsg  string      `json:"errorMsg"`
+	CoreFiles []string    `json:"coreFiles,omitempty"`
+
+	workingDir string
+}
+
+type crashReporter struct {
+	dir      string
+	logLines int
+}
+
+func newCrashReporter(logsDir string, logLines int) *crashReporter {
+	if logLines <= 0 {
+		return nil
+	}
+	return &crashReporter{
+		dir:      filepath.Join(logsDir, CrashDirName),
+		logLines: logLines,
+	}
+}
+
+// newCrashReport must be called with the process lock held.
+func (p *Process) newCrashReport(pid int) *CrashReport {
+	r := &CrashReport{
+		Name:      p.Name,
+		UUID:      p.UUID,
+		Binary:    p.Binary,
+		Args:      p.Args,
+		PID:       pid,
+		StartTime: p.StartTime,
+		Exit:      p.LastExit,
+		ErrorMsg:  p.ErrorMsg,
+	}
+	if p.LastExitTime != nil {
+		r.ExitTime = *p.LastExitTime
+	}
+	if p.Options != nil && p.Options.WorkingDir != "" {
+		r.workingDir = p.Options.WorkingDir
+	} else if wd, err := os.Getwd(); err == nil {
+		r.workingDir = wd
+	}
+	return r
+}
+
+func (p *Process) collectCrashReport(r *CrashReport) {
+	dir, err := p.crashReporter.collect(r, p.logger)
+	if err != nil {
+		logrus.WithError(err).Warnf("Process Manager: failed to collect the crash report of process %v", p.Name)
+		return
+	}
+	logrus.Infof("Process Manager: collected the crash report of process %v into %v", p.Name, dir)
+	p.events.record(EventReasonCrashReported, "collected the crash report with %v core files into %v", len(r.CoreFiles), dir)
+}
+
+// collect writes the crash report, the last lines of the log and the core files of the process.
+// It returns the directory of the report.
+func (c *crashReporter) collect(r *CrashReport, logger *util.LonghornWriter) (string, error) {
+	dir := filepath.Join(c.dir, r.Name+"-"+r.UUID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	prefix := filepath.Join(dir, r.ExitTime.UTC().Format(crashReportTimeFormat))
+
+	if err := writeLogTail(prefix+"-log.txt", logger, c.logLines); err != nil {
+		logrus.WithError(err).Warnf("Process Manager: failed to collect the log of crashed process %v", r.Name)
+	}
+
+	for _, core := range findCoreFiles(r) {
+		target := prefix + "-" + filepath.Base(core)
+		if err := moveFile(core, target); err != nil {
+			logrus.WithError(err).Warnf("Process Manager: failed to collect core file %v of crashed process %v", core, r.Name)
+			continue
+		}
+		r.CoreFiles = append(r.CoreFiles, filepath.Base(target))
+	}
+
+	content, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(prefix+crashReportSuffix, content, 0644); err != nil {
+		return "", err
+	}
+
+	pruneCrashReports(dir, MaxCrashReports)
+	return dir, nil
+}
+
+func writeLogTail(path string, logger *util.LonghornWriter, lines int) error {
+	done := make(chan struct{})
+	defer close(done)
+	logChan, err := logger.StreamLogWithOptions(done, util.LogStreamOptions{Tail: lines})
+	if err != nil {
+		return err
+	}
+	var content strings.Builder
+	for line := range logChan {
+		content.WriteString(line)
+		content.WriteString("\n")
+	}
+	return os.WriteFile(path, []byte(content.String()), 0644)
+}
+
+// findCoreFiles returns the core files the kernel wrote for the process, if the core pattern is a
+// plain path. A core pattern piping to a program, e.g. systemd-coredump, is not supported.
+func findCoreFiles(r *CrashReport) []string {
+	content, err := os.ReadFile(corePatternFile)
+	if err != nil {
+		return nil
+	}
+	pattern := strings.TrimSpace(string(content))
+	if pattern == "" || strings.HasPrefix(pattern, "|") {
+		return nil
+	}
+
+	dir := filepath.Dir(pattern)
+	if !filepath.IsAbs(pattern) {
+		dir = filepath.Join(r.workingDir, dir)
+	}
+	// The part of the name before the first specifier, e.g. "core." for "core.%p"
+	prefix := filepath.Base(pattern)
+	if i := strings.Index(prefix, "%"); i >= 0 {
+		prefix = prefix[:i]
+	}
+	if prefix == "" {
+		return nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	pid := strconv.Itoa(r.PID)
+	var cores []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if name != prefix && !strings.Contains(strings.TrimPrefix(name, prefix), pid) {
+			continue
+		}
+		// Skip the core files of a previous run
+		info, err := entry.Info()
+		if err != nil || (r.StartTime != nil && info.ModTime().Before(*r.StartTime)) {
+			continue
+		}
+		cores = append(cores, filepath.Join(dir, name))
+	}
+	return cores
+}
+
+func moveFile(source, target string) error {
+	if err := os.Rename(source, target); err == nil {
+		return nil
+	}
+
+	// The logs directory may be on another filesystem
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return errors.Wrapf(err, "failed to copy %v to %v", source, target)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(source)
+}
+
+// pruneCrashReports removes the files of all but the latest reports in the directory.
+func pruneCrashReports(dir string, keep int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var reports []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), crashReportSuffix) {
+			reports = append(reports, strings.TrimSuffix(entry.Name(), crashReportSuffix))
+		}
+	}
+	if len(reports) <= keep {
+		return
+	}
+	sort.Strings(reports)
+	stale := reports[:len(reports)-keep]
+	for _, entry := range entries {
+		for _, prefix := range stale {
+			if strings.HasPrefix(entry.Name(), prefix+"-") {
+				if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+					logrus.WithError(err).Warnf("Process Manager: failed to remove stale crash report file %v", entry.Name())
+				}
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	rpc "github.com/longhorn/types/pkg/generated/imrpc"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/util"
+)
+
+const (
+	DebugDumpDirName = "debug"
+
+	// DebugDumpTimeout is how long the output of the process is captured at most
+	DebugDumpTimeout = 10 * time.Second
+	// The dump is considered complete once the process writes nothing for this long
+	DebugDumpQuietPeriod = 1 * time.Second
+
+	// DefaultDebugDumpSignal is used when the request doesn't specify a signal
+	DefaultDebugDumpSignal = "SIGQUIT"
+)
+
+// DebugDumpSignals are the signals a debug dump can be triggered with. The effect depends on the
+// process, e.g. SIGQUIT makes a Go process dump the stacks of all goroutines and exit, and a process
+// without a handler exits on SIGUSR1 or SIGUSR2.
+var DebugDumpSignals = map[string]syscall.Signal{
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+func ParseDebugDumpSignal(signal string) (syscall.Signal, error) {
+	if signal == "" {
+		signal = DefaultDebugDumpSignal
+	}
+	if sig, ok := DebugDumpSignals[signal]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("doesn't support debug dump signal %v", signal)
+}
+
+// ProcessDebugDump sends the signal of the request, SIGQUIT by default, to a running process and captures what it
+// writes to its log right after, e.g. the goroutine dump of a hung engine, into an artifact file
+// under <logsDir>/debug/<name>-<uuid>/. The response has the path of the artifact.
+func (pm *Manager) ProcessDebugDump(ctx context.Context, req *rpc.ProcessDebugDumpRequest) (*rpc.ProcessDebugDumpResponse, error) {
+	name := req.Name
+	signal, err := ParseDebugDumpSignal(req.Signal)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	p := pm.findProcess(name)
+	if p == nil {
+		return nil, status.Errorf(codes.NotFound, "cannot find process %v", name)
+	}
+
+	p.lock.RLock()
+	cmd, state, suspended, uuid := p.cmd, p.State, p.suspended, p.UUID
+	p.lock.RUnlock()
+	if cmd == nil || !cmd.IsRunning() || (state != StateRunning && state != StateStarting) {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot dump process %v in state %v", name, state)
+	}
+	if suspended {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot dump suspended process %v, it should be resumed first", name)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	logChan, err := p.logger.StreamLogWithOptions(done, util.LogStreamOptions{SkipExisting: true})
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrapf(err, "failed to follow the log of process %v", name).Error())
+	}
+
+	logrus.Infof("Process Manager: sending %v to process %v with PID %v for a debug dump", signal, name, cmd.Pid())
+	p.events.record(EventReasonDebugDump, "sent %v to PID %v for a debug dump", signal, cmd.Pid())
+	if err := cmd.Signal(signal); err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrapf(err, "failed to send %v to process %v", signal, name).Error())
+	}
+
+	lines := captureDebugDump(ctx, logChan)
+	if len(lines) == 0 {
+		return nil, status.Errorf(codes.DeadlineExceeded, "process %v wrote nothing within %v after %v", name, DebugDumpTimeout, signal)
+	}
+
+	dir := filepath.Join(pm.logsDir, DebugDumpDirName, name+"-"+uuid)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	path := filepath.Join(dir, time.Now().UTC().Format(crashReportTimeFormat)+"-dump.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrapf(err, "failed to write the debug dump of process %v", name).Error())
+	}
+	logrus.Infof("Process Manager: captured the debug dump of process %v into %v", name, path)
+	return &rpc.ProcessDebugDumpResponse{Path: path}, nil
+}
+
+// captureDebugDump collects the log lines until the process is quiet for DebugDumpQuietPeriod
+// after writing something, the stream ends or DebugDumpTimeout is reached.
+func captureDebugDump(ctx context.Context, logChan chan string) []string {
+	timeout := time.NewTimer(DebugDumpTimeout)
+	defer timeout.Stop()
+	quiet := time.NewTimer(DebugDumpTimeout)
+	defer quiet.Stop()
+
+	var lines []string
+	for {
+		select {
+		case line, ok := <-logChan:
+			if !ok {
+				return lines
+			}
+			lines = append(lines, line)
+			quiet.Reset(DebugDumpQuietPeriod)
+		case <-quiet.C:
+			return lines
+		case <-timeout.C:
+			return lines
+		case <-ctx.Done():
+			return lines
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package process
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	rpc "github.com/longhorn/types/pkg/generated/imrpc"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/util"
+)
+
+const (
+	// MaxProcessEvents is the number of events kept for each process. The oldest ones are dropped first.
+	MaxProcessEvents = 100
+)
+
+const (
+	EventReasonCreated             = "Created"
+	EventReasonAttached            = "Attached"
+	EventReasonBinaryDenied        = "BinaryDenied"
+	EventReasonPortsAllocated      = "PortsAllocated"
+	EventReasonPortsReleased       = "PortsReleased"
+	EventReasonStarted             = "Started"
+	EventReasonSchedulingApplied   = "SchedulingApplied"
+	EventReasonStartFailed         = "StartFailed"
+	EventReasonWaitingForRunning   = "WaitingForRunning"
+	EventReasonRunning             = "Running"
+	EventReasonProbeFailed         = "ProbeFailed"
+	EventReasonLivenessProbeFailed = "LivenessProbeFailed"
+	EventReasonUnhealthy           = "Unhealthy"
+	EventReasonHealthy             = "Healthy"
+	EventReasonSuspended           = "Suspended"
+	EventReasonResumed             = "Resumed"
+	EventReasonSignalSent          = "SignalSent"
+	EventReasonStopTimeout         = "StopTimeout"
+	EventReasonKilled              = "Killed"
+	EventReasonExited              = "Exited"
+	EventReasonCrashReported       = "CrashReported"
+	EventReasonDebugDump           = "DebugDump"
+	EventReasonRestarting          = "Restarting"
+	EventReasonReplaced            = "Replaced"
+	EventReasonRolledBack          = "RolledBack"
+)
+
+// ProcessEvent is a timestamped transition in the lifecycle of a process.
+type ProcessEvent struct {
+	Time    time.Time `json:"time"`
+	Reason  string    `json:"reason"`
+	Message string    `json:"message"`
+}
+
+func (e ProcessEvent) RPC() *rpc.ProcessEvent {
+	return &rpc.ProcessEvent{
+		Time:    util.FormatTime(&e.Time),
+		Reason:  e.Reason,
+		Message: e.Message,
+	}
+}
+
+// eventRecorder keeps the last MaxProcessEvents events of a process in a ring buffer.
+// It has its own lock, so events can be recorded with or without the process lock held.
+type eventRecorder struct {
+	lock   *sync.Mutex
+	events []ProcessEvent
+	next   int
+	full   bool
+}
+
+func newEventRecorder() *eventRecorder {
+	return &eventRecorder{
+		lock:   &sync.Mutex{},
+		events: make([]ProcessEvent, MaxProcessEvents),
+	}
+}
+
+func (r *eventRecorder) record(reason, format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	event := ProcessEvent{
+		Time:    time.Now(),
+		Reason:  reason,
+		Message: fmt.Sprintf(format, args...),
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events[r.next] = event
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// prepend inserts older events before the recorded ones, e.g. the history of a replaced process.
+func (r *eventRecorder) prepend(events []ProcessEvent) {
+	if r == nil {
+		return
+	}
+	events = append(events, r.list()...)
+	if len(events) > MaxProcessEvents {
+		events = events[len(events)-MaxProcessEvents:]
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = make([]ProcessEvent, MaxProcessEvents)
+	r.next = copy(r.events, events) % MaxProcessEvents
+	r.full = len(events) == MaxProcessEvents
+}
+
+// list returns the events from the oldest to the newest.
+func (r *eventRecorder) list() []ProcessEvent {
+	if r == nil {
+		return nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.full {
+		return append([]ProcessEvent{}, r.events[:r.next]...)
+	}
+	return append(append([]ProcessEvent{}, r.events[r.next:]...), r.events[:r.next]...)
+}
+
+// Events returns the recorded events of the process, from the oldest to the newest.
+func (p *Process) Events() []ProcessEvent {
+	return p.events.list()
+}
@@ -0,0 +1,70 @@
+package process
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+	"time"
+
+	rpc "github.com/longhorn/types/pkg/generated/imrpc"
+)
+
+// ExitStatus describes how a process exited.
+type ExitStatus struct {
+	// Code is the exit code of the process. It is -1 if the process was terminated by a signal,
+	// or if the status is unknown, e.g. the process was attached and is not a child of this instance-manager.
+	Code int `json:"code"`
+	// Signal is the signal that terminated the process, 0 if the process exited by itself.
+	Signal syscall.Signal `json:"signal,omitempty"`
+	// OOMKilled is true if the process was killed by the OOM killer.
+	OOMKilled bool `json:"oomKilled,omitempty"`
+}
+
+func (e *ExitStatus) RPC() *rpc.ProcessExitStatus {
+	if e == nil {
+		return nil
+	}
+	return &rpc.ProcessExitStatus{
+		Code:      int32(e.Code),
+		Signal:    int32(e.Signal),
+		OomKilled: e.OOMKilled,
+	}
+}
+
+// ProcessLifecycle contains the timestamps and the last exit status of a process.
+type ProcessLifecycle struct {
+	StartTime    *time.Time
+	ReadyTime    *time.Time
+	ExitTime     *time.Time
+	RestartCount int
+	LastExit     *ExitStatus
+}
+
+// newExitStatus parses the error returned by Command.Run. oomKills is the number of
+// OOM kills in the cgroup of the process, nil if the process has no cgroup, in which case
+// an OOM kill cannot be told apart from any other SIGKILL.
+func newExitStatus(err error, oomKills *uint64) *ExitStatus {
+	exit := &ExitStatus{Code: -1}
+	if err == nil {
+		exit.Code = 0
+		return exit
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			switch {
+			case ws.Exited():
+				exit.Code = ws.ExitStatus()
+			case ws.Signaled():
+				exit.Signal = ws.Signal()
+			}
+		}
+	}
+
+	if oomKills != nil {
+		// Any kind of OOM kill is counted by the cgroup
+		exit.OOMKilled = *oomKills > 0
+	}
+	return exit
+}
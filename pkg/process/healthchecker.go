@@ -9,27 +9,36 @@ import (
 	"github.com/longhorn/longhorn-instance-manager/pkg/util"
 )
 
+// HealthChecker probes the processes. The probeTimeout of each probe falls back to the default
+// of the checker if it is 0.
 type HealthChecker interface {
-	IsRunning(address string) bool
-	WaitForRunning(address, name string, stopCh chan struct{}) bool
+	IsRunning(address string, probeTimeout time.Duration) bool
+	// WaitForRunning returns false if the process is not running after the timeout.
+	WaitForRunning(address, name string, timeout, probeTimeout time.Duration, stopCh chan struct{}) bool
 }
 
-type GRPCHealthChecker struct{}
+type GRPCHealthChecker struct {
+	// ProbeTimeout is the default timeout of each health probe. util.DefaultGRPCHealthProbeTimeout is used if it is 0.
+	ProbeTimeout time.Duration
+}
 
-func (c *GRPCHealthChecker) IsRunning(address string) bool {
-	return util.GRPCServiceReadinessProbe(address)
+func (c *GRPCHealthChecker) IsRunning(address string, probeTimeout time.Duration) bool {
+	if probeTimeout == 0 {
+		probeTimeout = c.ProbeTimeout
+	}
+	return util.GRPCServiceReadinessProbeWithTimeout(address, probeTimeout)
 }
 
-func (c *GRPCHealthChecker) WaitForRunning(address, name string, stopCh chan struct{}) bool {
+func (c *GRPCHealthChecker) WaitForRunning(address, name string, timeout, probeTimeout time.Duration, stopCh chan struct{}) bool {
 	ticker := time.NewTicker(types.WaitInterval)
 	defer ticker.Stop()
-	for i := 0; i < types.WaitCount; i++ {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
 		select {
 		case <-stopCh:
 			logrus.Infof("Stop waiting for gRPC service of process %v to start at %v", name, address)
 			return false
 		case <-ticker.C:
-			if c.IsRunning(address) {
+			if c.IsRunning(address, probeTimeout) {
 				logrus.Infof("Process %v has started at %v", name, address)
 				return true
 			}
@@ -41,10 +50,10 @@ func (c *GRPCHealthChecker) WaitForRunning(address, name string, stopCh chan str
 
 type MockHealthChecker struct{}
 
-func (c *MockHealthChecker) IsRunning(address string) bool {
+func (c *MockHealthChecker) IsRunning(address string, probeTimeout time.Duration) bool {
 	return true
 }
 
-func (c *MockHealthChecker) WaitForRunning(address, name string, stopCh chan struct{}) bool {
+func (c *MockHealthChecker) WaitForRunning(address, name string, timeout, probeTimeout time.Duration, stopCh chan struct{}) bool {
 	return true
 }
@@ -0,0 +1,69 @@
+package process
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/types"
+	"github.com/longhorn/longhorn-instance-manager/pkg/util"
+)
+
+// Labels returns a copy of the labels of the process.
+func (p *Process) Labels() map[string]string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.labels()
+}
+
+// labels must be called with the process lock held.
+func (p *Process) labels() labels.Set {
+	if p.Options == nil || len(p.Options.Labels) == 0 {
+		return nil
+	}
+	return labels.Merge(nil, p.Options.Labels)
+}
+
+// volumeName must be called with the process lock held. Processes created without the volume
+// label, e.g. by an older longhorn-manager, are named after their volume.
+func (p *Process) volumeName() string {
+	if p.Options != nil {
+		if volumeName := p.Options.Labels[types.LabelVolume]; volumeName != "" {
+			return volumeName
+		}
+	}
+	return util.ProcessNameToVolumeName(p.Name)
+}
+
+// ProcessLabels returns the labels of the process named by name.
+func (pm *Manager) ProcessLabels(name string) (map[string]string, error) {
+	p := pm.findProcess(name)
+	if p == nil {
+		return nil, status.Errorf(codes.NotFound, "cannot find process %v", name)
+	}
+	return p.Labels(), nil
+}
+
+// ProcessSetLabels replaces the labels of the process named by name.
+func (pm *Manager) ProcessSetLabels(name string, set map[string]string) error {
+	if err := util.ValidateLabels(set); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid labels for process %v: %v", name, err)
+	}
+	p := pm.findProcess(name)
+	if p == nil {
+		return status.Errorf(codes.NotFound, "cannot find process %v", name)
+	}
+
+	p.lock.Lock()
+	// The options may be shared with the state journal, so they are copied rather than modified
+	options := &ProcessOptions{}
+	if p.Options != nil {
+		*options = *p.Options
+	}
+	options.Labels = labels.Merge(nil, set)
+	p.Options = options
+	p.lock.Unlock()
+
+	p.UpdateCh <- p
+	return nil
+}
@@ -0,0 +1,134 @@
+package process
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/types"
+	"github.com/longhorn/longhorn-instance-manager/pkg/util"
+)
+
+// LivenessAction is what the process manager does with a running process failing its liveness probes.
+type LivenessAction string
+
+const (
+	// LivenessActionNone only sets the Healthy condition of the process to false
+	LivenessActionNone = LivenessAction("None")
+	// LivenessActionRestart stops the process and restarts it, regardless of its restart policy
+	LivenessActionRestart = LivenessAction("Restart")
+	// LivenessActionError stops the process and leaves it in the error state
+	LivenessActionError = LivenessAction("Error")
+
+	DefaultLivenessFailureThreshold = 3
+)
+
+func ParseLivenessAction(action string) (LivenessAction, error) {
+	switch LivenessAction(action) {
+	case LivenessActionNone, LivenessActionRestart, LivenessActionError:
+		return LivenessAction(action), nil
+	case "":
+		return LivenessActionNone, nil
+	}
+	return "", fmt.Errorf("invalid liveness action %v", action)
+}
+
+func (pm *Manager) startLivenessProbing() {
+	done := false
+
+	ticker := time.NewTicker(pm.config.LivenessPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pm.ctx.Done():
+			logrus.Infof("%s: stopped probing the liveness of processes due to the context done", types.ProcessManagerGrpcService)
+			done = true
+		case <-ticker.C:
+			pm.probeLiveness()
+		}
+		if done {
+			break
+		}
+	}
+}
+
+// probeLiveness probes all running processes in parallel, so a hanging process doesn't delay the others.
+func (pm *Manager) probeLiveness() {
+	threshold := pm.config.LivenessFailureThreshold
+	if threshold <= 0 {
+		threshold = DefaultLivenessFailureThreshold
+	}
+
+	pm.lock.RLock()
+	processes := make([]*Process, 0, len(pm.processes))
+	for _, p := range pm.processes {
+		processes = append(processes, p)
+	}
+	pm.lock.RUnlock()
+
+	wg := &sync.WaitGroup{}
+	for _, p := range processes {
+		wg.Add(1)
+		go func(p *Process) {
+			defer wg.Done()
+			p.probeLiveness(threshold, pm.config.LivenessAction)
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (p *Process) probeLiveness(threshold int, action LivenessAction) {
+	p.lock.RLock()
+	if p.State != StateRunning || p.PortStart == 0 || p.unhealthyAction != "" || p.suspended {
+		p.lock.RUnlock()
+		return
+	}
+	address := util.GetURL("localhost", int(p.PortStart))
+	probeTimeout := p.Options.timeouts().probeTimeout()
+	p.lock.RUnlock()
+
+	healthy := p.healthChecker.IsRunning(address, probeTimeout)
+
+	p.lock.Lock()
+	// The process may have been stopped in the meantime
+	if p.State != StateRunning || p.unhealthyAction != "" || p.suspended {
+		p.lock.Unlock()
+		return
+	}
+	wasHealthy, known := p.Conditions[types.ProcessConditionHealthy]
+	escalate := false
+	if healthy {
+		p.livenessFailures = 0
+		p.Conditions[types.ProcessConditionHealthy] = true
+		if known && !wasHealthy {
+			p.events.record(EventReasonHealthy, "liveness probe on %v succeeded again", address)
+		}
+	} else {
+		p.livenessFailures++
+		p.events.record(EventReasonLivenessProbeFailed, "liveness probe on %v failed %v times in a row", address, p.livenessFailures)
+		if p.livenessFailures >= threshold && (!known || wasHealthy) {
+			logrus.Warnf("Process Manager: process %v failed %v liveness probes in a row, liveness action %v", p.Name, p.livenessFailures, action)
+			p.events.record(EventReasonUnhealthy, "process is unhealthy after failing %v liveness probes, liveness action %v", p.livenessFailures, action)
+			p.Conditions[types.ProcessConditionHealthy] = false
+			if action == LivenessActionRestart || action == LivenessActionError {
+				p.unhealthyAction = action
+				escalate = true
+			}
+		}
+	}
+	changed := !known || wasHealthy != p.Conditions[types.ProcessConditionHealthy]
+	p.lock.Unlock()
+
+	if escalate {
+		// The process is restarted or set to error once it exits, according to the action
+		p.stopWithSignal(syscall.SIGINT, false)
+		return
+	}
+	if changed {
+		p.UpdateCh <- p
+	}
+}
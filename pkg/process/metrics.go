@@ -0,0 +1,49 @@
+package process
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "longhorn_instance_manager"
+
+var (
+	portPoolPorts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "port_pool",
+		Name:      "ports",
+		Help:      "Number of ports in the process port pool by state",
+	}, []string{"state"})
+
+	portsQuarantinedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "port_pool",
+		Name:      "quarantined_total",
+		Help:      "Total number of ports quarantined since they were already in use on the host",
+	})
+
+	admissionQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "admission",
+		Name:      "queue_depth",
+		Help:      "Number of process creations waiting for a starting slot",
+	})
+
+	admissionRejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "admission",
+		Name:      "rejections_total",
+		Help:      "Total number of process creations rejected by the admission limits by reason",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(portPoolPorts, portsQuarantinedTotal, admissionQueueDepth, admissionRejectionsTotal)
+}
+
+// updatePortMetrics must be called with the port lock held.
+func (pm *Manager) updatePortMetrics() {
+	pool := pm.portPool()
+	portPoolPorts.WithLabelValues("used").Set(float64(pool.UsedPorts))
+	portPoolPorts.WithLabelValues("free").Set(float64(pool.FreePorts))
+	portPoolPorts.WithLabelValues("quarantined").Set(float64(len(pool.QuarantinedPorts)))
+}
@@ -0,0 +1,224 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	rpc "github.com/longhorn/types/pkg/generated/imrpc"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/util"
+)
+
+const (
+	// NobodyID is the uid/gid a process runs as when it drops privileges.
+	NobodyID = 65534
+)
+
+// ProcessOptions are the settings of a process beyond its binary, arguments and ports.
+type ProcessOptions struct {
+	// Env replaces the environment inherited from the instance-manager. PATH is kept unless
+	// it is set explicitly. If Env is nil, the process inherits the whole environment.
+	Env map[string]string `json:"env,omitempty"`
+	// WorkingDir is the absolute working directory of the process. If empty, the process
+	// runs in the working directory of the instance-manager.
+	WorkingDir string `json:"workingDir,omitempty"`
+
+	UID *uint32 `json:"uid,omitempty"`
+	GID *uint32 `json:"gid,omitempty"`
+	// DropPrivileges runs the process as nobody. It cannot be combined with UID and GID.
+	DropPrivileges bool `json:"dropPrivileges,omitempty"`
+
+	Scheduling *SchedulingOptions `json:"scheduling,omitempty"`
+
+	Timeouts *TimeoutOptions `json:"timeouts,omitempty"`
+
+	// Labels are arbitrary key/value pairs, e.g. the volume, node, owner and engine image of the
+	// process, see types.LabelVolume. They can be used to select processes.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// RestartPolicy, MaxRestarts and RestartBackoff override the defaults of the process manager if set.
+	RestartPolicy  RestartPolicy `json:"restartPolicy,omitempty"`
+	MaxRestarts    *int          `json:"maxRestarts,omitempty"`
+	RestartBackoff time.Duration `json:"restartBackoff,omitempty"`
+
+	// Resources override the cgroup limits of the process manager field by field. They require cgroups.
+	Resources *ResourceLimits `json:"resources,omitempty"`
+}
+
+func (o *ProcessOptions) Validate() error {
+	if o == nil {
+		return nil
+	}
+	for key := range o.Env {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			return fmt.Errorf("invalid environment variable name %q", key)
+		}
+	}
+	if o.WorkingDir != "" && !filepath.IsAbs(o.WorkingDir) {
+		return fmt.Errorf("working directory %v is not an absolute path", o.WorkingDir)
+	}
+	if o.DropPrivileges && (o.UID != nil || o.GID != nil) {
+		return fmt.Errorf("cannot drop privileges with an explicit uid/gid")
+	}
+	if err := util.ValidateLabels(o.Labels); err != nil {
+		return err
+	}
+	if err := o.Timeouts.Validate(); err != nil {
+		return err
+	}
+	if err := o.validateRestart(); err != nil {
+		return err
+	}
+	if err := o.Resources.Validate(); err != nil {
+		return err
+	}
+	return o.Scheduling.Validate()
+}
+
+// withSchedulingDefaults returns the options with the unset scheduling settings taken from the defaults.
+func (o *ProcessOptions) withSchedulingDefaults(defaults *SchedulingOptions) *ProcessOptions {
+	if defaults.IsEmpty() {
+		return o
+	}
+	merged := &ProcessOptions{}
+	if o != nil {
+		*merged = *o
+	}
+	merged.Scheduling = merged.Scheduling.withDefaults(defaults)
+	return merged
+}
+
+// withTimeoutDefaults returns the options with the unset timeouts taken from the defaults.
+func (o *ProcessOptions) withTimeoutDefaults(defaults *TimeoutOptions) *ProcessOptions {
+	if defaults.IsEmpty() {
+		return o
+	}
+	merged := &ProcessOptions{}
+	if o != nil {
+		*merged = *o
+	}
+	merged.Timeouts = merged.Timeouts.withDefaults(defaults)
+	return merged
+}
+
+// environ returns the environment of the process, or nil if it inherits the environment.
+func (o *ProcessOptions) environ() []string {
+	if o == nil || o.Env == nil {
+		return nil
+	}
+
+	env := make([]string, 0, len(o.Env)+1)
+	for key, value := range o.Env {
+		env = append(env, key+"="+value)
+	}
+	if _, exists := o.Env["PATH"]; !exists {
+		env = append(env, "PATH="+os.Getenv("PATH"))
+	}
+	sort.Strings(env)
+	return env
+}
+
+// credential returns the uid/gid of the process, or nil if it runs as the instance-manager user.
+func (o *ProcessOptions) credential() *syscall.Credential {
+	if o == nil {
+		return nil
+	}
+	if o.DropPrivileges {
+		return &syscall.Credential{Uid: NobodyID, Gid: NobodyID, Groups: []uint32{}}
+	}
+	if o.UID == nil && o.GID == nil {
+		return nil
+	}
+
+	// Keep the ids of the instance-manager for the one that is not set
+	credential := &syscall.Credential{
+		Uid:    uint32(os.Getuid()),
+		Gid:    uint32(os.Getgid()),
+		Groups: []uint32{},
+	}
+	if o.UID != nil {
+		credential.Uid = *o.UID
+	}
+	if o.GID != nil {
+		credential.Gid = *o.GID
+	}
+	return credential
+}
+
+func (o *ProcessOptions) scheduling() *SchedulingOptions {
+	if o == nil {
+		return nil
+	}
+	return o.Scheduling
+}
+
+func (o *ProcessOptions) resources() *ResourceLimits {
+	if o == nil {
+		return nil
+	}
+	return o.Resources
+}
+
+func (o *ProcessOptions) timeouts() *TimeoutOptions {
+	if o == nil {
+		return nil
+	}
+	return o.Timeouts
+}
+
+// processOptionsFromSpec returns the options set in the spec of a process, nil if none is set.
+func processOptionsFromSpec(spec *rpc.ProcessSpec) *ProcessOptions {
+	o := &ProcessOptions{
+		WorkingDir:     spec.WorkingDir,
+		UID:            spec.Uid,
+		GID:            spec.Gid,
+		DropPrivileges: spec.DropPrivileges,
+		Scheduling:     schedulingOptionsFromRPC(spec.Scheduling),
+		Timeouts:       timeoutOptionsFromRPC(spec.Timeouts),
+		RestartPolicy:  RestartPolicy(spec.RestartPolicy),
+		RestartBackoff: time.Duration(spec.RestartBackoffSeconds) * time.Second,
+		Resources:      resourceLimitsFromRPC(spec.Resources),
+	}
+	if spec.MaxRestarts != nil {
+		maxRestarts := int(*spec.MaxRestarts)
+		o.MaxRestarts = &maxRestarts
+	}
+	// An empty map cannot be told apart from an unset one, so the environment is only replaced by a non-empty one
+	if len(spec.Env) > 0 {
+		o.Env = spec.Env
+	}
+	if len(spec.Labels) > 0 {
+		o.Labels = spec.Labels
+	}
+	if o.Env == nil && o.WorkingDir == "" && o.UID == nil && o.GID == nil && !o.DropPrivileges && o.Scheduling == nil && o.Timeouts == nil && o.Labels == nil &&
+		o.RestartPolicy == "" && o.MaxRestarts == nil && o.RestartBackoff == 0 && o.Resources == nil {
+		return nil
+	}
+	return o
+}
+
+// setSpec sets the options in the spec of a process.
+func (o *ProcessOptions) setSpec(spec *rpc.ProcessSpec) {
+	if o == nil {
+		return
+	}
+	spec.Env = o.Env
+	spec.WorkingDir = o.WorkingDir
+	spec.Uid = o.UID
+	spec.Gid = o.GID
+	spec.DropPrivileges = o.DropPrivileges
+	spec.Scheduling = o.Scheduling.RPC()
+	spec.Timeouts = o.Timeouts.RPC()
+	spec.Labels = o.Labels
+	spec.RestartPolicy = string(o.RestartPolicy)
+	if o.MaxRestarts != nil {
+		maxRestarts := int32(*o.MaxRestarts)
+		spec.MaxRestarts = &maxRestarts
+	}
+	spec.RestartBackoffSeconds = int64(o.RestartBackoff / time.Second)
+}
@@ -0,0 +1,394 @@
+package process
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	rpc "github.com/longhorn/types/pkg/generated/imrpc"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/types"
+)
+
+const (
+	PortReconcileInterval = 1 * time.Minute
+
+	// A replacement process holds its ports for a while before it is registered,
+	// so an allocation is only considered leaked after this period.
+	PortReconcileGracePeriod = 5 * time.Minute
+)
+
+// portAllocation is a range of ports held by a process. Allocations are keyed by the
+// process UUID, so a process can never release the ports of another one with the same name.
+type portAllocation struct {
+	name        string
+	start       int32
+	end         int32
+	allocatedAt time.Time
+	// pending is set while the owner is not registered yet, e.g. a replacement waiting to be
+	// running, so the port reconciliation keeps the ports however long it takes.
+	pending bool
+}
+
+type PortRange struct {
+	Start int32 `json:"start"`
+	End   int32 `json:"end"`
+
+	// The owner of the range. Empty for a free range.
+	ProcessName string `json:"processName,omitempty"`
+	ProcessUUID string `json:"processUUID,omitempty"`
+}
+
+type PortPool struct {
+	Start int32 `json:"start"`
+	End   int32 `json:"end"`
+
+	TotalPorts int32 `json:"totalPorts"`
+	UsedPorts  int32 `json:"usedPorts"`
+	FreePorts  int32 `json:"freePorts"`
+
+	QuarantinedPorts []int32 `json:"quarantinedPorts"`
+
+	UsedRanges []PortRange `json:"usedRanges"`
+	FreeRanges []PortRange `json:"freeRanges"`
+}
+
+func (pm *Manager) allocatePorts(owner, name string, portCount int32) (int32, int32, error) {
+	if portCount < 0 {
+		return 0, 0, fmt.Errorf("invalid port count %v", portCount)
+	}
+	if portCount == 0 {
+		return 0, 0, nil
+	}
+
+	pm.portLock.Lock()
+	defer pm.portLock.Unlock()
+
+	if a, exists := pm.portAllocations[owner]; exists {
+		return 0, 0, fmt.Errorf("process %v with UUID %v already holds ports %v-%v", a.name, owner, a.start, a.end)
+	}
+
+	for {
+		start, end, err := pm.availablePorts.AllocateRange(portCount)
+		if err != nil && len(pm.quarantinedPorts) > 0 {
+			// Some quarantined ports may be free by now, rather than at the next reconciliation
+			pm.releaseQuarantinedPorts()
+			start, end, err = pm.availablePorts.AllocateRange(portCount)
+		}
+		if err != nil {
+			pool := pm.portPool()
+			logrus.WithError(err).Warnf("Process Manager: port pool %v-%v is exhausted, %v of %v ports are free in %v ranges, %v ports are quarantined",
+				pool.Start, pool.End, pool.FreePorts, pool.TotalPorts, len(pool.FreeRanges), len(pool.QuarantinedPorts))
+			return 0, 0, errors.Wrapf(err, "failed to allocate %v ports, %v of %v ports are free", portCount, pool.FreePorts, pool.TotalPorts)
+		}
+
+		// The bitmap only knows about the processes of this instance-manager, so make sure
+		// nothing else on the host holds the ports before handing them out
+		inUse := pm.probePorts(start, end)
+		if len(inUse) == 0 {
+			pm.portAllocations[owner] = &portAllocation{
+				name:        name,
+				start:       start,
+				end:         end,
+				allocatedAt: time.Now(),
+			}
+			pm.updatePortMetrics()
+			return start, end, nil
+		}
+
+		// Keep the ports in use allocated so they are skipped from now on, and try again
+		if err := pm.quarantinePorts(start, end, inUse); err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+// probePorts returns the ports in [start, end] that cannot be bound on the probe host.
+func (pm *Manager) probePorts(start, end int32) []int32 {
+	var inUse []int32
+	for port := start; port <= end; port++ {
+		if isPortInUse(pm.config.PortProbeHost, port) {
+			inUse = append(inUse, port)
+		}
+	}
+	return inUse
+}
+
+func isPortInUse(host string, port int32) bool {
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		if errors.Is(err, syscall.EADDRINUSE) {
+			return true
+		}
+		// Only a port taken by someone else is quarantined, a misconfigured host should not drain the pool
+		logrus.WithError(err).Debugf("Process Manager: failed to probe port %v on host %v", port, host)
+		return false
+	}
+	if err := listener.Close(); err != nil {
+		logrus.WithError(err).Warnf("Process Manager: failed to close the probe listener of port %v", port)
+	}
+	return false
+}
+
+// quarantinePorts releases [start, end] except the ports in use, which stay allocated until
+// the reconcile pass finds them free again. It must be called with the port lock held.
+func (pm *Manager) quarantinePorts(start, end int32, inUse []int32) error {
+	next := start
+	for _, port := range inUse {
+		if port > next {
+			if err := pm.availablePorts.ReleaseRange(next, port-1); err != nil {
+				return err
+			}
+		}
+		next = port + 1
+		pm.quarantinedPorts[port] = time.Now()
+		portsQuarantinedTotal.Inc()
+		logrus.Warnf("Process Manager: quarantined port %v since it is already in use on the host", port)
+	}
+	if next <= end {
+		if err := pm.availablePorts.ReleaseRange(next, end); err != nil {
+			return err
+		}
+	}
+	pm.updatePortMetrics()
+	return nil
+}
+
+// releaseQuarantinedPorts returns the quarantined ports that are no longer in use to the pool.
+// It must be called with the port lock held.
+func (pm *Manager) releaseQuarantinedPorts() {
+	for port, quarantinedAt := range pm.quarantinedPorts {
+		if isPortInUse(pm.config.PortProbeHost, port) {
+			continue
+		}
+		if err := pm.availablePorts.ReleaseRange(port, port); err != nil {
+			logrus.WithError(err).Errorf("Process Manager: failed to release quarantined port %v", port)
+			continue
+		}
+		delete(pm.quarantinedPorts, port)
+		logrus.Infof("Process Manager: released port %v quarantined for %v", port, time.Since(quarantinedAt).Round(time.Second))
+	}
+	pm.updatePortMetrics()
+}
+
+// releasePorts releases the ports held by the owner. The range must match the allocation of the owner.
+func (pm *Manager) releasePorts(owner string, start, end int32) error {
+	if start < 0 || end < 0 {
+		return fmt.Errorf("invalid start/end port %v %v", start, end)
+	}
+	if start == 0 && end == 0 {
+		return nil
+	}
+
+	pm.portLock.Lock()
+	defer pm.portLock.Unlock()
+
+	a, exists := pm.portAllocations[owner]
+	if !exists {
+		return fmt.Errorf("ports %v-%v are not allocated to UUID %v", start, end, owner)
+	}
+	if a.start != start || a.end != end {
+		return fmt.Errorf("ports %v-%v don't match ports %v-%v allocated to process %v with UUID %v", start, end, a.start, a.end, a.name, owner)
+	}
+	if err := pm.availablePorts.ReleaseRange(start, end); err != nil {
+		return err
+	}
+	delete(pm.portAllocations, owner)
+	pm.updatePortMetrics()
+	return nil
+}
+
+// holdPorts renews the allocation of the owner, so the port reconciliation keeps it for a while
+// even though the owner is no longer registered.
+func (pm *Manager) holdPorts(owner string) {
+	pm.portLock.Lock()
+	defer pm.portLock.Unlock()
+	if a, exists := pm.portAllocations[owner]; exists {
+		a.allocatedAt = time.Now()
+	}
+}
+
+// setPortsPending marks the allocation of an owner that is not registered yet, see portAllocation.
+func (pm *Manager) setPortsPending(owner string, pending bool) {
+	pm.portLock.Lock()
+	defer pm.portLock.Unlock()
+	if a, exists := pm.portAllocations[owner]; exists {
+		a.pending = pending
+		a.allocatedAt = time.Now()
+	}
+}
+
+// transferPorts hands the ports allocated to one owner over to another.
+func (pm *Manager) transferPorts(from, to string) error {
+	pm.portLock.Lock()
+	defer pm.portLock.Unlock()
+	a, exists := pm.portAllocations[from]
+	if !exists {
+		return fmt.Errorf("no ports are allocated to UUID %v", from)
+	}
+	delete(pm.portAllocations, from)
+	a.allocatedAt = time.Now()
+	pm.portAllocations[to] = a
+	return nil
+}
+
+// PortPoolStatus returns the used and free port ranges, and the owner of each used range.
+func (pm *Manager) PortPoolStatus() *PortPool {
+	pm.portLock.Lock()
+	defer pm.portLock.Unlock()
+	return pm.portPool()
+}
+
+func (pm *Manager) PortPoolGet(ctx context.Context, req *emptypb.Empty) (*rpc.PortPoolResponse, error) {
+	return pm.PortPoolStatus().RPC(), nil
+}
+
+func (r PortRange) RPC() *rpc.PortRange {
+	return &rpc.PortRange{
+		Start:       r.Start,
+		End:         r.End,
+		ProcessName: r.ProcessName,
+		ProcessUuid: r.ProcessUUID,
+	}
+}
+
+func (pool *PortPool) RPC() *rpc.PortPoolResponse {
+	resp := &rpc.PortPoolResponse{
+		Start:            pool.Start,
+		End:              pool.End,
+		TotalPorts:       pool.TotalPorts,
+		UsedPorts:        pool.UsedPorts,
+		FreePorts:        pool.FreePorts,
+		QuarantinedPorts: pool.QuarantinedPorts,
+		UsedRanges:       make([]*rpc.PortRange, 0, len(pool.UsedRanges)),
+		FreeRanges:       make([]*rpc.PortRange, 0, len(pool.FreeRanges)),
+	}
+	for _, r := range pool.UsedRanges {
+		resp.UsedRanges = append(resp.UsedRanges, r.RPC())
+	}
+	for _, r := range pool.FreeRanges {
+		resp.FreeRanges = append(resp.FreeRanges, r.RPC())
+	}
+	return resp
+}
+
+// portPool must be called with the port lock held.
+func (pm *Manager) portPool() *PortPool {
+	pool := &PortPool{
+		Start:      pm.portRangeMin,
+		End:        pm.portRangeMax,
+		TotalPorts: pm.portRangeMax - pm.portRangeMin + 1,
+		UsedRanges: []PortRange{},
+		FreeRanges: []PortRange{},
+	}
+
+	for uuid, a := range pm.portAllocations {
+		pool.UsedRanges = append(pool.UsedRanges, PortRange{
+			Start:       a.start,
+			End:         a.end,
+			ProcessName: a.name,
+			ProcessUUID: uuid,
+		})
+		pool.UsedPorts += a.end - a.start + 1
+	}
+	sort.Slice(pool.UsedRanges, func(i, j int) bool {
+		return pool.UsedRanges[i].Start < pool.UsedRanges[j].Start
+	})
+
+	pool.QuarantinedPorts = []int32{}
+	for port := range pm.quarantinedPorts {
+		pool.QuarantinedPorts = append(pool.QuarantinedPorts, port)
+	}
+	sort.Slice(pool.QuarantinedPorts, func(i, j int) bool {
+		return pool.QuarantinedPorts[i] < pool.QuarantinedPorts[j]
+	})
+
+	taken := make([]PortRange, 0, len(pool.UsedRanges)+len(pool.QuarantinedPorts))
+	taken = append(taken, pool.UsedRanges...)
+	for _, port := range pool.QuarantinedPorts {
+		taken = append(taken, PortRange{Start: port, End: port})
+	}
+	sort.Slice(taken, func(i, j int) bool {
+		return taken[i].Start < taken[j].Start
+	})
+
+	next := pool.Start
+	for _, r := range taken {
+		if r.Start > next {
+			pool.FreeRanges = append(pool.FreeRanges, PortRange{Start: next, End: r.Start - 1})
+		}
+		if r.End+1 > next {
+			next = r.End + 1
+		}
+	}
+	if next <= pool.End {
+		pool.FreeRanges = append(pool.FreeRanges, PortRange{Start: next, End: pool.End})
+	}
+	pool.FreePorts = pool.TotalPorts - pool.UsedPorts - int32(len(pool.QuarantinedPorts))
+	return pool
+}
+
+// PortPoolReconcile releases the port ranges whose owner is no longer registered, and returns them.
+// Quarantined ports that are no longer in use on the host are returned to the pool as well.
+func (pm *Manager) PortPoolReconcile() []PortRange {
+	pm.lock.RLock()
+	defer pm.lock.RUnlock()
+
+	registered := map[string]bool{}
+	for _, p := range pm.processes {
+		registered[p.UUID] = true
+	}
+
+	pm.portLock.Lock()
+	defer pm.portLock.Unlock()
+
+	leaked := []PortRange{}
+	for uuid, a := range pm.portAllocations {
+		if registered[uuid] || a.pending || time.Since(a.allocatedAt) < PortReconcileGracePeriod {
+			continue
+		}
+		if err := pm.availablePorts.ReleaseRange(a.start, a.end); err != nil {
+			logrus.WithError(err).Errorf("Process Manager: failed to release leaked ports %v-%v of process %v with UUID %v",
+				a.start, a.end, a.name, uuid)
+			continue
+		}
+		delete(pm.portAllocations, uuid)
+		logrus.Warnf("Process Manager: released leaked ports %v-%v of process %v with UUID %v", a.start, a.end, a.name, uuid)
+		leaked = append(leaked, PortRange{
+			Start:       a.start,
+			End:         a.end,
+			ProcessName: a.name,
+			ProcessUUID: uuid,
+		})
+	}
+	pm.releaseQuarantinedPorts()
+	return leaked
+}
+
+func (pm *Manager) startPortReconciliation() {
+	done := false
+
+	ticker := time.NewTicker(PortReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pm.ctx.Done():
+			logrus.Infof("%s: stopped reconciling the port pool due to the context done", types.ProcessManagerGrpcService)
+			done = true
+		case <-ticker.C:
+			pm.PortPoolReconcile()
+		}
+		if done {
+			break
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package process
 
 import (
+	"fmt"
+	"os"
 	"sync"
 	"syscall"
 	"time"
@@ -37,6 +39,46 @@ type Process struct {
 	PortEnd           int32
 	DeletionTimestamp *time.Time
 
+	RestartPolicy  RestartPolicy
+	MaxRestarts    int
+	RestartBackoff time.Duration
+	RestartCount   int
+
+	StartTime    *time.Time
+	ReadyTime    *time.Time
+	LastExitTime *time.Time
+	LastExit     *ExitStatus
+
+	Options *ProcessOptions
+
+	Resources  *ResourceLimits
+	cgroupPath string
+	// binaryFile is the binary verified by the binary policy, executed on each start instead of
+	// looking up Binary. It is nil without a policy.
+	binaryFile *os.File
+
+	// appliedScheduling is the scheduling of the process read back after the options were applied
+	appliedScheduling *AppliedScheduling
+
+	consecutiveRestarts int
+	stopRequested       bool
+	// livenessFailures is the number of liveness probes failed in a row
+	livenessFailures int
+	// unhealthyAction is set once the process is stopped for failing its liveness probes
+	unhealthyAction LivenessAction
+	// suspended is set while the process is frozen by ProcessSuspend
+	suspended bool
+	// suspending is set while Suspend waits for the process to be frozen, without the process lock
+	suspending bool
+	// detached processes keep running after the instance-manager exits, see ManagerConfig.Handover
+	detached bool
+	// startSlotRelease releases the admission slot held by the process until it is running
+	startSlotRelease func()
+	// startSlots are the admission slots of the process manager, also taken by the restarts, nil if unlimited
+	startSlots chan struct{}
+	// crashReporter collects the crash reports of the abnormal exits, nil if disabled
+	crashReporter *crashReporter
+
 	lock     *sync.RWMutex
 	cmd      Command
 	UpdateCh chan *Process
@@ -45,67 +87,211 @@ type Process struct {
 
 	executor      Executor
 	healthChecker HealthChecker
+	cgroups       *CgroupManager
+	stats         *statsCollector
+	events        *eventRecorder
 }
 
 func (p *Process) Start() error {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
+	return p.start()
+}
+
+// start must be called with the process lock held.
+func (p *Process) start() error {
 	cmd, err := p.executor.NewCommand(p.Binary, p.Args...)
 	if err != nil {
 		p.State = StateError
 		p.ErrorMsg = err.Error()
+		p.events.record(EventReasonStartFailed, "failed to create the command of binary %v: %v", p.Binary, err)
+		p.releaseStartSlot()
 		return err
 	}
-	cmd.SetOutput(p.logger)
+	if p.detached {
+		// A pipe to the instance-manager would break once it exits
+		cmd.SetOutput(p.logger.File())
+	} else {
+		cmd.SetOutput(p.logger)
+	}
+	cmd.SetDetached(p.detached)
+	if p.binaryFile != nil {
+		cmd.SetBinaryFile(p.binaryFile)
+	}
+	cmd.SetEnv(p.Options.environ())
+	if p.Options != nil {
+		cmd.SetDir(p.Options.WorkingDir)
+	}
+	cmd.SetCredential(p.Options.credential())
+
+	if p.cgroups != nil {
+		path, err := p.cgroups.Create(p.cgroupName(), p.Resources)
+		if err != nil {
+			p.State = StateError
+			p.ErrorMsg = err.Error()
+			p.events.record(EventReasonStartFailed, "failed to create the cgroup: %v", err)
+			p.releaseStartSlot()
+			return err
+		}
+		cmd.SetCgroup(path)
+		p.cgroupPath = path
+	}
+
+	var startHooks []func(pid int) error
+	p.appliedScheduling = nil
+	if scheduling := p.Options.scheduling(); !scheduling.IsEmpty() {
+		startHooks = append(startHooks, func(pid int) error {
+			return p.setScheduling(pid, scheduling)
+		})
+	}
+	if len(startHooks) > 0 {
+		cmd.SetStartHook(func(pid int) error {
+			for _, hook := range startHooks {
+				if err := hook(pid); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
 	p.cmd = cmd
 
+	now := time.Now()
+	p.StartTime = &now
+	p.ReadyTime = nil
+	p.livenessFailures = 0
+	p.unhealthyAction = ""
+	delete(p.Conditions, types.ProcessConditionHealthy)
+	p.events.record(EventReasonStarted, "starting binary %v", p.Binary)
+	p.watch(cmd, true)
+
+	return nil
+}
+
+// Attach takes over a process that is already running with the given PID,
+// e.g. a process launched by a previous instance-manager.
+func (p *Process) Attach(pid int) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	cmd, err := p.executor.AttachCommand(pid, p.Binary, p.Args...)
+	if err != nil {
+		return err
+	}
+	p.cmd = cmd
+
+	if p.cgroups != nil {
+		path, err := p.cgroups.Path(p.cgroupName())
+		if err != nil {
+			logrus.WithError(err).Warnf("Process Manager: cannot find the cgroup of process %v", p.Name)
+		}
+		p.cgroupPath = path
+	}
+	if !p.Options.scheduling().IsEmpty() {
+		applied, err := readScheduling(pid)
+		if err != nil {
+			logrus.WithError(err).Warnf("Process Manager: cannot read the scheduling of process %v", p.Name)
+		}
+		p.appliedScheduling = applied
+	}
+
+	p.watch(cmd, p.State != StateRunning)
+
+	return nil
+}
+
+// watch runs the command and tracks its state. If waitForRunning is false, the process is
+// considered to be running already.
+func (p *Process) watch(cmd Command, waitForRunning bool) {
 	probeStopCh := make(chan struct{})
+	startupTimeout := p.Options.timeouts().startupTimeout()
+	probeTimeout := p.Options.timeouts().probeTimeout()
 	go func() {
-		if err := cmd.Run(); err != nil {
-			close(probeStopCh)
-			p.lock.Lock()
+		err := cmd.Run()
+		close(probeStopCh)
+
+		p.lock.Lock()
+		now := time.Now()
+		p.LastExitTime = &now
+		p.LastExit = newExitStatus(err, p.oomKillCount())
+		p.Conditions[types.ProcessConditionOOMKilled] = p.LastExit.OOMKilled
+		p.releaseStartSlot()
+		if p.suspended {
+			p.suspended = false
+			delete(p.Conditions, types.ProcessConditionSuspended)
+		}
+		p.removeCgroup()
+		if err != nil {
 			p.State = StateError
 			p.ErrorMsg = err.Error()
+			if p.LastExit.OOMKilled {
+				p.ErrorMsg += " (OOM killed)"
+			}
+			p.events.record(EventReasonExited, "exited with error: %v", p.ErrorMsg)
 			logrus.Infof("Process Manager: process %v error out, error msg: %v", p.Name, p.ErrorMsg)
-			p.lock.Unlock()
-
-			p.UpdateCh <- p
-			return
+		} else {
+			p.State = StateStopped
+			logrus.Infof("Process Manager: process %v stopped", p.Name)
+			p.events.record(EventReasonExited, "exited successfully")
 		}
-		close(probeStopCh)
-		p.lock.Lock()
-		p.State = StateStopped
-		logrus.Infof("Process Manager: process %v stopped", p.Name)
+		if p.unhealthyAction == LivenessActionError {
+			p.State = StateError
+			p.ErrorMsg = fmt.Sprintf("process was stopped after failing %v liveness probes", p.livenessFailures)
+		}
+		var crashReport *CrashReport
+		if err != nil && !p.stopRequested && p.crashReporter != nil {
+			crashReport = p.newCrashReport(cmd.Pid())
+		}
+		if p.needRestart(err) {
+			p.scheduleRestart()
+		}
+		portStart := p.PortStart
 		p.lock.Unlock()
 
+		if portStart != 0 {
+			util.ReleaseGRPCServiceReadinessProbe(util.GetURL("localhost", int(portStart)))
+		}
+		if crashReport != nil {
+			go p.collectCrashReport(crashReport)
+		}
 		p.UpdateCh <- p
 	}()
 
+	if !waitForRunning {
+		return
+	}
+
 	go func() {
 		if p.PortStart != 0 {
 			address := util.GetURL("localhost", int(p.PortStart))
-			if p.healthChecker.WaitForRunning(address, p.Name, probeStopCh) {
-				p.lock.Lock()
-				p.State = StateRunning
-				p.lock.Unlock()
+			p.events.record(EventReasonWaitingForRunning, "waiting up to %v for the health probe on %v", startupTimeout, address)
+			if p.healthChecker.WaitForRunning(address, p.Name, startupTimeout, probeTimeout, probeStopCh) {
+				p.setRunning()
 				p.UpdateCh <- p
 				return
 			}
-			// fail to start the process, then try to stop it.
+			// fail to start the process, then try to stop it. The restart policy still applies.
 			if !p.IsStopped() {
-				p.Stop()
+				p.events.record(EventReasonProbeFailed, "the health probe on %v failed within %v, stopping the process", address, startupTimeout)
+				p.stopWithSignal(syscall.SIGINT, false)
 			}
 		} else {
 			// Process Manager doesn't know the grpc address. directly set running state
-			p.lock.Lock()
-			p.State = StateRunning
-			p.lock.Unlock()
+			p.setRunning()
 			p.UpdateCh <- p
 		}
 	}()
+}
 
-	return nil
+func (p *Process) setRunning() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	p.State = StateRunning
+	p.ReadyTime = &now
+	p.releaseStartSlot()
+	p.events.record(EventReasonRunning, "process is running")
 }
 
 func (p *Process) RPCResponse() *rpc.ProcessResponse {
@@ -114,21 +300,36 @@ func (p *Process) RPCResponse() *rpc.ProcessResponse {
 	if p.ErrorMsg != "" {
 		logrus.Warnf("Process update: %v: state %v: errorMsg: %v", p.Name, p.State, p.ErrorMsg)
 	}
+	// The conditions are copied since the response is marshaled after the lock is released
+	conditions := make(map[string]bool, len(p.Conditions))
+	for k, v := range p.Conditions {
+		conditions[k] = v
+	}
+	spec := &rpc.ProcessSpec{
+		Name:      p.Name,
+		Binary:    p.Binary,
+		Args:      p.Args,
+		PortCount: p.PortCount,
+		PortArgs:  p.PortArgs,
+	}
+	p.Options.setSpec(spec)
+	// The response has the limits applied to the process, including the defaults
+	spec.Resources = p.Resources.RPC()
 	return &rpc.ProcessResponse{
-		Spec: &rpc.ProcessSpec{
-			Name:      p.Name,
-			Binary:    p.Binary,
-			Args:      p.Args,
-			PortCount: p.PortCount,
-			PortArgs:  p.PortArgs,
-		},
+		Spec: spec,
 
 		Status: &rpc.ProcessStatus{
-			State:      string(p.State),
-			ErrorMsg:   p.ErrorMsg,
-			PortStart:  p.PortStart,
-			PortEnd:    p.PortEnd,
-			Conditions: p.Conditions,
+			State:        string(p.State),
+			ErrorMsg:     p.ErrorMsg,
+			PortStart:    p.PortStart,
+			PortEnd:      p.PortEnd,
+			Conditions:   conditions,
+			RestartCount: int32(p.RestartCount),
+			LastExitTime: util.FormatTime(p.LastExitTime),
+			StartTime:    util.FormatTime(p.StartTime),
+			ReadyTime:    util.FormatTime(p.ReadyTime),
+			LastExit:     p.LastExit.RPC(),
+			Scheduling:   p.appliedScheduling.RPC(),
 		},
 	}
 }
@@ -138,18 +339,33 @@ func (p *Process) Stop() {
 }
 
 func (p *Process) StopWithSignal(signal syscall.Signal) {
+	p.stopWithSignal(signal, true)
+}
+
+// stopWithSignal stops the process. If requested is false, the process is stopped by the
+// process manager itself, hence it may be restarted according to its restart policy.
+func (p *Process) stopWithSignal(signal syscall.Signal, requested bool) {
 	needStop, needTimeoutKill := false, false
 	now := time.Now()
 
 	p.lock.Lock()
+	if requested {
+		p.stopRequested = true
+	}
 	if p.State != StateStopping && p.State != StateStopped && p.State != StateError {
 		p.State = StateStopping
 		p.DeletionTimestamp = &now
 		needStop = true
 	}
-	// Retry the deletion if the process is not stopped in 60 seconds
+	// A frozen process cannot handle the signal, so it is resumed first
+	if p.suspended {
+		if err := p.resume(); err != nil {
+			logrus.WithError(err).Warnf("Process Manager: failed to resume process %v before stopping it", p.Name)
+		}
+	}
+	// Retry the deletion if the process is not stopped in its grace period
 	if p.DeletionTimestamp != nil && !needStop {
-		deleteTimeout := time.Duration(int64(types.WaitInterval) * int64(types.WaitCount))
+		deleteTimeout := p.Options.timeouts().stopGracePeriod()
 		if p.DeletionTimestamp.Add(deleteTimeout).Before(now) {
 			logrus.Infof("Process Manager: process %v deletion takes more than %vs, will retry it", p.Name, deleteTimeout.Seconds())
 			needTimeoutKill = true
@@ -164,10 +380,15 @@ func (p *Process) StopWithSignal(signal syscall.Signal) {
 
 	p.lock.RLock()
 	cmd := p.cmd
+	timeouts := p.Options.timeouts()
 	p.lock.RUnlock()
 
 	go func() {
 		defer func() {
+			if !requested {
+				return
+			}
+			p.closeBinaryFile()
 			if err := p.logger.Close(); err != nil {
 				logrus.WithError(err).Warnf("Process Manager: failed to close process %v logger", p.Name)
 			}
@@ -184,22 +405,103 @@ func (p *Process) StopWithSignal(signal syscall.Signal) {
 		// no need for lock
 		if needStop {
 			logrus.Infof("Process Manager: trying to stop process %v", p.Name)
+			p.events.record(EventReasonSignalSent, "sent %v to PID %v", signal, cmd.Pid())
 			cmd.StopWithSignal(signal)
-			for i := 0; i < types.WaitCount; i++ {
-				if p.IsStopped() {
-					return
-				}
-				logrus.Infof("Wait for process %v to shutdown", p.Name)
-				time.Sleep(types.WaitInterval)
+			logrus.Infof("Wait for process %v to shutdown", p.Name)
+			if p.escalateStop(cmd, timeouts) {
+				return
 			}
-			logrus.Warnf("Process Manager: cannot graceful stop process %v in %v, will kill the process", p.Name, time.Duration(types.WaitCount)*types.WaitInterval)
+			logrus.Warnf("Process Manager: cannot graceful stop process %v in %v, will kill the process", p.Name, timeouts.stopGracePeriod())
+			p.events.record(EventReasonStopTimeout, "process didn't stop in %v after %v", timeouts.stopGracePeriod(), signal)
 		} else if needTimeoutKill {
 			logrus.Warnf("Process Manager: somehow timeout stopping process %v, will retry killing the process", p.Name)
+			p.events.record(EventReasonStopTimeout, "deletion is taking too long, retrying to kill the process")
 		}
+		p.events.record(EventReasonKilled, "sent SIGKILL to PID %v", cmd.Pid())
 		cmd.Kill()
 	}()
 }
 
+func (p *Process) cgroupName() string {
+	return p.Name + "_" + p.UUID
+}
+
+// removeCgroup must be called with the process lock held.
+func (p *Process) removeCgroup() {
+	if p.cgroupPath == "" {
+		return
+	}
+	if err := p.cgroups.Remove(p.cgroupPath); err != nil {
+		logrus.WithError(err).Warnf("Process Manager: failed to remove the cgroup of process %v", p.Name)
+	}
+	p.cgroupPath = ""
+}
+
+// closeBinaryFile closes the verified binary once the process won't start again.
+func (p *Process) closeBinaryFile() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.binaryFile == nil {
+		return
+	}
+	if err := p.binaryFile.Close(); err != nil {
+		logrus.WithError(err).Warnf("Process Manager: failed to close the binary of process %v", p.Name)
+	}
+	p.binaryFile = nil
+}
+
+// ResourceUsage returns the usage counters of the cgroup of the process.
+func (p *Process) ResourceUsage() (*ResourceUsage, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if p.cgroupPath == "" {
+		return nil, fmt.Errorf("process %v is not running in its own cgroup", p.Name)
+	}
+	return p.cgroups.GetUsage(p.cgroupPath)
+}
+
+// oomKillCount returns the number of OOM kills in the cgroup of the process, or nil if the
+// process has no cgroup. It must be called with the process lock held.
+func (p *Process) oomKillCount() *uint64 {
+	if p.cgroupPath == "" {
+		return nil
+	}
+	usage, err := p.cgroups.GetUsage(p.cgroupPath)
+	if err != nil {
+		logrus.WithError(err).Warnf("Process Manager: failed to read the OOM kills of process %v", p.Name)
+		return nil
+	}
+	return &usage.OOMKillCount
+}
+
+// Lifecycle returns the timestamps and the last exit status of the process.
+func (p *Process) Lifecycle() *ProcessLifecycle {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	lifecycle := &ProcessLifecycle{
+		StartTime:    p.StartTime,
+		ReadyTime:    p.ReadyTime,
+		ExitTime:     p.LastExitTime,
+		RestartCount: p.RestartCount,
+	}
+	if p.LastExit != nil {
+		exit := *p.LastExit
+		lifecycle.LastExit = &exit
+	}
+	return lifecycle
+}
+
+func (p *Process) Pid() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.cmd == nil {
+		return 0
+	}
+	return p.cmd.Pid()
+}
+
 func (p *Process) IsStopped() bool {
 	p.lock.RLock()
 	defer p.lock.RUnlock()
@@ -7,7 +7,6 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	rpc "github.com/longhorn/types/pkg/generated/imrpc"
@@ -16,7 +15,8 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/mount-utils"
 
 	lhBitmap "github.com/longhorn/go-common-libs/bitmap"
@@ -29,11 +29,67 @@ import (
 )
 
 const (
-	MountCheckInterval = 10 * time.Second
+	MountCheckInterval        = 10 * time.Second
+	LogRetentionSweepInterval = 1 * time.Hour
+	// LogRotationCheckInterval is how often the log files the detached processes write to directly
+	// are checked for rotation.
+	LogRotationCheckInterval = 10 * time.Second
 
 	DefaultEnginePortCount = 1
 )
 
+// ManagerConfig contains the daemon-wide settings of the process manager.
+type ManagerConfig struct {
+	// RestartPolicy, MaxRestarts and RestartBackoff are the defaults of every new process, the
+	// options of a process override them.
+	RestartPolicy  RestartPolicy
+	MaxRestarts    int
+	RestartBackoff time.Duration
+
+	// Cgroups runs every process in its own cgroup v2 cgroup, created under the cgroup of the
+	// instance-manager. Enabling it moves all the processes of that cgroup, including the
+	// instance-manager, into a leaf cgroup, see CgroupManager.
+	Cgroups bool
+	// Resources are the cgroup v2 limits of every new process. They require Cgroups. The resource
+	// limits of a process override them field by field.
+	Resources ResourceLimits
+
+	// PortProbeHost is the host on which allocated ports are probed before they are handed out.
+	PortProbeHost string
+
+	LogRotation util.LogRotation
+	// LogRetention is how long the logs of a deleted process are kept. 0 keeps them forever.
+	LogRetention time.Duration
+
+	// LivenessPeriod is how often the running processes are probed. 0 disables the liveness probes.
+	LivenessPeriod time.Duration
+	// LivenessFailureThreshold is the number of probes failed in a row for a process to be unhealthy.
+	LivenessFailureThreshold int
+	LivenessAction           LivenessAction
+
+	// BinaryPolicy restricts the binaries of the processes. nil allows any binary.
+	BinaryPolicy *BinaryPolicy
+
+	// Handover starts the processes detached from the instance-manager and journals them to the
+	// state file, so they keep running when it exits or crashes and the next instance-manager
+	// adopts them. Otherwise the processes die with the instance-manager and are not journaled.
+	Handover bool
+
+	Admission AdmissionLimits
+
+	// CrashLogLines is the number of log lines kept in the crash report of a process exiting
+	// abnormally. 0 disables the crash reports.
+	CrashLogLines int
+
+	// Scheduling is the CPU set, nice value, I/O priority and oom_score_adj of every new process.
+	// The scheduling options of a process override them field by field.
+	Scheduling SchedulingOptions
+
+	// Timeouts are the startup timeout, stop grace period and stop escalation of every new process.
+	// The timeouts of a process override them field by field.
+	Timeouts TimeoutOptions
+}
+
 /* Lock order
    1. Manager.lock
    2. Process.lock
@@ -53,15 +109,39 @@ type Manager struct {
 	processes       map[string]*Process
 	processUpdateCh chan *Process
 
-	availablePorts *lhBitmap.Bitmap
+	// portLock protects availablePorts and portAllocations
+	portLock        *sync.Mutex
+	availablePorts  *lhBitmap.Bitmap
+	portAllocations map[string]*portAllocation
+	// quarantinedPorts stay allocated in availablePorts since they are in use by someone else on the host
+	quarantinedPorts map[int32]time.Time
 
 	logsDir string
+	config  ManagerConfig
+
+	stateLock *sync.Mutex
+	stateFile string
+	// lastState is the content last written to the state file
+	lastState []byte
+
+	cgroups *CgroupManager
+
+	// startSlots limits the created processes starting at the same time, nil if unlimited
+	startSlots chan struct{}
+
+	crashReporter *crashReporter
 
 	Executor      Executor
 	HealthChecker HealthChecker
 }
 
-func NewManager(ctx context.Context, portRange string, logsDir string) (*Manager, error) {
+func NewManager(ctx context.Context, portRange string, logsDir string, config ManagerConfig) (*Manager, error) {
+	if !config.Resources.IsEmpty() && !config.Cgroups {
+		return nil, fmt.Errorf("process resource limits require process cgroups")
+	}
+	if err := config.Resources.Validate(); err != nil {
+		return nil, err
+	}
 	start, end, err := ParsePortRange(portRange)
 	if err != nil {
 		return nil, err
@@ -79,24 +159,59 @@ func NewManager(ctx context.Context, portRange string, logsDir string) (*Manager
 		broadcaster: &broadcaster.Broadcaster{},
 		broadcastCh: make(chan interface{}),
 
-		lock:            &sync.RWMutex{},
-		processes:       map[string]*Process{},
-		processUpdateCh: make(chan *Process),
-		availablePorts:  bitmap,
+		lock:             &sync.RWMutex{},
+		processes:        map[string]*Process{},
+		processUpdateCh:  make(chan *Process),
+		portLock:         &sync.Mutex{},
+		availablePorts:   bitmap,
+		portAllocations:  map[string]*portAllocation{},
+		quarantinedPorts: map[int32]time.Time{},
 
 		logsDir: logsDir,
+		config:  config,
+
+		stateLock: &sync.Mutex{},
+		stateFile: getStateFilePath(logsDir),
+
+		crashReporter: newCrashReporter(logsDir, config.CrashLogLines),
 
 		Executor:      &BinaryExecutor{},
 		HealthChecker: &GRPCHealthChecker{},
 	}
+	if config.Cgroups {
+		pm.cgroups = NewCgroupManager(CgroupV2MountPoint)
+	}
+	if config.Admission.MaxStarting > 0 {
+		pm.startSlots = make(chan struct{}, config.Admission.MaxStarting)
+	}
 	// help to kickstart the broadcaster
 	c, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	if _, err := pm.broadcaster.Subscribe(c, pm.broadcastConnector); err != nil {
+	if _, err := pm.broadcaster.Subscribe(c, pm.broadcastConnector, 0); err != nil {
 		return nil, err
 	}
+	if err := pm.restoreState(); err != nil {
+		return nil, errors.Wrap(err, "failed to restore processes from the state file")
+	}
+	if !config.Handover {
+		// The journal of a previous instance-manager in handover mode would go stale
+		if err := pm.removeState(); err != nil {
+			logrus.WithError(err).Warnf("%s: failed to remove the state file", types.ProcessManagerGrpcService)
+		}
+	}
 	go pm.startMonitoring()
 	go pm.startInstanceConditionCheck()
+	go pm.startStatsCollection()
+	go pm.startPortReconciliation()
+	if config.LogRetention > 0 {
+		go pm.startLogRetentionSweep()
+	}
+	if config.Handover && config.LogRotation.MaxSize > 0 {
+		go pm.startLogRotationCheck()
+	}
+	if config.LivenessPeriod > 0 {
+		go pm.startLivenessProbing()
+	}
 	return pm, nil
 }
 
@@ -116,6 +231,12 @@ func (pm *Manager) startMonitoring() {
 				resp.Deleted = true
 			}
 			pm.lock.RUnlock()
+			// Only the detached processes survive the instance-manager, see ManagerConfig.Handover
+			if pm.config.Handover {
+				if err := pm.persistState(); err != nil {
+					logrus.WithError(err).Warnf("%s: failed to persist process state", types.ProcessManagerGrpcService)
+				}
+			}
 			pm.broadcastCh <- interface{}(resp)
 		}
 		if done {
@@ -144,6 +265,75 @@ func (pm *Manager) startInstanceConditionCheck() {
 	}
 }
 
+func (pm *Manager) startLogRetentionSweep() {
+	done := false
+
+	ticker := time.NewTicker(LogRetentionSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pm.ctx.Done():
+			logrus.Infof("%s: stopped sweeping process logs due to the context done", types.ProcessManagerGrpcService)
+			done = true
+		case <-ticker.C:
+			pm.sweepLogs()
+		}
+		if done {
+			break
+		}
+	}
+}
+
+func (pm *Manager) sweepLogs() {
+	removed, err := util.RemoveStaleLogs(pm.logsDir, pm.config.LogRetention, func(name string) bool {
+		return pm.findProcess(name) != nil
+	})
+	if err != nil {
+		logrus.WithError(err).Warnf("%s: failed to remove stale process logs", types.ProcessManagerGrpcService)
+	}
+	for _, name := range removed {
+		logrus.Infof("%s: removed the logs of process %v gone for longer than %v", types.ProcessManagerGrpcService, name, pm.config.LogRetention)
+	}
+}
+
+// startLogRotationCheck rotates the log files the detached processes write to directly, since
+// their output doesn't go through the writer that rotates the file on write.
+func (pm *Manager) startLogRotationCheck() {
+	done := false
+
+	ticker := time.NewTicker(LogRotationCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pm.ctx.Done():
+			logrus.Infof("%s: stopped rotating process logs due to the context done", types.ProcessManagerGrpcService)
+			done = true
+		case <-ticker.C:
+			pm.rotateLogs()
+		}
+		if done {
+			break
+		}
+	}
+}
+
+func (pm *Manager) rotateLogs() {
+	pm.lock.RLock()
+	processes := make([]*Process, 0, len(pm.processes))
+	for _, p := range pm.processes {
+		processes = append(processes, p)
+	}
+	pm.lock.RUnlock()
+
+	for _, p := range processes {
+		if err := p.logger.RotateIfNeeded(); err != nil {
+			logrus.WithError(err).Warnf("%s: failed to rotate the log of process %v", types.ProcessManagerGrpcService, p.Name)
+		}
+	}
+}
+
 func (pm *Manager) checkMountPointStatusForEngine() {
 	volumeMountPointMap, err := util.GetVolumeMountPointMap()
 	if err != nil {
@@ -165,7 +355,7 @@ func (pm *Manager) getProcessesToUpdateConditions(volumeMountPointMap map[string
 	for _, p := range pm.processes {
 		p.lock.Lock()
 		if lhLonghorn.IsEngineProcess(p.Name) && p.State == StateRunning {
-			volumeName := util.ProcessNameToVolumeName(p.Name)
+			volumeName := p.volumeName()
 			volumeNameSHA := sha256.Sum256([]byte(volumeName))
 			volumeNameSHAStr := hex.EncodeToString(volumeNameSHA[:])
 
@@ -182,37 +372,59 @@ func (pm *Manager) getProcessesToUpdateConditions(volumeMountPointMap map[string
 // ProcessCreate will create a process according to the request.
 // If the specified process name exists already, the creation will fail.
 func (pm *Manager) ProcessCreate(ctx context.Context, req *rpc.ProcessCreateRequest) (ret *rpc.ProcessResponse, err error) {
+	return pm.ProcessCreateWithOptions(ctx, req, processOptionsFromSpec(req.Spec))
+}
+
+// ProcessCreateWithOptions is ProcessCreate with the environment, working directory, credential
+// and scheduling of the process set by the options rather than by the spec.
+func (pm *Manager) ProcessCreateWithOptions(ctx context.Context, req *rpc.ProcessCreateRequest, options *ProcessOptions) (ret *rpc.ProcessResponse, err error) {
 	if req.Spec.Name == "" || req.Spec.Binary == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "missing required argument")
 	}
+	if err := options.Validate(); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid options for process %v: %v", req.Spec.Name, err)
+	}
+	if !options.resources().IsEmpty() && !pm.config.Cgroups {
+		return nil, status.Errorf(codes.InvalidArgument, "resource limits of process %v require process cgroups", req.Spec.Name)
+	}
+	if err := options.scheduling().withDefaults(&pm.config.Scheduling).checkPermission(options.credential()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid scheduling for process %v: %v", req.Spec.Name, err)
+	}
+	binaryFile, err := pm.config.BinaryPolicy.Verify(req.Spec.Name, req.Spec.Binary)
+	if err != nil {
+		return nil, err
+	}
+	closeBinaryFile := func() {
+		if binaryFile != nil {
+			binaryFile.Close()
+		}
+	}
 
 	logrus.Infof("Process Manager: prepare to create process %v", req.Spec.Name)
-	logger, err := util.NewLonghornWriter(req.Spec.Name, pm.logsDir)
+	releaseStartSlot, err := pm.acquireStartSlot(ctx, req.Spec.Name)
 	if err != nil {
+		closeBinaryFile()
 		return nil, err
 	}
-
-	p := &Process{
-		Name:      req.Spec.Name,
-		Binary:    req.Spec.Binary,
-		Args:      req.Spec.Args,
-		PortCount: req.Spec.PortCount,
-		PortArgs:  req.Spec.PortArgs,
-
-		UUID: util.UUID(),
-
-		State:      StateStarting,
-		Conditions: make(map[string]bool),
-
-		lock: &sync.RWMutex{},
-
-		logger: logger,
-
-		executor:      pm.Executor,
-		healthChecker: pm.HealthChecker,
+	p, err := pm.newProcess(req.Spec)
+	if err != nil {
+		releaseStartSlot()
+		closeBinaryFile()
+		return nil, err
 	}
+	p.binaryFile = binaryFile
+	p.Options = options.withSchedulingDefaults(&pm.config.Scheduling).withTimeoutDefaults(&pm.config.Timeouts)
+	p.Options.setRestart(p)
+	p.Resources = p.Options.resources().withDefaults(&pm.config.Resources)
+	p.startSlotRelease = releaseStartSlot
+	p.events.record(EventReasonCreated, "created process with UUID %v", p.UUID)
 
 	if err := pm.registerProcess(p); err != nil {
+		releaseStartSlot()
+		p.closeBinaryFile()
+		if err := p.logger.Close(); err != nil {
+			logrus.WithError(err).Warnf("Process Manager: failed to close process %v logger", p.Name)
+		}
 		return nil, err
 	}
 
@@ -238,7 +450,11 @@ func (pm *Manager) ProcessDelete(ctx context.Context, req *rpc.ProcessDeleteRequ
 	if p == nil {
 		return nil, status.Errorf(codes.NotFound, "cannot find process %v", req.Name)
 	}
+	return pm.deleteProcess(p), nil
+}
 
+// deleteProcess stops and unregisters the process found by the caller.
+func (pm *Manager) deleteProcess(p *Process) *rpc.ProcessResponse {
 	p.Stop()
 
 	resp := p.RPCResponse()
@@ -246,8 +462,57 @@ func (pm *Manager) ProcessDelete(ctx context.Context, req *rpc.ProcessDeleteRequ
 
 	pm.unregisterProcess(p)
 
-	logrus.Infof("Process Manager: deleted process %v", req.Name)
-	return resp, nil
+	logrus.Infof("Process Manager: deleted process %v", p.Name)
+	return resp
+}
+
+// newProcessLogger returns the writer of the log file of a process. A replacement shares the writer
+// of the process it replaces, so a single writer rotates the file.
+func (pm *Manager) newProcessLogger(name string) (*util.LonghornWriter, error) {
+	if existing := pm.findProcess(name); existing != nil && existing.logger.Share() {
+		return existing.logger, nil
+	}
+	return util.NewLonghornWriter(name, pm.logsDir, pm.config.LogRotation)
+}
+
+func (pm *Manager) newProcess(spec *rpc.ProcessSpec) (*Process, error) {
+	logger, err := pm.newProcessLogger(spec.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Process{
+		Name:      spec.Name,
+		Binary:    spec.Binary,
+		Args:      spec.Args,
+		PortCount: spec.PortCount,
+		PortArgs:  spec.PortArgs,
+
+		UUID: util.UUID(),
+
+		RestartPolicy:  pm.config.RestartPolicy,
+		MaxRestarts:    pm.config.MaxRestarts,
+		RestartBackoff: pm.config.RestartBackoff,
+
+		State:      StateStarting,
+		Conditions: make(map[string]bool),
+
+		lock: &sync.RWMutex{},
+
+		logger: logger,
+
+		executor:      pm.Executor,
+		healthChecker: pm.HealthChecker,
+		cgroups:       pm.cgroups,
+		stats:         newStatsCollector(),
+		events:        newEventRecorder(),
+
+		detached:      pm.config.Handover,
+		crashReporter: pm.crashReporter,
+		startSlots:    pm.startSlots,
+	}
+	p.Resources = pm.config.Resources.withDefaults(nil)
+	return p, nil
 }
 
 func (pm *Manager) registerProcess(p *Process) error {
@@ -258,6 +523,9 @@ func (pm *Manager) registerProcess(p *Process) error {
 	if exists {
 		return status.Errorf(codes.AlreadyExists, "process %v already exists", p.Name)
 	}
+	if err := pm.checkCapacity(p.Name); err != nil {
+		return err
+	}
 
 	if err := pm.allocateProcessPorts(p); err != nil {
 		return err
@@ -279,15 +547,8 @@ func (pm *Manager) unregisterProcess(p *Process) {
 	}
 
 	go func() {
-		for i := 0; i < types.WaitCount; i++ {
-			if p.IsStopped() {
-				break
-			}
-			logrus.Debugf("Process Manager: wait for process %v to shutdown before unregistering process", p.Name)
-			time.Sleep(types.WaitInterval)
-		}
-
-		if !p.IsStopped() {
+		logrus.Debugf("Process Manager: wait for process %v to shutdown before unregistering process", p.Name)
+		if !p.waitForStopped(time.Now().Add(p.stopTimeout())) {
 			logrus.Errorf("Process Manager: failed to unregister process %v since it is state %v rather than stopped", p.Name, p.State)
 			return
 		}
@@ -315,6 +576,44 @@ func (pm *Manager) findProcess(name string) *Process {
 	return pm.processes[name]
 }
 
+// ProcessResourceUsage returns the usage counters of the cgroup of the process named by name.
+// If the process doesn't exist, the call will return with ErrorNotFound
+func (pm *Manager) ProcessResourceUsage(name string) (*ResourceUsage, error) {
+	p := pm.findProcess(name)
+	if p == nil {
+		return nil, status.Errorf(codes.NotFound, "cannot find process %v", name)
+	}
+
+	usage, err := p.ResourceUsage()
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot get resource usage of process %v: %v", name, err)
+	}
+	return usage, nil
+}
+
+// ProcessLifecycle returns the start, ready and exit times of a process, and how it exited last time.
+func (pm *Manager) ProcessLifecycle(name string) (*ProcessLifecycle, error) {
+	p := pm.findProcess(name)
+	if p == nil {
+		return nil, status.Errorf(codes.NotFound, "cannot find process %v", name)
+	}
+	return p.Lifecycle(), nil
+}
+
+// ProcessEvents returns the recorded events of a process, from the oldest to the newest.
+func (pm *Manager) ProcessEvents(ctx context.Context, req *rpc.ProcessEventsRequest) (*rpc.ProcessEventsResponse, error) {
+	p := pm.findProcess(req.Name)
+	if p == nil {
+		return nil, status.Errorf(codes.NotFound, "cannot find process %v", req.Name)
+	}
+
+	resp := &rpc.ProcessEventsResponse{}
+	for _, event := range p.Events() {
+		resp.Events = append(resp.Events, event.RPC())
+	}
+	return resp, nil
+}
+
 // ProcessGet will get a process named by the request.
 // If the process doesn't exist, the call will return with ErrorNotFound
 func (pm *Manager) ProcessGet(ctx context.Context, req *rpc.ProcessGetRequest) (*rpc.ProcessResponse, error) {
@@ -323,54 +622,108 @@ func (pm *Manager) ProcessGet(ctx context.Context, req *rpc.ProcessGetRequest) (
 		return nil, status.Errorf(codes.NotFound, "cannot find process %v", req.Name)
 	}
 
-	return p.RPCResponse(), nil
+	resp := p.RPCResponse()
+	// Only the processes running in their own cgroup have usage counters
+	if usage, err := p.ResourceUsage(); err == nil {
+		resp.Status.ResourceUsage = usage.RPC()
+	}
+	return resp, nil
 }
 
 func (pm *Manager) ProcessList(ctx context.Context, req *rpc.ProcessListRequest) (*rpc.ProcessListResponse, error) {
+	selector, err := util.ParseLabelSelector(req.LabelSelector)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// The revision is taken before listing, so a watch resumed from it doesn't miss any update
+	revision := pm.Revision()
+
 	pm.lock.RLock()
 	defer pm.lock.RUnlock()
 
 	resp := &rpc.ProcessListResponse{
 		Processes: map[string]*rpc.ProcessResponse{},
+		Revision:  revision,
 	}
 	for _, p := range pm.processes {
-		resp.Processes[p.Name] = p.RPCResponse()
+		if selector.Matches(labels.Set(p.Labels())) {
+			resp.Processes[p.Name] = p.RPCResponse()
+		}
 	}
 	return resp, nil
 }
 
 func (pm *Manager) ProcessLog(req *rpc.LogRequest, srv rpc.ProcessManagerService_ProcessLogServer) error {
+	opts, err := util.NewLogStreamOptions(req.Tail, req.Follow, req.Since, req.Until)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return pm.ProcessLogWithOptions(req, opts, srv)
+}
+
+// ProcessLogWithOptions is ProcessLog limited to the tail or a time window of the log, optionally
+// following the new lines until the client goes away.
+func (pm *Manager) ProcessLogWithOptions(req *rpc.LogRequest, opts util.LogStreamOptions, srv rpc.ProcessManagerService_ProcessLogServer) error {
 	logrus.Infof("Process Manager: start getting logs for process %v", req.Name)
 	p := pm.findProcess(req.Name)
 	if p == nil {
 		return status.Errorf(codes.NotFound, "cannot find process %v", req.Name)
 	}
+	if opts.Tail < 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid tail %v", opts.Tail)
+	}
+	if !opts.Since.IsZero() && !opts.Until.IsZero() && opts.Until.Before(opts.Since) {
+		return status.Errorf(codes.InvalidArgument, "until %v is before since %v", opts.Until, opts.Since)
+	}
+
 	doneChan := make(chan struct{})
-	logChan, err := p.logger.StreamLog(doneChan)
+	defer close(doneChan)
+	logChan, err := p.logger.StreamLogWithOptions(doneChan, opts)
 	if err != nil {
 		return err
 	}
-	for logLine := range logChan {
-		if err := srv.Send(&rpc.LogResponse{Line: logLine}); err != nil {
-			doneChan <- struct{}{}
-			close(doneChan)
-			return err
+	for {
+		select {
+		case <-srv.Context().Done():
+			logrus.Infof("Process Manager: stopped getting logs for process %v since the client is gone", req.Name)
+			return srv.Context().Err()
+		case logLine, ok := <-logChan:
+			if !ok {
+				logrus.Infof("Process Manager: got logs for process %v", req.Name)
+				return nil
+			}
+			if err := srv.Send(&rpc.LogResponse{Line: logLine}); err != nil {
+				return err
+			}
 		}
 	}
-	logrus.Infof("Process Manager: got logs for process %v", req.Name)
-	return nil
 }
 
 func (pm *Manager) broadcastConnector() (chan interface{}, error) {
 	return pm.broadcastCh, nil
 }
 
-func (pm *Manager) Subscribe() (<-chan interface{}, error) {
-	return pm.broadcaster.Subscribe(context.TODO(), pm.broadcastConnector)
+// Subscribe returns the process updates with a revision after since, or the updates from now on
+// if since is 0. If the updates since the revision are no longer kept, a resync required event
+// is returned first, and the subscriber has to list the processes again.
+func (pm *Manager) Subscribe(ctx context.Context, since uint64) (<-chan *broadcaster.Event, error) {
+	return pm.broadcaster.Subscribe(ctx, pm.broadcastConnector, since)
+}
+
+// Revision returns the revision of the latest process update. Listing the processes after
+// getting the revision, then subscribing since it, doesn't miss any update.
+func (pm *Manager) Revision() uint64 {
+	return pm.broadcaster.Revision()
 }
 
-func (pm *Manager) ProcessWatch(req *emptypb.Empty, srv rpc.ProcessManagerService_ProcessWatchServer) (err error) {
-	responseChan, err := pm.Subscribe()
+// ProcessWatch streams the process updates after the requested revision, each with its revision.
+// If the updates are no longer kept, a response with ResyncRequired is sent followed by the
+// current state of all processes.
+func (pm *Manager) ProcessWatch(req *rpc.ProcessWatchRequest, srv rpc.ProcessManagerService_ProcessWatchServer) (err error) {
+	ctx, cancel := context.WithCancel(srv.Context())
+	defer cancel()
+	filter := processWatchFilterFromRequest(req)
+	responseChan, err := pm.Watch(ctx, req.GetSinceRevision(), filter)
 	if err != nil {
 		return err
 	}
@@ -382,14 +735,25 @@ func (pm *Manager) ProcessWatch(req *emptypb.Empty, srv rpc.ProcessManagerServic
 			logrus.Info("Process manager update watch ended successfully")
 		}
 	}()
-	logrus.Info("Started new process manager update watch")
-
-	for resp := range responseChan {
-		r, ok := resp.(*rpc.ProcessResponse)
+	logrus.Infof("Started new process manager update watch since revision %v", req.GetSinceRevision())
+
+	for event := range responseChan {
+		if event.ResyncRequired {
+			// The updates the watcher asked for are gone, or it was too slow to keep up with them
+			logrus.Warnf("Process manager update watch missed updates, resyncing at revision %v", event.Revision)
+			if err := pm.sendAllProcesses(srv, event.Revision, filter); err != nil {
+				return err
+			}
+			continue
+		}
+		r, ok := event.Item.(*rpc.ProcessResponse)
 		if !ok {
 			return fmt.Errorf("BUG: cannot get ProcessResponse from channel")
 		}
-		if err := srv.Send(r); err != nil {
+		// The response is shared by all the watchers
+		resp := proto.Clone(r).(*rpc.ProcessResponse)
+		resp.Revision = event.Revision
+		if err := srv.Send(resp); err != nil {
 			return err
 		}
 	}
@@ -397,25 +761,31 @@ func (pm *Manager) ProcessWatch(req *emptypb.Empty, srv rpc.ProcessManagerServic
 	return nil
 }
 
-func (pm *Manager) allocatePorts(portCount int32) (int32, int32, error) {
-	if portCount < 0 {
-		return 0, 0, fmt.Errorf("invalid port count %v", portCount)
-	}
-	if portCount == 0 {
-		return 0, 0, nil
+// sendAllProcesses sends the resync marker, then the current state of all processes matching the
+// filter at the revision.
+func (pm *Manager) sendAllProcesses(srv rpc.ProcessManagerService_ProcessWatchServer, revision uint64, filter *ProcessWatchFilter) error {
+	if err := srv.Send(&rpc.ProcessResponse{Revision: revision, ResyncRequired: true}); err != nil {
+		return err
 	}
-	start, end, err := pm.availablePorts.AllocateRange(portCount)
-	if err != nil {
-		return 0, 0, errors.Wrapf(err, "failed to allocate %v ports", portCount)
+
+	pm.lock.RLock()
+	processes := make([]*Process, 0, len(pm.processes))
+	for _, p := range pm.processes {
+		processes = append(processes, p)
 	}
-	return int32(start), int32(end), nil
-}
+	pm.lock.RUnlock()
 
-func (pm *Manager) releasePorts(start, end int32) error {
-	if start < 0 || end < 0 {
-		return fmt.Errorf("invalid start/end port %v %v", start, end)
+	for _, p := range processes {
+		resp := p.RPCResponse()
+		if filter != nil && !filter.MatchLabels(resp, p.Labels()) {
+			continue
+		}
+		resp.Revision = revision
+		if err := srv.Send(resp); err != nil {
+			return err
+		}
 	}
-	return pm.availablePorts.ReleaseRange(start, end)
+	return nil
 }
 
 func ParsePortRange(portRange string) (int32, int32, error) {
@@ -440,54 +810,69 @@ func ParsePortRange(portRange string) (int32, int32, error) {
 // ProcessReplace will replace a process with the new process according to the request.
 // If the specified process name doesn't exist already, the replace will fail.
 func (pm *Manager) ProcessReplace(ctx context.Context, req *rpc.ProcessReplaceRequest) (ret *rpc.ProcessResponse, err error) {
+	return pm.ProcessReplaceWithOptions(ctx, req, replaceOptionsFromRPC(req))
+}
+
+// ProcessReplaceWithOptions is ProcessReplace with the readiness timeout of the replacement and
+// the observation window after the switch set by the options rather than by the request. If the
+// replacement exits within the window, the replaced process is relaunched with the RolledBack
+// condition after the response is returned.
+func (pm *Manager) ProcessReplaceWithOptions(ctx context.Context, req *rpc.ProcessReplaceRequest, opts ReplaceOptions) (ret *rpc.ProcessResponse, err error) {
 	if req.Spec.Name == "" || req.Spec.Binary == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "missing required argument")
 	}
-	if req.TerminateSignal != "SIGHUP" {
-		return nil, status.Errorf(codes.InvalidArgument, "doesn't support terminate signal %v", req.TerminateSignal)
+	terminateSignal, err := ParseReplaceTerminateSignal(req.TerminateSignal)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid replace options for process %v: %v", req.Spec.Name, err)
+	}
+	binaryFile, err := pm.config.BinaryPolicy.Verify(req.Spec.Name, req.Spec.Binary)
+	if err != nil {
+		return nil, err
 	}
-	terminateSignal := syscall.SIGHUP
 
 	logrus.Infof("Process Manager: prepare to replace process %v", req.Spec.Name)
-	logger, err := util.NewLonghornWriter(req.Spec.Name, pm.logsDir)
+	p, err := pm.newProcess(req.Spec)
 	if err != nil {
+		if binaryFile != nil {
+			binaryFile.Close()
+		}
 		return nil, err
 	}
+	p.binaryFile = binaryFile
 
-	p := &Process{
-		Name:      req.Spec.Name,
-		Binary:    req.Spec.Binary,
-		Args:      req.Spec.Args,
-		PortCount: req.Spec.PortCount,
-		PortArgs:  req.Spec.PortArgs,
-
-		UUID: util.UUID(),
-
-		State:      StateStarting,
-		Conditions: make(map[string]bool),
-
-		lock: &sync.RWMutex{},
-
-		logger: logger,
-
-		executor:      pm.Executor,
-		healthChecker: pm.HealthChecker,
+	// The replacement shares the log writer of the replaced process, see newProcessLogger
+	closeReplacement := func() {
+		p.closeBinaryFile()
+		if err := p.logger.Close(); err != nil {
+			logrus.WithError(err).Warnf("Process Manager: failed to close process %v logger", p.Name)
+		}
 	}
 
 	processToReplace, err := pm.initProcessReplace(p)
 	if err != nil {
+		closeReplacement()
 		return nil, err
 	}
 
+	// The replacement is the same engine with a new binary, so it keeps the options and the history
+	p.Options = processToReplace.Options
+	p.Options.setRestart(p)
+	p.Resources = processToReplace.Resources
+	p.events.prepend(processToReplace.Events())
+	p.events.record(EventReasonReplaced, "replacing process with UUID %v and binary %v by process with UUID %v and binary %v",
+		processToReplace.UUID, processToReplace.Binary, p.UUID, p.Binary)
+
 	if processToReplace.Binary == p.Binary {
 		logrus.Infof("Process Manager: the existing process already has the updated engine image %v", p.Binary)
+		closeReplacement()
+		pm.releaseProcessPorts(p)
 		return processToReplace.RPCResponse(), nil
 	}
 
 	cleanupReplacementProcess := func() {
-		// TODO process ports should be tied to process UUID's right now only the port ranges is used
-		//  so if one is not careful with allocation/release it's possible that different processes nuke each
-		//  others ports
 		p.Stop()
 		pm.releaseProcessPorts(p)
 		logrus.Errorf("Process Manager: cleaned up the replacement process %v with UUID %v", req.Spec.Name, p.UUID)
@@ -501,21 +886,25 @@ func (pm *Manager) ProcessReplace(ctx context.Context, req *rpc.ProcessReplaceRe
 	}
 
 	logrus.Infof("Process Manager: initiated replacement process %v with UUID %v", req.Spec.Name, p.UUID)
-	for i := 0; i < 30; i++ {
-		resp := p.RPCResponse()
-		if resp.Status.State == types.ProcessStateRunning {
-			logrus.Infof("Process Manager: replacement process for %v started running", req.Spec.Name)
-			break
-		} else if resp.Status.State != types.ProcessStateStarting {
-			logrus.Errorf("Process Manager: replacement process for %v failed to start, now in state %v", req.Spec.Name, resp.Status.State)
-			cleanupReplacementProcess()
-			return nil, fmt.Errorf("failed to start replacement process %v", p.Name)
-		}
-		logrus.Debugf("Process Manager: waiting for the replace process %v to start", req.Spec.Name)
-		time.Sleep(1 * time.Second)
+	readyTimeout := opts.readyTimeout(p)
+	running, err := p.waitForRunning(readyTimeout)
+	if err != nil {
+		logrus.WithError(err).Errorf("Process Manager: replacement process for %v failed to start", req.Spec.Name)
+		cleanupReplacementProcess()
+		return nil, status.Errorf(codes.Unavailable, "failed to start replacement process %v: %v", p.Name, err)
+	}
+	if running {
+		logrus.Infof("Process Manager: replacement process for %v started running", req.Spec.Name)
+	} else if opts.RequireReady {
+		logrus.Errorf("Process Manager: replacement process for %v is not running after %v", req.Spec.Name, readyTimeout)
+		cleanupReplacementProcess()
+		return nil, status.Errorf(codes.Unavailable, "replacement process %v is not running after %v", p.Name, readyTimeout)
+	} else {
+		logrus.Warnf("Process Manager: replacement process for %v is not running after %v, switching to it anyway", req.Spec.Name, readyTimeout)
 	}
 
 	// cleanup the process to replace this should always be safe to call outside of a lock
+	switchTime := time.Now()
 	processToReplace.StopWithSignal(terminateSignal)
 
 	// we need to lock the evaluation & assignment
@@ -525,7 +914,12 @@ func (pm *Manager) ProcessReplace(ctx context.Context, req *rpc.ProcessReplaceRe
 		logrus.Warnf("Process Manager: process %v with UUID %v no longer exists for replacement",
 			p.Name, processToReplace.UUID)
 	} else if existingProcess.UUID == processToReplace.UUID {
-		pm.releaseProcessPorts(processToReplace)
+		if opts.ObservationWindow > 0 {
+			// The ports are kept for a rollback until the end of the observation window
+			pm.holdPorts(processToReplace.UUID)
+		} else {
+			pm.releaseProcessPorts(processToReplace)
+		}
 		logrus.Infof("Process Manager: successfully unregistered old process %v", p.Name)
 	} else {
 		pm.lock.Unlock()
@@ -536,10 +930,14 @@ func (pm *Manager) ProcessReplace(ctx context.Context, req *rpc.ProcessReplaceRe
 	}
 
 	pm.processes[p.Name] = p
+	pm.setPortsPending(p.UUID, false)
 	logrus.Infof("Process Manager: process %v successfully registered replacement with UUID %v", p.Name, p.UUID)
 	pm.lock.Unlock()
 
 	p.UpdateCh <- p
+	if opts.ObservationWindow > 0 {
+		go pm.observeReplacement(p, processToReplace, switchTime, opts)
+	}
 	logrus.Infof("Process Manager: successfully replaced process %v", req.Spec.Name)
 	return p.RPCResponse(), nil
 }
@@ -552,10 +950,16 @@ func (pm *Manager) initProcessReplace(p *Process) (*Process, error) {
 	if !exists {
 		return nil, status.Errorf(codes.NotFound, "existing process %v doesn't exists", p.Name)
 	}
+	// The suspended process cannot hand over to its replacement
+	if oldProcess.IsSuspended() {
+		return nil, status.Errorf(codes.FailedPrecondition, "process %v is suspended, it should be resumed before the replacement", p.Name)
+	}
 
 	if err := pm.allocateProcessPorts(p); err != nil {
 		return nil, err
 	}
+	// The replacement is only registered once it is running
+	pm.setPortsPending(p.UUID, true)
 
 	p.UpdateCh = pm.processUpdateCh
 	return oldProcess, nil
@@ -567,10 +971,13 @@ func (pm *Manager) allocateProcessPorts(p *Process) error {
 		return fmt.Errorf("too many port args %v for port count %v", p.PortArgs, p.PortCount)
 	}
 
-	p.PortStart, p.PortEnd, err = pm.allocatePorts(p.PortCount)
+	p.PortStart, p.PortEnd, err = pm.allocatePorts(p.UUID, p.Name, p.PortCount)
 	if err != nil {
 		return errors.Wrapf(err, "cannot allocate %v ports for %v", p.PortCount, p.Name)
 	}
+	if p.PortCount > 0 {
+		p.events.record(EventReasonPortsAllocated, "allocated ports %v-%v", p.PortStart, p.PortEnd)
+	}
 
 	if len(p.PortArgs) != 0 {
 		for i, arg := range p.PortArgs {
@@ -585,8 +992,12 @@ func (pm *Manager) allocateProcessPorts(p *Process) error {
 }
 
 func (pm *Manager) releaseProcessPorts(p *Process) {
-	if err := pm.releasePorts(p.PortStart, p.PortEnd); err != nil {
+	if err := pm.releasePorts(p.UUID, p.PortStart, p.PortEnd); err != nil {
 		logrus.WithError(err).Errorf("Process Manager: cannot deallocate %v ports (%v-%v) for %v",
 			p.PortCount, p.PortStart, p.PortEnd, p.Name)
+		return
+	}
+	if p.PortCount > 0 {
+		p.events.record(EventReasonPortsReleased, "released ports %v-%v", p.PortStart, p.PortEnd)
 	}
 }
@@ -1,22 +1,36 @@
 package process
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	rpc "github.com/longhorn/types/pkg/generated/imrpc"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
 	. "gopkg.in/check.v1"
+	"k8s.io/mount-utils"
 
 	"github.com/longhorn/longhorn-instance-manager/pkg/types"
+	"github.com/longhorn/longhorn-instance-manager/pkg/util"
 )
 
 const (
@@ -46,6 +60,30 @@ func (pw *ProcessWatcher) Send(resp *rpc.ProcessResponse) error {
 	return nil
 }
 
+func (pw *ProcessWatcher) Context() context.Context {
+	return context.Background()
+}
+
+// RecordingProcessWatcher passes the responses it is sent on to its channel.
+type RecordingProcessWatcher struct {
+	grpc.ServerStream
+	ctx   context.Context
+	resps chan *rpc.ProcessResponse
+}
+
+func (pw *RecordingProcessWatcher) Send(resp *rpc.ProcessResponse) error {
+	select {
+	case pw.resps <- resp:
+		return nil
+	case <-pw.ctx.Done():
+		return pw.ctx.Err()
+	}
+}
+
+func (pw *RecordingProcessWatcher) Context() context.Context {
+	return pw.ctx
+}
+
 func (s *TestSuite) SetUpSuite(c *C) {
 	var err error
 
@@ -53,7 +91,7 @@ func (s *TestSuite) SetUpSuite(c *C) {
 	s.shutdownCh = make(chan error)
 
 	s.logDir = os.TempDir()
-	s.pm, err = NewManager(context.Background(), "10000-30000", s.logDir)
+	s.pm, err = NewManager(context.Background(), "10000-30000", s.logDir, ManagerConfig{})
 	c.Assert(err, IsNil)
 	s.pm.Executor = &MockExecutor{
 		CreationHook: func(cmd *MockCommand) (*MockCommand, error) {
@@ -295,6 +333,1829 @@ func (s *TestSuite) TestProcessReplaceDuringDeletion(c *C) {
 	wg.Wait()
 }
 
+func (s *TestSuite) TestProcessStateRestore(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logDir := c.MkDir()
+	pm, err := NewManager(ctx, "10000-10100", logDir, ManagerConfig{})
+	c.Assert(err, IsNil)
+	pm.HealthChecker = &MockHealthChecker{}
+
+	name := "test_process_state_restore"
+	_, err = pm.ProcessCreate(context.TODO(), &rpc.ProcessCreateRequest{
+		Spec: &rpc.ProcessSpec{
+			Name:      name,
+			Binary:    "sleep",
+			Args:      []string{"1000"},
+			PortCount: 1,
+		},
+	})
+	c.Assert(err, IsNil)
+
+	running, err := waitForProcessState(pm, name, func(process *rpc.ProcessResponse) bool {
+		return process.Status.State == types.ProcessStateRunning
+	})
+	c.Assert(err, IsNil)
+	c.Assert(running, Equals, true)
+	p := pm.findProcess(name)
+	c.Assert(p.Pid(), Not(Equals), 0)
+	c.Assert(pm.persistState(), IsNil)
+
+	// The unchanged journal is not rewritten
+	written, err := os.Stat(pm.stateFile)
+	c.Assert(err, IsNil)
+	c.Assert(pm.persistState(), IsNil)
+	unchanged, err := os.Stat(pm.stateFile)
+	c.Assert(err, IsNil)
+	c.Assert(os.SameFile(written, unchanged), Equals, true)
+
+	// A new manager should re-attach to the process and hold its ports
+	restoredPM, err := NewManager(ctx, "10000-10100", logDir, ManagerConfig{})
+	c.Assert(err, IsNil)
+	restoredPM.HealthChecker = &MockHealthChecker{}
+
+	restored := restoredPM.findProcess(name)
+	c.Assert(restored, NotNil)
+	c.Assert(restored.Pid(), Equals, p.Pid())
+	c.Assert(restored.UUID, Equals, p.UUID)
+	c.Assert(restored.State, Equals, StateRunning)
+	c.Assert(restored.PortStart, Equals, p.PortStart)
+
+	start, end, err := restoredPM.allocatePorts("test-owner", "test_port_owner", 1)
+	c.Assert(err, IsNil)
+	c.Assert(start, Not(Equals), p.PortStart)
+	c.Assert(restoredPM.releasePorts("test-owner", start, end), IsNil)
+
+	assertProcessDeletion(c, restoredPM, name)
+	deleted, err := waitForProcessListState(restoredPM, func(processes map[string]*rpc.ProcessResponse) bool {
+		_, exists := processes[name]
+		return !exists
+	})
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, true)
+}
+
+func (s *TestSuite) TestProcessReplaceRollback(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewManager(ctx, "10000-10100", c.MkDir(), ManagerConfig{})
+	c.Assert(err, IsNil)
+	cmdCh := make(chan *MockCommand, 10)
+	pm.Executor = &MockExecutor{
+		CreationHook: func(cmd *MockCommand) (*MockCommand, error) {
+			cmdCh <- cmd
+			return cmd, nil
+		},
+	}
+	pm.HealthChecker = &MockHealthChecker{}
+
+	name := "test_process_replace_rollback"
+	assertProcessCreation(c, pm, name, TestBinary)
+	<-cmdCh
+	original := pm.findProcess(name)
+
+	replaceReq := &rpc.ProcessReplaceRequest{
+		Spec:            createProcessSpec(name, TestBinaryReplace),
+		TerminateSignal: "SIGKILL",
+	}
+	_, err = pm.ProcessReplace(ctx, replaceReq)
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	replaceReq.TerminateSignal = "SIGTERM"
+	_, err = pm.ProcessReplaceWithOptions(ctx, replaceReq, ReplaceOptions{ReadyTimeout: types.GRPCServiceTimeout})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+
+	// The replacement is not running in time
+	pm.HealthChecker = &blockingHealthChecker{ready: make(chan struct{})}
+	_, err = pm.ProcessReplaceWithOptions(ctx, replaceReq, ReplaceOptions{ReadyTimeout: 500 * time.Millisecond, RequireReady: true})
+	c.Assert(status.Code(err), Equals, codes.Unavailable)
+	<-cmdCh
+	c.Assert(pm.findProcess(name).UUID, Equals, original.UUID)
+	c.Assert(pm.PortPoolStatus().UsedPorts, Equals, int32(1))
+
+	// The replacement errors right after the switch
+	pm.HealthChecker = &MockHealthChecker{}
+	go func() {
+		replacement := <-cmdCh
+		for pm.findProcess(name).Binary != TestBinaryReplace {
+			time.Sleep(ReplaceCheckInterval)
+		}
+		replacement.stopCh <- fmt.Errorf("crashed")
+	}()
+	replaceReq.ObservationWindowSeconds = 10
+	resp, err := pm.ProcessReplace(ctx, replaceReq)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Spec.Binary, Equals, TestBinaryReplace)
+	// The rollback happens after the replace returns
+	rolledBack, err := waitForProcessState(pm, name, func(process *rpc.ProcessResponse) bool {
+		return process.Status.Conditions[types.ProcessConditionRolledBack] && process.Status.State == types.ProcessStateRunning
+	})
+	c.Assert(err, IsNil)
+	c.Assert(rolledBack, Equals, true)
+	resp, err = pm.ProcessGet(ctx, &rpc.ProcessGetRequest{Name: name})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Spec.Binary, Equals, TestBinary)
+	c.Assert(resp.Status.PortStart, Equals, original.PortStart)
+	replaceReq.ObservationWindowSeconds = 0
+
+	rollback := pm.findProcess(name)
+	c.Assert(rollback.UUID, Not(Equals), original.UUID)
+	relaunched := <-cmdCh
+	c.Assert(relaunched.Binary, Equals, TestBinary)
+	c.Assert(relaunched.Args, DeepEquals, original.Args)
+	events, err := pm.ProcessEvents(context.Background(), &rpc.ProcessEventsRequest{Name: name})
+	c.Assert(err, IsNil)
+	var reasons []string
+	for _, event := range events.Events {
+		reasons = append(reasons, event.Reason)
+	}
+	c.Assert(strings.Join(reasons, ","), Matches, ".*,Replaced,.*,Exited,RolledBack,Started,.*,Running")
+
+	// The ports of the replacement are released and the ports of the original are handed over
+	pool := pm.PortPoolStatus()
+	c.Assert(pool.UsedPorts, Equals, int32(1))
+	c.Assert(pool.UsedRanges[0].ProcessUUID, Equals, rollback.UUID)
+
+	// Unless it is required to be ready, the replacement still starting after the timeout takes over
+	pm.HealthChecker = &blockingHealthChecker{ready: make(chan struct{})}
+	resp, err = pm.ProcessReplaceWithOptions(ctx, replaceReq, ReplaceOptions{ReadyTimeout: 500 * time.Millisecond})
+	c.Assert(err, IsNil)
+	<-cmdCh
+	c.Assert(resp.Spec.Binary, Equals, TestBinaryReplace)
+	c.Assert(resp.Status.State, Equals, types.ProcessStateStarting)
+	c.Assert(pm.findProcess(name).UUID, Not(Equals), rollback.UUID)
+
+	assertProcessDeletion(c, pm, name)
+}
+
+func (s *TestSuite) TestProcessHandover(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logDir := c.MkDir()
+	pm, err := NewManager(ctx, "10000-10100", logDir, ManagerConfig{})
+	c.Assert(err, IsNil)
+	c.Assert(pm.Handover(), NotNil)
+
+	pm, err = NewManager(ctx, "10000-10100", logDir, ManagerConfig{Handover: true})
+	c.Assert(err, IsNil)
+	pm.HealthChecker = &MockHealthChecker{}
+
+	name := "test_process_handover"
+	_, err = pm.ProcessCreate(context.TODO(), &rpc.ProcessCreateRequest{
+		Spec: &rpc.ProcessSpec{
+			Name:      name,
+			Binary:    "sleep",
+			Args:      []string{"1000"},
+			PortCount: 1,
+		},
+	})
+	c.Assert(err, IsNil)
+	running, err := waitForProcessState(pm, name, func(process *rpc.ProcessResponse) bool {
+		return process.Status.State == types.ProcessStateRunning
+	})
+	c.Assert(err, IsNil)
+	c.Assert(running, Equals, true)
+
+	// The detached process leads its own session
+	p := pm.findProcess(name)
+	pid := p.Pid()
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	c.Assert(err, IsNil)
+	// The fields after the command are the state, ppid, pgrp and session
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	c.Assert(fields[3], Equals, strconv.Itoa(pid))
+	c.Assert(pm.Handover(), IsNil)
+
+	// The next manager adopts the process by PID and port, and verifies its binary for the restarts
+	sleepBinary, err := exec.LookPath("sleep")
+	c.Assert(err, IsNil)
+	sleepBinary, err = filepath.EvalSymlinks(sleepBinary)
+	c.Assert(err, IsNil)
+	adoptingPM, err := NewManager(ctx, "10000-10100", logDir, ManagerConfig{
+		Handover:     true,
+		BinaryPolicy: &BinaryPolicy{AllowedDirs: []string{filepath.Dir(sleepBinary)}},
+	})
+	c.Assert(err, IsNil)
+	adoptingPM.HealthChecker = &MockHealthChecker{}
+	adopted := adoptingPM.findProcess(name)
+	c.Assert(adopted, NotNil)
+	c.Assert(adopted.Pid(), Equals, pid)
+	c.Assert(adopted.PortStart, Equals, p.PortStart)
+	c.Assert(adopted.detached, Equals, true)
+	c.Assert(adopted.binaryFile, NotNil)
+	c.Assert(adopted.Conditions[types.ProcessConditionBinaryDenied], Equals, false)
+
+	// A process whose binary is no longer allowed keeps running, but is never restarted
+	c.Assert(adoptingPM.Handover(), IsNil)
+	adoptingPM, err = NewManager(ctx, "10000-10100", logDir, ManagerConfig{
+		Handover:     true,
+		BinaryPolicy: &BinaryPolicy{AllowedDirs: []string{c.MkDir()}},
+	})
+	c.Assert(err, IsNil)
+	adoptingPM.HealthChecker = &MockHealthChecker{}
+	adopted = adoptingPM.findProcess(name)
+	c.Assert(adopted, NotNil)
+	c.Assert(adopted.Pid(), Equals, pid)
+	c.Assert(adopted.binaryFile, IsNil)
+	c.Assert(adopted.Conditions[types.ProcessConditionBinaryDenied], Equals, true)
+	adopted.lock.Lock()
+	c.Assert(adopted.needRestart(fmt.Errorf("exit status 1")), Equals, false)
+	adopted.lock.Unlock()
+
+	assertProcessDeletion(c, adoptingPM, name)
+	deleted, err := waitForProcessListState(adoptingPM, func(processes map[string]*rpc.ProcessResponse) bool {
+		_, exists := processes[name]
+		return !exists
+	})
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, true)
+}
+
+func (s *TestSuite) TestPortPool(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewManager(ctx, "10000-10009", c.MkDir(), ManagerConfig{})
+	c.Assert(err, IsNil)
+
+	start1, end1, err := pm.allocatePorts("uuid-1", "process-1", 3)
+	c.Assert(err, IsNil)
+	start2, end2, err := pm.allocatePorts("uuid-2", "process-2", 2)
+	c.Assert(err, IsNil)
+	_, _, err = pm.allocatePorts("uuid-3", "process-3", 6)
+	c.Assert(err, ErrorMatches, ".*5 of 10 ports are free.*")
+
+	// Only the owner can release its ports
+	c.Assert(pm.releasePorts("uuid-2", start1, end1), NotNil)
+	c.Assert(pm.releasePorts("uuid-3", start1, end1), NotNil)
+
+	pool := pm.PortPoolStatus()
+	c.Assert(pool.UsedPorts, Equals, int32(5))
+	c.Assert(pool.FreePorts, Equals, int32(5))
+	c.Assert(pool.UsedRanges, DeepEquals, []PortRange{
+		{Start: start1, End: end1, ProcessName: "process-1", ProcessUUID: "uuid-1"},
+		{Start: start2, End: end2, ProcessName: "process-2", ProcessUUID: "uuid-2"},
+	})
+	c.Assert(pool.FreeRanges, DeepEquals, []PortRange{{Start: 10005, End: 10009}})
+
+	c.Assert(pm.releasePorts("uuid-1", start1, end1), IsNil)
+	pool = pm.PortPoolStatus()
+	c.Assert(pool.FreeRanges, DeepEquals, []PortRange{{Start: 10000, End: 10002}, {Start: 10005, End: 10009}})
+
+	// Neither process is registered, but only the allocation past the grace period has leaked
+	c.Assert(pm.PortPoolReconcile(), HasLen, 0)
+	// The pending allocation of a replacement is kept however long it waits
+	pm.setPortsPending("uuid-2", true)
+	pm.portAllocations["uuid-2"].allocatedAt = time.Now().Add(-PortReconcileGracePeriod)
+	c.Assert(pm.PortPoolReconcile(), HasLen, 0)
+	pm.setPortsPending("uuid-2", false)
+	pm.portAllocations["uuid-2"].allocatedAt = time.Now().Add(-PortReconcileGracePeriod)
+	c.Assert(pm.PortPoolReconcile(), DeepEquals, []PortRange{
+		{Start: start2, End: end2, ProcessName: "process-2", ProcessUUID: "uuid-2"},
+	})
+	c.Assert(pm.PortPoolStatus().FreePorts, Equals, int32(10))
+
+	start, end, err := pm.allocatePorts("uuid-3", "process-3", 10)
+	c.Assert(err, IsNil)
+	c.Assert(pm.releasePorts("uuid-3", start, end), IsNil)
+}
+
+func (s *TestSuite) TestPortQuarantine(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewManager(ctx, "10100-10104", c.MkDir(), ManagerConfig{PortProbeHost: "127.0.0.1"})
+	c.Assert(err, IsNil)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:10101")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+
+	// The port in use is skipped and quarantined
+	start, end, err := pm.allocatePorts("uuid-1", "process-1", 2)
+	c.Assert(err, IsNil)
+	c.Assert(start, Equals, int32(10102))
+	c.Assert(end, Equals, int32(10103))
+
+	pool := pm.PortPoolStatus()
+	c.Assert(pool.QuarantinedPorts, DeepEquals, []int32{10101})
+	c.Assert(pool.FreePorts, Equals, int32(2))
+	c.Assert(pool.FreeRanges, DeepEquals, []PortRange{{Start: 10100, End: 10100}, {Start: 10104, End: 10104}})
+
+	_, _, err = pm.allocatePorts("uuid-2", "process-2", 2)
+	c.Assert(err, NotNil)
+
+	// The port is returned to the pool once it is free again
+	pm.PortPoolReconcile()
+	c.Assert(pm.PortPoolStatus().QuarantinedPorts, HasLen, 1)
+	c.Assert(listener.Close(), IsNil)
+	pm.PortPoolReconcile()
+	c.Assert(pm.PortPoolStatus().QuarantinedPorts, HasLen, 0)
+
+	start, end, err = pm.allocatePorts("uuid-2", "process-2", 2)
+	c.Assert(err, IsNil)
+	c.Assert(start, Equals, int32(10100))
+	c.Assert(end, Equals, int32(10101))
+
+	// An exhausted pool re-probes the quarantined ports right away
+	listener, err = net.Listen("tcp", "127.0.0.1:10104")
+	c.Assert(err, IsNil)
+	_, _, err = pm.allocatePorts("uuid-3", "process-3", 1)
+	c.Assert(err, NotNil)
+	c.Assert(pm.PortPoolStatus().QuarantinedPorts, DeepEquals, []int32{10104})
+	c.Assert(listener.Close(), IsNil)
+	start, _, err = pm.allocatePorts("uuid-3", "process-3", 1)
+	c.Assert(err, IsNil)
+	c.Assert(start, Equals, int32(10104))
+
+	resp, err := pm.PortPoolGet(ctx, &emptypb.Empty{})
+	c.Assert(err, IsNil)
+	c.Assert(resp.FreePorts, Equals, int32(0))
+	c.Assert(resp.QuarantinedPorts, HasLen, 0)
+	c.Assert(resp.UsedRanges, HasLen, 3)
+	c.Assert(resp.UsedRanges[0].ProcessUuid, Equals, "uuid-2")
+}
+
+func (s *TestSuite) TestProcessOptions(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logDir := c.MkDir()
+	pm, err := NewManager(ctx, "10200-10210", logDir, ManagerConfig{})
+	c.Assert(err, IsNil)
+	pm.HealthChecker = &MockHealthChecker{}
+
+	name := "test_process_options"
+	spec := &rpc.ProcessSpec{
+		Name:   name,
+		Binary: "sh",
+		Args:   []string{"-c", "echo \"env=$TEST_PROCESS_ENV home=$HOME dir=$(pwd)\"; exec sleep 1000"},
+	}
+	uid := uint32(1000)
+	_, err = pm.ProcessCreateWithOptions(context.TODO(), &rpc.ProcessCreateRequest{Spec: spec}, &ProcessOptions{
+		UID:            &uid,
+		DropPrivileges: true,
+	})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	_, err = pm.ProcessCreateWithOptions(context.TODO(), &rpc.ProcessCreateRequest{Spec: spec}, &ProcessOptions{
+		WorkingDir: "relative/dir",
+	})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+
+	workingDir := c.MkDir()
+	_, err = pm.ProcessCreateWithOptions(context.TODO(), &rpc.ProcessCreateRequest{Spec: spec}, &ProcessOptions{
+		Env:        map[string]string{"TEST_PROCESS_ENV": "value"},
+		WorkingDir: workingDir,
+	})
+	c.Assert(err, IsNil)
+
+	// The inherited environment is replaced, so HOME is not set
+	expected := fmt.Sprintf("env=value home= dir=%v\n", workingDir)
+	for i := 0; i < RetryCount; i++ {
+		content, err := os.ReadFile(filepath.Join(logDir, name+".log"))
+		c.Assert(err, IsNil)
+		if string(content) == expected {
+			break
+		}
+		time.Sleep(RetryInterval)
+	}
+	content, err := os.ReadFile(filepath.Join(logDir, name+".log"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, expected)
+
+	assertProcessDeletion(c, pm, name)
+
+	// The options can be set in the spec as well
+	name = "test_process_options_spec"
+	spec = &rpc.ProcessSpec{
+		Name:           name,
+		Binary:         "sh",
+		Args:           []string{"-c", "echo \"env=$TEST_PROCESS_ENV dir=$(pwd)\"; exec sleep 1000"},
+		Uid:            &uid,
+		DropPrivileges: true,
+	}
+	_, err = pm.ProcessCreate(context.TODO(), &rpc.ProcessCreateRequest{Spec: spec})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+
+	spec.Uid = nil
+	spec.DropPrivileges = false
+	spec.Env = map[string]string{"TEST_PROCESS_ENV": "spec"}
+	spec.WorkingDir = workingDir
+	spec.Timeouts = &rpc.ProcessTimeouts{
+		StopEscalation: []*rpc.ProcessStopStep{{Signal: "SIGKILL", DelaySeconds: 1}},
+	}
+	_, err = pm.ProcessCreate(context.TODO(), &rpc.ProcessCreateRequest{Spec: spec})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+
+	spec.Timeouts = &rpc.ProcessTimeouts{
+		ProbeTimeoutSeconds:    3,
+		StartupTimeoutSeconds:  30,
+		StopGracePeriodSeconds: 20,
+		StopEscalation:         []*rpc.ProcessStopStep{{Signal: "SIGTERM", DelaySeconds: 5}},
+	}
+	_, err = pm.ProcessCreate(context.TODO(), &rpc.ProcessCreateRequest{Spec: spec})
+	c.Assert(err, IsNil)
+	timeouts := pm.findProcess(name).Options.timeouts()
+	c.Assert(timeouts.probeTimeout(), Equals, 3*time.Second)
+	c.Assert(timeouts.startupTimeout(), Equals, 30*time.Second)
+	c.Assert(timeouts.stopGracePeriod(), Equals, 20*time.Second)
+	c.Assert(timeouts.stopEscalation(), DeepEquals, []StopStep{{Signal: syscall.SIGTERM, Delay: 5 * time.Second}})
+
+	expected = fmt.Sprintf("env=spec dir=%v\n", workingDir)
+	for i := 0; i < RetryCount; i++ {
+		content, err = os.ReadFile(filepath.Join(logDir, name+".log"))
+		c.Assert(err, IsNil)
+		if string(content) == expected {
+			break
+		}
+		time.Sleep(RetryInterval)
+	}
+	c.Assert(string(content), Equals, expected)
+
+	resp, err := pm.ProcessGet(context.TODO(), &rpc.ProcessGetRequest{Name: name})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Spec.Env, DeepEquals, spec.Env)
+	c.Assert(resp.Spec.WorkingDir, Equals, workingDir)
+	c.Assert(resp.Spec.Timeouts.ProbeTimeoutSeconds, Equals, int64(3))
+	c.Assert(resp.Spec.Timeouts.StartupTimeoutSeconds, Equals, int64(30))
+	c.Assert(resp.Spec.Timeouts.StopGracePeriodSeconds, Equals, int64(20))
+	c.Assert(resp.Spec.Timeouts.StopEscalation, HasLen, 1)
+	c.Assert(resp.Spec.Timeouts.StopEscalation[0].Signal, Equals, "SIGTERM")
+	c.Assert(resp.Spec.Timeouts.StopEscalation[0].DelaySeconds, Equals, int64(5))
+
+	assertProcessDeletion(c, pm, name)
+}
+
+func (s *TestSuite) TestProcessRestartPolicy(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewManager(ctx, "10000-10100", c.MkDir(), ManagerConfig{
+		RestartPolicy:  RestartPolicyOnFailure,
+		MaxRestarts:    1,
+		RestartBackoff: 10 * time.Millisecond,
+	})
+	c.Assert(err, IsNil)
+	cmdCh := make(chan *MockCommand, 10)
+	pm.Executor = &MockExecutor{
+		CreationHook: func(cmd *MockCommand) (*MockCommand, error) {
+			cmdCh <- cmd
+			return cmd, nil
+		},
+	}
+	pm.HealthChecker = &MockHealthChecker{}
+
+	name := "test_process_restart_policy"
+	assertProcessCreation(c, pm, name, TestBinary)
+	cmd := <-cmdCh
+
+	// The first failure triggers a restart
+	cmd.stopCh <- fmt.Errorf("exit status 1")
+	cmd = <-cmdCh
+	restarted, err := waitForProcessState(pm, name, func(process *rpc.ProcessResponse) bool {
+		return process.Status.State == types.ProcessStateRunning
+	})
+	c.Assert(err, IsNil)
+	c.Assert(restarted, Equals, true)
+	resp, err := pm.ProcessGet(ctx, &rpc.ProcessGetRequest{Name: name})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Status.RestartCount, Equals, int32(1))
+	c.Assert(resp.Status.LastExitTime, Not(Equals), "")
+
+	// The max restart count is reached
+	cmd.stopCh <- fmt.Errorf("exit status 1")
+	failed, err := waitForProcessState(pm, name, func(process *rpc.ProcessResponse) bool {
+		return process.Status.State == types.ProcessStateError
+	})
+	c.Assert(err, IsNil)
+	c.Assert(failed, Equals, true)
+	time.Sleep(10 * RetryInterval)
+	c.Assert(cmdCh, HasLen, 0)
+
+	assertProcessDeletion(c, pm, name)
+}
+
+func (s *TestSuite) TestProcessRestartPolicyPerProcess(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewManager(ctx, "10000-10100", c.MkDir(), ManagerConfig{
+		RestartPolicy:  RestartPolicyNever,
+		MaxRestarts:    5,
+		RestartBackoff: 10 * time.Millisecond,
+	})
+	c.Assert(err, IsNil)
+	cmdCh := make(chan *MockCommand, 10)
+	pm.Executor = &MockExecutor{
+		CreationHook: func(cmd *MockCommand) (*MockCommand, error) {
+			cmdCh <- cmd
+			return cmd, nil
+		},
+	}
+	pm.HealthChecker = &MockHealthChecker{}
+
+	spec := createProcessSpec("test_process_restart_policy_invalid", TestBinary)
+	spec.RestartPolicy = "Sometimes"
+	_, err = pm.ProcessCreate(ctx, &rpc.ProcessCreateRequest{Spec: spec})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+
+	// The process overriding the policy is restarted, the one with the default policy is not
+	always := "test_process_restart_policy_always"
+	spec = createProcessSpec(always, TestBinary)
+	spec.RestartPolicy = string(RestartPolicyAlways)
+	maxRestarts := int32(1)
+	spec.MaxRestarts = &maxRestarts
+	resp, err := pm.ProcessCreate(ctx, &rpc.ProcessCreateRequest{Spec: spec})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Spec.RestartPolicy, Equals, string(RestartPolicyAlways))
+	c.Assert(*resp.Spec.MaxRestarts, Equals, int32(1))
+	alwaysCmd := <-cmdCh
+
+	never := "test_process_restart_policy_never"
+	assertProcessCreation(c, pm, never, TestBinary)
+	neverCmd := <-cmdCh
+	c.Assert(pm.findProcess(never).MaxRestarts, Equals, 5)
+
+	alwaysCmd.stopCh <- nil
+	alwaysCmd = <-cmdCh
+	restarted, err := waitForProcessState(pm, always, func(process *rpc.ProcessResponse) bool {
+		return process.Status.State == types.ProcessStateRunning && process.Status.RestartCount == 1
+	})
+	c.Assert(err, IsNil)
+	c.Assert(restarted, Equals, true)
+
+	neverCmd.stopCh <- fmt.Errorf("exit status 1")
+	failed, err := waitForProcessState(pm, never, func(process *rpc.ProcessResponse) bool {
+		return process.Status.State == types.ProcessStateError
+	})
+	c.Assert(err, IsNil)
+	c.Assert(failed, Equals, true)
+
+	// The max restarts of the process are reached
+	alwaysCmd.stopCh <- nil
+	stopped, err := waitForProcessState(pm, always, func(process *rpc.ProcessResponse) bool {
+		return process.Status.State == types.ProcessStateStopped || process.Status.State == types.ProcessStateError
+	})
+	c.Assert(err, IsNil)
+	c.Assert(stopped, Equals, true)
+	time.Sleep(10 * RetryInterval)
+	c.Assert(cmdCh, HasLen, 0)
+
+	assertProcessDeletion(c, pm, always)
+	assertProcessDeletion(c, pm, never)
+}
+
+func (s *TestSuite) TestProcessExitStatus(c *C) {
+	exitCode := exec.Command("sh", "-c", "exit 3").Run()
+	exitSignal := exec.Command("sh", "-c", "kill -TERM $$").Run()
+	exitKilled := exec.Command("sh", "-c", "kill -KILL $$").Run()
+	zero, one := uint64(0), uint64(1)
+
+	testCases := []struct {
+		name     string
+		err      error
+		oomKills *uint64
+		expected ExitStatus
+	}{
+		{"testExited", nil, nil, ExitStatus{Code: 0}},
+		{"testExitCode", exitCode, nil, ExitStatus{Code: 3}},
+		{"testUnknown", ErrUnknownExitStatus, nil, ExitStatus{Code: -1}},
+		{"testSignal", exitSignal, nil, ExitStatus{Code: -1, Signal: syscall.SIGTERM}},
+		{"testKillWithoutCgroup", exitKilled, nil, ExitStatus{Code: -1, Signal: syscall.SIGKILL}},
+		{"testCgroupNoOOM", exitKilled, &zero, ExitStatus{Code: -1, Signal: syscall.SIGKILL}},
+		{"testCgroupOOM", exitCode, &one, ExitStatus{Code: 3, OOMKilled: true}},
+	}
+	for _, tc := range testCases {
+		c.Assert(*newExitStatus(tc.err, tc.oomKills), DeepEquals, tc.expected, Commentf(tc.name))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewManager(ctx, "10000-10100", c.MkDir(), ManagerConfig{})
+	c.Assert(err, IsNil)
+	cmdCh := make(chan *MockCommand, 1)
+	pm.Executor = &MockExecutor{
+		CreationHook: func(cmd *MockCommand) (*MockCommand, error) {
+			cmdCh <- cmd
+			return cmd, nil
+		},
+	}
+	pm.HealthChecker = &MockHealthChecker{}
+
+	name := "test_process_exit_status"
+	assertProcessCreation(c, pm, name, TestBinary)
+	lifecycle, err := pm.ProcessLifecycle(name)
+	c.Assert(err, IsNil)
+	c.Assert(lifecycle.StartTime, NotNil)
+	c.Assert(lifecycle.ReadyTime, NotNil)
+	c.Assert(lifecycle.ExitTime, IsNil)
+	c.Assert(lifecycle.LastExit, IsNil)
+
+	// Without a cgroup, a SIGKILL the process manager hasn't sent is not reported as an OOM kill
+	(<-cmdCh).stopCh <- exitKilled
+	failed, err := waitForProcessState(pm, name, func(process *rpc.ProcessResponse) bool {
+		return process.Status.State == types.ProcessStateError
+	})
+	c.Assert(err, IsNil)
+	c.Assert(failed, Equals, true)
+	lifecycle, err = pm.ProcessLifecycle(name)
+	c.Assert(err, IsNil)
+	c.Assert(lifecycle.ExitTime, NotNil)
+	c.Assert(*lifecycle.LastExit, DeepEquals, ExitStatus{Code: -1, Signal: syscall.SIGKILL})
+	resp, err := pm.ProcessGet(context.Background(), &rpc.ProcessGetRequest{Name: name})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Status.StartTime, Not(Equals), "")
+	c.Assert(resp.Status.LastExitTime, Not(Equals), "")
+	c.Assert(resp.Status.LastExit.Code, Equals, int32(-1))
+	c.Assert(resp.Status.LastExit.Signal, Equals, int32(syscall.SIGKILL))
+	c.Assert(resp.Status.LastExit.OomKilled, Equals, false)
+
+	assertProcessDeletion(c, pm, name)
+}
+
+func (s *TestSuite) TestProcessEvents(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewManager(ctx, "10000-10100", c.MkDir(), ManagerConfig{})
+	c.Assert(err, IsNil)
+	pm.Executor = &MockExecutor{}
+	pm.HealthChecker = &MockHealthChecker{}
+
+	name := "test_process_events"
+	assertProcessCreation(c, pm, name, TestBinary)
+	p := pm.findProcess(name)
+	assertProcessDeletion(c, pm, name)
+	deleted, err := waitForProcessListState(pm, func(processes map[string]*rpc.ProcessResponse) bool {
+		_, exists := processes[name]
+		return !exists
+	})
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, true)
+	_, err = pm.ProcessEvents(context.Background(), &rpc.ProcessEventsRequest{Name: name})
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+
+	var reasons []string
+	for _, event := range p.Events() {
+		reasons = append(reasons, event.Reason)
+	}
+	c.Assert(reasons, DeepEquals, []string{
+		EventReasonCreated,
+		EventReasonPortsAllocated,
+		EventReasonStarted,
+		EventReasonWaitingForRunning,
+		EventReasonRunning,
+		EventReasonSignalSent,
+		EventReasonExited,
+		EventReasonPortsReleased,
+	})
+
+	// Only the latest events are kept
+	recorder := newEventRecorder()
+	for i := 0; i < MaxProcessEvents+10; i++ {
+		recorder.record(EventReasonRestarting, "restart %v", i)
+	}
+	recorder.prepend([]ProcessEvent{{Reason: EventReasonCreated}})
+	events := recorder.list()
+	c.Assert(events, HasLen, MaxProcessEvents)
+	c.Assert(events[0].Message, Equals, "restart 10")
+	c.Assert(events[MaxProcessEvents-1].Message, Equals, fmt.Sprintf("restart %v", MaxProcessEvents+9))
+
+	recorder = newEventRecorder()
+	recorder.record(EventReasonReplaced, "replaced")
+	recorder.prepend([]ProcessEvent{{Reason: EventReasonCreated}})
+	recorder.record(EventReasonRunning, "running")
+	events = recorder.list()
+	c.Assert(events, HasLen, 3)
+	c.Assert(events[0].Reason, Equals, EventReasonCreated)
+	c.Assert(events[2].Reason, Equals, EventReasonRunning)
+}
+
+func (s *TestSuite) TestProcessWatchRevision(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewManager(ctx, "10000-10100", c.MkDir(), ManagerConfig{})
+	c.Assert(err, IsNil)
+	pm.Executor = &MockExecutor{}
+	pm.HealthChecker = &MockHealthChecker{}
+
+	list, err := pm.ProcessList(ctx, &rpc.ProcessListRequest{})
+	c.Assert(err, IsNil)
+	name := "test_process_watch_revision"
+	assertProcessCreation(c, pm, name, TestBinary)
+
+	recv := func(resps chan *rpc.ProcessResponse) *rpc.ProcessResponse {
+		select {
+		case resp := <-resps:
+			return resp
+		case <-time.After(10 * time.Second):
+			c.Fatal("timed out waiting for the process update")
+		}
+		return nil
+	}
+
+	// A watch resumed from the revision of the list gets the updates since
+	watchCtx, watchCancel := context.WithCancel(ctx)
+	pw := &RecordingProcessWatcher{ctx: watchCtx, resps: make(chan *rpc.ProcessResponse)}
+	go pm.ProcessWatch(&rpc.ProcessWatchRequest{SinceRevision: list.Revision}, pw)
+	resp := recv(pw.resps)
+	c.Assert(resp.ResyncRequired, Equals, false)
+	c.Assert(resp.Spec.Name, Equals, name)
+	c.Assert(resp.Revision, Equals, list.Revision+1)
+	c.Assert(recv(pw.resps).Revision, Equals, list.Revision+2)
+	watchCancel()
+
+	// A watch resumed from a revision no longer kept is told to resync, then gets all processes
+	pw = &RecordingProcessWatcher{ctx: ctx, resps: make(chan *rpc.ProcessResponse)}
+	go pm.ProcessWatch(&rpc.ProcessWatchRequest{SinceRevision: 1}, pw)
+	resp = recv(pw.resps)
+	c.Assert(resp.ResyncRequired, Equals, true)
+	c.Assert(resp.Revision, Equals, pm.Revision())
+	resp = recv(pw.resps)
+	c.Assert(resp.ResyncRequired, Equals, false)
+	c.Assert(resp.Spec.Name, Equals, name)
+
+	assertProcessDeletion(c, pm, name)
+}
+
+func (s *TestSuite) TestProcessWatchFilter(c *C) {
+	engine := &rpc.ProcessResponse{Spec: &rpc.ProcessSpec{Name: "pvc-1234-e-0"}}
+	replica := &rpc.ProcessResponse{Spec: &rpc.ProcessSpec{Name: "pvc-1234-r-a1b2c3d4"}}
+	other := &rpc.ProcessResponse{Spec: &rpc.ProcessSpec{Name: "pvc-5678-e-0"}}
+
+	testCases := []struct {
+		name     string
+		filter   ProcessWatchFilter
+		expected []bool
+	}{
+		{"testAll", ProcessWatchFilter{}, []bool{true, true, true}},
+		{"testNames", ProcessWatchFilter{Names: []string{"pvc-1234-e-0", "pvc-5678-e-0"}}, []bool{true, false, true}},
+		{"testNamePrefix", ProcessWatchFilter{NamePrefix: "pvc-1234-"}, []bool{true, true, false}},
+		{"testType", ProcessWatchFilter{Type: types.InstanceTypeReplica}, []bool{false, true, false}},
+		{"testVolumeName", ProcessWatchFilter{VolumeName: "pvc-5678"}, []bool{false, false, true}},
+		{"testCombined", ProcessWatchFilter{Type: types.InstanceTypeEngine, VolumeName: "pvc-1234"}, []bool{true, false, false}},
+	}
+	for _, tc := range testCases {
+		for i, p := range []*rpc.ProcessResponse{engine, replica, other} {
+			c.Assert(tc.filter.Match(p), Equals, tc.expected[i], Commentf("%v: %v", tc.name, p.Spec.Name))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewManager(ctx, "10000-10100", c.MkDir(), ManagerConfig{})
+	c.Assert(err, IsNil)
+	pm.Executor = &MockExecutor{}
+	pm.HealthChecker = &MockHealthChecker{}
+
+	_, err = pm.Watch(ctx, 0, &ProcessWatchFilter{Type: "invalid"})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+
+	events, err := pm.Watch(ctx, 0, &ProcessWatchFilter{NamePrefix: "test_process_watched"})
+	c.Assert(err, IsNil)
+	// The filter is taken from the request of ProcessWatch
+	pw := &RecordingProcessWatcher{ctx: ctx, resps: make(chan *rpc.ProcessResponse, 10)}
+	go pm.ProcessWatch(&rpc.ProcessWatchRequest{SinceRevision: pm.Revision(), Names: []string{"test_process_watched"}}, pw)
+	assertProcessCreation(c, pm, "test_process_ignored", TestBinary)
+	assertProcessCreation(c, pm, "test_process_watched", TestBinary)
+	select {
+	case event := <-events:
+		c.Assert(event.ResyncRequired, Equals, false)
+		c.Assert(event.Item.(*rpc.ProcessResponse).Spec.Name, Equals, "test_process_watched")
+	case <-time.After(10 * time.Second):
+		c.Fatal("timed out waiting for the process update")
+	}
+	select {
+	case resp := <-pw.resps:
+		c.Assert(resp.Spec.Name, Equals, "test_process_watched")
+	case <-time.After(10 * time.Second):
+		c.Fatal("timed out waiting for the process update")
+	}
+	assertProcessDeletion(c, pm, "test_process_ignored")
+	assertProcessDeletion(c, pm, "test_process_watched")
+}
+
+func (s *TestSuite) TestProcessLabels(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewManager(ctx, "10000-10100", c.MkDir(), ManagerConfig{})
+	c.Assert(err, IsNil)
+	pm.Executor = &MockExecutor{}
+	pm.HealthChecker = &MockHealthChecker{}
+
+	// The engine is not named after its volume
+	engine := "test-process-labels-e-0"
+	_, err = pm.ProcessCreateWithOptions(ctx, &rpc.ProcessCreateRequest{Spec: createProcessSpec(engine, TestBinary)},
+		&ProcessOptions{Labels: map[string]string{"longhorn.io/invalid/key": "value"}})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+
+	_, err = pm.Watch(ctx, 0, &ProcessWatchFilter{LabelSelector: "longhorn.io/volume in ("})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	events, err := pm.Watch(ctx, 0, &ProcessWatchFilter{LabelSelector: types.LabelNode + "=node-1"})
+	c.Assert(err, IsNil)
+
+	// The labels are set along with the process
+	spec := createProcessSpec(engine, TestBinary)
+	spec.Labels = map[string]string{types.LabelVolume: "vol-1", types.LabelNode: "node-1"}
+	created, err := pm.ProcessCreate(ctx, &rpc.ProcessCreateRequest{Spec: spec})
+	c.Assert(err, IsNil)
+	c.Assert(created.Spec.Labels, DeepEquals, spec.Labels)
+	assertProcessCreation(c, pm, "test-process-labels-r-0", TestBinary)
+	c.Assert(pm.ProcessSetLabels("test-process-labels-r-0", map[string]string{types.LabelVolume: "vol-1", types.LabelNode: "node-2"}), IsNil)
+
+	_, err = pm.ProcessList(ctx, &rpc.ProcessListRequest{LabelSelector: "longhorn.io/volume in ("})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	for selector, expected := range map[string][]string{
+		"":                           {engine, "test-process-labels-r-0"},
+		types.LabelVolume + "=vol-1": {engine, "test-process-labels-r-0"},
+		types.LabelNode + "!=node-1": {"test-process-labels-r-0"},
+		types.LabelVolume + ",!" + types.LabelOwner: {engine, "test-process-labels-r-0"},
+		types.LabelOwner: {},
+	} {
+		resp, err := pm.ProcessList(ctx, &rpc.ProcessListRequest{LabelSelector: selector})
+		c.Assert(err, IsNil)
+		var names []string
+		for name := range resp.Processes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		c.Assert(len(names), Equals, len(expected), Commentf("selector %q: %v", selector, names))
+		for i := range expected {
+			c.Assert(names[i], Equals, expected[i], Commentf("selector %q", selector))
+		}
+	}
+
+	// The mount check finds the volume by the label
+	volumeNameSHA := sha256.Sum256([]byte("vol-1"))
+	processes := pm.getProcessesToUpdateConditions(map[string]mount.MountPoint{
+		hex.EncodeToString(volumeNameSHA[:]): {Opts: []string{"ro"}},
+	})
+	c.Assert(processes, HasLen, 1)
+	c.Assert(processes[0].Name, Equals, engine)
+
+	// Only the updates of the engine match, including its deletion
+	assertProcessDeletion(c, pm, engine)
+	assertProcessDeletion(c, pm, "test-process-labels-r-0")
+	for deleted := false; !deleted; {
+		select {
+		case event := <-events:
+			resp := event.Item.(*rpc.ProcessResponse)
+			c.Assert(resp.Spec.Name, Equals, engine)
+			deleted = resp.Deleted
+		case <-time.After(30 * time.Second):
+			c.Fatal("timed out waiting for the deletion of the engine")
+		}
+	}
+}
+
+func (s *TestSuite) TestProcessDeleteBatch(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewManager(ctx, "10000-10100", c.MkDir(), ManagerConfig{})
+	c.Assert(err, IsNil)
+	pm.Executor = &MockExecutor{}
+	pm.HealthChecker = &MockHealthChecker{}
+
+	names := []string{"test-process-delete-batch-e-0", "test-process-delete-batch-r-0", "test-process-delete-batch-r-1"}
+	for _, name := range names {
+		_, err = pm.ProcessCreateWithOptions(ctx, &rpc.ProcessCreateRequest{Spec: createProcessSpec(name, TestBinary)},
+			&ProcessOptions{Labels: map[string]string{types.LabelNode: "node-1"}})
+		c.Assert(err, IsNil)
+	}
+	assertProcessCreation(c, pm, "test-process-delete-batch-other", TestBinary)
+
+	// The missing process fails alone
+	resp, err := pm.ProcessDeleteBatch(ctx, &rpc.ProcessDeleteBatchRequest{
+		Names:       []string{names[0], "test-process-delete-batch-missing"},
+		Parallelism: 2,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Results, HasLen, 2)
+	c.Assert(resp.Results[0].Name, Equals, names[0])
+	c.Assert(resp.Results[0].Error, Equals, "")
+	c.Assert(resp.Results[0].Process.Deleted, Equals, true)
+	c.Assert(resp.Results[1].Name, Equals, "test-process-delete-batch-missing")
+	c.Assert(codes.Code(resp.Results[1].ErrorCode), Equals, codes.NotFound)
+	for i := 0; i < RetryCount; i++ {
+		if _, err = pm.ProcessGet(ctx, &rpc.ProcessGetRequest{Name: names[0]}); status.Code(err) == codes.NotFound {
+			break
+		}
+		time.Sleep(RetryInterval)
+	}
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+
+	for _, req := range []*rpc.ProcessDeleteBatchRequest{
+		{},
+		{LabelSelector: " "},
+		{LabelSelector: "longhorn.io/node in ("},
+		{Names: names[1:], LabelSelector: types.LabelNode + "=node-1"},
+	} {
+		_, err = pm.ProcessDeleteBatch(ctx, req)
+		c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	}
+
+	// A process relabeled after it is listed is skipped
+	selector, err := util.ParseLabelSelector(types.LabelNode + "=node-1")
+	c.Assert(err, IsNil)
+	c.Assert(pm.ProcessSetLabels(names[2], map[string]string{types.LabelNode: "node-2"}), IsNil)
+	_, err = pm.deleteSelectedProcess(names[2], selector)
+	c.Assert(status.Code(err), Equals, codes.FailedPrecondition)
+	c.Assert(pm.ProcessSetLabels(names[2], map[string]string{types.LabelNode: "node-1"}), IsNil)
+
+	resp, err = pm.ProcessDeleteBatch(ctx, &rpc.ProcessDeleteBatchRequest{LabelSelector: types.LabelNode + "=node-1"})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Results, HasLen, 2)
+	for i, result := range resp.Results {
+		c.Assert(result.Name, Equals, names[i+1])
+		c.Assert(result.Error, Equals, "")
+		c.Assert(result.Process.Deleted, Equals, true)
+	}
+
+	// The processes without the label are left alone
+	process, err := pm.ProcessGet(ctx, &rpc.ProcessGetRequest{Name: "test-process-delete-batch-other"})
+	c.Assert(err, IsNil)
+	c.Assert(process.Status.State, Equals, types.ProcessStateRunning)
+	assertProcessDeletion(c, pm, "test-process-delete-batch-other")
+}
+
+type livenessHealthChecker struct {
+	MockHealthChecker
+	healthy atomic.Bool
+}
+
+func (c *livenessHealthChecker) IsRunning(address string, probeTimeout time.Duration) bool {
+	return c.healthy.Load()
+}
+
+func (s *TestSuite) TestProcessLiveness(c *C) {
+	_, err := ParseLivenessAction("invalid")
+	c.Assert(err, NotNil)
+
+	for _, action := range []LivenessAction{LivenessActionNone, LivenessActionRestart, LivenessActionError} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		pm, err := NewManager(ctx, "10000-10100", c.MkDir(), ManagerConfig{
+			LivenessFailureThreshold: 2,
+			LivenessAction:           action,
+			RestartBackoff:           10 * time.Millisecond,
+		})
+		c.Assert(err, IsNil)
+		cmdCh := make(chan *MockCommand, 10)
+		pm.Executor = &MockExecutor{
+			CreationHook: func(cmd *MockCommand) (*MockCommand, error) {
+				cmdCh <- cmd
+				return cmd, nil
+			},
+		}
+		healthChecker := &livenessHealthChecker{}
+		healthChecker.healthy.Store(true)
+		pm.HealthChecker = healthChecker
+
+		name := "test_process_liveness"
+		assertProcessCreation(c, pm, name, TestBinary)
+		<-cmdCh
+		pm.probeLiveness()
+		healthy, err := waitForProcessState(pm, name, func(process *rpc.ProcessResponse) bool {
+			return process.Status.Conditions[types.ProcessConditionHealthy]
+		})
+		c.Assert(err, IsNil)
+		c.Assert(healthy, Equals, true, Commentf(string(action)))
+
+		// A single failure is below the threshold
+		healthChecker.healthy.Store(false)
+		pm.probeLiveness()
+		p := pm.findProcess(name)
+		p.lock.RLock()
+		c.Assert(p.Conditions[types.ProcessConditionHealthy], Equals, true, Commentf(string(action)))
+		p.lock.RUnlock()
+
+		pm.probeLiveness()
+		switch action {
+		case LivenessActionNone:
+			unhealthy, err := waitForProcessState(pm, name, func(process *rpc.ProcessResponse) bool {
+				return process.Status.State == types.ProcessStateRunning &&
+					!process.Status.Conditions[types.ProcessConditionHealthy]
+			})
+			c.Assert(err, IsNil)
+			c.Assert(unhealthy, Equals, true)
+			c.Assert(cmdCh, HasLen, 0)
+		case LivenessActionRestart:
+			<-cmdCh
+			healthChecker.healthy.Store(true)
+			restarted, err := waitForProcessState(pm, name, func(process *rpc.ProcessResponse) bool {
+				return process.Status.State == types.ProcessStateRunning
+			})
+			c.Assert(err, IsNil)
+			c.Assert(restarted, Equals, true)
+			p.lock.RLock()
+			c.Assert(p.RestartCount, Equals, 1)
+			_, known := p.Conditions[types.ProcessConditionHealthy]
+			c.Assert(known, Equals, false)
+			p.lock.RUnlock()
+		case LivenessActionError:
+			failed, err := waitForProcessState(pm, name, func(process *rpc.ProcessResponse) bool {
+				return process.Status.State == types.ProcessStateError &&
+					!process.Status.Conditions[types.ProcessConditionHealthy]
+			})
+			c.Assert(err, IsNil)
+			c.Assert(failed, Equals, true)
+			c.Assert(cmdCh, HasLen, 0)
+		}
+
+		assertProcessDeletion(c, pm, name)
+		cancel()
+	}
+}
+
+func (s *TestSuite) TestBinaryPolicy(c *C) {
+	allowedDir := c.MkDir()
+	otherDir := c.MkDir()
+	writeBinary := func(path, content string) {
+		c.Assert(os.WriteFile(path, []byte(content), 0755), IsNil)
+	}
+	allowed := filepath.Join(allowedDir, "longhorn")
+	writeBinary(allowed, "#!/bin/sh\n")
+	outside := filepath.Join(otherDir, "longhorn")
+	writeBinary(outside, "#!/bin/sh\nexit 1\n")
+	escaping := filepath.Join(allowedDir, "escaping")
+	c.Assert(os.Symlink(outside, escaping), IsNil)
+	inside := filepath.Join(otherDir, "inside")
+	c.Assert(os.Symlink(allowed, inside), IsNil)
+	sum := sha256.Sum256([]byte("#!/bin/sh\n"))
+
+	checksumFile := filepath.Join(c.MkDir(), "checksums")
+	c.Assert(os.WriteFile(checksumFile, []byte(fmt.Sprintf("# pinned binaries\n%x  %v\n", sum, allowed)), 0644), IsNil)
+	checksums, err := LoadBinaryChecksums(checksumFile)
+	c.Assert(err, IsNil)
+	c.Assert(checksums, DeepEquals, map[string]string{allowed: hex.EncodeToString(sum[:])})
+	c.Assert(os.WriteFile(checksumFile, []byte("1234  relative/longhorn\n"), 0644), IsNil)
+	_, err = LoadBinaryChecksums(checksumFile)
+	c.Assert(err, NotNil)
+
+	testCases := []struct {
+		name    string
+		policy  *BinaryPolicy
+		binary  string
+		allowed bool
+	}{
+		{"testNoPolicy", nil, outside, true},
+		{"testNoPolicyMissingBinary", nil, TestBinaryMissing, true},
+		{"testAllowedDir", &BinaryPolicy{AllowedDirs: []string{allowedDir}}, allowed, true},
+		{"testOutsideDir", &BinaryPolicy{AllowedDirs: []string{allowedDir}}, outside, false},
+		{"testSymlinkEscape", &BinaryPolicy{AllowedDirs: []string{allowedDir}}, escaping, false},
+		{"testSymlinkInside", &BinaryPolicy{AllowedDirs: []string{allowedDir}}, inside, true},
+		{"testMissingBinary", &BinaryPolicy{AllowedDirs: []string{allowedDir}}, filepath.Join(allowedDir, "missing"), false},
+		{"testPinned", &BinaryPolicy{Checksums: checksums}, allowed, true},
+		{"testNotPinned", &BinaryPolicy{Checksums: checksums}, outside, false},
+		{"testChecksumMismatch", &BinaryPolicy{Checksums: map[string]string{outside: hex.EncodeToString(sum[:])}}, outside, false},
+	}
+	for _, tc := range testCases {
+		f, err := tc.policy.Verify(tc.name, tc.binary)
+		if tc.allowed {
+			c.Assert(err, IsNil, Commentf(tc.name))
+			if tc.policy != nil {
+				c.Assert(f, NotNil, Commentf(tc.name))
+				c.Assert(f.Close(), IsNil)
+			}
+		} else {
+			c.Assert(status.Code(err), Equals, codes.PermissionDenied, Commentf(tc.name))
+		}
+	}
+
+	// A modified binary no longer matches its pinned checksum
+	policy := &BinaryPolicy{AllowedDirs: []string{allowedDir}, Checksums: checksums}
+	f, err := policy.Verify("test_process_binary_policy", allowed)
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+	writeBinary(allowed, "#!/bin/sh\nexit 2\n")
+	_, err = policy.Verify("test_process_binary_policy", allowed)
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+
+	// A binary swapped for one of the same size, with its modification time set back, is hashed again
+	writeBinary(allowed, "#!/bin/sh\n")
+	info, err := os.Stat(allowed)
+	c.Assert(err, IsNil)
+	f, err = policy.Verify("test_process_binary_policy", allowed)
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+	// Let the change time move on past its granularity
+	time.Sleep(50 * time.Millisecond)
+	writeBinary(allowed, "#!/bin/ls\n")
+	c.Assert(os.Chtimes(allowed, info.ModTime(), info.ModTime()), IsNil)
+	_, err = policy.Verify("test_process_binary_policy", allowed)
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewManager(ctx, "10000-10100", c.MkDir(), ManagerConfig{BinaryPolicy: policy})
+	c.Assert(err, IsNil)
+	pm.Executor = &MockExecutor{}
+	pm.HealthChecker = &MockHealthChecker{}
+
+	_, err = pm.ProcessCreate(ctx, &rpc.ProcessCreateRequest{Spec: createProcessSpec("test_process_binary_policy", outside)})
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+	_, err = pm.ProcessReplace(ctx, &rpc.ProcessReplaceRequest{
+		Spec:            createProcessSpec("test_process_binary_policy", outside),
+		TerminateSignal: "SIGHUP",
+	})
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+	c.Assert(pm.findProcess("test_process_binary_policy"), IsNil)
+
+	// The verified file is executed even if the binary is swapped afterwards
+	trueBinary, err := exec.LookPath("true")
+	c.Assert(err, IsNil)
+	falseBinary, err := exec.LookPath("false")
+	c.Assert(err, IsNil)
+	copyBinary := func(src, dst string) {
+		content, err := os.ReadFile(src)
+		c.Assert(err, IsNil)
+		c.Assert(os.WriteFile(dst+".tmp", content, 0755), IsNil)
+		c.Assert(os.Rename(dst+".tmp", dst), IsNil)
+	}
+	swapped := filepath.Join(allowedDir, "swapped")
+	copyBinary(trueBinary, swapped)
+	policy = &BinaryPolicy{AllowedDirs: []string{allowedDir}}
+	f, err = policy.Verify("test_process_binary_policy", swapped)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	copyBinary(falseBinary, swapped)
+	cmd, err := NewBinaryCommand(swapped)
+	c.Assert(err, IsNil)
+	c.Assert(cmd.Run(), NotNil)
+	cmd, err = NewBinaryCommand(swapped)
+	c.Assert(err, IsNil)
+	cmd.SetBinaryFile(f)
+	c.Assert(cmd.Run(), IsNil)
+	c.Assert(cmd.Args[0], Equals, swapped)
+
+	cmdCh := make(chan *MockCommand, 1)
+	pm.config.BinaryPolicy = policy
+	pm.Executor = &MockExecutor{
+		CreationHook: func(cmd *MockCommand) (*MockCommand, error) {
+			cmdCh <- cmd
+			return cmd, nil
+		},
+	}
+	_, err = pm.ProcessCreate(ctx, &rpc.ProcessCreateRequest{Spec: createProcessSpec("test_process_binary_policy", swapped)})
+	c.Assert(err, IsNil)
+	created := <-cmdCh
+	c.Assert(created.BinaryFile, NotNil)
+	resolved, err := os.Readlink(fdPath(created.BinaryFile))
+	c.Assert(err, IsNil)
+	c.Assert(resolved, Equals, swapped)
+}
+
+func (s *TestSuite) TestProcessSuspend(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewManager(ctx, "10000-10100", c.MkDir(), ManagerConfig{})
+	c.Assert(err, IsNil)
+	cmdCh := make(chan *MockCommand, 1)
+	pm.Executor = &MockExecutor{
+		CreationHook: func(cmd *MockCommand) (*MockCommand, error) {
+			cmdCh <- cmd
+			return cmd, nil
+		},
+	}
+	pm.HealthChecker = &MockHealthChecker{}
+	signals := func(cmd *MockCommand) []syscall.Signal {
+		cmd.RLock()
+		defer cmd.RUnlock()
+		return append([]syscall.Signal{}, cmd.Signals...)
+	}
+
+	err = pm.ProcessSuspend("test_process_missing")
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+
+	name := "test_process_suspend"
+	assertProcessCreation(c, pm, name, TestBinary)
+	cmd := <-cmdCh
+
+	// The process without its own cgroup is suspended by SIGSTOP
+	c.Assert(pm.ProcessSuspend(name), IsNil)
+	c.Assert(pm.ProcessSuspend(name), IsNil)
+	c.Assert(signals(cmd), DeepEquals, []syscall.Signal{syscall.SIGSTOP})
+	suspended, err := waitForProcessState(pm, name, func(process *rpc.ProcessResponse) bool {
+		return process.Status.State == types.ProcessStateRunning &&
+			process.Status.Conditions[types.ProcessConditionSuspended]
+	})
+	c.Assert(err, IsNil)
+	c.Assert(suspended, Equals, true)
+
+	_, err = pm.ProcessReplace(ctx, &rpc.ProcessReplaceRequest{
+		Spec:            createProcessSpec(name, TestBinaryReplace),
+		TerminateSignal: "SIGHUP",
+	})
+	c.Assert(status.Code(err), Equals, codes.FailedPrecondition)
+
+	c.Assert(pm.ProcessResume(name), IsNil)
+	c.Assert(signals(cmd), DeepEquals, []syscall.Signal{syscall.SIGSTOP, syscall.SIGCONT})
+	resumed, err := waitForProcessState(pm, name, func(process *rpc.ProcessResponse) bool {
+		_, exists := process.Status.Conditions[types.ProcessConditionSuspended]
+		return !exists
+	})
+	c.Assert(err, IsNil)
+	c.Assert(resumed, Equals, true)
+
+	// Neither a suspend nor a resume can interleave with a pending suspension
+	p := pm.findProcess(name)
+	p.lock.Lock()
+	p.suspending = true
+	p.lock.Unlock()
+	c.Assert(status.Code(pm.ProcessSuspend(name)), Equals, codes.Aborted)
+	c.Assert(status.Code(pm.ProcessResume(name)), Equals, codes.Aborted)
+	p.lock.Lock()
+	p.suspending = false
+	p.lock.Unlock()
+
+	// The suspended process is resumed before it is stopped
+	c.Assert(pm.ProcessSuspend(name), IsNil)
+	assertProcessDeletion(c, pm, name)
+	c.Assert(signals(cmd), DeepEquals, []syscall.Signal{syscall.SIGSTOP, syscall.SIGCONT, syscall.SIGSTOP, syscall.SIGCONT})
+	c.Assert(p.IsSuspended(), Equals, false)
+}
+
+func (s *TestSuite) TestProcessTimeouts(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewManager(ctx, "10000-10100", c.MkDir(), ManagerConfig{
+		Timeouts: TimeoutOptions{StartupTimeout: 2 * time.Minute, StopGracePeriod: 5 * time.Second},
+	})
+	c.Assert(err, IsNil)
+	cmdCh := make(chan *MockCommand, 1)
+	pm.Executor = &MockExecutor{
+		CreationHook: func(cmd *MockCommand) (*MockCommand, error) {
+			cmd.IgnoredSignals = map[syscall.Signal]bool{syscall.SIGINT: true}
+			cmdCh <- cmd
+			return cmd, nil
+		},
+	}
+	pm.HealthChecker = &MockHealthChecker{}
+
+	_, err = pm.ProcessCreateWithOptions(ctx, &rpc.ProcessCreateRequest{Spec: createProcessSpec("test_process_timeouts", TestBinary)},
+		&ProcessOptions{Timeouts: &TimeoutOptions{StopEscalation: []StopStep{{Signal: syscall.SIGKILL, Delay: time.Second}}}})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+
+	name := "test_process_timeouts"
+	_, err = pm.ProcessCreateWithOptions(ctx, &rpc.ProcessCreateRequest{Spec: createProcessSpec(name, TestBinary)},
+		&ProcessOptions{Timeouts: &TimeoutOptions{StopEscalation: []StopStep{
+			{Signal: syscall.SIGTERM, Delay: 200 * time.Millisecond},
+			{Signal: syscall.SIGQUIT, Delay: time.Minute},
+		}}})
+	c.Assert(err, IsNil)
+	cmd := <-cmdCh
+	running, err := waitForProcessState(pm, name, func(process *rpc.ProcessResponse) bool {
+		return process.Status.State == types.ProcessStateRunning
+	})
+	c.Assert(err, IsNil)
+	c.Assert(running, Equals, true)
+
+	// The unset timeouts are the defaults of the process manager
+	p := pm.findProcess(name)
+	c.Assert(p.Options.Timeouts.StartupTimeout, Equals, 2*time.Minute)
+	c.Assert(p.Options.Timeouts.StopGracePeriod, Equals, 5*time.Second)
+	var messages []string
+	for _, event := range p.Events() {
+		messages = append(messages, event.Message)
+	}
+	c.Assert(strings.Join(messages, "\n"), Matches, "(?s).*waiting up to 2m0s for the health probe.*")
+
+	// The process ignoring SIGINT stops on SIGTERM, long before its grace period
+	start := time.Now()
+	_, err = pm.ProcessDelete(ctx, &rpc.ProcessDeleteRequest{Name: name})
+	c.Assert(err, IsNil)
+	c.Assert(p.waitForStopped(time.Now().Add(10*time.Second)), Equals, true)
+	c.Assert(time.Since(start) < 5*time.Second, Equals, true)
+	cmd.RLock()
+	c.Assert(cmd.StopSignals, DeepEquals, []syscall.Signal{syscall.SIGINT, syscall.SIGTERM})
+	cmd.RUnlock()
+
+	steps, err := ParseStopEscalation("SIGTERM:10s, SIGQUIT:5s")
+	c.Assert(err, IsNil)
+	c.Assert(steps, DeepEquals, []StopStep{{Signal: syscall.SIGTERM, Delay: 10 * time.Second}, {Signal: syscall.SIGQUIT, Delay: 5 * time.Second}})
+	for _, escalation := range []string{"SIGTERM", "SIGKILL:1s", "SIGTERM:soon"} {
+		_, err = ParseStopEscalation(escalation)
+		c.Assert(err, NotNil, Commentf("escalation %q", escalation))
+	}
+}
+
+type blockingHealthChecker struct {
+	MockHealthChecker
+	ready chan struct{}
+}
+
+func (c *blockingHealthChecker) WaitForRunning(address, name string, timeout, probeTimeout time.Duration, stopCh chan struct{}) bool {
+	select {
+	case <-c.ready:
+		return true
+	case <-stopCh:
+		return false
+	}
+}
+
+func (s *TestSuite) TestProcessAdmission(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewManager(ctx, "10000-10100", c.MkDir(), ManagerConfig{
+		Admission: AdmissionLimits{MaxProcesses: 3, MaxEngines: 1},
+	})
+	c.Assert(err, IsNil)
+	pm.Executor = &MockExecutor{}
+	pm.HealthChecker = &MockHealthChecker{}
+
+	assertProcessCreation(c, pm, "pvc-1234-e-0", TestBinary)
+	_, err = pm.ProcessCreate(ctx, &rpc.ProcessCreateRequest{Spec: createProcessSpec("pvc-5678-e-0", TestBinary)})
+	c.Assert(status.Code(err), Equals, codes.ResourceExhausted)
+	assertProcessCreation(c, pm, "pvc-1234-r-1", TestBinary)
+	assertProcessCreation(c, pm, "pvc-1234-r-2", TestBinary)
+	_, err = pm.ProcessCreate(ctx, &rpc.ProcessCreateRequest{Spec: createProcessSpec("pvc-1234-r-3", TestBinary)})
+	c.Assert(status.Code(err), Equals, codes.ResourceExhausted)
+	for _, name := range []string{"pvc-1234-e-0", "pvc-1234-r-1", "pvc-1234-r-2"} {
+		assertProcessDeletion(c, pm, name)
+	}
+
+	// Only one process starts at a time
+	for _, queueTimeout := range []time.Duration{0, 10 * time.Second} {
+		pm, err := NewManager(ctx, "10000-10100", c.MkDir(), ManagerConfig{
+			Admission: AdmissionLimits{MaxStarting: 1, QueueTimeout: queueTimeout},
+		})
+		c.Assert(err, IsNil)
+		pm.Executor = &MockExecutor{}
+		healthChecker := &blockingHealthChecker{ready: make(chan struct{})}
+		pm.HealthChecker = healthChecker
+
+		_, err = pm.ProcessCreate(ctx, &rpc.ProcessCreateRequest{Spec: createProcessSpec("test_process_starting", TestBinary)})
+		c.Assert(err, IsNil)
+
+		if queueTimeout == 0 {
+			_, err = pm.ProcessCreate(ctx, &rpc.ProcessCreateRequest{Spec: createProcessSpec("test_process_rejected", TestBinary)})
+			c.Assert(status.Code(err), Equals, codes.ResourceExhausted)
+			close(healthChecker.ready)
+			assertProcessDeletion(c, pm, "test_process_starting")
+			continue
+		}
+
+		// The queued creation gives up with its context
+		shortCtx, shortCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		_, err = pm.ProcessCreate(shortCtx, &rpc.ProcessCreateRequest{Spec: createProcessSpec("test_process_queued", TestBinary)})
+		shortCancel()
+		c.Assert(status.Code(err), Equals, codes.DeadlineExceeded)
+		c.Assert(pm.findProcess("test_process_queued"), IsNil)
+
+		errCh := make(chan error)
+		go func() {
+			_, err := pm.ProcessCreate(ctx, &rpc.ProcessCreateRequest{Spec: createProcessSpec("test_process_queued", TestBinary)})
+			errCh <- err
+		}()
+		select {
+		case err := <-errCh:
+			c.Fatalf("the creation is not queued: %v", err)
+		case <-time.After(10 * RetryInterval):
+		}
+		c.Assert(pm.findProcess("test_process_queued"), IsNil)
+
+		// The queued creation proceeds once the starting process is running
+		close(healthChecker.ready)
+		select {
+		case err := <-errCh:
+			c.Assert(err, IsNil)
+		case <-time.After(10 * time.Second):
+			c.Fatal("timed out waiting for the queued creation")
+		}
+		running, err := waitForProcessListState(pm, func(processes map[string]*rpc.ProcessResponse) bool {
+			return processes["test_process_starting"].Status.State == types.ProcessStateRunning &&
+				processes["test_process_queued"].Status.State == types.ProcessStateRunning
+		})
+		c.Assert(err, IsNil)
+		c.Assert(running, Equals, true)
+		assertProcessDeletion(c, pm, "test_process_starting")
+		assertProcessDeletion(c, pm, "test_process_queued")
+	}
+
+	// The restarts wait for a start slot too
+	pm, err = NewManager(ctx, "10000-10100", c.MkDir(), ManagerConfig{
+		RestartPolicy:  RestartPolicyAlways,
+		RestartBackoff: 10 * time.Millisecond,
+		Admission:      AdmissionLimits{MaxStarting: 1},
+	})
+	c.Assert(err, IsNil)
+	cmdCh := make(chan *MockCommand, 10)
+	pm.Executor = &MockExecutor{
+		CreationHook: func(cmd *MockCommand) (*MockCommand, error) {
+			cmdCh <- cmd
+			return cmd, nil
+		},
+	}
+	pm.HealthChecker = &MockHealthChecker{}
+	_, err = pm.ProcessCreate(ctx, &rpc.ProcessCreateRequest{Spec: createProcessSpec("test_process_crashing", TestBinary)})
+	c.Assert(err, IsNil)
+	crashing := <-cmdCh
+	running, err := waitForProcessState(pm, "test_process_crashing", func(process *rpc.ProcessResponse) bool {
+		return process.Status.State == types.ProcessStateRunning
+	})
+	c.Assert(err, IsNil)
+	c.Assert(running, Equals, true)
+
+	healthChecker := &blockingHealthChecker{ready: make(chan struct{})}
+	pm.HealthChecker = healthChecker
+	_, err = pm.ProcessCreate(ctx, &rpc.ProcessCreateRequest{Spec: createProcessSpec("test_process_starting", TestBinary)})
+	c.Assert(err, IsNil)
+	<-cmdCh
+
+	crashing.stopCh <- fmt.Errorf("exit status 1")
+	select {
+	case <-cmdCh:
+		c.Fatal("the process is restarted while another one is starting")
+	case <-time.After(10 * RetryInterval):
+	}
+	close(healthChecker.ready)
+	select {
+	case <-cmdCh:
+	case <-time.After(10 * time.Second):
+		c.Fatal("timed out waiting for the restart")
+	}
+	assertProcessDeletion(c, pm, "test_process_crashing")
+	assertProcessDeletion(c, pm, "test_process_starting")
+}
+
+func (s *TestSuite) TestProcessDebugDumpAndCrashReport(c *C) {
+	workingDir := c.MkDir()
+	corePattern := filepath.Join(c.MkDir(), "core_pattern")
+	c.Assert(os.WriteFile(corePattern, []byte("core.%p\n"), 0644), IsNil)
+	defaultCorePatternFile := corePatternFile
+	corePatternFile = corePattern
+	defer func() {
+		corePatternFile = defaultCorePatternFile
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logDir := c.MkDir()
+	pm, err := NewManager(ctx, "10000-10100", logDir, ManagerConfig{CrashLogLines: 2})
+	c.Assert(err, IsNil)
+	cmdCh := make(chan *MockCommand, 1)
+	pm.Executor = &MockExecutor{
+		CreationHook: func(cmd *MockCommand) (*MockCommand, error) {
+			cmdCh <- cmd
+			return cmd, nil
+		},
+	}
+	pm.HealthChecker = &MockHealthChecker{}
+
+	name := "test_process_debug_dump"
+	_, err = pm.ProcessCreateWithOptions(ctx, &rpc.ProcessCreateRequest{Spec: createProcessSpec(name, TestBinary)},
+		&ProcessOptions{WorkingDir: workingDir})
+	c.Assert(err, IsNil)
+	cmd := <-cmdCh
+	running, err := waitForProcessState(pm, name, func(process *rpc.ProcessResponse) bool {
+		return process.Status.State == types.ProcessStateRunning
+	})
+	c.Assert(err, IsNil)
+	c.Assert(running, Equals, true)
+	p := pm.findProcess(name)
+	_, err = p.logger.Write([]byte("before the dump\n"))
+	c.Assert(err, IsNil)
+
+	// The process writes its goroutines once it receives the signal
+	go func() {
+		for i := 0; i < RetryCount; i++ {
+			cmd.RLock()
+			signaled := len(cmd.Signals) != 0
+			cmd.RUnlock()
+			if signaled {
+				_, _ = p.logger.Write([]byte("SIGQUIT: quit\ngoroutine 1 [running]:\n"))
+				return
+			}
+			time.Sleep(RetryInterval)
+		}
+	}()
+	_, err = pm.ProcessDebugDump(ctx, &rpc.ProcessDebugDumpRequest{Name: name, Signal: "SIGKILL"})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	// SIGQUIT is sent if the request doesn't specify a signal
+	resp, err := pm.ProcessDebugDump(ctx, &rpc.ProcessDebugDumpRequest{Name: name})
+	c.Assert(err, IsNil)
+	dump := resp.Path
+	c.Assert(filepath.Dir(dump), Equals, filepath.Join(logDir, DebugDumpDirName, name+"-"+p.UUID))
+	content, err := os.ReadFile(dump)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "SIGQUIT: quit\ngoroutine 1 [running]:\n")
+	cmd.RLock()
+	c.Assert(cmd.Signals, DeepEquals, []syscall.Signal{syscall.SIGQUIT})
+	cmd.RUnlock()
+
+	// The abnormal exit is reported with the last log lines and the core file
+	c.Assert(os.WriteFile(filepath.Join(workingDir, "core.0"), []byte("core"), 0644), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(workingDir, "core.other"), []byte("core"), 0644), IsNil)
+	cmd.stopCh <- fmt.Errorf("exit status 2")
+	reported := false
+	for i := 0; i < RetryCount && !reported; i++ {
+		for _, event := range p.Events() {
+			reported = reported || event.Reason == EventReasonCrashReported
+		}
+		time.Sleep(RetryInterval)
+	}
+	c.Assert(reported, Equals, true)
+
+	crashDir := filepath.Join(logDir, CrashDirName, name+"-"+p.UUID)
+	reports, err := filepath.Glob(filepath.Join(crashDir, "*"+crashReportSuffix))
+	c.Assert(err, IsNil)
+	c.Assert(reports, HasLen, 1)
+	prefix := strings.TrimSuffix(reports[0], crashReportSuffix)
+	content, err = os.ReadFile(prefix + "-log.txt")
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "SIGQUIT: quit\ngoroutine 1 [running]:\n")
+	_, err = os.Stat(prefix + "-core.0")
+	c.Assert(err, IsNil)
+	_, err = os.Stat(filepath.Join(workingDir, "core.other"))
+	c.Assert(err, IsNil)
+
+	// Only the latest reports are kept
+	for i := 0; i < MaxCrashReports+2; i++ {
+		exitTime := time.Now().Add(time.Duration(i) * time.Second)
+		_, err := p.crashReporter.collect(&CrashReport{Name: name, UUID: p.UUID, ExitTime: exitTime}, p.logger)
+		c.Assert(err, IsNil)
+	}
+	reports, err = filepath.Glob(filepath.Join(crashDir, "*"+crashReportSuffix))
+	c.Assert(err, IsNil)
+	c.Assert(reports, HasLen, MaxCrashReports)
+	_, err = os.Stat(prefix + "-core.0")
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *TestSuite) TestProcessScheduling(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nice, oomScoreAdj := 5, 500
+	pm, err := NewManager(ctx, "10000-10100", c.MkDir(), ManagerConfig{
+		Scheduling: SchedulingOptions{Nice: &nice, OOMScoreAdj: &oomScoreAdj},
+	})
+	c.Assert(err, IsNil)
+	pm.HealthChecker = &MockHealthChecker{}
+
+	spec := &rpc.ProcessSpec{
+		Name:      "test_process_scheduling",
+		Binary:    "sleep",
+		Args:      []string{"1000"},
+		PortCount: 1,
+	}
+	invalidPriority := 8
+	_, err = pm.ProcessCreateWithOptions(ctx, &rpc.ProcessCreateRequest{Spec: spec},
+		&ProcessOptions{Scheduling: &SchedulingOptions{IOPriority: &invalidPriority}})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	_, err = pm.ProcessCreateWithOptions(ctx, &rpc.ProcessCreateRequest{Spec: spec},
+		&ProcessOptions{Scheduling: &SchedulingOptions{CPUSet: "3-1"}})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	_, err = pm.ProcessCreate(ctx, &rpc.ProcessCreateRequest{Spec: &rpc.ProcessSpec{
+		Name:       spec.Name,
+		Binary:     spec.Binary,
+		Scheduling: &rpc.ProcessScheduling{IoClass: "Unknown"},
+	}})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	// Settings the instance-manager has no permission for are rejected rather than failing the start
+	lowNice := -5
+	_, err = pm.ProcessCreateWithOptions(ctx, &rpc.ProcessCreateRequest{Spec: &rpc.ProcessSpec{Name: "test_process_scheduling_nice", Binary: "sleep", Args: []string{"1000"}}},
+		&ProcessOptions{Scheduling: &SchedulingOptions{Nice: &lowNice}})
+	if hasCapability(unix.CAP_SYS_NICE) {
+		c.Assert(err, IsNil)
+		assertProcessDeletion(c, pm, "test_process_scheduling_nice")
+	} else {
+		c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	}
+
+	// The options override the daemon defaults field by field
+	ioPriority, processOOMScoreAdj := 6, 800
+	_, err = pm.ProcessCreateWithOptions(ctx, &rpc.ProcessCreateRequest{Spec: spec}, &ProcessOptions{
+		Scheduling: &SchedulingOptions{
+			CPUSet:      "0",
+			IOClass:     IOClassBestEffort,
+			IOPriority:  &ioPriority,
+			OOMScoreAdj: &processOOMScoreAdj,
+		},
+	})
+	c.Assert(err, IsNil)
+	running, err := waitForProcessState(pm, spec.Name, func(process *rpc.ProcessResponse) bool {
+		return process.Status.State == types.ProcessStateRunning
+	})
+	c.Assert(err, IsNil)
+	c.Assert(running, Equals, true)
+
+	applied, err := pm.ProcessScheduling(spec.Name)
+	c.Assert(err, IsNil)
+	c.Assert(applied, DeepEquals, &AppliedScheduling{
+		CPUSet:      "0",
+		Nice:        5,
+		IOClass:     IOClassBestEffort,
+		IOPriority:  6,
+		OOMScoreAdj: 800,
+	})
+	current, err := readScheduling(pm.findProcess(spec.Name).Pid())
+	c.Assert(err, IsNil)
+	c.Assert(current, DeepEquals, applied)
+
+	// The response has both the options and what the kernel took from them
+	process, err := pm.ProcessGet(ctx, &rpc.ProcessGetRequest{Name: spec.Name})
+	c.Assert(err, IsNil)
+	c.Assert(schedulingOptionsFromRPC(process.Spec.Scheduling), DeepEquals, &SchedulingOptions{
+		CPUSet:      "0",
+		Nice:        &nice,
+		IOClass:     IOClassBestEffort,
+		IOPriority:  &ioPriority,
+		OOMScoreAdj: &processOOMScoreAdj,
+	})
+	c.Assert(process.Status.Scheduling.CpuSet, Equals, "0")
+	c.Assert(process.Status.Scheduling.GetNice(), Equals, int32(5))
+	c.Assert(process.Status.Scheduling.IoClass, Equals, string(IOClassBestEffort))
+	c.Assert(process.Status.Scheduling.GetIoPriority(), Equals, int32(6))
+	c.Assert(process.Status.Scheduling.GetOomScoreAdj(), Equals, int32(800))
+
+	assertProcessDeletion(c, pm, spec.Name)
+}
+
+func (s *TestSuite) TestCgroupResourceLimits(c *C) {
+	self, err := getSelfCgroup()
+	if err != nil {
+		c.Skip("cgroup v2 is not available")
+	}
+
+	// Fake the cgroup v2 hierarchy of the instance-manager with regular files
+	mountPoint := c.MkDir()
+	root := filepath.Join(mountPoint, self)
+	c.Assert(os.MkdirAll(root, 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(root, "cgroup.procs"), []byte("1\n"), 0644), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpuset cpu io memory pids\n"), 0644), IsNil)
+
+	m := NewCgroupManager(mountPoint)
+	path, err := m.Create("test_cgroup_process", &ResourceLimits{
+		CPUMax:    "50000 100000",
+		MemoryMax: "1073741824",
+		IOWeight:  200,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(path, Equals, filepath.Join(root, "test_cgroup_process"))
+
+	content, err := os.ReadFile(filepath.Join(root, cgroupSupervisorName, "cgroup.procs"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "1")
+	content, err = os.ReadFile(filepath.Join(root, "cgroup.subtree_control"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "+cpu +memory +io")
+	content, err = os.ReadFile(filepath.Join(path, "cpu.max"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "50000 100000")
+	content, err = os.ReadFile(filepath.Join(path, "io.weight"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "default 200")
+
+	// The process is started in the cgroup by the kernel
+	c.Assert(os.WriteFile(filepath.Join(path, "cgroup.procs"), []byte("1234\n"), 0644), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(path, "cpu.stat"), []byte("usage_usec 1500\nthrottled_usec 20\n"), 0644), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(path, "memory.current"), []byte("4096\n"), 0644), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(path, "memory.events"), []byte("low 0\noom 1\noom_kill 1\n"), 0644), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(path, "io.stat"), []byte("8:0 rbytes=100 wbytes=200 rios=1 wios=2\n8:16 rbytes=10 wbytes=20 rios=3 wios=4\n"), 0644), IsNil)
+
+	usage, err := m.GetUsage(path)
+	c.Assert(err, IsNil)
+	c.Assert(*usage, DeepEquals, ResourceUsage{
+		CPUUsageUsec:      1500,
+		MemoryCurrent:     4096,
+		IOReadBytes:       110,
+		IOWriteBytes:      220,
+		IOReadOps:         4,
+		IOWriteOps:        6,
+		OOMKillCount:      1,
+		ThrottledUsec:     20,
+		NumberOfProcesses: 1,
+	})
+
+	// The fake cgroup reports it is frozen right away
+	c.Assert(os.WriteFile(filepath.Join(path, "cgroup.events"), []byte("populated 1\nfrozen 1\n"), 0644), IsNil)
+	c.Assert(m.Freeze(path, true), IsNil)
+	content, err = os.ReadFile(filepath.Join(path, "cgroup.freeze"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "1")
+
+	// A second manager, e.g. after a restart, finds the existing cgroup
+	p, err := NewCgroupManager(mountPoint).Path("test_cgroup_process")
+	c.Assert(err, IsNil)
+	c.Assert(p, Equals, path)
+
+	// A process without limits still gets its own cgroup
+	path, err = m.Create("test_cgroup_unlimited_process", nil)
+	c.Assert(err, IsNil)
+	_, err = os.Stat(filepath.Join(path, "cpu.max"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// The limits cannot be applied without the process cgroups
+	_, err = NewManager(context.Background(), "1000-2000", c.MkDir(), ManagerConfig{
+		Resources: ResourceLimits{MemoryMax: "1073741824"},
+	})
+	c.Assert(err, ErrorMatches, ".*require process cgroups.*")
+	pm, err := NewManager(context.Background(), "1000-2000", c.MkDir(), ManagerConfig{})
+	c.Assert(err, IsNil)
+	spec := createProcessSpec("test_cgroup_engine", TestBinary)
+	spec.Resources = &rpc.ProcessResources{MemoryMax: "2147483648"}
+	_, err = pm.ProcessCreate(context.Background(), &rpc.ProcessCreateRequest{Spec: spec})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+
+	// The limits of a process override the defaults field by field
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pm, err = NewManager(ctx, "1000-2000", c.MkDir(), ManagerConfig{
+		Cgroups:   true,
+		Resources: ResourceLimits{CPUMax: "50000 100000", MemoryMax: "1073741824"},
+	})
+	c.Assert(err, IsNil)
+	pm.cgroups = m
+	pm.Executor = &MockExecutor{}
+	pm.HealthChecker = &MockHealthChecker{}
+
+	spec.Resources.IoWeight = 500
+	resp, err := pm.ProcessCreate(ctx, &rpc.ProcessCreateRequest{Spec: spec})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Spec.Resources.CpuMax, Equals, "50000 100000")
+	c.Assert(resp.Spec.Resources.MemoryMax, Equals, "2147483648")
+	c.Assert(resp.Spec.Resources.IoWeight, Equals, uint32(500))
+	assertProcessCreation(c, pm, "test_cgroup_replica", TestBinary)
+
+	for name, memoryMax := range map[string]string{"test_cgroup_engine": "2147483648", "test_cgroup_replica": "1073741824"} {
+		content, err = os.ReadFile(filepath.Join(root, pm.findProcess(name).cgroupName(), "memory.max"))
+		c.Assert(err, IsNil)
+		c.Assert(string(content), Equals, memoryMax)
+		assertProcessDeletion(c, pm, name)
+	}
+}
+
+func (s *TestSuite) TestProcessStats(c *C) {
+	sample, err := readStatsSample(os.Getpid())
+	c.Assert(err, IsNil)
+	c.Assert(sample.rssBytes > 0, Equals, true)
+	c.Assert(sample.threads > 0, Equals, true)
+	c.Assert(sample.openFDs > 0, Equals, true)
+
+	now := time.Now()
+	newSample := func(pid int, ago time.Duration, cpuSeconds float64, rssBytes, readBytes uint64) *statsSample {
+		return &statsSample{
+			pid:        pid,
+			timestamp:  now.Add(-ago),
+			cpuSeconds: cpuSeconds,
+			rssBytes:   rssBytes,
+			readBytes:  readBytes,
+			hasIO:      true,
+		}
+	}
+
+	sc := newStatsCollector()
+	// Samples of the process before a restart are dropped
+	sc.add(newSample(1, 30*time.Second, 100, 1000, 1000))
+	// Samples older than the long window are dropped
+	sc.add(newSample(2, 2*time.Minute, 0, 1000, 0))
+	sc.add(newSample(2, 50*time.Second, 10, 100, 1000))
+	sc.add(newSample(2, 10*time.Second, 30, 200, 3000))
+	sc.add(newSample(2, 5*time.Second, 34, 300, 3500))
+	stats := sc.stats("test_process_stats", newSample(2, 0, 35, 400, 4000))
+	c.Assert(stats.PID, Equals, 2)
+	c.Assert(stats.ReadBytes, Equals, uint64(4000))
+
+	c.Assert(stats.Current.RSSBytes, Equals, uint64(400))
+	c.Assert(stats.Current.CPUPercent, Equals, float64(20))
+	c.Assert(stats.Current.ReadBytesPerSecond, Equals, float64(100))
+
+	c.Assert(stats.ShortAverage.RSSBytes, Equals, uint64(300))
+	c.Assert(stats.ShortAverage.CPUPercent, Equals, float64(50))
+	c.Assert(stats.ShortAverage.ReadBytesPerSecond, Equals, float64(100))
+
+	c.Assert(stats.LongAverage.RSSBytes, Equals, uint64(250))
+	c.Assert(stats.LongAverage.CPUPercent, Equals, float64(50))
+	c.Assert(stats.LongAverage.ReadBytesPerSecond, Equals, float64(60))
+
+	// No IO rate is calculated from a sample missing the IO counters, or from counters gone backwards
+	sc = newStatsCollector()
+	sc.add(newSample(3, 10*time.Second, 0, 100, 1000))
+	noIO := newSample(3, 5*time.Second, 1, 100, 0)
+	noIO.hasIO = false
+	stats = sc.stats("test_process_stats", noIO)
+	c.Assert(stats.Current.ReadBytesPerSecond, Equals, float64(0))
+	stats = sc.stats("test_process_stats", newSample(3, 0, 2, 100, 500))
+	c.Assert(stats.Current.ReadBytesPerSecond, Equals, float64(0))
+	c.Assert(stats.LongAverage.ReadBytesPerSecond, Equals, float64(0))
+
+	_, err = s.pm.ProcessStats(context.TODO(), &rpc.ProcessStatsRequest{Name: "test_process_stats_missing"})
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+}
+
 func assertProcessReplace(c *C, pm *Manager, name, binary string) {
 	replaceReq := &rpc.ProcessReplaceRequest{
 		Spec:            createProcessSpec(name, binary),
@@ -0,0 +1,209 @@
+package process
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	rpc "github.com/longhorn/types/pkg/generated/imrpc"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/types"
+)
+
+const (
+	ReplaceCheckInterval = 100 * time.Millisecond
+)
+
+// ReplaceTerminateSignals are the signals a process can be terminated with once its replacement is running.
+var ReplaceTerminateSignals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+// ReplaceOptions control how ProcessReplaceWithOptions switches to the replacement process.
+type ReplaceOptions struct {
+	// ReadyTimeout is how long the replacement has to be running before the replace goes ahead
+	// anyway, or fails if RequireReady is set. It is the startup timeout of the replacement if 0.
+	// The replace waits for it, so it is shorter than the timeout of the gRPC clients.
+	ReadyTimeout time.Duration
+	// RequireReady fails the replace if the replacement is still starting after ReadyTimeout.
+	RequireReady bool
+	// ObservationWindow is how long the replacement is watched in the background after the replaced
+	// process is terminated. If the replacement exits in the meantime, the replaced process is
+	// relaunched with its binary on its ports and the RolledBack condition. 0 disables the rollback.
+	ObservationWindow time.Duration
+}
+
+func (o ReplaceOptions) Validate() error {
+	if o.ReadyTimeout < 0 || o.ReadyTimeout >= types.GRPCServiceTimeout {
+		return fmt.Errorf("ready timeout %v is not in the range [0, %v)", o.ReadyTimeout, types.GRPCServiceTimeout)
+	}
+	// The ports of the replaced process are only held until the port reconciliation takes them
+	if o.ObservationWindow < 0 || o.ObservationWindow > PortReconcileGracePeriod {
+		return fmt.Errorf("observation window %v is not in the range [0, %v]", o.ObservationWindow, PortReconcileGracePeriod)
+	}
+	return nil
+}
+
+func (o ReplaceOptions) readyTimeout(replacement *Process) time.Duration {
+	if o.ReadyTimeout == 0 {
+		replacement.lock.RLock()
+		defer replacement.lock.RUnlock()
+		return replacement.Options.timeouts().startupTimeout()
+	}
+	return o.ReadyTimeout
+}
+
+// replaceOptionsFromRPC returns the replace options set in the request.
+func replaceOptionsFromRPC(req *rpc.ProcessReplaceRequest) ReplaceOptions {
+	return ReplaceOptions{
+		ReadyTimeout:      time.Duration(req.ReadyTimeoutSeconds) * time.Second,
+		RequireReady:      req.RequireReady,
+		ObservationWindow: time.Duration(req.ObservationWindowSeconds) * time.Second,
+	}
+}
+
+func ParseReplaceTerminateSignal(signal string) (syscall.Signal, error) {
+	if sig, ok := ReplaceTerminateSignals[signal]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("doesn't support terminate signal %v", signal)
+}
+
+// waitForRunning returns false if the process is still starting after the timeout, or an error
+// if it is neither starting nor running.
+func (p *Process) waitForRunning(timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		p.lock.RLock()
+		state := p.State
+		p.lock.RUnlock()
+
+		switch state {
+		case StateRunning:
+			return true, nil
+		case StateStarting:
+		default:
+			return false, fmt.Errorf("process %v is in state %v", p.Name, state)
+		}
+		if time.Now().After(deadline) {
+			return false, nil
+		}
+		time.Sleep(ReplaceCheckInterval)
+	}
+}
+
+// exitedSince returns the error message of the process if it exited unexpectedly after the given time.
+func (p *Process) exitedSince(since time.Time) (string, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.stopRequested || p.LastExitTime == nil || p.LastExitTime.Before(since) {
+		return "", false
+	}
+	if p.ErrorMsg == "" {
+		return "exited", true
+	}
+	return p.ErrorMsg, true
+}
+
+// observeReplacement watches the replacement process during the observation window after the
+// replaced process is signalled. If the replacement exits, the replaced process is relaunched. It
+// runs after the replace returns, so the rollback is only reported by the RolledBack condition and
+// event of the relaunched process.
+func (pm *Manager) observeReplacement(p, replaced *Process, switchTime time.Time, opts ReplaceOptions) {
+	deadline := switchTime.Add(opts.ObservationWindow)
+	for time.Now().Before(deadline) {
+		time.Sleep(ReplaceCheckInterval)
+
+		// The replacement has been deleted or replaced in the meantime
+		if current := pm.findProcess(p.Name); current == nil || current.UUID != p.UUID {
+			break
+		}
+		if errorMsg, exited := p.exitedSince(switchTime); exited {
+			if err := pm.rollbackReplacement(p, replaced, errorMsg, opts); err != nil {
+				logrus.WithError(err).Errorf("Process Manager: failed to roll back the replacement of process %v", p.Name)
+			}
+			return
+		}
+	}
+
+	pm.releaseProcessPorts(replaced)
+}
+
+// rollbackReplacement stops the failed replacement process and relaunches the replaced process
+// with its binary on its ports.
+func (pm *Manager) rollbackReplacement(p, replaced *Process, errorMsg string, opts ReplaceOptions) error {
+	logrus.Warnf("Process Manager: replacement process %v with UUID %v failed within %v after the switch: %v, rolling back to binary %v",
+		p.Name, p.UUID, opts.ObservationWindow, errorMsg, replaced.Binary)
+
+	// The binary is verified again, since the file of the replaced process is closed once it stops
+	binaryFile, err := pm.config.BinaryPolicy.Verify(replaced.Name, replaced.Binary)
+	if err != nil {
+		pm.releaseProcessPorts(replaced)
+		return err
+	}
+	// The arguments of the replaced process already contain its ports
+	r, err := pm.newProcess(&rpc.ProcessSpec{
+		Name:      replaced.Name,
+		Binary:    replaced.Binary,
+		Args:      replaced.Args,
+		PortCount: replaced.PortCount,
+	})
+	if err != nil {
+		if binaryFile != nil {
+			binaryFile.Close()
+		}
+		pm.releaseProcessPorts(replaced)
+		return err
+	}
+	r.binaryFile = binaryFile
+	r.PortArgs = replaced.PortArgs
+	r.PortStart, r.PortEnd = replaced.PortStart, replaced.PortEnd
+	r.Options = replaced.Options
+	r.Options.setRestart(r)
+	r.Resources = replaced.Resources
+	r.UpdateCh = pm.processUpdateCh
+	r.Conditions[types.ProcessConditionRolledBack] = true
+	r.events.prepend(p.Events())
+	r.events.record(EventReasonRolledBack, "rolling back from binary %v of process with UUID %v to binary %v since the replacement failed: %v",
+		p.Binary, p.UUID, r.Binary, errorMsg)
+
+	pm.lock.Lock()
+	if existingProcess, exists := pm.processes[p.Name]; !exists || existingProcess.UUID != p.UUID {
+		pm.lock.Unlock()
+		r.closeBinaryFile()
+		if err := r.logger.Close(); err != nil {
+			logrus.WithError(err).Warnf("Process Manager: failed to close process %v logger", r.Name)
+		}
+		pm.releaseProcessPorts(replaced)
+		return status.Errorf(codes.Aborted, "process %v has changed before the rollback of its replacement", p.Name)
+	}
+	if err := pm.transferPorts(replaced.UUID, r.UUID); err != nil {
+		logrus.WithError(err).Errorf("Process Manager: failed to hand the ports of process %v over to its rollback", p.Name)
+	}
+	pm.processes[p.Name] = r
+	pm.lock.Unlock()
+
+	p.Stop()
+	pm.releaseProcessPorts(p)
+
+	// The replaced process may still hold its ports
+	replaced.waitForStopped(time.Now().Add(replaced.stopTimeout()))
+
+	r.UpdateCh <- r
+	if err := r.Start(); err != nil {
+		logrus.WithError(err).Errorf("Process Manager: failed to relaunch process %v with binary %v", r.Name, r.Binary)
+		r.UpdateCh <- r
+		return nil
+	}
+	if running, err := r.waitForRunning(opts.readyTimeout(r)); err != nil || !running {
+		logrus.WithError(err).Warnf("Process Manager: relaunched process %v is not running", r.Name)
+	} else {
+		logrus.Infof("Process Manager: rolled back process %v to binary %v with UUID %v", r.Name, r.Binary, r.UUID)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package process
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/types"
+)
+
+type RestartPolicy string
+
+const (
+	RestartPolicyNever     = RestartPolicy("Never")
+	RestartPolicyOnFailure = RestartPolicy("OnFailure")
+	RestartPolicyAlways    = RestartPolicy("Always")
+
+	DefaultRestartBackoff = 1 * time.Second
+	MaxRestartBackoff     = 5 * time.Minute
+
+	// A process that keeps running for this long is considered healthy again,
+	// so the backoff starts over the next time it exits.
+	RestartBackoffResetInterval = 10 * time.Minute
+)
+
+func ParseRestartPolicy(policy string) (RestartPolicy, error) {
+	switch RestartPolicy(policy) {
+	case RestartPolicyNever, RestartPolicyOnFailure, RestartPolicyAlways:
+		return RestartPolicy(policy), nil
+	case "":
+		return RestartPolicyNever, nil
+	}
+	return "", fmt.Errorf("invalid restart policy %v", policy)
+}
+
+func (o *ProcessOptions) validateRestart() error {
+	if o.RestartPolicy != "" {
+		if _, err := ParseRestartPolicy(string(o.RestartPolicy)); err != nil {
+			return err
+		}
+	}
+	if o.MaxRestarts != nil && *o.MaxRestarts < 0 {
+		return fmt.Errorf("invalid max restarts %v", *o.MaxRestarts)
+	}
+	if o.RestartBackoff < 0 {
+		return fmt.Errorf("invalid restart backoff %v", o.RestartBackoff)
+	}
+	return nil
+}
+
+// setRestart overrides the restart policy, max restarts and restart backoff of the process
+// by the ones set in the options.
+func (o *ProcessOptions) setRestart(p *Process) {
+	if o == nil {
+		return
+	}
+	if o.RestartPolicy != "" {
+		p.RestartPolicy = o.RestartPolicy
+	}
+	if o.MaxRestarts != nil {
+		p.MaxRestarts = *o.MaxRestarts
+	}
+	if o.RestartBackoff != 0 {
+		p.RestartBackoff = o.RestartBackoff
+	}
+}
+
+// needRestart decides whether the process should be restarted after the command exited with
+// the given error. It must be called with the process lock held.
+func (p *Process) needRestart(exitErr error) bool {
+	if p.stopRequested {
+		return false
+	}
+	if p.Conditions[types.ProcessConditionBinaryDenied] {
+		logrus.Warnf("Process Manager: will not restart process %v since its binary %v is not allowed", p.Name, p.Binary)
+		return false
+	}
+
+	switch p.unhealthyAction {
+	case LivenessActionError:
+		return false
+	case LivenessActionRestart:
+		// The process has been stopped to be restarted
+	default:
+		switch p.RestartPolicy {
+		case RestartPolicyAlways:
+		case RestartPolicyOnFailure:
+			if exitErr == nil {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+
+	if p.StartTime != nil && time.Since(*p.StartTime) >= RestartBackoffResetInterval {
+		p.consecutiveRestarts = 0
+	}
+	if p.MaxRestarts > 0 && p.consecutiveRestarts >= p.MaxRestarts {
+		logrus.Warnf("Process Manager: process %v has been restarted %v times in a row, will not restart it anymore", p.Name, p.consecutiveRestarts)
+		return false
+	}
+	return true
+}
+
+// restartBackoff returns the delay before the next restart. The delay doubles with
+// every consecutive restart, up to MaxRestartBackoff. It must be called with the process lock held.
+func (p *Process) restartBackoff() time.Duration {
+	backoff := p.RestartBackoff
+	if backoff <= 0 {
+		backoff = DefaultRestartBackoff
+	}
+	for i := 0; i < p.consecutiveRestarts && backoff < MaxRestartBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > MaxRestartBackoff {
+		backoff = MaxRestartBackoff
+	}
+	return backoff
+}
+
+// scheduleRestart restarts the process after the backoff unless it is stopped in the meantime.
+// It must be called with the process lock held.
+func (p *Process) scheduleRestart() {
+	backoff := p.restartBackoff()
+	p.consecutiveRestarts++
+	logrus.Infof("Process Manager: will restart process %v in %v, restart policy %v", p.Name, backoff, p.RestartPolicy)
+
+	time.AfterFunc(backoff, p.restart)
+}
+
+func (p *Process) restart() {
+	releaseStartSlot, ok := p.acquireRestartSlot()
+	if !ok {
+		logrus.Infof("Process Manager: cancelled restarting process %v since it is being stopped", p.Name)
+		return
+	}
+
+	p.lock.Lock()
+	if p.stopRequested {
+		p.lock.Unlock()
+		releaseStartSlot()
+		logrus.Infof("Process Manager: cancelled restarting process %v since it is being stopped", p.Name)
+		return
+	}
+	// The slot is released once the process is running or failed to start, see start
+	p.startSlotRelease = releaseStartSlot
+
+	logrus.Infof("Process Manager: restarting process %v, restart count %v", p.Name, p.RestartCount+1)
+	p.events.record(EventReasonRestarting, "restarting process, restart count %v", p.RestartCount+1)
+	p.RestartCount++
+	p.State = StateStarting
+	p.ErrorMsg = ""
+	p.DeletionTimestamp = nil
+	if err := p.start(); err != nil {
+		logrus.WithError(err).Errorf("Process Manager: failed to restart process %v", p.Name)
+		if p.needRestart(err) {
+			p.scheduleRestart()
+		}
+	}
+	p.lock.Unlock()
+
+	p.UpdateCh <- p
+}
@@ -0,0 +1,465 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	rpc "github.com/longhorn/types/pkg/generated/imrpc"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type IOClass string
+
+const (
+	IOClassNone       = IOClass("None")
+	IOClassRealTime   = IOClass("RealTime")
+	IOClassBestEffort = IOClass("BestEffort")
+	IOClassIdle       = IOClass("Idle")
+
+	MinNice        = -20
+	MaxNice        = 19
+	MaxIOPriority  = 7
+	MinOOMScoreAdj = -1000
+	MaxOOMScoreAdj = 1000
+
+	// See include/uapi/linux/ioprio.h
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+	ioprioDataMask   = 1<<ioprioClassShift - 1
+)
+
+var ioClassValues = map[IOClass]int{
+	IOClassNone:       0,
+	IOClassRealTime:   1,
+	IOClassBestEffort: 2,
+	IOClassIdle:       3,
+}
+
+func ParseIOClass(class string) (IOClass, error) {
+	switch IOClass(class) {
+	case IOClassRealTime, IOClassBestEffort, IOClassIdle:
+		return IOClass(class), nil
+	case "":
+		return "", nil
+	}
+	return "", fmt.Errorf("invalid I/O scheduling class %v", class)
+}
+
+// SchedulingOptions pin a process to CPUs and set its CPU, I/O and OOM priorities. They are
+// applied to all threads of the process right after it starts. Unset fields keep the values inherited from the
+// instance-manager.
+type SchedulingOptions struct {
+	// CPUSet is the list of CPUs the process may run on, e.g. "0-3,8".
+	CPUSet string `json:"cpuSet,omitempty"`
+	// Nice is in the range [-20, 19].
+	Nice *int `json:"nice,omitempty"`
+	// IOClass is the I/O scheduling class. IOPriority in the range [0, 7] is the priority
+	// within the RealTime or BestEffort class, the class defaults to BestEffort if only the
+	// priority is set.
+	IOClass    IOClass `json:"ioClass,omitempty"`
+	IOPriority *int    `json:"ioPriority,omitempty"`
+	// OOMScoreAdj is in the range [-1000, 1000]. -1000 protects the process from the OOM killer.
+	OOMScoreAdj *int `json:"oomScoreAdj,omitempty"`
+}
+
+// AppliedScheduling contains the scheduling settings of a process as read back from the kernel.
+type AppliedScheduling struct {
+	CPUSet      string
+	Nice        int
+	IOClass     IOClass
+	IOPriority  int
+	OOMScoreAdj int
+}
+
+func (s *SchedulingOptions) IsEmpty() bool {
+	return s == nil || (s.CPUSet == "" && s.Nice == nil && s.IOClass == "" && s.IOPriority == nil && s.OOMScoreAdj == nil)
+}
+
+func (s *SchedulingOptions) Validate() error {
+	if s == nil {
+		return nil
+	}
+	if s.CPUSet != "" {
+		if _, err := parseCPUSet(s.CPUSet); err != nil {
+			return err
+		}
+	}
+	if s.Nice != nil && (*s.Nice < MinNice || *s.Nice > MaxNice) {
+		return fmt.Errorf("nice value %v is not in the range [%v, %v]", *s.Nice, MinNice, MaxNice)
+	}
+	if _, err := ParseIOClass(string(s.IOClass)); err != nil {
+		return err
+	}
+	if s.IOPriority != nil {
+		if *s.IOPriority < 0 || *s.IOPriority > MaxIOPriority {
+			return fmt.Errorf("I/O priority %v is not in the range [0, %v]", *s.IOPriority, MaxIOPriority)
+		}
+		if s.IOClass == IOClassIdle {
+			return fmt.Errorf("cannot set an I/O priority with the %v I/O scheduling class", IOClassIdle)
+		}
+	}
+	if s.OOMScoreAdj != nil && (*s.OOMScoreAdj < MinOOMScoreAdj || *s.OOMScoreAdj > MaxOOMScoreAdj) {
+		return fmt.Errorf("oom_score_adj %v is not in the range [%v, %v]", *s.OOMScoreAdj, MinOOMScoreAdj, MaxOOMScoreAdj)
+	}
+	return nil
+}
+
+// withDefaults returns the options with the unset fields taken from the defaults.
+func (s *SchedulingOptions) withDefaults(defaults *SchedulingOptions) *SchedulingOptions {
+	if s == nil {
+		return defaults
+	}
+	if defaults == nil {
+		return s
+	}
+	merged := *s
+	if merged.CPUSet == "" {
+		merged.CPUSet = defaults.CPUSet
+	}
+	if merged.Nice == nil {
+		merged.Nice = defaults.Nice
+	}
+	// The I/O class and priority go together
+	if merged.IOClass == "" && merged.IOPriority == nil {
+		merged.IOClass = defaults.IOClass
+		merged.IOPriority = defaults.IOPriority
+	}
+	if merged.OOMScoreAdj == nil {
+		merged.OOMScoreAdj = defaults.OOMScoreAdj
+	}
+	return &merged
+}
+
+// RPC returns the scheduling options set in a process spec, nil if none is set.
+func (s *SchedulingOptions) RPC() *rpc.ProcessScheduling {
+	if s.IsEmpty() {
+		return nil
+	}
+	int32Ptr := func(value *int) *int32 {
+		if value == nil {
+			return nil
+		}
+		v := int32(*value)
+		return &v
+	}
+	return &rpc.ProcessScheduling{
+		CpuSet:      s.CPUSet,
+		Nice:        int32Ptr(s.Nice),
+		IoClass:     string(s.IOClass),
+		IoPriority:  int32Ptr(s.IOPriority),
+		OomScoreAdj: int32Ptr(s.OOMScoreAdj),
+	}
+}
+
+// schedulingOptionsFromRPC returns the scheduling options of a process spec, nil if none is set.
+func schedulingOptionsFromRPC(scheduling *rpc.ProcessScheduling) *SchedulingOptions {
+	if scheduling == nil {
+		return nil
+	}
+	intPtr := func(value *int32) *int {
+		if value == nil {
+			return nil
+		}
+		v := int(*value)
+		return &v
+	}
+	s := &SchedulingOptions{
+		CPUSet:      scheduling.CpuSet,
+		Nice:        intPtr(scheduling.Nice),
+		IOClass:     IOClass(scheduling.IoClass),
+		IOPriority:  intPtr(scheduling.IoPriority),
+		OOMScoreAdj: intPtr(scheduling.OomScoreAdj),
+	}
+	if s.IsEmpty() {
+		return nil
+	}
+	return s
+}
+
+// RPC returns the applied scheduling in the status of a process.
+func (a *AppliedScheduling) RPC() *rpc.ProcessScheduling {
+	if a == nil {
+		return nil
+	}
+	nice, ioPriority, oomScoreAdj := int32(a.Nice), int32(a.IOPriority), int32(a.OOMScoreAdj)
+	return &rpc.ProcessScheduling{
+		CpuSet:      a.CPUSet,
+		Nice:        &nice,
+		IoClass:     string(a.IOClass),
+		IoPriority:  &ioPriority,
+		OomScoreAdj: &oomScoreAdj,
+	}
+}
+
+// applyScheduling applies the options to every thread of the process with the given PID. The CPU
+// affinity, nice value and I/O priority are per thread and a new thread inherits them from the one
+// creating it, so the threads are listed again until there is no new one: from then on, every
+// thread is created by a thread that has the options applied.
+func applyScheduling(pid int, s *SchedulingOptions) error {
+	applied := map[int]bool{}
+	for {
+		tids, err := listThreads(pid)
+		if err != nil {
+			return err
+		}
+		newThreads := false
+		for _, tid := range tids {
+			if applied[tid] {
+				continue
+			}
+			newThreads = true
+			// A thread that exits in the meantime needs nothing
+			if err := applyThreadScheduling(tid, s); err != nil && !errors.Is(err, unix.ESRCH) {
+				return errors.Wrapf(err, "failed to apply the scheduling to PID %v", pid)
+			}
+			applied[tid] = true
+		}
+		if !newThreads {
+			break
+		}
+	}
+
+	// Unlike the others, oom_score_adj is shared by all threads of the process
+	if s.OOMScoreAdj != nil {
+		path := filepath.Join("/proc", strconv.Itoa(pid), "oom_score_adj")
+		if err := os.WriteFile(path, []byte(strconv.Itoa(*s.OOMScoreAdj)), 0644); err != nil {
+			return errors.Wrapf(err, "failed to set the oom_score_adj of PID %v to %v", pid, *s.OOMScoreAdj)
+		}
+	}
+	return nil
+}
+
+// applyThreadScheduling applies the CPU affinity, nice value and I/O priority to the thread with
+// the given TID.
+func applyThreadScheduling(tid int, s *SchedulingOptions) error {
+	if s.CPUSet != "" {
+		set, err := parseCPUSet(s.CPUSet)
+		if err != nil {
+			return err
+		}
+		if err := unix.SchedSetaffinity(tid, set); err != nil {
+			return errors.Wrapf(err, "failed to set the CPU affinity of TID %v to %v", tid, s.CPUSet)
+		}
+	}
+	if s.Nice != nil {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, tid, *s.Nice); err != nil {
+			return errors.Wrapf(err, "failed to set the nice value of TID %v to %v", tid, *s.Nice)
+		}
+	}
+	if s.IOClass != "" || s.IOPriority != nil {
+		class, priority := s.ioPriority()
+		ioprio := ioClassValues[class]<<ioprioClassShift | priority
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(ioprio)); errno != 0 {
+			return errors.Wrapf(errno, "failed to set the I/O priority of TID %v to %v/%v", tid, class, priority)
+		}
+	}
+	return nil
+}
+
+// ioPriority returns the I/O scheduling class and the priority within it.
+func (s *SchedulingOptions) ioPriority() (IOClass, int) {
+	class, priority := s.IOClass, 0
+	if class == "" {
+		class = IOClassBestEffort
+	}
+	if s.IOPriority != nil {
+		priority = *s.IOPriority
+	}
+	return class, priority
+}
+
+func listThreads(pid int) ([]int, error) {
+	entries, err := os.ReadDir(filepath.Join("/proc", strconv.Itoa(pid), "task"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list the threads of PID %v", pid)
+	}
+	tids := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		tid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		tids = append(tids, tid)
+	}
+	return tids, nil
+}
+
+// checkPermission returns an error if the instance-manager is not allowed to apply the options to a
+// process running with the given credential, nil meaning the instance-manager user. Otherwise the
+// process would fail right after it starts.
+func (s *SchedulingOptions) checkPermission(credential *syscall.Credential) error {
+	if s.IsEmpty() {
+		return nil
+	}
+	canNice := hasCapability(unix.CAP_SYS_NICE)
+	if credential != nil && int(credential.Uid) != os.Geteuid() && !canNice &&
+		(s.CPUSet != "" || s.Nice != nil || s.IOClass != "" || s.IOPriority != nil) {
+		return fmt.Errorf("setting the scheduling of a process running as uid %v requires CAP_SYS_NICE", credential.Uid)
+	}
+	if s.Nice != nil && !canNice {
+		// The raw value of the syscall is 20 - nice
+		priority, err := unix.Getpriority(unix.PRIO_PROCESS, 0)
+		if err != nil {
+			return errors.Wrap(err, "failed to get the nice value of the instance-manager")
+		}
+		var limit unix.Rlimit
+		if err := unix.Getrlimit(unix.RLIMIT_NICE, &limit); err != nil {
+			return errors.Wrap(err, "failed to get the nice limit of the instance-manager")
+		}
+		if *s.Nice < 20-priority && uint64(20-*s.Nice) > limit.Cur {
+			return fmt.Errorf("lowering the nice value to %v requires CAP_SYS_NICE", *s.Nice)
+		}
+	}
+	if class, _ := s.ioPriority(); (s.IOClass != "" || s.IOPriority != nil) && class == IOClassRealTime &&
+		!canNice && !hasCapability(unix.CAP_SYS_ADMIN) {
+		return fmt.Errorf("the %v I/O scheduling class requires CAP_SYS_NICE or CAP_SYS_ADMIN", IOClassRealTime)
+	}
+	if s.OOMScoreAdj != nil && !hasCapability(unix.CAP_SYS_RESOURCE) {
+		content, err := os.ReadFile("/proc/self/oom_score_adj")
+		if err != nil {
+			return errors.Wrap(err, "failed to get the oom_score_adj of the instance-manager")
+		}
+		current, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil {
+			return errors.Wrap(err, "failed to parse the oom_score_adj of the instance-manager")
+		}
+		if *s.OOMScoreAdj < current {
+			return fmt.Errorf("lowering the oom_score_adj to %v requires CAP_SYS_RESOURCE", *s.OOMScoreAdj)
+		}
+	}
+	return nil
+}
+
+// hasCapability returns if the capability is in the effective set of the instance-manager.
+func hasCapability(capability int) bool {
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{}
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return false
+	}
+	return data[capability/32].Effective&(1<<(uint(capability)%32)) != 0
+}
+
+// readScheduling reads the scheduling settings of the process with the given PID.
+func readScheduling(pid int) (*AppliedScheduling, error) {
+	applied := &AppliedScheduling{}
+
+	set := &unix.CPUSet{}
+	if err := unix.SchedGetaffinity(pid, set); err != nil {
+		return nil, errors.Wrapf(err, "failed to get the CPU affinity of PID %v", pid)
+	}
+	applied.CPUSet = formatCPUSet(set)
+
+	// The raw value of the syscall is 20 - nice, so it is never negative
+	priority, err := unix.Getpriority(unix.PRIO_PROCESS, pid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get the nice value of PID %v", pid)
+	}
+	applied.Nice = 20 - priority
+
+	ioprio, _, errno := unix.Syscall(unix.SYS_IOPRIO_GET, ioprioWhoProcess, uintptr(pid), 0)
+	if errno != 0 {
+		return nil, errors.Wrapf(errno, "failed to get the I/O priority of PID %v", pid)
+	}
+	applied.IOClass = IOClassNone
+	for class, value := range ioClassValues {
+		if int(ioprio>>ioprioClassShift) == value {
+			applied.IOClass = class
+		}
+	}
+	applied.IOPriority = int(ioprio & ioprioDataMask)
+
+	content, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "oom_score_adj"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get the oom_score_adj of PID %v", pid)
+	}
+	if applied.OOMScoreAdj, err = strconv.Atoi(strings.TrimSpace(string(content))); err != nil {
+		return nil, errors.Wrapf(err, "invalid oom_score_adj of PID %v", pid)
+	}
+	return applied, nil
+}
+
+// parseCPUSet parses a CPU list in the format of the cpuset cgroup, e.g. "0-3,8".
+func parseCPUSet(cpus string) (*unix.CPUSet, error) {
+	set := &unix.CPUSet{}
+	maxCPU := len(set) * 64
+	for _, part := range strings.Split(cpus, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU set %v", cpus)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil {
+				return nil, fmt.Errorf("invalid CPU set %v", cpus)
+			}
+		}
+		if start < 0 || end < start || end >= maxCPU {
+			return nil, fmt.Errorf("invalid CPU range %v in CPU set %v", part, cpus)
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			set.Set(cpu)
+		}
+	}
+	return set, nil
+}
+
+func formatCPUSet(set *unix.CPUSet) string {
+	var ranges []string
+	maxCPU := len(set) * 64
+	for cpu := 0; cpu < maxCPU; cpu++ {
+		if !set.IsSet(cpu) {
+			continue
+		}
+		start := cpu
+		for cpu+1 < maxCPU && set.IsSet(cpu+1) {
+			cpu++
+		}
+		if start == cpu {
+			ranges = append(ranges, strconv.Itoa(start))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%v-%v", start, cpu))
+		}
+	}
+	return strings.Join(ranges, ",")
+}
+
+// setScheduling applies the scheduling options to the started process with the given PID and
+// records the values the kernel actually took.
+func (p *Process) setScheduling(pid int, s *SchedulingOptions) error {
+	if err := applyScheduling(pid, s); err != nil {
+		return err
+	}
+	applied, err := readScheduling(pid)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.appliedScheduling = applied
+	p.events.record(EventReasonSchedulingApplied, "applied CPU set %v, nice %v, I/O priority %v/%v and oom_score_adj %v",
+		applied.CPUSet, applied.Nice, applied.IOClass, applied.IOPriority, applied.OOMScoreAdj)
+	return nil
+}
+
+// ProcessScheduling returns the CPU set, nice value, I/O priority and oom_score_adj applied to the
+// process named by name. It is nil if the process has no scheduling options.
+func (pm *Manager) ProcessScheduling(name string) (*AppliedScheduling, error) {
+	p := pm.findProcess(name)
+	if p == nil {
+		return nil, status.Errorf(codes.NotFound, "cannot find process %v", name)
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.appliedScheduling, nil
+}
@@ -0,0 +1,362 @@
+package process
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	lhBitmap "github.com/longhorn/go-common-libs/bitmap"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/types"
+	"github.com/longhorn/longhorn-instance-manager/pkg/util"
+)
+
+const (
+	StateFileName = "process-manager-state.json"
+)
+
+// processRecord is the journaled form of a Process. It contains everything needed
+// to re-attach to the process after the instance-manager restarts.
+type processRecord struct {
+	Name      string   `json:"name"`
+	Binary    string   `json:"binary"`
+	Args      []string `json:"args"`
+	PortCount int32    `json:"portCount"`
+	PortArgs  []string `json:"portArgs"`
+
+	UUID      string `json:"uuid"`
+	PID       int    `json:"pid"`
+	State     State  `json:"state"`
+	PortStart int32  `json:"portStart"`
+	PortEnd   int32  `json:"portEnd"`
+
+	RestartPolicy  RestartPolicy `json:"restartPolicy"`
+	MaxRestarts    int           `json:"maxRestarts"`
+	RestartBackoff time.Duration `json:"restartBackoff"`
+	RestartCount   int           `json:"restartCount"`
+
+	StartTime    *time.Time  `json:"startTime,omitempty"`
+	ReadyTime    *time.Time  `json:"readyTime,omitempty"`
+	LastExitTime *time.Time  `json:"lastExitTime,omitempty"`
+	LastExit     *ExitStatus `json:"lastExit,omitempty"`
+
+	Options   *ProcessOptions `json:"options,omitempty"`
+	Resources *ResourceLimits `json:"resources,omitempty"`
+
+	Suspended bool `json:"suspended,omitempty"`
+}
+
+func (p *Process) record() *processRecord {
+	pid := p.Pid()
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return &processRecord{
+		Name:      p.Name,
+		Binary:    p.Binary,
+		Args:      p.Args,
+		PortCount: p.PortCount,
+		PortArgs:  p.PortArgs,
+
+		UUID:      p.UUID,
+		PID:       pid,
+		State:     p.State,
+		PortStart: p.PortStart,
+		PortEnd:   p.PortEnd,
+
+		RestartPolicy:  p.RestartPolicy,
+		MaxRestarts:    p.MaxRestarts,
+		RestartBackoff: p.RestartBackoff,
+		RestartCount:   p.RestartCount,
+
+		StartTime:    p.StartTime,
+		ReadyTime:    p.ReadyTime,
+		LastExitTime: p.LastExitTime,
+		LastExit:     p.LastExit,
+
+		Options:   p.Options,
+		Resources: p.Resources,
+
+		Suspended: p.suspended,
+	}
+}
+
+// persistState journals all registered processes to the state file, unless the journal is unchanged,
+// e.g. for the updates of the conditions or resource usage only.
+// The file is replaced atomically so a crash never leaves a partially written journal behind.
+func (pm *Manager) persistState() error {
+	pm.stateLock.Lock()
+	defer pm.stateLock.Unlock()
+
+	pm.lock.RLock()
+	records := make([]*processRecord, 0, len(pm.processes))
+	for _, p := range pm.processes {
+		records = append(records, p.record())
+	}
+	pm.lock.RUnlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Name < records[j].Name
+	})
+
+	content, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return err
+	}
+	if pm.lastState != nil && bytes.Equal(content, pm.lastState) {
+		return nil
+	}
+
+	tmpFile := pm.stateFile + ".tmp"
+	if err := writeFileSync(tmpFile, content); err != nil {
+		return errors.Wrapf(err, "failed to write %v", tmpFile)
+	}
+	if err := os.Rename(tmpFile, pm.stateFile); err != nil {
+		return err
+	}
+	pm.lastState = content
+	return nil
+}
+
+func writeFileSync(path string, content []byte) (err error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	if _, err := file.Write(content); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (pm *Manager) removeState() error {
+	pm.stateLock.Lock()
+	defer pm.stateLock.Unlock()
+
+	pm.lastState = nil
+	if err := os.Remove(pm.stateFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (pm *Manager) loadState() ([]*processRecord, error) {
+	content, err := os.ReadFile(pm.stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var records []*processRecord
+	if err := json.Unmarshal(content, &records); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %v", pm.stateFile)
+	}
+	return records, nil
+}
+
+// Handover journals the processes for the next instance-manager to adopt them, and leaves them
+// running. It is called instead of deleting the processes when the instance-manager shuts down.
+func (pm *Manager) Handover() error {
+	if !pm.config.Handover {
+		return fmt.Errorf("the processes are not detached from the instance-manager, handover mode is disabled")
+	}
+	if err := pm.persistState(); err != nil {
+		return errors.Wrap(err, "failed to persist the process state for the handover")
+	}
+
+	pm.lock.RLock()
+	defer pm.lock.RUnlock()
+	for _, p := range pm.processes {
+		if pid := p.Pid(); pid > 0 {
+			logrus.Infof("Process Manager: handing over process %v with PID %v", p.Name, pid)
+		}
+	}
+	return nil
+}
+
+// restoreState re-attaches to the processes journaled by a previous instance-manager that are
+// still alive, and rebuilds the port bitmap with the ports they hold.
+func (pm *Manager) restoreState() error {
+	records, err := pm.loadState()
+	if err != nil {
+		return err
+	}
+
+	var restored []*Process
+	for _, r := range records {
+		if r.PID <= 0 || r.State == StateStopping || r.State == StateStopped || r.State == StateError {
+			logrus.Infof("Process Manager: skipped re-attaching process %v in state %v", r.Name, r.State)
+			continue
+		}
+
+		logger, err := util.NewLonghornWriter(r.Name, pm.logsDir, pm.config.LogRotation)
+		if err != nil {
+			return err
+		}
+
+		p := &Process{
+			Name:      r.Name,
+			Binary:    r.Binary,
+			Args:      r.Args,
+			PortCount: r.PortCount,
+			PortArgs:  r.PortArgs,
+
+			UUID:      r.UUID,
+			State:     r.State,
+			PortStart: r.PortStart,
+			PortEnd:   r.PortEnd,
+
+			RestartPolicy:  r.RestartPolicy,
+			MaxRestarts:    r.MaxRestarts,
+			RestartBackoff: r.RestartBackoff,
+			RestartCount:   r.RestartCount,
+
+			StartTime:    r.StartTime,
+			ReadyTime:    r.ReadyTime,
+			LastExitTime: r.LastExitTime,
+			LastExit:     r.LastExit,
+
+			Options:   r.Options,
+			Resources: r.Resources,
+
+			Conditions: make(map[string]bool),
+
+			lock:     &sync.RWMutex{},
+			UpdateCh: pm.processUpdateCh,
+
+			logger: logger,
+
+			executor:      pm.Executor,
+			healthChecker: pm.HealthChecker,
+			cgroups:       pm.cgroups,
+			stats:         newStatsCollector(),
+			events:        newEventRecorder(),
+
+			detached:      pm.config.Handover,
+			crashReporter: pm.crashReporter,
+			startSlots:    pm.startSlots,
+		}
+
+		if r.LastExit != nil {
+			p.Conditions[types.ProcessConditionOOMKilled] = r.LastExit.OOMKilled
+		}
+		if r.Suspended {
+			p.suspended = true
+			p.Conditions[types.ProcessConditionSuspended] = true
+		}
+		// The restarts of the process execute the binary, so it is verified like at the creation. The
+		// running process is left alone if it is no longer allowed, but it is never restarted.
+		binaryFile, err := pm.config.BinaryPolicy.Verify(r.Name, r.Binary)
+		if err != nil {
+			p.Conditions[types.ProcessConditionBinaryDenied] = true
+			p.events.record(EventReasonBinaryDenied, "binary %v is no longer allowed, the process will not be restarted: %v", r.Binary, err)
+		}
+		p.binaryFile = binaryFile
+
+		if err := p.Attach(r.PID); err != nil {
+			logrus.WithError(err).Warnf("Process Manager: failed to re-attach process %v with PID %v", r.Name, r.PID)
+			p.closeBinaryFile()
+			if err := logger.Close(); err != nil {
+				logrus.WithError(err).Warnf("Process Manager: failed to close process %v logger", r.Name)
+			}
+			continue
+		}
+		logrus.Infof("Process Manager: re-attached process %v with PID %v", r.Name, r.PID)
+		p.events.record(EventReasonAttached, "re-attached process with PID %v after the instance-manager restarted", r.PID)
+		restored = append(restored, p)
+	}
+
+	bitmap, err := newPortBitmap(pm.portRangeMin, pm.portRangeMax, restored)
+	if err != nil {
+		return err
+	}
+
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.portLock.Lock()
+	defer pm.portLock.Unlock()
+	pm.availablePorts = bitmap
+	for _, p := range restored {
+		pm.processes[p.Name] = p
+		if p.PortStart != 0 || p.PortEnd != 0 {
+			pm.portAllocations[p.UUID] = &portAllocation{
+				name:        p.Name,
+				start:       p.PortStart,
+				end:         p.PortEnd,
+				allocatedAt: time.Now(),
+			}
+		}
+	}
+	pm.updatePortMetrics()
+	return nil
+}
+
+// newPortBitmap creates a bitmap for [start, end] in which the port ranges of the given processes
+// are marked as allocated.
+func newPortBitmap(start, end int32, processes []*Process) (*lhBitmap.Bitmap, error) {
+	bitmap, err := lhBitmap.NewBitmap(start, end)
+	if err != nil {
+		return nil, err
+	}
+	if len(processes) == 0 {
+		return bitmap, nil
+	}
+
+	// The bitmap cannot allocate a specific range, so allocate everything first
+	// then release the gaps between the ranges in use.
+	if _, _, err := bitmap.AllocateRange(end - start + 1); err != nil {
+		return nil, err
+	}
+
+	var used [][2]int32
+	for _, p := range processes {
+		if p.PortStart == 0 && p.PortEnd == 0 {
+			continue
+		}
+		if p.PortStart < start || p.PortEnd > end || p.PortStart > p.PortEnd {
+			return nil, errors.Errorf("ports %v-%v of process %v are out of range %v-%v", p.PortStart, p.PortEnd, p.Name, start, end)
+		}
+		used = append(used, [2]int32{p.PortStart, p.PortEnd})
+	}
+	sort.Slice(used, func(i, j int) bool {
+		return used[i][0] < used[j][0]
+	})
+
+	next := start
+	for _, r := range used {
+		if r[0] > next {
+			if err := bitmap.ReleaseRange(next, r[0]-1); err != nil {
+				return nil, err
+			}
+		}
+		if r[1]+1 > next {
+			next = r[1] + 1
+		}
+	}
+	if next <= end {
+		if err := bitmap.ReleaseRange(next, end); err != nil {
+			return nil, err
+		}
+	}
+	return bitmap, nil
+}
+
+func getStateFilePath(logsDir string) string {
+	return filepath.Join(logsDir, StateFileName)
+}
@@ -0,0 +1,303 @@
+package process
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/procfs"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	rpc "github.com/longhorn/types/pkg/generated/imrpc"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/types"
+	"github.com/longhorn/longhorn-instance-manager/pkg/util"
+)
+
+const (
+	StatsSampleInterval = 2 * time.Second
+
+	StatsShortWindow = 10 * time.Second
+	StatsLongWindow  = 1 * time.Minute
+)
+
+// ResourceStats is the resource usage of a process. Rates are calculated over the
+// period the stats cover, and gauges are averaged over it.
+type ResourceStats struct {
+	CPUPercent               float64 `json:"cpuPercent"`
+	RSSBytes                 uint64  `json:"rssBytes"`
+	VirtualMemoryBytes       uint64  `json:"virtualMemoryBytes"`
+	OpenFDs                  uint64  `json:"openFDs"`
+	Threads                  uint64  `json:"threads"`
+	ReadBytesPerSecond       float64 `json:"readBytesPerSecond"`
+	WriteBytesPerSecond      float64 `json:"writeBytesPerSecond"`
+	ContextSwitchesPerSecond float64 `json:"contextSwitchesPerSecond"`
+}
+
+// ProcessStats contains the current resource usage of a process, and the rolling averages
+// over the last StatsShortWindow and StatsLongWindow.
+type ProcessStats struct {
+	Name      string    `json:"name"`
+	PID       int       `json:"pid"`
+	Timestamp time.Time `json:"timestamp"`
+
+	ReadBytes  uint64 `json:"readBytes"`
+	WriteBytes uint64 `json:"writeBytes"`
+
+	Current      ResourceStats `json:"current"`
+	ShortAverage ResourceStats `json:"shortAverage"`
+	LongAverage  ResourceStats `json:"longAverage"`
+}
+
+// statsSample is a raw reading of /proc/<pid>/stat, status, io and fd.
+type statsSample struct {
+	pid       int
+	timestamp time.Time
+
+	cpuSeconds      float64
+	rssBytes        uint64
+	vmBytes         uint64
+	openFDs         uint64
+	threads         uint64
+	readBytes       uint64
+	writeBytes      uint64
+	contextSwitches uint64
+	// hasIO is false if /proc/<pid>/io could not be read, leaving readBytes and writeBytes unset
+	hasIO bool
+}
+
+func readStatsSample(pid int) (*statsSample, error) {
+	proc, err := procfs.NewProc(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := proc.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read stat of PID %v", pid)
+	}
+	procStatus, err := proc.NewStatus()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read status of PID %v", pid)
+	}
+	fds, err := proc.FileDescriptorsLen()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read file descriptors of PID %v", pid)
+	}
+
+	sample := &statsSample{
+		pid:       pid,
+		timestamp: time.Now(),
+
+		cpuSeconds:      stat.CPUTime(),
+		rssBytes:        procStatus.VmRSS,
+		vmBytes:         uint64(stat.VirtualMemory()),
+		openFDs:         uint64(fds),
+		threads:         uint64(stat.NumThreads),
+		contextSwitches: procStatus.TotalCtxtSwitches(),
+	}
+
+	// /proc/<pid>/io requires ptrace access, so the stats are still useful without it
+	if io, err := proc.IO(); err == nil {
+		sample.readBytes = io.ReadBytes
+		sample.writeBytes = io.WriteBytes
+		sample.hasIO = true
+	} else {
+		logrus.WithError(err).Debugf("Failed to read io of PID %v", pid)
+	}
+
+	return sample, nil
+}
+
+// statsCollector keeps the samples of a process for the last StatsLongWindow.
+type statsCollector struct {
+	lock    *sync.Mutex
+	samples []*statsSample
+}
+
+func newStatsCollector() *statsCollector {
+	return &statsCollector{
+		lock: &sync.Mutex{},
+	}
+}
+
+func (sc *statsCollector) add(sample *statsSample) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	// The process has been restarted, the counters of the old one are meaningless
+	if len(sc.samples) > 0 && sc.samples[len(sc.samples)-1].pid != sample.pid {
+		sc.samples = nil
+	}
+	sc.samples = append(sc.samples, sample)
+
+	expired := 0
+	for expired < len(sc.samples) && sample.timestamp.Sub(sc.samples[expired].timestamp) > StatsLongWindow {
+		expired++
+	}
+	sc.samples = sc.samples[expired:]
+}
+
+// stats adds the latest sample and calculates the stats up to it.
+func (sc *statsCollector) stats(name string, latest *statsSample) *ProcessStats {
+	sc.add(latest)
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	return &ProcessStats{
+		Name:      name,
+		PID:       latest.pid,
+		Timestamp: latest.timestamp,
+
+		ReadBytes:  latest.readBytes,
+		WriteBytes: latest.writeBytes,
+
+		Current:      sc.window(0),
+		ShortAverage: sc.window(StatsShortWindow),
+		LongAverage:  sc.window(StatsLongWindow),
+	}
+}
+
+// window calculates the stats over the samples taken within the period before the latest
+// sample. Rates need at least two samples, so the previous sample is always included.
+// It must be called with the lock held.
+func (sc *statsCollector) window(period time.Duration) ResourceStats {
+	last := sc.samples[len(sc.samples)-1]
+
+	first := len(sc.samples) - 1
+	for first > 0 && (first == len(sc.samples)-1 || last.timestamp.Sub(sc.samples[first-1].timestamp) <= period) {
+		first--
+	}
+	samples := sc.samples[first:]
+
+	stats := ResourceStats{}
+	for _, s := range samples {
+		stats.RSSBytes += s.rssBytes
+		stats.VirtualMemoryBytes += s.vmBytes
+		stats.OpenFDs += s.openFDs
+		stats.Threads += s.threads
+	}
+	count := uint64(len(samples))
+	stats.RSSBytes /= count
+	stats.VirtualMemoryBytes /= count
+	stats.OpenFDs /= count
+	stats.Threads /= count
+	if period == 0 {
+		stats.RSSBytes = last.rssBytes
+		stats.VirtualMemoryBytes = last.vmBytes
+		stats.OpenFDs = last.openFDs
+		stats.Threads = last.threads
+	}
+
+	elapsed := last.timestamp.Sub(samples[0].timestamp).Seconds()
+	if elapsed > 0 {
+		stats.CPUPercent = (last.cpuSeconds - samples[0].cpuSeconds) / elapsed * 100
+		if last.hasIO && samples[0].hasIO {
+			stats.ReadBytesPerSecond = counterRate(samples[0].readBytes, last.readBytes, elapsed)
+			stats.WriteBytesPerSecond = counterRate(samples[0].writeBytes, last.writeBytes, elapsed)
+		}
+		stats.ContextSwitchesPerSecond = counterRate(samples[0].contextSwitches, last.contextSwitches, elapsed)
+	}
+	return stats
+}
+
+// counterRate returns the rate of a counter between two samples, 0 if the counter went backwards
+// rather than underflowing.
+func counterRate(first, last uint64, elapsed float64) float64 {
+	if last < first {
+		return 0
+	}
+	return float64(last-first) / elapsed
+}
+
+func (s *ResourceStats) RPC() *rpc.ResourceStats {
+	return &rpc.ResourceStats{
+		CpuPercent:               s.CPUPercent,
+		RssBytes:                 s.RSSBytes,
+		VirtualMemoryBytes:       s.VirtualMemoryBytes,
+		OpenFds:                  s.OpenFDs,
+		Threads:                  s.Threads,
+		ReadBytesPerSecond:       s.ReadBytesPerSecond,
+		WriteBytesPerSecond:      s.WriteBytesPerSecond,
+		ContextSwitchesPerSecond: s.ContextSwitchesPerSecond,
+	}
+}
+
+func (s *ProcessStats) RPC() *rpc.ProcessStatsResponse {
+	return &rpc.ProcessStatsResponse{
+		Name:         s.Name,
+		Pid:          int32(s.PID),
+		Timestamp:    util.FormatTime(&s.Timestamp),
+		ReadBytes:    s.ReadBytes,
+		WriteBytes:   s.WriteBytes,
+		Current:      s.Current.RPC(),
+		ShortAverage: s.ShortAverage.RPC(),
+		LongAverage:  s.LongAverage.RPC(),
+	}
+}
+
+func (pm *Manager) startStatsCollection() {
+	done := false
+
+	ticker := time.NewTicker(StatsSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pm.ctx.Done():
+			logrus.Infof("%s: stopped collecting process stats due to the context done", types.ProcessManagerGrpcService)
+			done = true
+		case <-ticker.C:
+			pm.collectStats()
+		}
+		if done {
+			break
+		}
+	}
+}
+
+func (pm *Manager) collectStats() {
+	pm.lock.RLock()
+	processes := make([]*Process, 0, len(pm.processes))
+	for _, p := range pm.processes {
+		processes = append(processes, p)
+	}
+	pm.lock.RUnlock()
+
+	for _, p := range processes {
+		pid := p.Pid()
+		if pid <= 0 || p.IsStopped() {
+			continue
+		}
+		sample, err := readStatsSample(pid)
+		if err != nil {
+			logrus.WithError(err).Debugf("%s: failed to collect stats of process %v", types.ProcessManagerGrpcService, p.Name)
+			continue
+		}
+		p.stats.add(sample)
+	}
+}
+
+// ProcessStats returns the resource usage of the process named by req.Name, read from /proc.
+// If the process doesn't exist, the call will return with ErrorNotFound
+func (pm *Manager) ProcessStats(ctx context.Context, req *rpc.ProcessStatsRequest) (*rpc.ProcessStatsResponse, error) {
+	name := req.Name
+	p := pm.findProcess(name)
+	if p == nil {
+		return nil, status.Errorf(codes.NotFound, "cannot find process %v", name)
+	}
+
+	pid := p.Pid()
+	if pid <= 0 || p.IsStopped() {
+		return nil, status.Errorf(codes.FailedPrecondition, "process %v is not running", name)
+	}
+	sample, err := readStatsSample(pid)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read stats of process %v: %v", name, err)
+	}
+	return p.stats.stats(name, sample).RPC(), nil
+}
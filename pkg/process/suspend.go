@@ -0,0 +1,152 @@
+package process
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/types"
+)
+
+// ProcessSuspend freezes a running process, e.g. to quiesce an engine during maintenance.
+// The process keeps its ports and stays in the running state with the Suspended condition set.
+func (pm *Manager) ProcessSuspend(name string) error {
+	p := pm.findProcess(name)
+	if p == nil {
+		return status.Errorf(codes.NotFound, "cannot find process %v", name)
+	}
+	if err := p.Suspend(); err != nil {
+		return err
+	}
+	logrus.Infof("Process Manager: suspended process %v", name)
+	return nil
+}
+
+// ProcessResume thaws a process frozen by ProcessSuspend. Resuming a process not suspended is a no-op.
+func (pm *Manager) ProcessResume(name string) error {
+	p := pm.findProcess(name)
+	if p == nil {
+		return status.Errorf(codes.NotFound, "cannot find process %v", name)
+	}
+	if err := p.Resume(); err != nil {
+		return err
+	}
+	logrus.Infof("Process Manager: resumed process %v", name)
+	return nil
+}
+
+// Suspend freezes the process with the cgroup v2 freezer if the process has its own cgroup,
+// or with SIGSTOP otherwise.
+func (p *Process) Suspend() error {
+	p.lock.Lock()
+	if p.suspended {
+		p.lock.Unlock()
+		return nil
+	}
+	if p.suspending {
+		p.lock.Unlock()
+		return status.Errorf(codes.Aborted, "process %v is being suspended", p.Name)
+	}
+	if p.State != StateRunning || p.cmd == nil {
+		defer p.lock.Unlock()
+		return status.Errorf(codes.FailedPrecondition, "cannot suspend process %v in state %v", p.Name, p.State)
+	}
+	cmd, cgroupPath := p.cmd, p.cgroupPath
+	p.suspending = true
+	p.lock.Unlock()
+
+	// The freezer may take a while, so the process is not locked while waiting for it
+	method := "SIGSTOP"
+	if cgroupPath != "" {
+		method = "cgroup freezer"
+		if err := p.cgroups.Freeze(cgroupPath, true); err != nil {
+			logrus.WithError(err).Warnf("Process Manager: failed to freeze the cgroup of process %v, falling back to SIGSTOP", p.Name)
+			// Don't leave the cgroup partially frozen
+			if err := p.cgroups.Freeze(cgroupPath, false); err != nil {
+				logrus.WithError(err).Warnf("Process Manager: failed to thaw the cgroup of process %v", p.Name)
+			}
+			method = "SIGSTOP"
+		}
+	}
+	var err error
+	if method == "SIGSTOP" {
+		err = cmd.Signal(syscall.SIGSTOP)
+	}
+
+	p.lock.Lock()
+	p.suspending = false
+	if err != nil {
+		defer p.lock.Unlock()
+		return status.Error(codes.Internal, errors.Wrapf(err, "failed to suspend process %v", p.Name).Error())
+	}
+	// The process may have been stopped or have exited in the meantime
+	if p.State != StateRunning || p.cmd != cmd {
+		state := p.State
+		p.lock.Unlock()
+		// A stopping process must handle its stop signal
+		if method == "SIGSTOP" {
+			err = cmd.Signal(syscall.SIGCONT)
+		} else {
+			err = p.cgroups.Freeze(cgroupPath, false)
+		}
+		if err != nil && cmd.IsRunning() {
+			logrus.WithError(err).Warnf("Process Manager: failed to resume process %v changed during its suspension", p.Name)
+		}
+		return status.Errorf(codes.FailedPrecondition, "process %v is in state %v after the suspension", p.Name, state)
+	}
+	p.suspended = true
+	p.Conditions[types.ProcessConditionSuspended] = true
+	p.events.record(EventReasonSuspended, "suspended process with %v", method)
+	p.lock.Unlock()
+
+	p.UpdateCh <- p
+	return nil
+}
+
+func (p *Process) Resume() error {
+	p.lock.Lock()
+	if p.suspending {
+		p.lock.Unlock()
+		return status.Errorf(codes.Aborted, "process %v is being suspended", p.Name)
+	}
+	if !p.suspended {
+		p.lock.Unlock()
+		return nil
+	}
+	if err := p.resume(); err != nil {
+		defer p.lock.Unlock()
+		return status.Error(codes.Internal, errors.Wrapf(err, "failed to resume process %v", p.Name).Error())
+	}
+	p.lock.Unlock()
+
+	p.UpdateCh <- p
+	return nil
+}
+
+// resume thaws the cgroup and sends SIGCONT, since the process may have been suspended
+// by either of them, e.g. before the instance-manager restarted. It must be called with the process lock held.
+func (p *Process) resume() error {
+	if p.cgroupPath != "" {
+		if err := p.cgroups.Freeze(p.cgroupPath, false); err != nil {
+			return err
+		}
+	}
+	if p.cmd != nil && p.cmd.IsRunning() {
+		if err := p.cmd.Signal(syscall.SIGCONT); err != nil {
+			return err
+		}
+	}
+	p.suspended = false
+	delete(p.Conditions, types.ProcessConditionSuspended)
+	p.events.record(EventReasonResumed, "resumed process")
+	return nil
+}
+
+func (p *Process) IsSuspended() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.suspended
+}
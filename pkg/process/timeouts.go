@@ -0,0 +1,267 @@
+package process
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	rpc "github.com/longhorn/types/pkg/generated/imrpc"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/types"
+)
+
+const (
+	DefaultStartupTimeout  = 60 * time.Second
+	DefaultStopGracePeriod = 60 * time.Second
+
+	// KillWaitPeriod is how long a process is waited for after SIGKILL.
+	KillWaitPeriod = 10 * time.Second
+)
+
+// StopSignals are the signals a stopping process can be sent before it is killed.
+var StopSignals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+// StopStep sends Signal to a stopping process still running Delay after the previous signal.
+type StopStep struct {
+	Signal syscall.Signal `json:"signal"`
+	Delay  time.Duration  `json:"delay"`
+}
+
+// TimeoutOptions bound how long a process may take to start and to stop. Unset fields fall
+// back to the defaults of the process manager, then to DefaultStartupTimeout and DefaultStopGracePeriod.
+type TimeoutOptions struct {
+	// StartupTimeout is how long the process has to pass its health probe once started.
+	StartupTimeout time.Duration `json:"startupTimeout,omitempty"`
+	// StopGracePeriod is how long the process has to exit after the stop signal before it is killed.
+	StopGracePeriod time.Duration `json:"stopGracePeriod,omitempty"`
+	// StopEscalation are the signals sent in order to the process still running during the
+	// grace period, e.g. SIGTERM 10s after SIGINT. The steps due after the grace period are skipped.
+	StopEscalation []StopStep `json:"stopEscalation,omitempty"`
+	// ProbeTimeout is the timeout of each health probe of the process. If it is 0, the timeout of
+	// the health checker is used.
+	ProbeTimeout time.Duration `json:"probeTimeout,omitempty"`
+}
+
+func (t *TimeoutOptions) IsEmpty() bool {
+	return t == nil || (t.StartupTimeout == 0 && t.StopGracePeriod == 0 && len(t.StopEscalation) == 0 && t.ProbeTimeout == 0)
+}
+
+func (t *TimeoutOptions) Validate() error {
+	if t == nil {
+		return nil
+	}
+	if t.StartupTimeout < 0 {
+		return fmt.Errorf("invalid startup timeout %v", t.StartupTimeout)
+	}
+	if t.StopGracePeriod < 0 {
+		return fmt.Errorf("invalid stop grace period %v", t.StopGracePeriod)
+	}
+	if t.ProbeTimeout < 0 {
+		return fmt.Errorf("invalid probe timeout %v", t.ProbeTimeout)
+	}
+	for _, step := range t.StopEscalation {
+		if !isStopSignal(step.Signal) {
+			return fmt.Errorf("doesn't support stop signal %v", step.Signal)
+		}
+		if step.Delay <= 0 {
+			return fmt.Errorf("invalid delay %v of stop signal %v", step.Delay, step.Signal)
+		}
+	}
+	return nil
+}
+
+// withDefaults returns the options with the unset fields taken from the defaults.
+func (t *TimeoutOptions) withDefaults(defaults *TimeoutOptions) *TimeoutOptions {
+	if t == nil {
+		return defaults
+	}
+	if defaults == nil {
+		return t
+	}
+	merged := *t
+	if merged.StartupTimeout == 0 {
+		merged.StartupTimeout = defaults.StartupTimeout
+	}
+	if merged.StopGracePeriod == 0 {
+		merged.StopGracePeriod = defaults.StopGracePeriod
+	}
+	if merged.StopEscalation == nil {
+		merged.StopEscalation = defaults.StopEscalation
+	}
+	if merged.ProbeTimeout == 0 {
+		merged.ProbeTimeout = defaults.ProbeTimeout
+	}
+	return &merged
+}
+
+func (t *TimeoutOptions) startupTimeout() time.Duration {
+	if t == nil || t.StartupTimeout == 0 {
+		return DefaultStartupTimeout
+	}
+	return t.StartupTimeout
+}
+
+func (t *TimeoutOptions) stopGracePeriod() time.Duration {
+	if t == nil || t.StopGracePeriod == 0 {
+		return DefaultStopGracePeriod
+	}
+	return t.StopGracePeriod
+}
+
+func (t *TimeoutOptions) stopEscalation() []StopStep {
+	if t == nil {
+		return nil
+	}
+	return t.StopEscalation
+}
+
+func (t *TimeoutOptions) probeTimeout() time.Duration {
+	if t == nil {
+		return 0
+	}
+	return t.ProbeTimeout
+}
+
+// RPC returns the timeouts set in a process spec, nil if none is set. The durations are truncated
+// to whole seconds.
+func (t *TimeoutOptions) RPC() *rpc.ProcessTimeouts {
+	if t.IsEmpty() {
+		return nil
+	}
+	timeouts := &rpc.ProcessTimeouts{
+		ProbeTimeoutSeconds:    int64(t.ProbeTimeout / time.Second),
+		StartupTimeoutSeconds:  int64(t.StartupTimeout / time.Second),
+		StopGracePeriodSeconds: int64(t.StopGracePeriod / time.Second),
+	}
+	for _, step := range t.StopEscalation {
+		timeouts.StopEscalation = append(timeouts.StopEscalation, &rpc.ProcessStopStep{
+			Signal:       stopSignalName(step.Signal),
+			DelaySeconds: int64(step.Delay / time.Second),
+		})
+	}
+	return timeouts
+}
+
+// timeoutOptionsFromRPC returns the timeouts of a process spec, nil if none is set. The unknown stop
+// signals are left 0, so they fail the validation of the options.
+func timeoutOptionsFromRPC(timeouts *rpc.ProcessTimeouts) *TimeoutOptions {
+	t := &TimeoutOptions{
+		ProbeTimeout:    time.Duration(timeouts.GetProbeTimeoutSeconds()) * time.Second,
+		StartupTimeout:  time.Duration(timeouts.GetStartupTimeoutSeconds()) * time.Second,
+		StopGracePeriod: time.Duration(timeouts.GetStopGracePeriodSeconds()) * time.Second,
+	}
+	for _, step := range timeouts.GetStopEscalation() {
+		t.StopEscalation = append(t.StopEscalation, StopStep{
+			Signal: StopSignals[step.Signal],
+			Delay:  time.Duration(step.DelaySeconds) * time.Second,
+		})
+	}
+	if t.IsEmpty() {
+		return nil
+	}
+	return t
+}
+
+func stopSignalName(signal syscall.Signal) string {
+	for name, sig := range StopSignals {
+		if sig == signal {
+			return name
+		}
+	}
+	return signal.String()
+}
+
+func isStopSignal(signal syscall.Signal) bool {
+	for _, sig := range StopSignals {
+		if sig == signal {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseStopEscalation parses a comma separated list of stop steps, e.g. "SIGTERM:10s,SIGQUIT:5s".
+func ParseStopEscalation(escalation string) ([]StopStep, error) {
+	if strings.TrimSpace(escalation) == "" {
+		return nil, nil
+	}
+
+	var steps []StopStep
+	for _, step := range strings.Split(escalation, ",") {
+		signal, delay, found := strings.Cut(strings.TrimSpace(step), ":")
+		if !found {
+			return nil, fmt.Errorf("invalid stop step %q, expected <signal>:<delay>", step)
+		}
+		sig, ok := StopSignals[signal]
+		if !ok {
+			return nil, fmt.Errorf("doesn't support stop signal %v", signal)
+		}
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delay of stop signal %v: %v", signal, err)
+		}
+		steps = append(steps, StopStep{Signal: sig, Delay: d})
+	}
+	return steps, nil
+}
+
+// stopTimeout is how long the process may take to exit once stopped, including the wait after SIGKILL.
+func (p *Process) stopTimeout() time.Duration {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.Options.timeouts().stopGracePeriod() + KillWaitPeriod
+}
+
+// waitForStopped returns false if the process is still running at the deadline.
+func (p *Process) waitForStopped(deadline time.Time) bool {
+	for !p.IsStopped() {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(types.WaitInterval)
+	}
+	return true
+}
+
+// escalateStop waits for the process to exit after the stop signal, sending it the escalation
+// signals on the way. It returns false if the process is still running after the grace period.
+func (p *Process) escalateStop(cmd Command, timeouts *TimeoutOptions) bool {
+	start := time.Now()
+	deadline := start.Add(timeouts.stopGracePeriod())
+
+	next := start
+	for _, step := range timeouts.stopEscalation() {
+		if next = next.Add(step.Delay); !next.Before(deadline) {
+			break
+		}
+		if p.waitForStopped(next) {
+			return true
+		}
+		logrus.Infof("Process Manager: process %v is still running after %v, escalating to %v", p.Name, next.Sub(start), step.Signal)
+		p.events.record(EventReasonSignalSent, "sent %v to PID %v", step.Signal, cmd.Pid())
+		cmd.StopWithSignal(step.Signal)
+	}
+	return p.waitForStopped(deadline)
+}
+
+// StopTimeout returns how long the processes may take to exit once deleted, at most.
+func (pm *Manager) StopTimeout() time.Duration {
+	pm.lock.RLock()
+	defer pm.lock.RUnlock()
+
+	timeout := pm.config.Timeouts.stopGracePeriod() + KillWaitPeriod
+	for _, p := range pm.processes {
+		if t := p.stopTimeout(); t > timeout {
+			timeout = t
+		}
+	}
+	return timeout
+}
@@ -0,0 +1,158 @@
+package process
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	lhLonghorn "github.com/longhorn/go-common-libs/longhorn"
+	rpc "github.com/longhorn/types/pkg/generated/imrpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/longhorn/longhorn-instance-manager/pkg/types"
+	"github.com/longhorn/longhorn-instance-manager/pkg/util"
+	"github.com/longhorn/longhorn-instance-manager/pkg/util/broadcaster"
+)
+
+// ProcessWatchFilter limits the process updates a watch receives. The zero value matches all processes.
+type ProcessWatchFilter struct {
+	// Names matches the processes with any of the names.
+	Names []string
+	// NamePrefix matches the processes with a name starting with the prefix.
+	NamePrefix string
+	// Type is types.InstanceTypeEngine or types.InstanceTypeReplica.
+	Type string
+	// VolumeName matches the processes of the volume.
+	VolumeName string
+	// LabelSelector matches the processes whose labels match the Kubernetes label selector.
+	LabelSelector string
+
+	selector labels.Selector
+}
+
+// processWatchFilterFromRequest returns the filter of a ProcessWatch request, nil if it has none.
+func processWatchFilterFromRequest(req *rpc.ProcessWatchRequest) *ProcessWatchFilter {
+	filter := &ProcessWatchFilter{
+		Names:         req.GetNames(),
+		NamePrefix:    req.GetNamePrefix(),
+		Type:          req.GetType(),
+		VolumeName:    req.GetVolumeName(),
+		LabelSelector: req.GetLabelSelector(),
+	}
+	if len(filter.Names) == 0 && filter.NamePrefix == "" && filter.Type == "" && filter.VolumeName == "" && filter.LabelSelector == "" {
+		return nil
+	}
+	return filter
+}
+
+func (f *ProcessWatchFilter) Validate() error {
+	if f.Type != "" && f.Type != types.InstanceTypeEngine && f.Type != types.InstanceTypeReplica {
+		return fmt.Errorf("invalid process type %v", f.Type)
+	}
+	selector, err := util.ParseLabelSelector(f.LabelSelector)
+	if err != nil {
+		return err
+	}
+	f.selector = selector
+	return nil
+}
+
+// Match returns true if the filter matches the process without labels.
+func (f *ProcessWatchFilter) Match(p *rpc.ProcessResponse) bool {
+	return f.MatchLabels(p, nil)
+}
+
+// MatchLabels returns true if the filter matches the process with the given labels.
+func (f *ProcessWatchFilter) MatchLabels(p *rpc.ProcessResponse, set map[string]string) bool {
+	if p == nil || p.Spec == nil {
+		return false
+	}
+	name := p.Spec.Name
+	if f.Type != "" {
+		processType := types.InstanceTypeReplica
+		if lhLonghorn.IsEngineProcess(name) {
+			processType = types.InstanceTypeEngine
+		}
+		if processType != f.Type {
+			return false
+		}
+	}
+	if f.NamePrefix != "" && !strings.HasPrefix(name, f.NamePrefix) {
+		return false
+	}
+	if len(f.Names) != 0 && !slices.Contains(f.Names, name) {
+		return false
+	}
+	if f.VolumeName != "" {
+		volumeName := set[types.LabelVolume]
+		if volumeName == "" {
+			volumeName = util.ProcessNameToVolumeName(name)
+		}
+		if volumeName != f.VolumeName {
+			return false
+		}
+	}
+	if f.LabelSelector != "" {
+		selector := f.selector
+		if selector == nil {
+			var err error
+			if selector, err = labels.Parse(f.LabelSelector); err != nil {
+				return false
+			}
+		}
+		if !selector.Matches(labels.Set(set)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Watch is like Subscribe, but only returns the updates of the processes matching the filter.
+// The resync required events are always returned.
+func (pm *Manager) Watch(ctx context.Context, since uint64, filter *ProcessWatchFilter) (<-chan *broadcaster.Event, error) {
+	if filter == nil {
+		return pm.Subscribe(ctx, since)
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid watch filter: %v", err)
+	}
+
+	events, err := pm.Subscribe(ctx, since)
+	if err != nil {
+		return nil, err
+	}
+	// The labels are remembered for the updates of the processes deleted in the meantime
+	processLabels := map[string]map[string]string{}
+	pm.lock.RLock()
+	for name, p := range pm.processes {
+		processLabels[name] = p.Labels()
+	}
+	pm.lock.RUnlock()
+
+	filtered := make(chan *broadcaster.Event)
+	go func() {
+		defer close(filtered)
+		for event := range events {
+			if !event.ResyncRequired {
+				r, ok := event.Item.(*rpc.ProcessResponse)
+				if ok && r.Spec != nil {
+					if p := pm.findProcess(r.Spec.Name); p != nil {
+						processLabels[r.Spec.Name] = p.Labels()
+					}
+				}
+				if ok && !filter.MatchLabels(r, processLabels[r.GetSpec().GetName()]) {
+					continue
+				}
+			}
+			select {
+			case filtered <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return filtered, nil
+}
@@ -14,10 +14,13 @@ type HealthChecker interface {
 	WaitForRunning(address, name string, stopCh chan struct{}) bool
 }
 
-type GRPCHealthChecker struct{}
+type GRPCHealthChecker struct {
+	// ProbeTimeout is the timeout of each health probe. util.DefaultGRPCHealthProbeTimeout is used if it is 0.
+	ProbeTimeout time.Duration
+}
 
 func (c *GRPCHealthChecker) IsRunning(address string) bool {
-	return util.GRPCServiceReadinessProbe(address)
+	return util.GRPCServiceReadinessProbeWithTimeout(address, c.ProbeTimeout)
 }
 
 func (c *GRPCHealthChecker) WaitForRunning(address, name string, stopCh chan struct{}) bool {
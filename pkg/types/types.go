@@ -45,6 +45,21 @@ const (
 
 const (
 	EngineConditionFilesystemReadOnly = "FilesystemReadOnly"
+
+	ProcessConditionOOMKilled = "OOMKilled"
+	ProcessConditionHealthy   = "Healthy"
+	ProcessConditionSuspended = "Suspended"
+	// ProcessConditionRolledBack is set on a process relaunched after its replacement failed
+	ProcessConditionRolledBack = "RolledBack"
+	// ProcessConditionBinaryDenied is set on a process re-attached after its binary is no longer allowed
+	ProcessConditionBinaryDenied = "BinaryDenied"
+)
+
+const (
+	LabelVolume      = "longhorn.io/volume"
+	LabelNode        = "longhorn.io/node"
+	LabelOwner       = "longhorn.io/owner"
+	LabelEngineImage = "longhorn.io/engine-image"
 )
 
 const TcpAddressPrefix = "tcp://"
@@ -0,0 +1,43 @@
+package util
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultBatchParallelism is the number of operations of a batch running at the same time by default.
+const DefaultBatchParallelism = 10
+
+// RunBatch calls fn for each index in [0, count), with at most parallelism calls running at the same
+// time. It returns the error of each call. The calls not started yet once ctx is done get its error.
+func RunBatch(ctx context.Context, count, parallelism int, fn func(i int) error) []error {
+	if parallelism <= 0 {
+		parallelism = DefaultBatchParallelism
+	}
+
+	errs := make([]error, count)
+	slots := make(chan struct{}, parallelism)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < count; i++ {
+		if err := ctx.Err(); err != nil {
+			errs[i] = err
+			continue
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() {
+				<-slots
+			}()
+			errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
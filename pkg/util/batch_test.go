@@ -0,0 +1,51 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunBatch(t *testing.T) {
+	var running, maxRunning atomic.Int32
+	errs := RunBatch(context.Background(), 20, 3, func(i int) error {
+		current := running.Add(1)
+		defer running.Add(-1)
+		for {
+			observed := maxRunning.Load()
+			if current <= observed || maxRunning.CompareAndSwap(observed, current) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		if i%2 == 1 {
+			return fmt.Errorf("failed %v", i)
+		}
+		return nil
+	})
+	if maxRunning.Load() != 3 {
+		t.Errorf("RunBatch() ran %v calls at the same time, want 3", maxRunning.Load())
+	}
+	for i, err := range errs {
+		if (err != nil) != (i%2 == 1) {
+			t.Errorf("RunBatch() error of call %v = %v", i, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs = RunBatch(ctx, 5, 1, func(i int) error {
+		cancel()
+		return nil
+	})
+	if errs[0] != nil {
+		t.Errorf("RunBatch() error of the started call = %v, want nil", errs[0])
+	}
+	// The second call may have been waiting for the slot already
+	for i := 2; i < len(errs); i++ {
+		if errs[i] != context.Canceled {
+			t.Errorf("RunBatch() error of call %v = %v, want %v", i, errs[i], context.Canceled)
+		}
+	}
+}
@@ -3,50 +3,130 @@ package broadcaster
 import (
 	"context"
 	"sync"
+	"time"
+)
+
+const (
+	// DefaultHistorySize is the number of events kept for the subscribers to catch up on
+	DefaultHistorySize = 1024
 )
 
 type ConnectFunc func() (chan interface{}, error)
 
+// Event is a broadcast item with its revision. The revisions increase monotonically, and
+// start from the creation time of the broadcaster in nanoseconds, so a revision from before
+// a restart is older than any revision after it.
+type Event struct {
+	Revision uint64
+	Item     interface{}
+	// ResyncRequired is set instead of an item when the events the subscriber asked for
+	// are no longer in the history. The subscriber has to get the current state again,
+	// and receives the events after Revision from then on.
+	ResyncRequired bool
+}
+
+// Broadcaster sends the items of the connected channel to all subscribers. It keeps a bounded
+// history of the events, so a subscriber can resume from a revision, and a slow subscriber
+// is told to resync rather than losing events silently.
 type Broadcaster struct {
 	sync.Mutex
 	running bool
-	subs    map[chan interface{}]struct{}
+
+	// HistorySize is the number of events kept. DefaultHistorySize is used if it is 0.
+	HistorySize int
+
+	history  []*Event
+	revision uint64
+	// updated is closed and replaced whenever a new event is added or the stream ends
+	updated chan struct{}
 }
 
-func (b *Broadcaster) Subscribe(ctx context.Context, connect ConnectFunc) (<-chan interface{}, error) {
+// Subscribe returns the events with a revision after since. If since is 0, only the events
+// broadcast from now on are returned. The channel is closed once ctx is done or the
+// connected channel is closed.
+func (b *Broadcaster) Subscribe(ctx context.Context, connect ConnectFunc, since uint64) (<-chan *Event, error) {
 	b.Lock()
 	defer b.Unlock()
 
+	b.init()
 	if !b.running {
 		if err := b.start(connect); err != nil {
 			return nil, err
 		}
 	}
-
-	sub := make(chan interface{}, 100)
-	if b.subs == nil {
-		b.subs = map[chan interface{}]struct{}{}
+	if since == 0 {
+		since = b.revision
 	}
-	b.subs[sub] = struct{}{}
-	go func() {
-		<-ctx.Done()
-		b.unsub(sub, true)
-	}()
 
+	sub := make(chan *Event)
+	go b.serve(ctx, sub, since)
 	return sub, nil
 }
 
-func (b *Broadcaster) unsub(sub chan interface{}, lock bool) {
-	if lock {
-		b.Lock()
+// Revision returns the revision of the latest event.
+func (b *Broadcaster) Revision() uint64 {
+	b.Lock()
+	defer b.Unlock()
+
+	b.init()
+	return b.revision
+}
+
+// init must be called with the lock held.
+func (b *Broadcaster) init() {
+	if b.updated != nil {
+		return
 	}
-	if _, ok := b.subs[sub]; ok {
-		close(sub)
-		delete(b.subs, sub)
+	if b.HistorySize <= 0 {
+		b.HistorySize = DefaultHistorySize
 	}
-	if lock {
-		b.Unlock()
+	b.revision = uint64(time.Now().UnixNano())
+	b.updated = make(chan struct{})
+}
+
+func (b *Broadcaster) serve(ctx context.Context, sub chan *Event, cursor uint64) {
+	defer close(sub)
+
+	for {
+		events, updated, running := b.eventsSince(cursor)
+		for _, event := range events {
+			select {
+			case sub <- event:
+				cursor = event.Revision
+			case <-ctx.Done():
+				return
+			}
+		}
+		if len(events) != 0 {
+			continue
+		}
+		if !running {
+			return
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// eventsSince returns the events after the revision, or a resync event if they are not in the
+// history anymore. It also returns the channel closed on the next update, and whether the
+// broadcaster is still running.
+func (b *Broadcaster) eventsSince(revision uint64) ([]*Event, chan struct{}, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if revision == b.revision {
+		return nil, b.updated, b.running
 	}
+	if revision > b.revision || len(b.history) == 0 || revision+1 < b.history[0].Revision {
+		return []*Event{{Revision: b.revision, ResyncRequired: true}}, b.updated, b.running
+	}
+	first := len(b.history) - int(b.revision-revision)
+	return append([]*Event{}, b.history[first:]...), b.updated, b.running
 }
 
 func (b *Broadcaster) start(connect ConnectFunc) error {
@@ -63,21 +143,23 @@ func (b *Broadcaster) start(connect ConnectFunc) error {
 func (b *Broadcaster) stream(input chan interface{}) {
 	for item := range input {
 		b.Lock()
-		for sub := range b.subs {
-			select {
-			case sub <- item:
-			default:
-				// Slow consumer, drop
-				go b.unsub(sub, true)
-			}
+		b.revision++
+		b.history = append(b.history, &Event{Revision: b.revision, Item: item})
+		if len(b.history) > b.HistorySize {
+			b.history = b.history[len(b.history)-b.HistorySize:]
 		}
+		b.notify()
 		b.Unlock()
 	}
 
 	b.Lock()
-	for sub := range b.subs {
-		b.unsub(sub, false)
-	}
 	b.running = false
+	b.notify()
 	b.Unlock()
 }
+
+// notify must be called with the lock held.
+func (b *Broadcaster) notify() {
+	close(b.updated)
+	b.updated = make(chan struct{})
+}
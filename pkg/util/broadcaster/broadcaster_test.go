@@ -0,0 +1,99 @@
+package broadcaster
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, sub <-chan *Event) *Event {
+	t.Helper()
+	select {
+	case event, ok := <-sub:
+		if !ok {
+			t.Fatal("the subscription is closed")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return nil
+}
+
+func TestBroadcasterResume(t *testing.T) {
+	input := make(chan interface{})
+	connect := func() (chan interface{}, error) { return input, nil }
+	b := &Broadcaster{HistorySize: 4}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	live, err := b.Subscribe(ctx, connect, 0)
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	start := b.Revision()
+
+	for i := 0; i < 3; i++ {
+		input <- i
+		if event := receive(t, live); event.Item != i || event.Revision != start+uint64(i)+1 {
+			t.Fatalf("got event %+v, want item %v at revision %v", event, i, start+uint64(i)+1)
+		}
+	}
+
+	// Resume after the first event
+	resumed, err := b.Subscribe(ctx, connect, start+1)
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	for _, want := range []int{1, 2} {
+		if event := receive(t, resumed); event.ResyncRequired || event.Item != want {
+			t.Fatalf("got resumed event %+v, want item %v", event, want)
+		}
+	}
+
+	// A slow subscriber isn't dropped, it is told to resync once the history is exceeded.
+	// It may have fetched up to a history of events before, so more than twice of it are sent.
+	for i := 3; i < 12; i++ {
+		input <- i
+	}
+	for b.Revision() != start+12 {
+		time.Sleep(time.Millisecond)
+	}
+	event := receive(t, resumed)
+	for !event.ResyncRequired {
+		event = receive(t, resumed)
+	}
+	// The events after the resync are not missed
+	for revision := event.Revision; revision < start+12; revision++ {
+		if event := receive(t, resumed); event.ResyncRequired || event.Revision != revision+1 {
+			t.Fatalf("got event %+v after the resync, want revision %v", event, revision+1)
+		}
+	}
+	input <- 12
+	if event := receive(t, resumed); event.Item != 12 {
+		t.Fatalf("got event %+v after the resync, want item 12", event)
+	}
+
+	// A revision from the future, e.g. from before a restart, requires a resync
+	future, err := b.Subscribe(ctx, connect, b.Revision()+100)
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	if event := receive(t, future); !event.ResyncRequired {
+		t.Fatalf("got event %+v, want resync required", event)
+	}
+
+	// The subscriptions are closed once the input is closed
+	close(input)
+	timeout := time.After(5 * time.Second)
+	for _, sub := range []<-chan *Event{live, resumed, future} {
+		for closed := false; !closed; {
+			select {
+			case _, ok := <-sub:
+				closed = !ok
+			case <-timeout:
+				t.Fatal("timed out waiting for the subscriptions to be closed")
+			}
+		}
+	}
+}
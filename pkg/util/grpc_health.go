@@ -0,0 +1,119 @@
+package util
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	DefaultGRPCHealthProbeTimeout = time.Second
+
+	// A connection not probed for this long is closed, e.g. the one of a process gone
+	grpcHealthProbeIdleTimeout = 5 * time.Minute
+)
+
+type grpcHealthConn struct {
+	conn     *grpc.ClientConn
+	health   healthpb.HealthClient
+	lastUsed time.Time
+}
+
+// GRPCHealthProber calls the gRPC health service of the servers directly. It keeps a client
+// connection per address, so the repeated probes of a starting server share the same one.
+type GRPCHealthProber struct {
+	lock  *sync.Mutex
+	conns map[string]*grpcHealthConn
+}
+
+var defaultGRPCHealthProber = NewGRPCHealthProber()
+
+func NewGRPCHealthProber() *GRPCHealthProber {
+	return &GRPCHealthProber{
+		lock:  &sync.Mutex{},
+		conns: map[string]*grpcHealthConn{},
+	}
+}
+
+// Probe returns true if the server at the address reports it is serving within the timeout.
+func (p *GRPCHealthProber) Probe(address string, timeout time.Duration) bool {
+	if timeout <= 0 {
+		timeout = DefaultGRPCHealthProbeTimeout
+	}
+	health, err := p.getHealthClient(address)
+	if err != nil {
+		logrus.WithError(err).Debugf("Failed to create the gRPC health client for %v", address)
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := health.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return false
+	}
+	return resp.Status == healthpb.HealthCheckResponse_SERVING
+}
+
+// Release closes the connection to the address, e.g. once the server is gone.
+func (p *GRPCHealthProber) Release(address string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if c, ok := p.conns[address]; ok {
+		p.closeConn(address, c)
+	}
+}
+
+func (p *GRPCHealthProber) getHealthClient(address string) (healthpb.HealthClient, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	for a, c := range p.conns {
+		if a != address && now.Sub(c.lastUsed) > grpcHealthProbeIdleTimeout {
+			p.closeConn(a, c)
+		}
+	}
+
+	if c, ok := p.conns[address]; ok {
+		c.lastUsed = now
+		return c.health, nil
+	}
+
+	conn, err := grpc.NewClient(address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		// A starting server is probed often, don't back off for long between the connection attempts
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  100 * time.Millisecond,
+				Multiplier: 1.6,
+				MaxDelay:   time.Second,
+			},
+			MinConnectTimeout: DefaultGRPCHealthProbeTimeout,
+		}))
+	if err != nil {
+		return nil, err
+	}
+	c := &grpcHealthConn{
+		conn:     conn,
+		health:   healthpb.NewHealthClient(conn),
+		lastUsed: now,
+	}
+	p.conns[address] = c
+	return c.health, nil
+}
+
+// closeConn must be called with the lock held.
+func (p *GRPCHealthProber) closeConn(address string, c *grpcHealthConn) {
+	if err := c.conn.Close(); err != nil {
+		logrus.WithError(err).Debugf("Failed to close the gRPC health connection to %v", address)
+	}
+	delete(p.conns, address)
+}
@@ -0,0 +1,73 @@
+package util
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type testHealthServer struct {
+	healthpb.UnimplementedHealthServer
+	serving atomic.Bool
+	checks  atomic.Int32
+}
+
+func (s *testHealthServer) Check(context.Context, *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	s.checks.Add(1)
+	if s.serving.Load() {
+		return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+	}
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING}, nil
+}
+
+func TestGRPCHealthProber(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	healthServer := &testHealthServer{}
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	prober := NewGRPCHealthProber()
+	defer prober.Release(address)
+
+	if prober.Probe(address, time.Second) {
+		t.Errorf("Probe() = true for a server not serving")
+	}
+	healthServer.serving.Store(true)
+	for i := 0; i < 3; i++ {
+		if !prober.Probe(address, time.Second) {
+			t.Errorf("Probe() = false for a serving server")
+		}
+	}
+	if checks := healthServer.checks.Load(); checks != 4 {
+		t.Errorf("got %v health checks, want 4", checks)
+	}
+	if len(prober.conns) != 1 {
+		t.Errorf("got %v connections, want the probes to share 1", len(prober.conns))
+	}
+
+	server.Stop()
+	start := time.Now()
+	if prober.Probe(address, 200*time.Millisecond) {
+		t.Errorf("Probe() = true for a stopped server")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Probe() of a stopped server took %v, longer than its timeout", elapsed)
+	}
+
+	prober.Release(address)
+	if len(prober.conns) != 0 {
+		t.Errorf("got %v connections after the release, want 0", len(prober.conns))
+	}
+}
@@ -0,0 +1,32 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// ValidateLabels checks that the labels are valid Kubernetes label keys and values.
+func ValidateLabels(set map[string]string) error {
+	for key, value := range set {
+		if errs := validation.IsQualifiedName(key); len(errs) != 0 {
+			return fmt.Errorf("invalid label key %q: %v", key, strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) != 0 {
+			return fmt.Errorf("invalid value %q of label %v: %v", value, key, strings.Join(errs, "; "))
+		}
+	}
+	return nil
+}
+
+// ParseLabelSelector parses a Kubernetes label selector, e.g. "longhorn.io/volume=pvc-1234,longhorn.io/node".
+// An empty selector matches everything.
+func ParseLabelSelector(selector string) (labels.Selector, error) {
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label selector %q: %v", selector, err)
+	}
+	return parsed, nil
+}
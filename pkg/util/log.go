@@ -1,7 +1,6 @@
 package util
 
 import (
-	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
@@ -9,12 +8,17 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 const (
 	LogComponentField = "component"
+
+	// LogSyncDelay is how long the output written to a log file may stay unsynced to the disk.
+	LogSyncDelay = 1 * time.Second
 )
 
 type LonghornFormatter struct {
@@ -24,12 +28,27 @@ type LonghornFormatter struct {
 }
 
 type LonghornWriter struct {
+	lock *sync.Mutex
 	file *os.File
 	name string
 	path string
+
+	rotation LogRotation
+	size     int64
+	closed   bool
+	// dirty is set once the file has been written since it was last synced, see Sync
+	dirty bool
+	// refs is the number of users of the writer, see Share
+	refs int
+	// direct is set once a process writes to the file directly, see File
+	direct bool
+	// rotatedSegments are the segments rotated by this writer in order, for the followers to catch up
+	rotatedSegments []string
+	// compressing tracks the rotated segments being compressed in the background
+	compressing *sync.WaitGroup
 }
 
-func NewLonghornWriter(name string, logsDir string) (*LonghornWriter, error) {
+func NewLonghornWriter(name string, logsDir string, rotation LogRotation) (*LonghornWriter, error) {
 	logPath := filepath.Join(logsDir, name+".log")
 	logPath, err := filepath.Abs(logPath)
 	if err != nil {
@@ -39,10 +58,21 @@ func NewLonghornWriter(name string, logsDir string) (*LonghornWriter, error) {
 	if err != nil {
 		return nil, err
 	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
 	return &LonghornWriter{
+		lock: &sync.Mutex{},
 		file: file,
 		name: name,
 		path: logPath,
+
+		rotation:    rotation,
+		size:        info.Size(),
+		refs:        1,
+		compressing: &sync.WaitGroup{},
 	}, nil
 }
 
@@ -99,45 +129,127 @@ func (l LonghornFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	return logMsg.Bytes(), nil
 }
 
-func (l LonghornWriter) Close() error {
+// Share adds a user of the writer, e.g. a replacement process writing to the log file of the process
+// it replaces, so that a single writer rotates the file. Every user closes the writer once. It returns
+// false if the writer has been closed already.
+func (l *LonghornWriter) Share() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return false
+	}
+	l.refs++
+	return true
+}
+
+// Close closes the log file once all the users of the writer have closed it.
+func (l *LonghornWriter) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	if l.refs--; l.refs > 0 {
+		return nil
+	}
+	l.compressing.Wait()
+	if err := l.sync(); err != nil {
+		logrus.WithError(err).Warnf("Failed to sync log file %v", l.path)
+	}
+	l.closed = true
 	if err := l.file.Close(); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (l LonghornWriter) StreamLog(done chan struct{}) (chan string, error) {
-	file, err := os.OpenFile(l.path, os.O_RDONLY, 0644)
+// File returns the current log file, e.g. for a process that has to keep writing its output
+// after the instance-manager exits. Such output bypasses Write, so the file is then rotated by
+// RotateIfNeeded, copying and truncating it since the process keeps its own file descriptor.
+func (l *LonghornWriter) File() *os.File {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.direct = true
+	return l.file
+}
+
+// RotateIfNeeded rotates the log file if it has reached the maximum size, e.g. for the output
+// written to File directly.
+func (l *LonghornWriter) RotateIfNeeded() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed || l.rotation.MaxSize <= 0 {
+		return nil
+	}
+	info, err := l.file.Stat()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	logChan := make(chan string)
-	scanner := bufio.NewScanner(file)
-	go func() {
-		for scanner.Scan() {
-			select {
-			case <-done:
-				close(logChan)
-				return
-			default:
-				logChan <- scanner.Text()
-			}
-		}
-		close(logChan)
-		file.Close()
-	}()
-	return logChan, nil
+	l.size = info.Size()
+	if l.size < l.rotation.MaxSize {
+		return nil
+	}
+	return l.rotate()
+}
+
+func (l *LonghornWriter) isClosed() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.closed
 }
 
-func (l LonghornWriter) Write(input []byte) (int, error) {
+// StreamLog streams the rotated segments from the oldest one, followed by the current log file.
+func (l *LonghornWriter) StreamLog(done chan struct{}) (chan string, error) {
+	return l.StreamLogWithOptions(done, LogStreamOptions{})
+}
+
+func (l *LonghornWriter) Write(input []byte) (int, error) {
 	msg := string(input)
 	logrus.WithField(LogComponentField, l.name).Println(msg)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
 	outLen, err := l.file.Write(input)
 	if err != nil {
 		return 0, err
 	}
-	if err := l.file.Sync(); err != nil {
-		return 0, err
+	l.size += int64(outLen)
+	// Syncing every write is too costly for a chatty process, so the writes are synced together
+	// within LogSyncDelay, and before the file is rotated or closed
+	if !l.dirty {
+		l.dirty = true
+		time.AfterFunc(LogSyncDelay, l.Sync)
+	}
+
+	if l.rotation.MaxSize > 0 && l.size >= l.rotation.MaxSize {
+		if err := l.rotate(); err != nil {
+			// The output is kept in the current file, rotation is retried on the next write
+			logrus.WithError(err).Warnf("Failed to rotate log file %v", l.path)
+		}
 	}
 	return outLen, nil
 }
+
+// Sync flushes the output written to the log file to the disk, if any.
+func (l *LonghornWriter) Sync() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return
+	}
+	if err := l.sync(); err != nil {
+		logrus.WithError(err).Warnf("Failed to sync log file %v", l.path)
+	}
+}
+
+// sync must be called with the lock held.
+func (l *LonghornWriter) sync() error {
+	if !l.dirty {
+		return nil
+	}
+	l.dirty = false
+	return l.file.Sync()
+}
@@ -0,0 +1,288 @@
+package util
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	logSegmentTimeFormat = "20060102T150405.000000000"
+	logSegmentGzipSuffix = ".gz"
+)
+
+// A rotated segment of <name>.log is named <name>.log.<rotation time>, with a .gz suffix if it is compressed
+var logSegmentRegex = regexp.MustCompile(`^(.+)\.log\.(\d{8}T\d{6}\.\d{9})(\.gz)?$`)
+
+type LogRotation struct {
+	// MaxSize is the size in bytes at which the log file is rotated. 0 disables the rotation.
+	MaxSize int64
+	// MaxSegments is the number of rotated segments kept for each log file. 0 keeps all of them.
+	MaxSegments int
+	// Compress gzips the rotated segments.
+	Compress bool
+}
+
+// rotate moves the current log file to a new segment and starts a new one.
+// It must be called with the lock held.
+func (l *LonghornWriter) rotate() error {
+	// The segments are pruned once the previous compression is done
+	l.compressing.Wait()
+
+	// The segment is complete on the disk before the writer moves on to a new file
+	if err := l.sync(); err != nil {
+		logrus.WithError(err).Warnf("Failed to sync log file %v before rotating it", l.path)
+	}
+
+	segment := l.path + "." + time.Now().UTC().Format(logSegmentTimeFormat)
+	if l.direct {
+		if err := l.copyTruncate(segment); err != nil {
+			return err
+		}
+	} else {
+		if err := os.Rename(l.path, segment); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			if renameErr := os.Rename(segment, l.path); renameErr != nil {
+				logrus.WithError(renameErr).Warnf("Failed to restore log file %v from segment %v", l.path, segment)
+			}
+			return err
+		}
+		if err := l.file.Close(); err != nil {
+			logrus.WithError(err).Warnf("Failed to close rotated log segment %v", segment)
+		}
+		l.file = file
+	}
+	l.size = 0
+	l.rotatedSegments = append(l.rotatedSegments, segment)
+
+	if !l.rotation.Compress {
+		pruneLogSegments(l.path, l.rotation.MaxSegments)
+		return nil
+	}
+
+	// Compress in the background so the output of the process is not blocked
+	l.compressing.Add(1)
+	go func() {
+		defer l.compressing.Done()
+		if err := compressLogSegment(segment); err != nil {
+			logrus.WithError(err).Warnf("Failed to compress log segment %v", segment)
+		}
+		pruneLogSegments(l.path, l.rotation.MaxSegments)
+	}()
+	return nil
+}
+
+// copyTruncate copies the log file to the segment and truncates it, for a log file a process writes to
+// directly. The process appends to the file, so it keeps writing at the start of the truncated file.
+// Output written between the copy and the truncation is lost. It must be called with the lock held.
+func (l *LonghornWriter) copyTruncate(segment string) (err error) {
+	source, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(segment, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			target.Close()
+			os.Remove(segment)
+		}
+	}()
+	if _, err := io.Copy(target, source); err != nil {
+		return err
+	}
+	if err := target.Close(); err != nil {
+		return err
+	}
+	return l.file.Truncate(0)
+}
+
+func compressLogSegment(segment string) (err error) {
+	source, err := os.Open(segment)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	tmpFile := segment + logSegmentGzipSuffix + ".tmp"
+	target, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			target.Close()
+			os.Remove(tmpFile)
+		}
+	}()
+
+	writer := gzip.NewWriter(target)
+	if _, err := io.Copy(writer, source); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := target.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, segment+logSegmentGzipSuffix); err != nil {
+		return err
+	}
+	return os.Remove(segment)
+}
+
+// listLogSegments returns the rotated segments of the log file, from the oldest to the newest.
+func listLogSegments(logPath string) ([]string, error) {
+	paths, err := filepath.Glob(escapeGlob(logPath) + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	segments := map[string]string{}
+	for _, path := range paths {
+		matches := logSegmentRegex.FindStringSubmatch(filepath.Base(path))
+		if matches == nil || matches[1]+".log" != filepath.Base(logPath) {
+			continue
+		}
+		// Both files exist for a moment when a segment is compressed, prefer the complete gzip one
+		if _, exists := segments[matches[2]]; exists && matches[3] == "" {
+			continue
+		}
+		segments[matches[2]] = path
+	}
+
+	timestamps := make([]string, 0, len(segments))
+	for timestamp := range segments {
+		timestamps = append(timestamps, timestamp)
+	}
+	sort.Strings(timestamps)
+
+	result := make([]string, 0, len(timestamps))
+	for _, timestamp := range timestamps {
+		result = append(result, segments[timestamp])
+	}
+	return result, nil
+}
+
+func escapeGlob(path string) string {
+	replacer := strings.NewReplacer(`*`, `\*`, `?`, `\?`, `[`, `\[`, `\`, `\\`)
+	return replacer.Replace(path)
+}
+
+func pruneLogSegments(logPath string, maxSegments int) {
+	if maxSegments <= 0 {
+		return
+	}
+	segments, err := listLogSegments(logPath)
+	if err != nil {
+		logrus.WithError(err).Warnf("Failed to list log segments of %v", logPath)
+		return
+	}
+	for i := 0; i < len(segments)-maxSegments; i++ {
+		if err := os.Remove(segments[i]); err != nil && !os.IsNotExist(err) {
+			logrus.WithError(err).Warnf("Failed to remove log segment %v", segments[i])
+		}
+	}
+}
+
+// openLogSegments opens the rotated segments of the log file from the oldest to the newest,
+// followed by the log file itself.
+func openLogSegments(logPath string) ([]*os.File, error) {
+	segments, err := listLogSegments(logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*os.File
+	for _, path := range append(segments, logPath) {
+		file, err := os.OpenFile(path, os.O_RDONLY, 0644)
+		if err != nil {
+			// The segment may have been pruned in the meantime
+			if os.IsNotExist(err) && path != logPath {
+				continue
+			}
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func newLogSegmentReader(file *os.File) (io.Reader, error) {
+	if strings.HasSuffix(file.Name(), logSegmentGzipSuffix) {
+		return gzip.NewReader(file)
+	}
+	return file, nil
+}
+
+// RemoveStaleLogs removes the log files and rotated segments of the processes that are not active
+// and haven't written anything for longer than the retention. It returns the names of the removed logs.
+func RemoveStaleLogs(logsDir string, retention time.Duration, isActive func(name string) bool) ([]string, error) {
+	entries, err := os.ReadDir(logsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]string{}
+	lastWrite := map[string]time.Time{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		var name string
+		if matches := logSegmentRegex.FindStringSubmatch(entry.Name()); matches != nil {
+			name = matches[1]
+		} else if strings.HasSuffix(entry.Name(), ".log") {
+			name = strings.TrimSuffix(entry.Name(), ".log")
+		} else {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		files[name] = append(files[name], filepath.Join(logsDir, entry.Name()))
+		if info.ModTime().After(lastWrite[name]) {
+			lastWrite[name] = info.ModTime()
+		}
+	}
+
+	var removed []string
+	for name, paths := range files {
+		if isActive(name) || time.Since(lastWrite[name]) < retention {
+			continue
+		}
+		for _, path := range paths {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return removed, errors.Wrapf(err, "failed to remove stale log %v", path)
+			}
+		}
+		removed = append(removed, name)
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
@@ -0,0 +1,454 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	LogFollowInterval = 250 * time.Millisecond
+)
+
+// Matches the timestamp of the logrus text format, e.g. time="2024-01-02T15:04:05Z",
+// or a RFC3339 timestamp at the beginning of the line.
+var logLineTimeRegex = regexp.MustCompile(`^(?:\[[^\]]*\] )?(?:.*?\btime="([^"]+)"|(\d{4}-\d{2}-\d{2}T[0-9:.]+(?:Z|[+-]\d{2}:\d{2})))`)
+
+type LogStreamOptions struct {
+	// Tail streams only the last Tail lines. 0 streams all of them.
+	Tail int
+	// Follow keeps streaming the lines written after the end of the log is reached,
+	// until the stream is done or the writer is closed.
+	Follow bool
+	// Since and Until limit the lines to a time window. The time of a line is parsed from
+	// the line itself, and a line without a time, e.g. part of a stack trace, takes the time of
+	// the line before it. Lines before the first line with a time are always streamed.
+	Since time.Time
+	Until time.Time
+	// SkipExisting streams only the lines written after the stream is started. It implies Follow.
+	SkipExisting bool
+}
+
+// NewLogStreamOptions returns the options of a log stream request, since and until being RFC 3339 times.
+func NewLogStreamOptions(tail int32, follow bool, since, until string) (LogStreamOptions, error) {
+	opts := LogStreamOptions{
+		Tail:   int(tail),
+		Follow: follow,
+	}
+	var err error
+	if opts.Since, err = ParseTime(since); err != nil {
+		return LogStreamOptions{}, fmt.Errorf("invalid since %q: %v", since, err)
+	}
+	if opts.Until, err = ParseTime(until); err != nil {
+		return LogStreamOptions{}, fmt.Errorf("invalid until %q: %v", until, err)
+	}
+	return opts, nil
+}
+
+type logLineFilter struct {
+	since    time.Time
+	until    time.Time
+	lastTime time.Time
+}
+
+func (f *logLineFilter) match(line string) bool {
+	if f.since.IsZero() && f.until.IsZero() {
+		return true
+	}
+	if t, ok := parseLogLineTime(line); ok {
+		f.lastTime = t
+	}
+	if f.lastTime.IsZero() {
+		return true
+	}
+	if !f.since.IsZero() && f.lastTime.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && f.lastTime.After(f.until) {
+		return false
+	}
+	return true
+}
+
+// pastUntil returns true once a line after the end of the time window has been seen.
+func (f *logLineFilter) pastUntil() bool {
+	return !f.until.IsZero() && f.lastTime.After(f.until)
+}
+
+func parseLogLineTime(line string) (time.Time, bool) {
+	matches := logLineTimeRegex.FindStringSubmatch(line)
+	if matches == nil {
+		return time.Time{}, false
+	}
+	value := matches[1]
+	if value == "" {
+		value = matches[2]
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// logTail keeps the last lines streamed.
+type logTail struct {
+	lines []string
+	next  int
+	full  bool
+}
+
+func newLogTail(size int) *logTail {
+	return &logTail{lines: make([]string, size)}
+}
+
+func (t *logTail) add(line string) {
+	t.lines[t.next] = line
+	t.next = (t.next + 1) % len(t.lines)
+	if t.next == 0 {
+		t.full = true
+	}
+}
+
+func (t *logTail) get() []string {
+	if !t.full {
+		return t.lines[:t.next]
+	}
+	return append(append([]string{}, t.lines[t.next:]...), t.lines[:t.next]...)
+}
+
+// StreamLogWithOptions streams the log like StreamLog, limited by the options.
+func (l *LonghornWriter) StreamLogWithOptions(done chan struct{}, opts LogStreamOptions) (chan string, error) {
+	l.lock.Lock()
+	// Open all the files upfront, so a rotation in the meantime doesn't affect the stream
+	files, err := openLogSegments(l.path)
+	rotations := len(l.rotatedSegments)
+	// end is the size of the current file, the lines written after it are followed
+	var end int64
+	if err == nil {
+		// Seek before the lock is released, so the lines written right after are not skipped
+		end, err = files[len(files)-1].Seek(0, io.SeekEnd)
+	}
+	if err == nil && !opts.SkipExisting {
+		_, err = files[len(files)-1].Seek(0, io.SeekStart)
+	}
+	l.lock.Unlock()
+	if err != nil {
+		for _, file := range files {
+			file.Close()
+		}
+		return nil, err
+	}
+
+	logChan := make(chan string)
+	go func() {
+		defer close(logChan)
+		defer func() {
+			for _, file := range files {
+				file.Close()
+			}
+		}()
+
+		send := func(line string) bool {
+			select {
+			case <-done:
+				return false
+			case logChan <- line:
+				return true
+			}
+		}
+
+		filter := &logLineFilter{since: opts.Since, until: opts.Until}
+		var tail *logTail
+		if opts.Tail > 0 && !opts.SkipExisting {
+			tail = newLogTail(opts.Tail)
+		}
+		handle := func(line string) bool {
+			if !filter.match(line) {
+				return true
+			}
+			if tail != nil {
+				tail.add(line)
+				return true
+			}
+			return send(line)
+		}
+
+		if opts.SkipExisting {
+			l.followLog(files[len(files)-1], rotations, done, handle)
+			return
+		}
+
+		if tail != nil && opts.Since.IsZero() && opts.Until.IsZero() {
+			// Without a time window the tail is read backwards from the end, so only the
+			// segments holding it are read
+			lines, err := tailLogFiles(files, end, opts.Tail)
+			if err != nil {
+				logrus.WithError(err).Warnf("Failed to read the tail of log %v", l.path)
+				return
+			}
+			for _, line := range lines {
+				if !send(line) {
+					return
+				}
+			}
+			tail = nil
+			if opts.Follow {
+				if _, err := files[len(files)-1].Seek(end, io.SeekStart); err != nil {
+					logrus.WithError(err).Warnf("Failed to follow log %v", l.path)
+					return
+				}
+				l.followLog(files[len(files)-1], rotations, done, handle)
+			}
+			return
+		}
+
+		for i, file := range files {
+			// A segment that was rotated before the time window starts has nothing in it
+			if i < len(files)-1 && !opts.Since.IsZero() {
+				if info, err := file.Stat(); err == nil && info.ModTime().Before(opts.Since) {
+					continue
+				}
+			}
+			reader, err := newLogSegmentReader(file)
+			if err != nil {
+				logrus.WithError(err).Warnf("Failed to read log segment %v", file.Name())
+				continue
+			}
+			if !readLogLines(bufio.NewReader(reader), handle) {
+				return
+			}
+		}
+
+		if tail != nil {
+			for _, line := range tail.get() {
+				if !send(line) {
+					return
+				}
+			}
+			tail = nil
+		}
+
+		if opts.Follow && !filter.pastUntil() {
+			l.followLog(files[len(files)-1], rotations, done, func(line string) bool {
+				return handle(line) && !filter.pastUntil()
+			})
+		}
+	}()
+	return logChan, nil
+}
+
+// tailLogFiles returns the last n lines of the files, the current file being read up to end.
+// The files are read from the newest one backwards until there are enough lines.
+func tailLogFiles(files []*os.File, end int64, n int) ([]string, error) {
+	var lines []string
+	for i := len(files) - 1; i >= 0 && len(lines) < n; i-- {
+		file := files[i]
+		var fileLines []string
+		if strings.HasSuffix(file.Name(), logSegmentGzipSuffix) {
+			// A compressed segment can only be read forwards
+			reader, err := newLogSegmentReader(file)
+			if err != nil {
+				logrus.WithError(err).Warnf("Failed to read log segment %v", file.Name())
+				continue
+			}
+			tail := newLogTail(n - len(lines))
+			readLogLines(bufio.NewReader(reader), func(line string) bool {
+				tail.add(line)
+				return true
+			})
+			fileLines = tail.get()
+		} else {
+			size := end
+			if i < len(files)-1 {
+				info, err := file.Stat()
+				if err != nil {
+					return nil, err
+				}
+				size = info.Size()
+			}
+			var err error
+			if fileLines, err = readLastLines(file, size, n-len(lines)); err != nil {
+				return nil, err
+			}
+		}
+		lines = append(fileLines, lines...)
+	}
+	return lines, nil
+}
+
+// readLastLines returns the last n lines of the first size bytes of the file, reading it backwards in chunks.
+func readLastLines(file *os.File, size int64, n int) ([]string, error) {
+	const chunkSize = 64 * 1024
+
+	var data []byte
+	offset := size
+	// n lines are complete once there are n line breaks before the last line
+	for offset > 0 && bytes.Count(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) < n {
+		chunk := make([]byte, min(chunkSize, offset))
+		offset -= int64(len(chunk))
+		if _, err := file.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		data = append(chunk, data...)
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
+
+// readLogLines calls handle for every complete line until EOF or handle returns false.
+// It returns false if it was stopped by handle.
+func readLogLines(reader *bufio.Reader, handle func(line string) bool) bool {
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" && !handle(strings.TrimSuffix(line, "\n")) {
+			return false
+		}
+		if err != nil {
+			if err != io.EOF {
+				logrus.WithError(err).Warn("Failed to read log")
+			}
+			return true
+		}
+	}
+}
+
+// followLog keeps reading the current log file from where it has been read, and moves on to
+// the segments rotated in the meantime and the new file after a rotation. It stops once the
+// stream is done, or the writer is closed and everything written has been read.
+func (l *LonghornWriter) followLog(file *os.File, rotations int, done chan struct{}, handle func(line string) bool) {
+	var opened []*os.File
+	defer func() {
+		for _, f := range opened {
+			f.Close()
+		}
+	}()
+
+	reader := bufio.NewReader(file)
+	partial := ""
+	// offset is how far the current file has been read
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		logrus.WithError(err).Warnf("Failed to follow log %v", l.path)
+		return
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		partial += line
+		offset += int64(len(line))
+		if err == nil {
+			if !handle(strings.TrimSuffix(partial, "\n")) {
+				return
+			}
+			partial = ""
+			continue
+		}
+		if err != io.EOF {
+			logrus.WithError(err).Warnf("Failed to follow log %v", l.path)
+			return
+		}
+
+		// Reached the end of the file
+		l.lock.Lock()
+		closed := l.closed
+		direct := l.direct
+		var rotated []string
+		var newFile *os.File
+		var openErr error
+		if len(l.rotatedSegments) > rotations {
+			// The file being read is the first segment rotated since, the rest have to be caught up on
+			rotated = l.rotatedSegments[rotations:]
+			rotations = len(l.rotatedSegments)
+			newFile, openErr = os.Open(l.path)
+		}
+		l.lock.Unlock()
+		// The writer may be closed after a rotation, catch up on it before stopping
+
+		if closed && newFile == nil {
+			if partial != "" {
+				handle(partial)
+			}
+			return
+		}
+		if openErr != nil {
+			logrus.WithError(openErr).Warnf("Failed to open log %v after rotation", l.path)
+			return
+		}
+		if newFile == nil {
+			select {
+			case <-done:
+				return
+			case <-time.After(LogFollowInterval):
+			}
+			continue
+		}
+		opened = append(opened, newFile)
+
+		// The old file is complete once it has been rotated, read what was written before the rotation.
+		// A file written directly is copied to the segment and truncated rather than renamed, so the
+		// rest of it is in the segment.
+		handleRest := func(line string) bool {
+			line = partial + line
+			partial = ""
+			return handle(line)
+		}
+		if direct {
+			if !readLogSegment(rotated[0], offset, handleRest) {
+				return
+			}
+		} else if !readLogLines(reader, handleRest) {
+			return
+		}
+		if partial != "" {
+			if !handle(partial) {
+				return
+			}
+			partial = ""
+		}
+		for _, segment := range rotated[1:] {
+			if !readLogSegment(segment, 0, handle) {
+				return
+			}
+		}
+		reader = bufio.NewReader(newFile)
+		offset = 0
+	}
+}
+
+// readLogSegment reads a rotated segment from the offset, the segment may have been compressed in the meantime.
+func readLogSegment(segment string, offset int64, handle func(line string) bool) bool {
+	file, err := os.Open(segment)
+	if os.IsNotExist(err) {
+		file, err = os.Open(segment + logSegmentGzipSuffix)
+	}
+	if err != nil {
+		logrus.WithError(err).Warnf("Failed to read log segment %v, it may have been pruned", segment)
+		return true
+	}
+	defer file.Close()
+
+	reader, err := newLogSegmentReader(file)
+	if err != nil {
+		logrus.WithError(err).Warnf("Failed to read log segment %v", file.Name())
+		return true
+	}
+	if _, err := io.CopyN(io.Discard, reader, offset); err != nil {
+		logrus.WithError(err).Warnf("Failed to skip to offset %v of log segment %v", offset, file.Name())
+		return true
+	}
+	return readLogLines(bufio.NewReader(reader), handle)
+}
@@ -0,0 +1,411 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLonghornWriterRotation(t *testing.T) {
+	tests := []struct {
+		name         string
+		compress     bool
+		wantSegments int
+	}{
+		{name: "testRotation", compress: false, wantSegments: 2},
+		{name: "testRotationCompress", compress: true, wantSegments: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logsDir := t.TempDir()
+			writer, err := NewLonghornWriter(tt.name, logsDir, LogRotation{
+				MaxSize:     20,
+				MaxSegments: tt.wantSegments,
+				Compress:    tt.compress,
+			})
+			if err != nil {
+				t.Fatalf("NewLonghornWriter() error = %v", err)
+			}
+
+			// Every 2 lines fill a segment
+			var lines []string
+			for i := 0; i < 10; i++ {
+				line := fmt.Sprintf("line %04d", i)
+				lines = append(lines, line)
+				if _, err := writer.Write([]byte(line + "\n")); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+			}
+			if _, err := writer.Write([]byte("last\n")); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			lines = append(lines, "last")
+			writer.lock.Lock()
+			writer.compressing.Wait()
+			writer.lock.Unlock()
+
+			segments, err := listLogSegments(filepath.Join(logsDir, tt.name+".log"))
+			if err != nil {
+				t.Fatalf("listLogSegments() error = %v", err)
+			}
+			if len(segments) != tt.wantSegments {
+				t.Fatalf("got %v segments %v, want %v", len(segments), segments, tt.wantSegments)
+			}
+			for _, segment := range segments {
+				if isCompressed := filepath.Ext(segment) == logSegmentGzipSuffix; isCompressed != tt.compress {
+					t.Errorf("segment %v compressed = %v, want %v", segment, isCompressed, tt.compress)
+				}
+			}
+
+			// Only the lines of the segments kept and the current file are streamed, in order
+			logChan, err := writer.StreamLog(make(chan struct{}))
+			if err != nil {
+				t.Fatalf("StreamLog() error = %v", err)
+			}
+			var got []string
+			for line := range logChan {
+				got = append(got, line)
+			}
+			want := lines[len(lines)-2*tt.wantSegments-1:]
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("StreamLog() got %v, want %v", got, want)
+			}
+
+			// The tail is read backwards across the current file and the segments
+			for _, tail := range []int{1, 4, 20} {
+				logChan, err = writer.StreamLogWithOptions(make(chan struct{}), LogStreamOptions{Tail: tail})
+				if err != nil {
+					t.Fatalf("StreamLogWithOptions() error = %v", err)
+				}
+				got = nil
+				for line := range logChan {
+					got = append(got, line)
+				}
+				wantTail := want[max(0, len(want)-tail):]
+				if !reflect.DeepEqual(got, wantTail) {
+					t.Errorf("StreamLogWithOptions() tail %v got %v, want %v", tail, got, wantTail)
+				}
+			}
+
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestRemoveStaleLogs(t *testing.T) {
+	logsDir := t.TempDir()
+	old := time.Now().Add(-2 * time.Hour)
+	for _, file := range []struct {
+		name  string
+		mtime time.Time
+	}{
+		{name: "deleted.log", mtime: old},
+		{name: "deleted.log.20260101T000000.000000000.gz", mtime: old},
+		{name: "active.log", mtime: old},
+		{name: "recent.log", mtime: old},
+		{name: "recent.log.20260101T000000.000000000", mtime: time.Now()},
+		{name: "process-manager-state.json", mtime: old},
+	} {
+		path := filepath.Join(logsDir, file.name)
+		if err := os.WriteFile(path, []byte("log\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, file.mtime, file.mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := RemoveStaleLogs(logsDir, time.Hour, func(name string) bool {
+		return name == "active"
+	})
+	if err != nil {
+		t.Fatalf("RemoveStaleLogs() error = %v", err)
+	}
+	if !reflect.DeepEqual(removed, []string{"deleted"}) {
+		t.Errorf("RemoveStaleLogs() removed %v, want [deleted]", removed)
+	}
+
+	entries, err := os.ReadDir(logsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var remaining []string
+	for _, entry := range entries {
+		remaining = append(remaining, entry.Name())
+	}
+	want := []string{"active.log", "process-manager-state.json", "recent.log", "recent.log.20260101T000000.000000000"}
+	if !reflect.DeepEqual(remaining, want) {
+		t.Errorf("remaining files %v, want %v", remaining, want)
+	}
+}
+
+func TestLonghornWriterStreamLogWithOptions(t *testing.T) {
+	lines := []string{
+		`time="2026-01-01T00:00:00Z" level=info msg="line 0"`,
+		`time="2026-01-01T00:01:00Z" level=info msg="line 1"`,
+		`goroutine 1 [running]:`,
+		`2026-01-01T00:02:00.5Z line 2`,
+		`time="2026-01-01T00:03:00Z" level=info msg="line 3"`,
+	}
+	tests := []struct {
+		name string
+		opts LogStreamOptions
+		want []string
+	}{
+		{name: "testAll", opts: LogStreamOptions{}, want: lines},
+		{name: "testTail", opts: LogStreamOptions{Tail: 2}, want: lines[3:]},
+		{name: "testTailMoreThanLines", opts: LogStreamOptions{Tail: 10}, want: lines},
+		{name: "testSince", opts: LogStreamOptions{Since: time.Date(2026, 1, 1, 0, 1, 0, 0, time.UTC)}, want: lines[1:]},
+		{name: "testSinceUntil", opts: LogStreamOptions{
+			Since: time.Date(2026, 1, 1, 0, 0, 30, 0, time.UTC),
+			Until: time.Date(2026, 1, 1, 0, 2, 30, 0, time.UTC),
+		}, want: lines[1:4]},
+		{name: "testUntilTail", opts: LogStreamOptions{
+			Until: time.Date(2026, 1, 1, 0, 1, 30, 0, time.UTC),
+			Tail:  2,
+		}, want: lines[1:3]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer, err := NewLonghornWriter(tt.name, t.TempDir(), LogRotation{MaxSize: 100})
+			if err != nil {
+				t.Fatalf("NewLonghornWriter() error = %v", err)
+			}
+			defer writer.Close()
+			for _, line := range lines {
+				if _, err := writer.Write([]byte(line + "\n")); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+			}
+
+			logChan, err := writer.StreamLogWithOptions(make(chan struct{}), tt.opts)
+			if err != nil {
+				t.Fatalf("StreamLogWithOptions() error = %v", err)
+			}
+			var got []string
+			for line := range logChan {
+				got = append(got, line)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("StreamLogWithOptions() got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLonghornWriterFollowLog(t *testing.T) {
+	writer, err := NewLonghornWriter("testFollow", t.TempDir(), LogRotation{MaxSize: 20})
+	if err != nil {
+		t.Fatalf("NewLonghornWriter() error = %v", err)
+	}
+	if _, err := writer.Write([]byte("before 1\nbefore 2\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	logChan, err := writer.StreamLogWithOptions(done, LogStreamOptions{Tail: 1, Follow: true})
+	if err != nil {
+		t.Fatalf("StreamLogWithOptions() error = %v", err)
+	}
+	got := []string{<-logChan}
+
+	// The new lines are streamed across rotations, until the writer is closed
+	want := []string{"before 2"}
+	for i := 0; i < 10; i++ {
+		line := fmt.Sprintf("after %04d", i)
+		want = append(want, line)
+		if _, err := writer.Write([]byte(line + "\n")); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		// Sometimes rotate more than once between the polls
+		time.Sleep(LogFollowInterval / time.Duration(1+i%3))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case line, ok := <-logChan:
+			if ok {
+				got = append(got, line)
+				continue
+			}
+		case <-timeout:
+			t.Fatalf("the stream didn't end after the writer was closed, got %v", got)
+		}
+		break
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("followed %v, want %v", got, want)
+	}
+}
+
+func TestLonghornWriterSkipExisting(t *testing.T) {
+	writer, err := NewLonghornWriter("testSkipExisting", t.TempDir(), LogRotation{})
+	if err != nil {
+		t.Fatalf("NewLonghornWriter() error = %v", err)
+	}
+	if _, err := writer.Write([]byte("before 1\nbefore 2\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	logChan, err := writer.StreamLogWithOptions(done, LogStreamOptions{SkipExisting: true, Tail: 1})
+	if err != nil {
+		t.Fatalf("StreamLogWithOptions() error = %v", err)
+	}
+	if _, err := writer.Write([]byte("after 1\nafter 2\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	var got []string
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case line, ok := <-logChan:
+			if ok {
+				got = append(got, line)
+				continue
+			}
+		case <-timeout:
+			t.Fatalf("the stream didn't end after the writer was closed, got %v", got)
+		}
+		break
+	}
+	if want := []string{"after 1", "after 2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("streamed %v, want %v", got, want)
+	}
+}
+
+func TestLonghornWriterDirectRotation(t *testing.T) {
+	writer, err := NewLonghornWriter("testDirect", t.TempDir(), LogRotation{MaxSize: 20})
+	if err != nil {
+		t.Fatalf("NewLonghornWriter() error = %v", err)
+	}
+	// A replacement shares the writer, the file stays open until both have closed it
+	if !writer.Share() {
+		t.Fatalf("Share() = false on an open writer")
+	}
+
+	// The process writes to its own descriptor of the file, like a detached process does
+	file, err := os.OpenFile(writer.File().Name(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer file.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	logChan, err := writer.StreamLogWithOptions(done, LogStreamOptions{Follow: true})
+	if err != nil {
+		t.Fatalf("StreamLogWithOptions() error = %v", err)
+	}
+
+	var want []string
+	for i := 0; i < 6; i++ {
+		line := fmt.Sprintf("direct %04d", i)
+		want = append(want, line)
+		if _, err := file.Write([]byte(line + "\n")); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		// The file reaches the maximum size every other line
+		if i%2 == 1 {
+			if err := writer.RotateIfNeeded(); err != nil {
+				t.Fatalf("RotateIfNeeded() error = %v", err)
+			}
+		}
+		time.Sleep(LogFollowInterval / 2)
+	}
+
+	segments, err := listLogSegments(writer.path)
+	if err != nil {
+		t.Fatalf("listLogSegments() error = %v", err)
+	}
+	if len(segments) != 3 {
+		t.Fatalf("got %v segments %v, want 3", len(segments), segments)
+	}
+	if info, err := file.Stat(); err != nil || info.Size() != 0 {
+		t.Fatalf("the log file was not truncated, stat %v error %v", info, err)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if writer.isClosed() {
+		t.Fatalf("the writer was closed while still shared")
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if writer.Share() {
+		t.Fatalf("Share() = true on a closed writer")
+	}
+
+	var got []string
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case line, ok := <-logChan:
+			if ok {
+				got = append(got, line)
+				continue
+			}
+		case <-timeout:
+			t.Fatalf("the stream didn't end after the writer was closed, got %v", got)
+		}
+		break
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("followed %v, want %v", got, want)
+	}
+}
+
+func TestLonghornWriterSync(t *testing.T) {
+	writer, err := NewLonghornWriter("testSync", t.TempDir(), LogRotation{})
+	if err != nil {
+		t.Fatalf("NewLonghornWriter() error = %v", err)
+	}
+	isDirty := func() bool {
+		writer.lock.Lock()
+		defer writer.lock.Unlock()
+		return writer.dirty
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := writer.Write([]byte("line\n")); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if !isDirty() {
+		t.Fatalf("the writes were synced right away")
+	}
+	for deadline := time.Now().Add(LogSyncDelay + 5*time.Second); isDirty(); time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the writes were not synced after %v", LogSyncDelay)
+		}
+	}
+
+	// The pending sync is skipped once the writer is closed
+	if _, err := writer.Write([]byte("last\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if isDirty() {
+		t.Fatalf("the writes were not synced on close")
+	}
+	time.Sleep(LogSyncDelay + 100*time.Millisecond)
+}
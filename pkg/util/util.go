@@ -22,8 +22,6 @@ import (
 
 const (
 	DefaulCmdTimeout = time.Minute // one minute by default
-
-	GRPCHealthProbe = "/usr/local/bin/grpc_health_probe"
 )
 
 func Execute(binary string, args ...string) (string, error) {
@@ -92,16 +90,40 @@ func RemoveFile(file string) error {
 }
 
 func GRPCServiceReadinessProbe(address string) bool {
-	if _, err := Execute(GRPCHealthProbe, "-addr", address); err != nil {
-		return false
-	}
-	return true
+	return GRPCServiceReadinessProbeWithTimeout(address, DefaultGRPCHealthProbeTimeout)
+}
+
+// GRPCServiceReadinessProbeWithTimeout checks the gRPC health service at the address, sharing the
+// connection with the previous probes of the same address.
+func GRPCServiceReadinessProbeWithTimeout(address string, timeout time.Duration) bool {
+	return defaultGRPCHealthProber.Probe(address, timeout)
+}
+
+// ReleaseGRPCServiceReadinessProbe closes the connection shared by the probes of the address.
+func ReleaseGRPCServiceReadinessProbe(address string) {
+	defaultGRPCHealthProber.Release(address)
 }
 
 func Now() string {
 	return time.Now().UTC().Format(time.RFC3339)
 }
 
+// FormatTime formats t in RFC 3339 with nanoseconds, or returns an empty string if t is nil.
+func FormatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// ParseTime parses a time formatted by FormatTime, an empty value is the zero time.
+func ParseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
 func UUID() string {
 	return uuid.New().String()
 }
@@ -177,6 +199,9 @@ func GetVolumeNameSHAStrFromPath(path string) string {
 func ProcessNameToVolumeName(processName string) string {
 	// process name: "pvc-e130e369-274d-472d-98d1-f6074d2725e8-e-0"
 	nameSlices := strings.Split(processName, "-")
+	if len(nameSlices) < 3 {
+		return ""
+	}
 	volumeName := strings.Join(nameSlices[:len(nameSlices)-2], "-")
 	return volumeName
 }